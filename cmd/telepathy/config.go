@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/discord"
+	"gitlab.com/kavenc/telepathy/internal/pkg/fwd"
+	"gitlab.com/kavenc/telepathy/internal/pkg/info"
+	"gitlab.com/kavenc/telepathy/internal/pkg/line"
+	"gitlab.com/kavenc/telepathy/internal/pkg/slackmsg"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+	"gitlab.com/kavenc/telepathy/internal/pkg/twitch"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfig is used if no config file is given
+// It reads the settings from the environment variables Telepathy used before config files,
+// plugins can be disabled by setting <PLUGIN>_ENABLED to false
+const defaultConfig = `
+server:
+  port: ${PORT}
+  url: ${URL}
+  admin_token: ${ADMIN_TOKEN}
+  metrics_token: ${METRICS_TOKEN}
+database:
+  type: ${DATABASE_TYPE:-mongo}
+  mongo_url: ${MONGODB_URL}
+  name: ${MONGODB_NAME}
+  file: ${DATABASE_FILE}
+plugins:
+  info:
+    enabled: ${INFO_ENABLED:-true}
+  fwd:
+    enabled: ${FWD_ENABLED:-true}
+  line:
+    enabled: ${LINE_ENABLED:-true}
+    secret: ${LINE_CHANNEL_SECRET}
+    token: ${LINE_CHANNEL_TOKEN}
+  discord:
+    enabled: ${DISCORD_ENABLED:-true}
+    token: ${DISCORD_BOT_TOKEN}
+  slack:
+    enabled: ${SLACK_ENABLED:-true}
+    client_id: ${SLACK_CLIENT_ID}
+    client_secret: ${SLACK_CLIENT_SECRET}
+    signing_secret: ${SLACK_SIGNING_SECRET}
+  twitch:
+    enabled: ${TWITCH_ENABLED:-true}
+    client_id: ${TWITCH_CLIENT_ID}
+    client_secret: ${TWITCH_SECRET}
+    websub_secret: ${TWITCH_WEBSUB_SECRET}
+`
+
+// config is the structure of Telepathy config file
+type config struct {
+	Server     serverConfig     `yaml:"server"`
+	Database   databaseConfig   `yaml:"database"`
+	Command    commandConfig    `yaml:"command"`
+	Router     routerConfig     `yaml:"router"`
+	Supervisor supervisorConfig `yaml:"supervisor"`
+	Plugins    pluginsConfig    `yaml:"plugins"`
+}
+
+type serverConfig struct {
+	Port            string        `yaml:"port"`
+	URL             string        `yaml:"url"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	AdminToken      string        `yaml:"admin_token"`   // Bearer token of the admin API, disabled if empty
+	MetricsToken    string        `yaml:"metrics_token"` // Bearer token required to scrape metrics, not required if empty
+}
+
+type databaseConfig struct {
+	Type     string `yaml:"type"`
+	MongoURL string `yaml:"mongo_url"`
+	Name     string `yaml:"name"`
+	File     string `yaml:"file"`
+}
+
+type commandConfig struct {
+	Prefix    string        `yaml:"prefix"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Operators []string      `yaml:"operators"` // Bot operators, in the form of <messenger-id>@<user-id>
+}
+
+type routerConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	Retry   retryConfig   `yaml:"retry"`
+}
+
+type retryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+}
+
+// supervisorConfig sets how plugins are restarted after panics
+type supervisorConfig struct {
+	MaxFailures int           `yaml:"max_failures"` // Consecutive failures before a plugin is reported degraded
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+}
+
+type rateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type pluginsConfig struct {
+	Info    pluginConfig  `yaml:"info"`
+	Fwd     pluginConfig  `yaml:"fwd"`
+	Line    lineConfig    `yaml:"line"`
+	Discord discordConfig `yaml:"discord"`
+	Slack   slackConfig   `yaml:"slack"`
+	Twitch  twitchConfig  `yaml:"twitch"`
+}
+
+type pluginConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// messengerConfig holds the settings shared by all messengers
+type messengerConfig struct {
+	Enabled          bool             `yaml:"enabled"`
+	Buffer           int              `yaml:"buffer"`             // Size of the inbound message buffer
+	Retry            *retryConfig     `yaml:"retry"`              // Overrides router.retry
+	RateLimit        *rateLimitConfig `yaml:"rate_limit"`         // Outbound rate limit of the messenger, overrides its default
+	ChannelRateLimit *rateLimitConfig `yaml:"channel_rate_limit"` // Outbound rate limit of each channel, overrides its default
+	DefaultRole      string           `yaml:"default_role"`       // Role of users if the messenger can not resolve roles, user if not set
+}
+
+type lineConfig struct {
+	messengerConfig `yaml:",inline"`
+	Secret          string `yaml:"secret"`
+	Token           string `yaml:"token"`
+}
+
+type discordConfig struct {
+	messengerConfig `yaml:",inline"`
+	Token           string `yaml:"token"`
+}
+
+type slackConfig struct {
+	messengerConfig `yaml:",inline"`
+	ClientID        string `yaml:"client_id"`
+	ClientSecret    string `yaml:"client_secret"`
+	SigningSecret   string `yaml:"signing_secret"`
+}
+
+type twitchConfig struct {
+	pluginConfig `yaml:",inline"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	WebsubSecret string `yaml:"websub_secret"`
+}
+
+// envPattern matches ${VAR} and ${VAR:-default}
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+func expandEnv(value string) string {
+	return envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if env := os.Getenv(groups[1]); env != "" {
+			return env
+		}
+		return groups[2]
+	})
+}
+
+// interpolate expands environment variables in all scalar values of node
+// Unquoted values are re-resolved, so that variables can be used for numbers, booleans and durations
+func interpolate(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && envPattern.MatchString(node.Value) {
+		node.Value = expandEnv(node.Value)
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) == 0 {
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		interpolate(child)
+	}
+}
+
+func parseConfig(data []byte) (*config, error) {
+	node := yaml.Node{}
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	interpolate(&node)
+
+	// Interpolated document is encoded again to reject unknown fields when decoding
+	interpolated, err := yaml.Marshal(&node)
+	if err != nil {
+		return nil, err
+	}
+	conf := config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(interpolated))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// loadConfig loads config file from path, or defaultConfig if path is empty
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		return parseConfig([]byte(defaultConfig))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func required(errs []error, field string, value string) []error {
+	if value == "" {
+		errs = append(errs, fmt.Errorf("%s is required", field))
+	}
+	return errs
+}
+
+func nonNegative(errs []error, field string, value time.Duration) []error {
+	if value < 0 {
+		errs = append(errs, fmt.Errorf("%s must not be negative", field))
+	}
+	return errs
+}
+
+func (r *retryConfig) validate(errs []error, section string) []error {
+	if r.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_attempts must not be negative", section))
+	}
+	errs = nonNegative(errs, section+".base_delay", r.BaseDelay)
+	errs = nonNegative(errs, section+".max_delay", r.MaxDelay)
+	return errs
+}
+
+func (r *rateLimitConfig) validate(errs []error, section string) []error {
+	if r.Rate <= 0 {
+		errs = append(errs, fmt.Errorf("%s.rate must be positive", section))
+	}
+	if r.Burst < 0 {
+		errs = append(errs, fmt.Errorf("%s.burst must not be negative", section))
+	}
+	return errs
+}
+
+func (m *messengerConfig) validate(errs []error, section string) []error {
+	if m.Buffer < 0 {
+		errs = append(errs, fmt.Errorf("%s.buffer must not be negative", section))
+	}
+	if m.Retry != nil {
+		errs = m.Retry.validate(errs, section+".retry")
+	}
+	if m.RateLimit != nil {
+		errs = m.RateLimit.validate(errs, section+".rate_limit")
+	}
+	if m.ChannelRateLimit != nil {
+		errs = m.ChannelRateLimit.validate(errs, section+".channel_rate_limit")
+	}
+	if m.DefaultRole != "" {
+		if _, err := telepathy.ParseRole(m.DefaultRole); err != nil {
+			errs = append(errs, fmt.Errorf("%s.default_role is invalid: %s", section, m.DefaultRole))
+		}
+	}
+	return errs
+}
+
+// validate reports all missing or invalid settings
+func (c *config) validate() []error {
+	errs := []error{}
+	errs = required(errs, "server.port", c.Server.Port)
+	errs = required(errs, "server.url", c.Server.URL)
+	errs = nonNegative(errs, "server.shutdown_timeout", c.Server.ShutdownTimeout)
+
+	switch c.Database.Type {
+	case telepathy.DBTypeMongo, "":
+		errs = required(errs, "database.mongo_url", c.Database.MongoURL)
+		errs = required(errs, "database.name", c.Database.Name)
+	case telepathy.DBTypeFile:
+		errs = required(errs, "database.file", c.Database.File)
+	case telepathy.DBTypeMemory:
+	default:
+		errs = append(errs, fmt.Errorf("database.type is invalid: %s", c.Database.Type))
+	}
+
+	if strings.ContainsAny(c.Command.Prefix, " \t\n") {
+		errs = append(errs, fmt.Errorf("command.prefix must not contain spaces"))
+	}
+	errs = nonNegative(errs, "command.timeout", c.Command.Timeout)
+	for _, operator := range c.Command.Operators {
+		if parts := strings.SplitN(operator, "@", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fmt.Errorf("command.operators is invalid: %s, should be <messenger-id>@<user-id>", operator))
+		}
+	}
+	errs = nonNegative(errs, "router.timeout", c.Router.Timeout)
+	errs = c.Router.Retry.validate(errs, "router.retry")
+	if c.Supervisor.MaxFailures < 0 {
+		errs = append(errs, fmt.Errorf("supervisor.max_failures must not be negative"))
+	}
+	errs = nonNegative(errs, "supervisor.base_delay", c.Supervisor.BaseDelay)
+	errs = nonNegative(errs, "supervisor.max_delay", c.Supervisor.MaxDelay)
+
+	plugins := c.Plugins
+	if plugins.Line.Enabled {
+		errs = plugins.Line.validate(errs, "plugins.line")
+		errs = required(errs, "plugins.line.secret", plugins.Line.Secret)
+		errs = required(errs, "plugins.line.token", plugins.Line.Token)
+	}
+	if plugins.Discord.Enabled {
+		errs = plugins.Discord.validate(errs, "plugins.discord")
+		errs = required(errs, "plugins.discord.token", plugins.Discord.Token)
+	}
+	if plugins.Slack.Enabled {
+		errs = plugins.Slack.validate(errs, "plugins.slack")
+		errs = required(errs, "plugins.slack.client_id", plugins.Slack.ClientID)
+		errs = required(errs, "plugins.slack.client_secret", plugins.Slack.ClientSecret)
+		errs = required(errs, "plugins.slack.signing_secret", plugins.Slack.SigningSecret)
+	}
+	if plugins.Twitch.Enabled {
+		errs = required(errs, "plugins.twitch.client_id", plugins.Twitch.ClientID)
+		errs = required(errs, "plugins.twitch.client_secret", plugins.Twitch.ClientSecret)
+		errs = required(errs, "plugins.twitch.websub_secret", plugins.Twitch.WebsubSecret)
+	}
+	if !plugins.Line.Enabled && !plugins.Discord.Enabled && !plugins.Slack.Enabled {
+		errs = append(errs, fmt.Errorf("no messenger is enabled"))
+	}
+	return errs
+}
+
+func (r retryConfig) policy() telepathy.RetryPolicy {
+	return telepathy.RetryPolicy{
+		MaxAttempts: r.MaxAttempts,
+		BaseDelay:   r.BaseDelay,
+		MaxDelay:    r.MaxDelay,
+	}
+}
+
+func (s supervisorConfig) policy() telepathy.RestartPolicy {
+	return telepathy.RestartPolicy{
+		MaxFailures: s.MaxFailures,
+		BaseDelay:   s.BaseDelay,
+		MaxDelay:    s.MaxDelay,
+	}
+}
+
+func (r rateLimitConfig) limit() telepathy.RateLimit {
+	return telepathy.RateLimit{
+		Rate:  r.Rate,
+		Burst: r.Burst,
+	}
+}
+
+// sessionConfig converts config to telepathy.SessionConfig
+func (c *config) sessionConfig() telepathy.SessionConfig {
+	session := telepathy.SessionConfig{
+		Port:                   c.Server.Port,
+		RootURL:                c.Server.URL,
+		DatabaseType:           c.Database.Type,
+		MongoURL:               c.Database.MongoURL,
+		DatabaseName:           c.Database.Name,
+		DatabaseFile:           c.Database.File,
+		RetryPolicy:            c.Router.Retry.policy(),
+		MessengerRetryPolicies: make(map[string]telepathy.RetryPolicy),
+		MessengerRateLimits:    make(map[string]telepathy.RateLimit),
+		ChannelRateLimits:      make(map[string]telepathy.RateLimit),
+		MessengerDefaultRoles:  make(map[string]telepathy.Role),
+		CommandPrefix:          c.Command.Prefix,
+		CommandTimeout:         c.Command.Timeout,
+		Operators:              c.Command.Operators,
+		RouterTimeout:          c.Router.Timeout,
+		ShutdownTimeout:        c.Server.ShutdownTimeout,
+		AdminToken:             c.Server.AdminToken,
+		MetricsToken:           c.Server.MetricsToken,
+		RestartPolicy:          c.Supervisor.policy(),
+	}
+
+	messengers := map[string]messengerConfig{
+		(&line.Messenger{}).ID():     c.Plugins.Line.messengerConfig,
+		(&discord.Messenger{}).ID():  c.Plugins.Discord.messengerConfig,
+		(&slackmsg.Messenger{}).ID(): c.Plugins.Slack.messengerConfig,
+	}
+	for id, messenger := range messengers {
+		if messenger.Retry != nil {
+			session.MessengerRetryPolicies[id] = messenger.Retry.policy()
+		}
+		if messenger.RateLimit != nil {
+			session.MessengerRateLimits[id] = messenger.RateLimit.limit()
+		}
+		if messenger.ChannelRateLimit != nil {
+			session.ChannelRateLimits[id] = messenger.ChannelRateLimit.limit()
+		}
+		if role, err := telepathy.ParseRole(messenger.DefaultRole); err == nil {
+			session.MessengerDefaultRoles[id] = role
+		}
+	}
+	return session
+}
+
+// plugins creates the enabled plugins
+func (c *config) plugins() []telepathy.Plugin {
+	conf := c.Plugins
+	plugins := []telepathy.Plugin{}
+	if conf.Info.Enabled {
+		plugins = append(plugins, &info.Service{})
+	}
+	if conf.Line.Enabled {
+		plugins = append(plugins, &line.Messenger{
+			Secret:      conf.Line.Secret,
+			Token:       conf.Line.Token,
+			InMsgBuffer: conf.Line.Buffer,
+		})
+	}
+	if conf.Discord.Enabled {
+		plugins = append(plugins, &discord.Messenger{
+			Token:       conf.Discord.Token,
+			InMsgBuffer: conf.Discord.Buffer,
+		})
+	}
+	if conf.Slack.Enabled {
+		plugins = append(plugins, &slackmsg.Messenger{
+			ClientID:      conf.Slack.ClientID,
+			ClientSecret:  conf.Slack.ClientSecret,
+			SigningSecret: []byte(conf.Slack.SigningSecret),
+			InMsgBuffer:   conf.Slack.Buffer,
+		})
+	}
+	if conf.Fwd.Enabled {
+		plugins = append(plugins, &fwd.Service{})
+	}
+	if conf.Twitch.Enabled {
+		plugins = append(plugins, &twitch.Service{
+			ClientID:     conf.Twitch.ClientID,
+			ClientSecret: conf.Twitch.ClientSecret,
+			WebsubSecret: []byte(conf.Twitch.WebsubSecret),
+		})
+	}
+	return plugins
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+const testConfig = `
+server:
+  port: ${TEST_TELEPATHY_PORT:-8080}
+  url: ${TEST_TELEPATHY_URL}
+  admin_token: ${TEST_TELEPATHY_ADMIN_TOKEN:-admin}
+  metrics_token: metrics
+database:
+  type: memory
+supervisor:
+  base_delay: 2s
+command:
+  prefix: bot
+  timeout: ${TEST_TELEPATHY_TIMEOUT:-3s}
+plugins:
+  info:
+    enabled: ${TEST_TELEPATHY_INFO}
+  discord:
+    enabled: true
+    token: "${TEST_TELEPATHY_TOKEN}"
+    buffer: 20
+    rate_limit:
+      rate: 5
+      burst: 2
+  line:
+    default_role: user
+`
+
+func TestParseConfig(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("TEST_TELEPATHY_URL", "https://example.com")
+	os.Setenv("TEST_TELEPATHY_INFO", "true")
+	os.Setenv("TEST_TELEPATHY_TOKEN", "123: #456")
+	defer os.Unsetenv("TEST_TELEPATHY_URL")
+	defer os.Unsetenv("TEST_TELEPATHY_INFO")
+	defer os.Unsetenv("TEST_TELEPATHY_TOKEN")
+
+	conf, err := parseConfig([]byte(testConfig))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Empty(conf.validate())
+	assert.Equal("8080", conf.Server.Port)
+	assert.Equal("https://example.com", conf.Server.URL)
+	assert.Equal(3*time.Second, conf.Command.Timeout)
+	assert.True(conf.Plugins.Info.Enabled)
+	assert.False(conf.Plugins.Twitch.Enabled)
+	assert.Equal("123: #456", conf.Plugins.Discord.Token)
+	assert.Equal(20, conf.Plugins.Discord.Buffer)
+
+	session := conf.sessionConfig()
+	assert.Equal("bot", session.CommandPrefix)
+	assert.Equal("admin", session.AdminToken)
+	assert.Equal("metrics", session.MetricsToken)
+	assert.Equal(telepathy.RestartPolicy{BaseDelay: 2 * time.Second}, session.RestartPolicy)
+	assert.Equal(telepathy.RateLimit{Rate: 5, Burst: 2}, session.MessengerRateLimits["DISCORD"])
+	assert.Equal(map[string]telepathy.Role{"LINE": telepathy.RoleUser}, session.MessengerDefaultRoles)
+	assert.Len(conf.plugins(), 2)
+}
+
+func TestParseConfigUnknownField(t *testing.T) {
+	_, err := parseConfig([]byte("plugins:\n  discrod:\n    enabled: true\n"))
+	assert.Error(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+	conf, err := parseConfig([]byte(`
+server:
+  port: "8080"
+database:
+  type: sql
+command:
+  prefix: my bot
+  operators: [DISCORD]
+plugins:
+  slack:
+    enabled: true
+    client_id: id
+    buffer: -1
+    default_role: owner
+    channel_rate_limit:
+      rate: 0
+`))
+	if !assert.NoError(err) {
+		return
+	}
+	errs := []string{}
+	for _, err := range conf.validate() {
+		errs = append(errs, err.Error())
+	}
+	assert.ElementsMatch([]string{
+		"server.url is required",
+		"database.type is invalid: sql",
+		"command.prefix must not contain spaces",
+		"command.operators is invalid: DISCORD, should be <messenger-id>@<user-id>",
+		"plugins.slack.buffer must not be negative",
+		"plugins.slack.channel_rate_limit.rate must be positive",
+		"plugins.slack.default_role is invalid: owner",
+		"plugins.slack.client_secret is required",
+		"plugins.slack.signing_secret is required",
+	}, errs)
+}
@@ -2,51 +2,61 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
-	"gitlab.com/kavenc/telepathy/internal/pkg/discord"
-	"gitlab.com/kavenc/telepathy/internal/pkg/fwd"
-	"gitlab.com/kavenc/telepathy/internal/pkg/info"
-	"gitlab.com/kavenc/telepathy/internal/pkg/line"
-	"gitlab.com/kavenc/telepathy/internal/pkg/slackmsg"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
-	"gitlab.com/kavenc/telepathy/internal/pkg/twitch"
 )
 
+const usage = `Usage:
+  telepathy [-config file]                  start Telepathy
+  telepathy config validate [-config file]  validate the config and exit
+
+Without -config, the path is read from TELEPATHY_CONFIG.
+If neither is set, the settings are read from environment variables.
+`
+
 func main() {
 	// colorized log
 	logrus.SetFormatter(&logrus.TextFormatter{ForceColors: true})
-	config := telepathy.SessionConfig{
-		Port:         os.Getenv("PORT"),
-		RootURL:      os.Getenv("URL"),
-		MongoURL:     os.Getenv("MONGODB_URL"),
-		DatabaseName: os.Getenv("MONGODB_NAME"),
+
+	args := os.Args[1:]
+	validateOnly := len(args) >= 2 && args[0] == "config" && args[1] == "validate"
+	if validateOnly {
+		args = args[2:]
+	}
+	flags := flag.NewFlagSet("telepathy", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	configPath := flags.String("config", os.Getenv("TELEPATHY_CONFIG"), "path to the config file")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	plugins := []telepathy.Plugin{
-		&info.Service{},
-		&line.Messenger{
-			Secret: os.Getenv("LINE_CHANNEL_SECRET"),
-			Token:  os.Getenv("LINE_CHANNEL_TOKEN"),
-		},
-		&discord.Messenger{
-			Token: os.Getenv("DISCORD_BOT_TOKEN"),
-		},
-		&slackmsg.Messenger{
-			ClientID:      os.Getenv("SLACK_CLIENT_ID"),
-			ClientSecret:  os.Getenv("SLACK_CLIENT_SECRET"),
-			SigningSecret: []byte(os.Getenv("SLACK_SIGNING_SECRET")),
-		},
-		&fwd.Service{},
-		&twitch.Service{
-			ClientID:     os.Getenv("TWITCH_CLIENT_ID"),
-			ClientSecret: os.Getenv("TWITCH_SECRET"),
-			WebsubSecret: []byte(os.Getenv("TWITCH_WEBSUB_SECRET")),
-		},
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if errs := conf.validate(); len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid config:")
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", err.Error())
+		}
+		os.Exit(1)
 	}
+	if validateOnly {
+		fmt.Println("config is valid")
+		return
+	}
+
+	config := conf.sessionConfig()
+	plugins := conf.plugins()
 
 	session, err := telepathy.NewSession(config, plugins)
 	if err != nil {
@@ -62,7 +72,7 @@ func main() {
 	}()
 
 	// Catch termination interrupts
-	sc := make(chan os.Signal)
+	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 	<-sc
 
@@ -7,11 +7,12 @@ package discord
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"path"
 	"strings"
-
-	"gitlab.com/kavenc/telepathy/internal/pkg/imgur"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/sirupsen/logrus"
@@ -19,22 +20,40 @@ import (
 )
 
 const (
-	inMsgLen = 10
+	inMsgLen          = 10
+	maxTextLen        = 2000     // Max characters of a Discord message
+	maxAttachmentSize = 50 << 20 // Max bytes of an attachment downloaded, as allowed for Nitro users
+	attachmentTimeout = 30 * time.Second
+)
+
+// attachmentClient downloads attachments, so that a stalled download does not block the handlers
+var attachmentClient = &http.Client{Timeout: attachmentTimeout}
+
+// Default outbound rate limits, Discord allows 50 requests per second of a bot,
+// and 5 messages per 5 seconds in a channel
+var (
+	defaultRateLimit        = telepathy.RateLimit{Rate: 50, Burst: 50}
+	defaultChannelRateLimit = telepathy.RateLimit{Rate: 1, Burst: 5}
 )
 
 // Messenger is the main discord plugin structure
 type Messenger struct {
 	Token         string
-	stopListening func()
+	InMsgBuffer   int // Size of the inbound message buffer, inMsgLen if not set
+	listenLock    sync.Mutex
+	stopListening []func()
+	guilds        *guildTracker
+	conn          connection
 	bot           *discordgo.Session
 	inMsg         chan telepathy.InboundMessage
 	outMsg        <-chan telepathy.OutboundMessage
+	panicHandler  func(interface{})
 	logger        *logrus.Entry
 }
 
 // ID implements telepathy.Plugin interface
 func (m *Messenger) ID() string {
-	return "DISCORD"
+	return messengerID
 }
 
 // SetLogger implements telepathy.Plugin interface
@@ -42,112 +61,348 @@ func (m *Messenger) SetLogger(logger *logrus.Entry) {
 	m.logger = logger
 }
 
+// AttachPanicHandler implements telepathy.PluginPanicHandler
+func (m *Messenger) AttachPanicHandler(handler func(interface{})) {
+	m.panicHandler = handler
+}
+
+// recoverHandler recovers panics in event handlers, which are called in goroutines of discordgo
+func (m *Messenger) recoverHandler() {
+	if r := recover(); r != nil {
+		if m.panicHandler == nil {
+			m.logger.Errorf("event handler panicked: %v", r)
+			return
+		}
+		m.panicHandler(r)
+	}
+}
+
 // Start implements telepathy.Plugin interface
 func (m *Messenger) Start() {
-	var err error
-	m.bot, err = discordgo.New("Bot " + m.Token)
+	// Start panics if it fails to connect, so that it is restarted with backoff
+	bot, err := discordgo.New("Bot " + m.Token)
 	if err != nil {
-		m.logger.Errorf("start failed: %s", err.Error())
-		return
+		m.conn.set(telepathy.HealthDown, err.Error())
+		m.logger.Panicf("start failed: %s", err.Error())
 	}
+	m.bot = bot
 
-	m.stopListening = m.bot.AddHandler(m.msgHandler)
-	err = m.bot.Open()
+	m.guilds = newGuildTracker()
+	m.listen([]func(){
+		m.bot.AddHandler(m.msgHandler),
+		m.bot.AddHandler(m.msgUpdateHandler),
+		m.bot.AddHandler(m.msgDeleteHandler),
+		m.bot.AddHandler(m.reactionAddHandler),
+		m.bot.AddHandler(m.reactionRemoveHandler),
+		m.bot.AddHandler(m.readyHandler),
+		m.bot.AddHandler(m.guildCreateHandler),
+		m.bot.AddHandler(m.guildDeleteHandler),
+		m.bot.AddHandler(m.channelCreateHandler),
+		m.bot.AddHandler(m.channelDeleteHandler),
+		m.bot.AddHandler(m.memberAddHandler),
+		m.bot.AddHandler(m.memberRemoveHandler),
+		m.bot.AddHandler(m.connectHandler),
+		m.bot.AddHandler(m.disconnectHandler),
+	})
+	// The handlers and the websocket are released even if Start panics,
+	// otherwise events are handled twice once Start is called again
+	defer func() {
+		m.conn.setSession(nil)
+		m.unlisten()
+		if err := bot.Close(); err != nil {
+			m.logger.Errorf("termination failed: %s", err.Error())
+		}
+	}()
+
+	err = bot.Open()
 	if err != nil {
-		m.logger.Errorf("open websocket connection failed: %s", err.Error())
-		return
+		m.conn.set(telepathy.HealthDown, err.Error())
+		m.logger.Panicf("open websocket connection failed: %s", err.Error())
 	}
+	m.conn.setSession(bot)
 
 	m.logger.Info("started")
 	m.transmitter()
-	err = m.bot.Close()
-	if err != nil {
-		m.logger.Errorf("termination failed: %s", err.Error())
-	}
 	m.logger.Info("terminated")
 }
 
+// listen keeps the functions removing the event handlers added by Start
+func (m *Messenger) listen(stopListening []func()) {
+	m.listenLock.Lock()
+	defer m.listenLock.Unlock()
+	m.stopListening = stopListening
+}
+
+// unlisten removes the event handlers added by Start, it may be called more than once
+func (m *Messenger) unlisten() {
+	m.listenLock.Lock()
+	stopListening := m.stopListening
+	m.stopListening = nil
+	m.listenLock.Unlock()
+	for _, stop := range stopListening {
+		stop()
+	}
+}
+
 // Stop implements telepathy.Plugin interface
 func (m *Messenger) Stop() {
-	m.stopListening()
+	m.unlisten()
 	close(m.inMsg)
 }
 
 // InMsgChannel implements telepathy.PluginMessenger
 func (m *Messenger) InMsgChannel() <-chan telepathy.InboundMessage {
 	if m.inMsg == nil {
-		m.inMsg = make(chan telepathy.InboundMessage, inMsgLen)
+		size := inMsgLen
+		if m.InMsgBuffer > 0 {
+			size = m.InMsgBuffer
+		}
+		m.inMsg = make(chan telepathy.InboundMessage, size)
 	}
 	return m.inMsg
 }
 
+// MaxTextLength implements telepathy.PluginTextLimiter
+func (m *Messenger) MaxTextLength() int {
+	return maxTextLen
+}
+
+// DefaultRateLimits implements telepathy.PluginRateLimiter
+func (m *Messenger) DefaultRateLimits() (telepathy.RateLimit, telepathy.RateLimit) {
+	return defaultRateLimit, defaultChannelRateLimit
+}
+
 // AttachOutMsgChannel impelements telepathy.PluginMessenger
 func (m *Messenger) AttachOutMsgChannel(ch <-chan telepathy.OutboundMessage) {
 	m.outMsg = ch
 }
 
+// RenderText implements telepathy.PluginTextRenderer
+func (m *Messenger) RenderText(message telepathy.OutboundMessage) string {
+	return withSender(message.AsName, renderContent(message))
+}
+
+// renderContent renders the content of message in discord markdown
+func renderContent(message telepathy.OutboundMessage) string {
+	if message.RichText != nil {
+		return renderMarkdown(message.RichText)
+	}
+	return message.Text
+}
+
+// withSender shows the name of the sender above content
+func withSender(asName, content string) string {
+	if asName == "" {
+		return content
+	}
+	return fmt.Sprintf("**[ %s ]**\n%s", asName, content)
+}
+
 func (m *Messenger) transmitter() {
-	var err error
 	for message := range m.outMsg {
-		text := strings.Builder{}
-		if message.AsName != "" {
-			fmt.Fprintf(&text, "**[ %s ]**\n%s", message.AsName, message.Text)
-		} else {
-			text.WriteString(message.Text)
-		}
+		content := renderContent(message)
+		text := withSender(message.AsName, content)
 
-		if message.Image != nil {
-			_, err = m.bot.ChannelMessageSendComplex(
-				message.ToChannel.ChannelID,
+		chID := message.ToChannel.ChannelID
+		var sent *discordgo.Message
+		var err error
+		switch {
+		case message.Action == telepathy.ActionDelete:
+			err = m.bot.ChannelMessageDelete(chID, message.MessageID)
+			if err == nil {
+				sent = &discordgo.Message{ID: message.MessageID}
+			}
+		case message.Action == telepathy.ActionEdit:
+			// Attachments can not be changed by editing
+			sent, err = m.bot.ChannelMessageEdit(chID, message.MessageID, text)
+		case len(message.Attachments) > 0:
+			files := []*discordgo.File{}
+			for _, att := range message.Attachments {
+				name := att.Name
+				if name == "" && att.Type == telepathy.AttachmentImage {
+					name = "sent-from-telepathy.png" // discord shows the image only if the name is an image file
+				}
+				files = append(files, &discordgo.File{
+					Name:        name,
+					ContentType: att.MIMEType,
+					Reader:      bytes.NewReader(att.Content),
+				})
+			}
+			sent, err = m.bot.ChannelMessageSendComplex(
+				chID,
 				&discordgo.MessageSend{
-					Content: text.String(),
-					File: &discordgo.File{
-						Name:        "sent-from-telepathy.png", // always use png, just to make discord show the image
-						ContentType: message.Image.Type,
-						Reader:      bytes.NewReader(message.Image.Content),
-					},
+					Content: text,
+					Files:   files,
 				},
 			)
-		} else {
-			if len(message.Text) > 0 {
-				_, err = m.bot.ChannelMessageSend(message.ToChannel.ChannelID, text.String())
-			}
+		case len(content) > 0:
+			sent, err = m.bot.ChannelMessageSend(chID, text)
 		}
 
 		if err != nil {
 			m.logger.Error("msg send failed: " + err.Error())
+			message.ReportResult("", deliveryError(err))
+			continue
 		}
+
+		msgID := ""
+		if sent != nil {
+			msgID = sent.ID
+		}
+		message.ReportResult(msgID, nil)
 	}
 }
 
-func createImgContent(att *discordgo.MessageAttachment, logger *logrus.Entry) *imgur.ByteContent {
-	dl, err := http.Get(att.ProxyURL)
+// deliveryError classifies errors returned by discord REST API
+func deliveryError(err error) error {
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok || restErr.Response == nil {
+		return err
+	}
+	if restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+		return telepathy.DeliveryError(telepathy.ErrMessageGone, err)
+	}
+	switch restErr.Response.StatusCode {
+	case http.StatusTooManyRequests:
+		return &telepathy.RateLimitError{Err: err}
+	case http.StatusNotFound:
+		return telepathy.DeliveryError(telepathy.ErrChannelGone, err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return telepathy.DeliveryError(telepathy.ErrUnauthorized, err)
+	}
+	return err
+}
+
+// createAttachment downloads att, returns false if the download failed
+func createAttachment(att *discordgo.MessageAttachment, logger *logrus.Entry) (telepathy.Attachment, bool) {
+	attachment := telepathy.Attachment{
+		Name:     att.Filename,
+		MIMEType: telepathy.MIMETypeByName(att.Filename),
+		Size:     int64(att.Size),
+	}
+	// Widht > 0 && Height > 0 indicates that this is a image file
+	if att.Height > 0 && att.Width > 0 && !strings.HasPrefix(attachment.MIMEType, "image/") {
+		attachment.MIMEType = "image/png"
+	}
+	attachment.Type = telepathy.AttachmentTypeOf(attachment.MIMEType)
+
+	if att.Size > maxAttachmentSize {
+		logger.Warnf("attachment %s is too large: %d bytes", att.Filename, att.Size)
+		return attachment, false
+	}
+	dl, err := attachmentClient.Get(att.ProxyURL)
 	if err != nil {
-		logger.Error("download attached image failed: " + err.Error())
-		return nil
+		logger.Error("download attachment failed: " + err.Error())
+		return attachment, false
 	}
 	defer dl.Body.Close()
-	buf := bytes.NewBuffer([]byte{})
-	buf.ReadFrom(dl.Body)
-	content := imgur.ByteContent{
-		Content: buf.Bytes(),
+	if dl.StatusCode != http.StatusOK {
+		logger.Errorf("download attachment failed: %s", dl.Status)
+		return attachment, false
 	}
-	ext := strings.ToLower(path.Ext(att.Filename))
-	if ext == "" {
-		logger.Warn("unknown attach image type: " + att.Filename)
-		ext = "png"
+	content, err := ioutil.ReadAll(io.LimitReader(dl.Body, maxAttachmentSize+1))
+	if err != nil {
+		logger.Error("download attachment failed: " + err.Error())
+		return attachment, false
+	}
+	if len(content) > maxAttachmentSize {
+		logger.Warnf("attachment %s is too large", att.Filename)
+		return attachment, false
 	}
-	content.Type = "image/" + ext
-	return &content
+	attachment.Content = content
+	return attachment, true
 }
 
 func (m *Messenger) msgHandler(_ *discordgo.Session, dgmessage *discordgo.MessageCreate) {
+	defer m.recoverHandler()
 	// Ignore all messages created by the bot itself
 	if dgmessage.Author.ID == m.bot.State.User.ID {
 		return
 	}
 
+	m.inMsg <- m.inboundMessage(telepathy.EventNewMessage, dgmessage.Message)
+}
+
+func (m *Messenger) msgUpdateHandler(_ *discordgo.Session, dgmessage *discordgo.MessageUpdate) {
+	defer m.recoverHandler()
+	// Updates without author are embeds resolved by discord, not edits by users
+	if dgmessage.Author == nil || dgmessage.Author.ID == m.bot.State.User.ID {
+		return
+	}
+
+	m.inMsg <- m.inboundMessage(telepathy.EventMessageEdited, dgmessage.Message)
+}
+
+func (m *Messenger) msgDeleteHandler(_ *discordgo.Session, dgmessage *discordgo.MessageDelete) {
+	defer m.recoverHandler()
+	// Only the IDs are available for deleted messages
+	m.inMsg <- telepathy.InboundMessage{
+		Event:     telepathy.EventMessageDeleted,
+		MessageID: dgmessage.ID,
+		FromChannel: telepathy.Channel{
+			MessengerID: m.ID(),
+			ChannelID:   dgmessage.ChannelID,
+		},
+	}
+}
+
+func (m *Messenger) reactionAddHandler(_ *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+	defer m.recoverHandler()
+	m.handleReaction(telepathy.EventReactionAdded, reaction.MessageReaction)
+}
+
+func (m *Messenger) reactionRemoveHandler(_ *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
+	defer m.recoverHandler()
+	m.handleReaction(telepathy.EventReactionRemoved, reaction.MessageReaction)
+}
+
+func (m *Messenger) handleReaction(event telepathy.InboundEvent, reaction *discordgo.MessageReaction) {
+	// Ignore reactions of the bot itself
+	if reaction.UserID == m.bot.State.User.ID {
+		return
+	}
+
 	message := telepathy.InboundMessage{
+		Event:     event,
+		MessageID: reaction.MessageID,
+		FromChannel: telepathy.Channel{
+			MessengerID: m.ID(),
+			ChannelID:   reaction.ChannelID,
+		},
+		SourceProfile: &telepathy.MsgrUserProfile{
+			ID:          reaction.UserID,
+			DisplayName: reaction.UserID,
+		},
+		Reaction: &telepathy.Reaction{},
+	}
+
+	// Custom emojis have IDs, otherwise the name is the unicode emoji
+	if reaction.Emoji.ID != "" {
+		message.Reaction.Name = reaction.Emoji.Name
+	} else {
+		message.Reaction.Emoji = reaction.Emoji.Name
+	}
+
+	// Reaction events carry only the user ID
+	if user, err := m.bot.User(reaction.UserID); err != nil {
+		m.logger.Error("get user fail: " + err.Error())
+	} else {
+		message.SourceProfile.DisplayName = user.Username
+	}
+
+	if channel, err := m.bot.Channel(reaction.ChannelID); err != nil {
+		m.logger.Error("get channel fail: " + err.Error())
+	} else {
+		message.IsDirectMessage = channel.Type == discordgo.ChannelTypeDM
+	}
+
+	m.inMsg <- message
+}
+
+func (m *Messenger) inboundMessage(event telepathy.InboundEvent, dgmessage *discordgo.Message) telepathy.InboundMessage {
+	message := telepathy.InboundMessage{
+		Event:     event,
+		MessageID: dgmessage.ID,
 		FromChannel: telepathy.Channel{
 			MessengerID: m.ID(),
 			ChannelID:   dgmessage.ChannelID,
@@ -156,24 +411,24 @@ func (m *Messenger) msgHandler(_ *discordgo.Session, dgmessage *discordgo.Messag
 			ID:          dgmessage.Author.ID,
 			DisplayName: dgmessage.Author.Username,
 		},
-		Text: dgmessage.Content,
+		Text:       dgmessage.Content,
+		RichText:   parseMarkdown(dgmessage.Content, dgmessage.Mentions),
+		BotMention: leadingMention(dgmessage.Content, m.bot.State.User.ID),
 	}
 
-	if len(dgmessage.Attachments) > 0 {
-		// Widht > 0 && Height > 0 indicates that this is a image file
-		if att := dgmessage.Attachments[0]; att.Height > 0 && att.Width > 0 {
-			content := createImgContent(att, m.logger)
-			if content != nil {
-				message.Image = imgur.NewImage(*content)
-			}
+	// Attachments failed to download are dropped, instead of being forwarded empty
+	for _, att := range dgmessage.Attachments {
+		if attachment, ok := createAttachment(att, m.logger); ok {
+			message.Attachments = append(message.Attachments, attachment)
 		}
 	}
 
 	channel, err := m.bot.Channel(dgmessage.ChannelID)
 	if err != nil {
 		m.logger.Error("get channel fail: " + err.Error())
+	} else {
+		message.IsDirectMessage = channel.Type == discordgo.ChannelTypeDM
 	}
-	message.IsDirectMessage = channel.Type == discordgo.ChannelTypeDM
 
-	m.inMsg <- message
+	return message
 }
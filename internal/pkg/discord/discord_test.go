@@ -0,0 +1,48 @@
+package discord
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestCreateAttachment(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	logger := logrus.WithField("module", "test")
+
+	att, ok := createAttachment(&discordgo.MessageAttachment{
+		Filename: "image.png", ProxyURL: server.URL + "/image.png", Size: 7, Width: 1, Height: 1,
+	}, logger)
+	assert.True(ok)
+	assert.Equal([]byte("content"), att.Content)
+	assert.Equal("image/png", att.MIMEType)
+
+	// Failed or oversized downloads are not forwarded as empty files
+	_, ok = createAttachment(&discordgo.MessageAttachment{Filename: "gone.png", ProxyURL: server.URL + "/gone.png"}, logger)
+	assert.False(ok)
+	_, ok = createAttachment(&discordgo.MessageAttachment{
+		Filename: "large.zip", ProxyURL: server.URL + "/image.png", Size: maxAttachmentSize + 1,
+	}, logger)
+	assert.False(ok)
+}
+
+func TestIsChannelAdminNotConnected(t *testing.T) {
+	m := &Messenger{}
+	admin, err := m.IsChannelAdmin(context.Background(), telepathy.Channel{MessengerID: messengerID, ChannelID: "C1"}, "U1")
+	assert.Error(t, err)
+	assert.False(t, admin)
+}
@@ -0,0 +1,62 @@
+package discord
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// connection tracks the state of the websocket connection to Discord
+type connection struct {
+	lock    sync.Mutex
+	status  telepathy.HealthStatus
+	detail  string
+	session *discordgo.Session // The session once its websocket is opened, nil before that or after closed
+}
+
+func (c *connection) set(status telepathy.HealthStatus, detail string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.status = status
+	c.detail = detail
+}
+
+// setSession publishes the session used by other goroutines, nil if it is not opened
+func (c *connection) setSession(session *discordgo.Session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.session = session
+}
+
+// getSession returns the opened session, or nil if there is none
+func (c *connection) getSession() *discordgo.Session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.session
+}
+
+// Health implements telepathy.PluginHealthReporter
+// No message can be received while the websocket is disconnected, but discordgo reconnects it,
+// so the websocket affects the readiness only
+func (m *Messenger) Health() map[string]telepathy.ComponentHealth {
+	m.conn.lock.Lock()
+	defer m.conn.lock.Unlock()
+	status := m.conn.status
+	if status == "" {
+		status = telepathy.HealthStarting
+	}
+	return map[string]telepathy.ComponentHealth{
+		"websocket": {Status: status, Detail: m.conn.detail},
+	}
+}
+
+func (m *Messenger) connectHandler(_ *discordgo.Session, _ *discordgo.Connect) {
+	defer m.recoverHandler()
+	m.conn.set(telepathy.HealthUp, "")
+}
+
+func (m *Messenger) disconnectHandler(_ *discordgo.Session, _ *discordgo.Disconnect) {
+	defer m.recoverHandler()
+	m.conn.set(telepathy.HealthDown, "disconnected")
+}
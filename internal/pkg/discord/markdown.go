@@ -0,0 +1,111 @@
+package discord
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+const messengerID = "DISCORD"
+
+var (
+	regexMention     = regexp.MustCompile(`^<@!?(\d+)>`)
+	regexCustomEmoji = regexp.MustCompile(`^<a?(:\w+:)\d+>`)
+	markdownEscaper  = strings.NewReplacer(
+		`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `~`, `\~`, `|`, `\|`, `>`, `\>`,
+	)
+)
+
+var markdownRules = []telepathy.MarkupRule{
+	{Delimiter: "```", Type: telepathy.RichCodeBlock, Multiline: true},
+	{Delimiter: "**", Type: telepathy.RichBold, Multiline: true},
+	{Delimiter: "*", Type: telepathy.RichItalic, Multiline: true},
+	{Delimiter: "_", Type: telepathy.RichItalic, Multiline: true, WordBoundary: true},
+	{Delimiter: "`", Type: telepathy.RichCode},
+}
+
+// leadingMention returns the mention of userID which text starts with, or empty string if there is none
+func leadingMention(text, userID string) string {
+	if match := regexMention.FindStringSubmatch(text); match != nil && match[1] == userID {
+		return match[0]
+	}
+	return ""
+}
+
+// parseMarkdown parses discord markdown into RichText
+// Mentions are resolved with the users mentioned by the message
+// Underline, strikethrough and spoiler have no counterparts on other messengers, and are kept as plain text
+func parseMarkdown(text string, mentions []*discordgo.User) telepathy.RichText {
+	syntax := telepathy.MarkupSyntax{
+		Rules:       markdownRules,
+		QuotePrefix: "> ",
+		AutoLink:    true,
+		Token: func(text string) (telepathy.RichNode, int, bool) {
+			plain := func(content string, length int) (telepathy.RichNode, int, bool) {
+				return telepathy.RichNode{Type: telepathy.RichPlain, Text: content}, length, true
+			}
+			switch {
+			case len(text) > 1 && text[0] == '\\' && text[1] < utf8.RuneSelf &&
+				(unicode.IsPunct(rune(text[1])) || unicode.IsSymbol(rune(text[1]))):
+				return plain(text[1:2], 2)
+			case strings.HasPrefix(text, "__"), strings.HasPrefix(text, "~~"), strings.HasPrefix(text, "||"):
+				return plain(text[:2], 2)
+			}
+			if match := regexMention.FindStringSubmatch(text); match != nil {
+				user := &telepathy.MsgrUserProfile{ID: match[1], DisplayName: match[1]}
+				for _, mentioned := range mentions {
+					if mentioned.ID == user.ID {
+						user.DisplayName = mentioned.Username
+						break
+					}
+				}
+				return telepathy.RichNode{
+					Type:        telepathy.RichMention,
+					User:        user,
+					MessengerID: messengerID,
+				}, len(match[0]), true
+			}
+			if match := regexCustomEmoji.FindStringSubmatch(text); match != nil {
+				return plain(match[1], len(match[0]))
+			}
+			return telepathy.RichNode{}, 0, false
+		},
+	}
+	return syntax.Parse(text)
+}
+
+// renderMarkdown renders RichText into discord markdown
+func renderMarkdown(text telepathy.RichText) string {
+	return text.Render(func(node telepathy.RichNode, content string) string {
+		switch node.Type {
+		case telepathy.RichPlain:
+			return markdownEscaper.Replace(content)
+		case telepathy.RichBold:
+			return "**" + content + "**"
+		case telepathy.RichItalic:
+			return "_" + content + "_"
+		case telepathy.RichCode:
+			return "`" + content + "`"
+		case telepathy.RichCodeBlock:
+			return "```\n" + content + "\n```"
+		case telepathy.RichLink:
+			// Discord does not support masked links in messages
+			if node.Children.PlainText() == node.URL {
+				return node.URL
+			}
+			return content + " (" + node.URL + ")"
+		case telepathy.RichMention:
+			if node.MessengerID == messengerID {
+				return "<@" + node.User.ID + ">"
+			}
+			return "@" + markdownEscaper.Replace(node.User.DisplayName)
+		case telepathy.RichQuote:
+			return telepathy.QuoteLines(content, "> ")
+		}
+		return content
+	})
+}
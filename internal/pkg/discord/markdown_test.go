@@ -0,0 +1,62 @@
+package discord
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	assert := assert.New(t)
+	mentions := []*discordgo.User{{ID: "123", Username: "user"}}
+	text := parseMarkdown("**bold** *it* _it_ `code` <@!123> \\*esc\\* __under__ <:emoji:456>", mentions)
+	assert.Equal(telepathy.RichText{
+		{Type: telepathy.RichBold, Children: telepathy.PlainRichText("bold")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichItalic, Children: telepathy.PlainRichText("it")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichItalic, Children: telepathy.PlainRichText("it")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichCode, Text: "code"},
+		{Type: telepathy.RichPlain, Text: " "},
+		{
+			Type:        telepathy.RichMention,
+			User:        &telepathy.MsgrUserProfile{ID: "123", DisplayName: "user"},
+			MessengerID: messengerID,
+		},
+		{Type: telepathy.RichPlain, Text: " *esc* __under__ :emoji:"},
+	}, text)
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	assert := assert.New(t)
+	text := telepathy.RichText{
+		{Type: telepathy.RichBold, Children: telepathy.PlainRichText("bold")},
+		{Type: telepathy.RichPlain, Text: " snake_case "},
+		{Type: telepathy.RichLink, URL: "https://example.com", Children: telepathy.PlainRichText("link")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichLink, URL: "https://example.com/a_b", Children: telepathy.PlainRichText("https://example.com/a_b")},
+		{Type: telepathy.RichPlain, Text: "\n"},
+		{Type: telepathy.RichQuote, Children: telepathy.RichText{
+			{Type: telepathy.RichMention, User: &telepathy.MsgrUserProfile{ID: "U1", DisplayName: "slacker"}, MessengerID: "SLACK"},
+			{Type: telepathy.RichPlain, Text: "\n"},
+			{Type: telepathy.RichMention, User: &telepathy.MsgrUserProfile{ID: "123", DisplayName: "user"}, MessengerID: messengerID},
+		}},
+	}
+	assert.Equal("**bold** snake\\_case link (https://example.com) https://example.com/a_b\n> @slacker\n> <@123>",
+		renderMarkdown(text))
+
+	// Round trip
+	markdown := "**bold _italic_** `code`\n```\nblock\n```"
+	assert.Equal(markdown, renderMarkdown(parseMarkdown(markdown, nil)))
+}
+
+func TestLeadingMention(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("<@123>", leadingMention("<@123> fwd info", "123"))
+	assert.Equal("<@!123>", leadingMention("<@!123>", "123"))
+	assert.Equal("", leadingMention("<@456> fwd info", "123"))
+	assert.Equal("", leadingMention("hi <@123>", "123"))
+}
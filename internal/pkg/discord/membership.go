@@ -0,0 +1,171 @@
+package discord
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// guildTracker tracks the guilds and their text channels,
+// so that the channels can be notified when the bot is removed from a guild
+// The guild is already removed from discordgo state when the handlers are called
+type guildTracker struct {
+	lock     sync.Mutex
+	startup  map[string]bool     // Guilds the bot is in when connected, their GuildCreate events are not joins
+	channels map[string][]string // Text channels of guilds
+}
+
+func newGuildTracker() *guildTracker {
+	return &guildTracker{
+		startup:  make(map[string]bool),
+		channels: make(map[string][]string),
+	}
+}
+
+func isGuildText(channel *discordgo.Channel) bool {
+	return channel.GuildID != "" && channel.Type == discordgo.ChannelTypeGuildText
+}
+
+// join records the channels of guild, returns true if the bot newly joined the guild
+func (t *guildTracker) join(guild *discordgo.Guild) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	channels := []string{}
+	for _, channel := range guild.Channels {
+		if channel.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, channel.ID)
+		}
+	}
+	t.channels[guild.ID] = channels
+	if t.startup[guild.ID] {
+		delete(t.startup, guild.ID)
+		return false
+	}
+	return true
+}
+
+// leave returns the channels of the guild the bot left
+func (t *guildTracker) leave(guildID string) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	channels := t.channels[guildID]
+	delete(t.channels, guildID)
+	return channels
+}
+
+func (t *guildTracker) addChannel(channel *discordgo.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.channels[channel.GuildID] = append(t.channels[channel.GuildID], channel.ID)
+}
+
+func (t *guildTracker) removeChannel(channel *discordgo.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	channels := t.channels[channel.GuildID]
+	for i, id := range channels {
+		if id == channel.ID {
+			t.channels[channel.GuildID] = append(channels[:i], channels[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *Messenger) membershipEvent(event telepathy.InboundEvent, channelID string, user *discordgo.User) telepathy.InboundMessage {
+	message := telepathy.InboundMessage{
+		Event: event,
+		FromChannel: telepathy.Channel{
+			MessengerID: m.ID(),
+			ChannelID:   channelID,
+		},
+	}
+	if user != nil {
+		message.SourceProfile = &telepathy.MsgrUserProfile{
+			ID:          user.ID,
+			DisplayName: user.Username,
+		}
+	}
+	return message
+}
+
+func (m *Messenger) readyHandler(_ *discordgo.Session, ready *discordgo.Ready) {
+	defer m.recoverHandler()
+	m.guilds.lock.Lock()
+	defer m.guilds.lock.Unlock()
+	for _, guild := range ready.Guilds {
+		m.guilds.startup[guild.ID] = true
+	}
+}
+
+func (m *Messenger) guildCreateHandler(_ *discordgo.Session, guild *discordgo.GuildCreate) {
+	defer m.recoverHandler()
+	if !m.guilds.join(guild.Guild) {
+		return
+	}
+	// Greetings are sent to the system channel, or the first text channel if not set
+	channelID := guild.SystemChannelID
+	if channelID == "" {
+		for _, channel := range guild.Channels {
+			if channel.Type == discordgo.ChannelTypeGuildText {
+				channelID = channel.ID
+				break
+			}
+		}
+	}
+	if channelID != "" {
+		m.inMsg <- m.membershipEvent(telepathy.EventBotJoined, channelID, nil)
+	}
+}
+
+func (m *Messenger) guildDeleteHandler(_ *discordgo.Session, guild *discordgo.GuildDelete) {
+	defer m.recoverHandler()
+	// Unavailable guilds are outages, the bot is still in the guild
+	if guild.Unavailable {
+		return
+	}
+	for _, channelID := range m.guilds.leave(guild.ID) {
+		m.inMsg <- m.membershipEvent(telepathy.EventBotLeft, channelID, nil)
+	}
+}
+
+func (m *Messenger) channelCreateHandler(_ *discordgo.Session, channel *discordgo.ChannelCreate) {
+	defer m.recoverHandler()
+	if isGuildText(channel.Channel) {
+		m.guilds.addChannel(channel.Channel)
+	}
+}
+
+func (m *Messenger) channelDeleteHandler(_ *discordgo.Session, channel *discordgo.ChannelDelete) {
+	defer m.recoverHandler()
+	if !isGuildText(channel.Channel) {
+		return
+	}
+	m.guilds.removeChannel(channel.Channel)
+	m.inMsg <- m.membershipEvent(telepathy.EventBotLeft, channel.ID, nil)
+}
+
+// Discord members join and leave guilds, the events are notified in the system channel
+func (m *Messenger) memberEvent(event telepathy.InboundEvent, member *discordgo.Member) {
+	if member.User == nil || member.User.ID == m.bot.State.User.ID {
+		return
+	}
+	guild, err := m.bot.State.Guild(member.GuildID)
+	if err != nil {
+		m.logger.Error("get guild fail: " + err.Error())
+		return
+	}
+	if guild.SystemChannelID != "" {
+		m.inMsg <- m.membershipEvent(event, guild.SystemChannelID, member.User)
+	}
+}
+
+func (m *Messenger) memberAddHandler(_ *discordgo.Session, member *discordgo.GuildMemberAdd) {
+	defer m.recoverHandler()
+	m.memberEvent(telepathy.EventUserJoined, member.Member)
+}
+
+func (m *Messenger) memberRemoveHandler(_ *discordgo.Session, member *discordgo.GuildMemberRemove) {
+	defer m.recoverHandler()
+	m.memberEvent(telepathy.EventUserLeft, member.Member)
+}
@@ -0,0 +1,28 @@
+package discord
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuildTracker(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newGuildTracker()
+	tracker.startup["G1"] = true
+
+	guild := &discordgo.Guild{ID: "G1", Channels: []*discordgo.Channel{
+		{ID: "C1", GuildID: "G1", Type: discordgo.ChannelTypeGuildText},
+		{ID: "V1", GuildID: "G1", Type: discordgo.ChannelTypeGuildVoice},
+	}}
+	// Guilds available at startup are not joins, but later ones are
+	assert.False(tracker.join(guild))
+	assert.True(tracker.join(&discordgo.Guild{ID: "G2"}))
+
+	tracker.addChannel(&discordgo.Channel{ID: "C2", GuildID: "G1"})
+	tracker.addChannel(&discordgo.Channel{ID: "C3", GuildID: "G1"})
+	tracker.removeChannel(&discordgo.Channel{ID: "C2", GuildID: "G1"})
+	assert.Equal([]string{"C1", "C3"}, tracker.leave("G1"))
+	assert.Empty(tracker.leave("G1"))
+}
@@ -0,0 +1,27 @@
+package discord
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// Users with any of these permissions in a channel are its admins
+const adminPermissions = discordgo.PermissionAdministrator |
+	discordgo.PermissionManageServer |
+	discordgo.PermissionManageChannels
+
+// IsChannelAdmin implements telepathy.PluginRoleProvider
+func (m *Messenger) IsChannelAdmin(_ context.Context, channel telepathy.Channel, userID string) (bool, error) {
+	bot := m.conn.getSession()
+	if bot == nil {
+		return false, errors.New("not connected")
+	}
+	permissions, err := bot.UserChannelPermissions(userID, channel.ChannelID)
+	if err != nil {
+		return false, err
+	}
+	return permissions&adminPermissions != 0, nil
+}
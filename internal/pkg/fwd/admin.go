@@ -0,0 +1,74 @@
+package fwd
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// adminPair is a forwarding pair in the admin API
+type adminPair struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	SrcAlias string `json:"src_alias"`
+	DstAlias string `json:"dst_alias"`
+}
+
+// AdminHandlers implements telepathy.PluginAdminHandler
+func (m *Service) AdminHandlers() map[string]telepathy.HTTPHandler {
+	return map[string]telepathy.HTTPHandler{
+		funcKey: m.adminTable,
+	}
+}
+
+// adminTable lists the forwarding pairs with GET, and deletes a pair given by from and to queries with DELETE
+func (m *Service) adminTable(response http.ResponseWriter, request *http.Request) {
+	m.tableLock.RLock()
+	defer m.tableLock.RUnlock()
+	if m.table == nil || m.tableStopped {
+		telepathy.WriteAdminError(response, http.StatusServiceUnavailable, errors.New("forwarding table is not running"))
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		pairs := []adminPair{}
+		for _, record := range <-m.table.dump() {
+			pairs = append(pairs, adminPair{
+				From:     record.From.Name(),
+				To:       record.To.Name(),
+				SrcAlias: record.SrcAlias,
+				DstAlias: record.DstAlias,
+			})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			if pairs[i].From != pairs[j].From {
+				return pairs[i].From < pairs[j].From
+			}
+			return pairs[i].To < pairs[j].To
+		})
+		telepathy.WriteAdminJSON(response, http.StatusOK, pairs)
+	case http.MethodDelete:
+		from, err := telepathy.ParseAdminChannel(request.URL.Query().Get("from"))
+		if err != nil {
+			telepathy.WriteAdminError(response, http.StatusBadRequest, err)
+			return
+		}
+		to, err := telepathy.ParseAdminChannel(request.URL.Query().Get("to"))
+		if err != nil {
+			telepathy.WriteAdminError(response, http.StatusBadRequest, err)
+			return
+		}
+		if !<-m.table.delete(from, to) {
+			telepathy.WriteAdminError(response, http.StatusNotFound, errors.New("forwarding does not exist"))
+			return
+		}
+		m.deleteRecord(request.Context(), from, to)
+		m.logger.Infof("forwarding removed by admin API: %s -> %s", from.Name(), to.Name())
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		telepathy.WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
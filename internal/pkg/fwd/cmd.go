@@ -19,19 +19,19 @@ func (m *Service) Command(done <-chan interface{}) *argo.Action {
 	cmd.AddSubAction(argo.Action{
 		Trigger:    "2way",
 		ShortDescr: "Create two-way channel forwarding",
-		LongDescr:  "Setup message forwarding between 2 channels",
-		MinConsume: 2,
-		ArgNames:   []string{"channel-alias-1", "channel-alias-2"},
-		Do:         m.createTwoWay,
+		LongDescr:  "Setup message forwarding between this channel and another channel. Channel aliases not given are asked",
+		MaxConsume: 2,
+		ArgNames:   []string{"this-channel-alias", "other-channel-alias"},
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, m.createTwoWay),
 	})
 
 	cmd.AddSubAction(argo.Action{
 		Trigger:    "1way",
 		ShortDescr: "Create one-way channel forwarding",
-		LongDescr:  "Setup message forwarding from 1 channel to another",
-		MinConsume: 2,
-		ArgNames:   []string{"channel-alias-1", "channel-alias-2"},
-		Do:         m.createOneWay,
+		LongDescr:  "Setup message forwarding from this channel to another channel. Channel aliases not given are asked",
+		MaxConsume: 2,
+		ArgNames:   []string{"this-channel-alias", "other-channel-alias"},
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, m.createOneWay),
 	})
 
 	cmd.AddSubAction(argo.Action{
@@ -46,7 +46,7 @@ func (m *Service) Command(done <-chan interface{}) *argo.Action {
 		MaxConsume: -1,
 		ArgNames:   []string{"channel-id", "channel-id"},
 		ShortDescr: "Stop receiving forwarded messages",
-		Do:         m.delFrom,
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, m.delFrom),
 	})
 
 	cmd.AddSubAction(argo.Action{
@@ -55,15 +55,15 @@ func (m *Service) Command(done <-chan interface{}) *argo.Action {
 		MaxConsume: -1,
 		ArgNames:   []string{"channel-id", "channel-id"},
 		ShortDescr: "Stop forwarding messages",
-		Do:         m.delTo,
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, m.delTo),
 	})
 
 	cmd.AddSubAction(argo.Action{
 		Trigger:    "set",
-		ShortDescr: "Used for identify channel",
+		ShortDescr: "Join a forwarding setup started in another channel",
 		ArgNames:   []string{"hash"},
 		MinConsume: 1,
-		Do:         m.set,
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, m.set),
 	})
 
 	return cmd
@@ -76,11 +76,7 @@ func (m *Service) createTwoWay(state *argo.State, extras ...interface{}) error {
 		return errors.New("failed to parse extraArgs")
 	}
 
-	if !telepathy.CommandEnsureDM(state, extraArgs) {
-		return nil
-	}
-
-	state.OutputStr.WriteString("Setup two-way channel forwarding (1st Channel <-> 2nd Channel)\n")
+	state.OutputStr.WriteString("Setup two-way channel forwarding (this channel <-> the other channel)\n")
 	return m.setupFwd(state, Session{Cmd: twoWay}, extraArgs)
 }
 
@@ -91,13 +87,8 @@ func (m *Service) createOneWay(state *argo.State, extras ...interface{}) error {
 		return errors.New("failed to parse extraArgs")
 	}
 
-	if !telepathy.CommandEnsureDM(state, extraArgs) {
-		return nil
-	}
-
-	state.OutputStr.WriteString("Setup one-way channel forwarding (1st Channel -> 2nd Channel)\n")
-	m.setupFwd(state, Session{Cmd: oneWay}, extraArgs)
-	return nil
+	state.OutputStr.WriteString("Setup one-way channel forwarding (this channel -> the other channel)\n")
+	return m.setupFwd(state, Session{Cmd: oneWay}, extraArgs)
 }
 
 func (m *Service) info(state *argo.State, extras ...interface{}) error {
@@ -140,11 +131,7 @@ func (m *Service) set(state *argo.State, extras ...interface{}) error {
 	args := state.Args()
 	key := args[0]
 
-	reply, err := m.setKeyProcess(key, extraArgs.Message.FromChannel)
-	if err != nil {
-		return err
-	}
-	state.OutputStr.WriteString(reply)
+	state.OutputStr.WriteString(m.setKeyProcess(extraArgs.Ctx, key, extraArgs.Message.FromChannel))
 	return nil
 }
 
@@ -181,6 +168,7 @@ func (m *Service) delFrom(state *argo.State, extras ...interface{}) error {
 		fromCh, ok := aliasMap[fromChName]
 		toChName := fromList[fromCh].DstAlias
 		if ok && <-m.table.delete(fromCh, thisCh) {
+			m.deleteRecord(extraArgs.Ctx, fromCh, thisCh)
 			fmt.Fprintf(&state.OutputStr, "Stop receiving messages from: %s\n", fromChName)
 			msg := telepathy.OutboundMessage{
 				ToChannel: fromCh,
@@ -214,6 +202,7 @@ func (m *Service) delTo(state *argo.State, extras ...interface{}) error {
 		toCh, ok := aliasMap[toChName]
 		fromChName := toList[toCh].SrcAlias
 		if ok && <-m.table.delete(thisCh, toCh) {
+			m.deleteRecord(extraArgs.Ctx, thisCh, toCh)
 			fmt.Fprintf(&state.OutputStr, "Stop forwarding messages to: %s\n", toChName)
 			msg := telepathy.OutboundMessage{
 				ToChannel: toCh,
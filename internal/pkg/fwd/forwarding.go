@@ -2,45 +2,70 @@ package fwd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
-	"github.com/mongodb/mongo-go-driver/mongo/options"
 	"github.com/sirupsen/logrus"
 
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 const (
-	id             = "FWD"
-	funcKey        = "fwd"
-	dbTableName    = "fwdtable"
-	outMsgLen      = 20
-	dbReqLen       = 1
-	redisReqLen    = 1
-	dbSyncInterval = 10 * time.Minute
+	id          = "FWD"
+	funcKey     = "fwd"
+	outMsgLen   = 20
+	redisReqLen = 1
+	kvTimeout   = 10 * time.Second
+	// Edits and deletions are forwarded only for messages in this period
+	forwardedExpireTime = 24 * time.Hour
 )
 
+// forwardedMsg records the IDs of the messages forwarded from a message,
+// so that edits and deletions of the message can be forwarded as well
+type forwardedMsg struct {
+	lock sync.Mutex
+	ids  map[telepathy.Channel]string
+}
+
+func (f *forwardedMsg) set(ch telepathy.Channel, msgID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.ids[ch] = msgID
+}
+
+func (f *forwardedMsg) all() map[telepathy.Channel]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ids := make(map[telepathy.Channel]string, len(f.ids))
+	for ch, msgID := range f.ids {
+		ids[ch] = msgID
+	}
+	return ids
+}
+
+func forwardedKey(from telepathy.Channel, msgID string) string {
+	return from.Name() + "/" + msgID
+}
+
 // Service defines the plugin structure
 type Service struct {
 	inMsg   <-chan telepathy.InboundMessage
 	outMsg  chan telepathy.OutboundMessage
-	dbReq   chan telepathy.DatabaseRequest
+	kv      *telepathy.KVStore
 	cmdDone <-chan interface{}
 
-	sessionKeys *cache.Cache
-	table       *table
-
-	// Control variables for db sync routine
-	dbCtx    context.Context
-	dbCancel context.CancelFunc
-	dbDone   chan interface{}
+	sessionKeys  *cache.Cache
+	forwarded    *cache.Cache // *forwardedMsg of recently forwarded messages
+	table        *table
+	tableLock    sync.RWMutex
+	tableStopped bool
 
-	logger *logrus.Entry
+	panicHandler func(interface{})
+	logger       *logrus.Entry
 }
 
 // ID implements telepathy.Plugin
@@ -53,24 +78,45 @@ func (m *Service) SetLogger(logger *logrus.Entry) {
 	m.logger = logger
 }
 
+// AttachPanicHandler implements telepathy.PluginPanicHandler
+func (m *Service) AttachPanicHandler(handler func(interface{})) {
+	m.panicHandler = handler
+}
+
+// recoverHandler recovers panics in routines started by Start, which are not recovered by the session
+func (m *Service) recoverHandler() {
+	if r := recover(); r != nil {
+		m.recovered(r)
+	}
+}
+
+func (m *Service) recovered(r interface{}) {
+	if m.panicHandler == nil {
+		m.logger.Errorf("handler panicked: %v", r)
+		return
+	}
+	m.panicHandler(r)
+}
+
 // Start implements telepathy.Plugin
 func (m *Service) Start() {
 	m.sessionKeys = cache.New(keyExpireTime, keyExpireTime)
-	m.dbCtx, m.dbCancel = context.WithCancel(context.Background())
-	m.dbDone = make(chan interface{})
+	m.forwarded = cache.New(forwardedExpireTime, forwardedExpireTime)
+	// Admin handlers may access the table while starting
+	m.tableLock.Lock()
 	m.table = newTable()
+	m.table.onPanic = m.recovered
+	m.tableLock.Unlock()
 
 	// Starting sequence
-	// 1. Load fwd table from DB
+	// 1. Load fwd table from KV store
 	// 2. Start table handler
 	// 3. start receiving/forwarding messages
-	err := m.loadFromDB()
+	err := m.loadFromKV()
 	if err != nil {
-		m.logger.Errorf("table LoadDB failed: %s", err.Error())
+		m.logger.Errorf("table load failed: %s", err.Error())
 	}
 
-	go m.dbSyncRoutine()
-
 	tableDone := make(chan interface{})
 	go func() {
 		m.table.start()
@@ -87,18 +133,17 @@ func (m *Service) Start() {
 
 	// Terminating sequence
 	// 1. Wait until msgHandler and command parser ends
-	// 2. close redis & close outMsg
-	// 3. Store fwd table to DB
-	// 4. Stop table handler
-	// 5. close db
+	// 2. close outMsg
+	// 3. Stop table handler
 	<-msgDone
 	<-m.cmdDone
-	m.dbCancel()
 	close(m.outMsg)
-	<-m.dbDone
+	// Delivery results may still arrive after outMsg is closed
+	m.tableLock.Lock()
+	m.tableStopped = true
 	m.table.stop()
+	m.tableLock.Unlock()
 	<-tableDone
-	close(m.dbReq)
 	m.logger.Info("terminated")
 }
 
@@ -120,92 +165,172 @@ func (m *Service) OutMsgChannel() <-chan telepathy.OutboundMessage {
 	return m.outMsg
 }
 
-// DBRequestChannel implements telepathy.PluginDatabaseUser
-func (m *Service) DBRequestChannel() <-chan telepathy.DatabaseRequest {
-	if m.dbReq == nil {
-		m.dbReq = make(chan telepathy.DatabaseRequest, dbReqLen)
-	}
-	return m.dbReq
+// AttachKVStore implements telepathy.PluginKVUser
+func (m *Service) AttachKVStore(kv *telepathy.KVStore) {
+	m.kv = kv
 }
 
 func (m *Service) msgHandler() {
 	for message := range m.inMsg {
-		toChList := m.table.getTo(message.FromChannel)
-		if toChList != nil {
-			for toCh, alias := range toChList {
-				outMsg := telepathy.OutboundMessage{
-					ToChannel: toCh,
-					AsName:    fmt.Sprintf("%s | %s", alias.SrcAlias, message.SourceProfile.DisplayName),
-					Text:      message.Text,
-					Image:     message.Image,
-				}
-				m.outMsg <- outMsg
-			}
+		m.handleMessage(message)
+	}
+}
+
+// handleMessage handles a message, a panic only drops the message
+func (m *Service) handleMessage(message telepathy.InboundMessage) {
+	defer m.recoverHandler()
+	switch message.Event {
+	case telepathy.EventNewMessage:
+		m.forwardMessage(message)
+	case telepathy.EventMessageEdited, telepathy.EventMessageDeleted:
+		m.forwardChange(message)
+	case telepathy.EventBotLeft:
+		m.removeChannel(message.FromChannel)
+	}
+}
+
+func (m *Service) forwardMessage(message telepathy.InboundMessage) {
+	toChList := m.table.getTo(message.FromChannel)
+	if toChList == nil {
+		return
+	}
+	var sent *forwardedMsg
+	if message.MessageID != "" {
+		sent = &forwardedMsg{ids: make(map[telepathy.Channel]string)}
+		m.forwarded.SetDefault(forwardedKey(message.FromChannel, message.MessageID), sent)
+	}
+	for toCh, alias := range toChList {
+		outMsg := telepathy.OutboundMessage{
+			ToChannel:   toCh,
+			AsName:      forwardName(alias, message),
+			Text:        message.Text,
+			RichText:    message.RichText,
+			Attachments: message.Attachments,
+			OnResult:    m.onResult(message.FromChannel, sent),
 		}
+		m.outMsg <- outMsg
 	}
 }
 
-func (m *Service) dbSyncRoutine() {
-	defer close(m.dbDone)
-	do := func() {
-		dirty := <-m.table.isDirty()
-		if dirty {
-			<-m.writeToDB()
-			m.logger.WithField("phase", "dbSyncRoutine").Info("fwd table sync to DB")
+// forwardChange edits or deletes the messages forwarded from the changed message
+func (m *Service) forwardChange(message telepathy.InboundMessage) {
+	key := forwardedKey(message.FromChannel, message.MessageID)
+	item, ok := m.forwarded.Get(key)
+	if !ok {
+		return
+	}
+	sent := item.(*forwardedMsg)
+	action := telepathy.ActionEdit
+	if message.Event == telepathy.EventMessageDeleted {
+		action = telepathy.ActionDelete
+		m.forwarded.Delete(key)
+	}
+
+	toChList := m.table.getTo(message.FromChannel)
+	for toCh, msgID := range sent.all() {
+		alias, ok := toChList[toCh]
+		if !ok {
+			// Forwarding is removed after the message was forwarded
+			continue
 		}
+		m.outMsg <- telepathy.OutboundMessage{
+			Action:    action,
+			MessageID: msgID,
+			ToChannel: toCh,
+			AsName:    forwardName(alias, message),
+			Text:      message.Text,
+			RichText:  message.RichText,
+		}
+	}
+}
+
+func forwardName(alias Alias, message telepathy.InboundMessage) string {
+	name := ""
+	if message.SourceProfile != nil {
+		name = message.SourceProfile.DisplayName
 	}
+	return fmt.Sprintf("%s | %s", alias.SrcAlias, name)
+}
 
-	for {
-		select {
-		case <-time.After(dbSyncInterval):
-			do()
-		case <-m.dbCtx.Done():
-			do()
+// onResult returns a DeliveryCallback which records the ID of the forwarded message in sent,
+// and removes the forwarding if the destination channel no longer exists
+func (m *Service) onResult(from telepathy.Channel, sent *forwardedMsg) telepathy.DeliveryCallback {
+	return func(result telepathy.DeliveryResult) {
+		if result.Err == nil {
+			if sent != nil && result.MessageID != "" {
+				sent.set(result.Message.ToChannel, result.MessageID)
+			}
 			return
 		}
+		if !errors.Is(result.Err, telepathy.ErrChannelGone) {
+			return
+		}
+		go func() {
+			defer m.recoverHandler()
+			m.removeForwarding(from, result.Message.ToChannel)
+		}()
 	}
 }
 
-func (m *Service) writeToDB() chan interface{} {
-	retCh := make(chan interface{}, 1)
-	bsonChan := m.table.bson()
-	m.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			tableBSON := bson.M{"ID": dbTableName, "Table": *(<-bsonChan)}
-			collection := db.Collection(funcKey)
-			result, err := collection.ReplaceOne(ctx,
-				map[string]string{"ID": dbTableName}, tableBSON, options.Replace().SetUpsert(true))
-			if err != nil {
-				m.logger.Error("error when writing table back to DB: " + err.Error())
-			}
-			return result
-		},
-		Return: retCh,
-	}
-	return retCh
-}
-
-func (m *Service) loadFromDB() error {
-	retCh := make(chan interface{}, 1)
-	m.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection(funcKey)
-			result := collection.FindOne(ctx, map[string]string{"ID": dbTableName})
-			raw, err := result.DecodeBytes()
-			if err != nil {
-				return err
-			}
-			return raw.Lookup("Table")
-		},
-		Return: retCh,
+// removeChannel removes all the forwardings from or to a channel the bot is removed from
+func (m *Service) removeChannel(ch telepathy.Channel) {
+	for to := range m.table.getTo(ch) {
+		m.removeForwarding(ch, to)
 	}
+	for from := range m.table.getFrom(ch) {
+		m.removeForwarding(from, ch)
+	}
+}
 
-	// Wait until DB operation is done
-	result := <-retCh
-	if err, ok := result.(error); ok {
+func (m *Service) removeForwarding(from, to telepathy.Channel) {
+	m.tableLock.RLock()
+	defer m.tableLock.RUnlock()
+	if m.tableStopped {
+		return
+	}
+	if <-m.table.delete(from, to) {
+		m.logger.Infof("channel is gone, forwarding removed: %s -> %s", from.Name(), to.Name())
+		m.deleteRecord(context.Background(), from, to)
+	}
+}
+
+// recordKey returns the KV store key of a forwarding pair
+func recordKey(from, to telepathy.Channel) string {
+	return from.Name() + ">" + to.Name()
+}
+
+func (m *Service) storeRecord(ctx context.Context, record TableRecord) {
+	ctx, cancel := context.WithTimeout(ctx, kvTimeout)
+	defer cancel()
+	if err := m.kv.Put(ctx, recordKey(record.From, record.To), record); err != nil {
+		m.logger.WithField("phase", "storeRecord").Errorf("%s: %s", recordKey(record.From, record.To), err.Error())
+	}
+}
+
+func (m *Service) deleteRecord(ctx context.Context, from, to telepathy.Channel) {
+	ctx, cancel := context.WithTimeout(ctx, kvTimeout)
+	defer cancel()
+	if err := m.kv.Delete(ctx, recordKey(from, to)); err != nil {
+		m.logger.WithField("phase", "deleteRecord").Errorf("%s: %s", recordKey(from, to), err.Error())
+	}
+}
+
+func (m *Service) loadFromKV() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	keys, err := m.kv.List(ctx, "")
+	if err != nil {
 		return err
 	}
 
-	bsonValue, _ := result.(bson.RawValue)
-	return m.table.loadBSON(bsonValue)
+	records := make([]TableRecord, 0, len(keys))
+	for _, key := range keys {
+		record := TableRecord{}
+		if err := m.kv.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	m.table.load(records)
+	return nil
 }
@@ -0,0 +1,100 @@
+package fwd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// The forwarding table was stored as {"ID": "fwdtable", "Table": [[from, [[to, alias], ...]], ...]}
+// in the "fwd" collection before it is kept in KVStore
+const (
+	legacyCollection = "fwd"
+	legacyID         = "fwdtable"
+	legacyField      = "Table"
+)
+
+// LegacyDocuments implements telepathy.PluginLegacyImporter
+func (m *Service) LegacyDocuments() []telepathy.LegacyDocument {
+	return []telepathy.LegacyDocument{{Collection: legacyCollection, ID: legacyID, Field: legacyField}}
+}
+
+// ImportLegacy implements telepathy.PluginLegacyImporter
+func (m *Service) ImportLegacy(ctx context.Context, _ telepathy.LegacyDocument, data bson.RawValue) error {
+	records, err := parseLegacyTable(data)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := m.kv.Put(ctx, recordKey(record.From, record.To), record); err != nil {
+			return err
+		}
+	}
+	m.logger.Infof("%d forwarding(s) imported", len(records))
+	return nil
+}
+
+// legacyPair splits a 2-element BSON array
+func legacyPair(value bson.RawValue) (bson.RawValue, bson.RawValue, error) {
+	array, ok := value.ArrayOK()
+	if !ok {
+		return bson.RawValue{}, bson.RawValue{}, errors.New("legacy table: pair is not an array")
+	}
+	values, err := array.Values()
+	if err != nil {
+		return bson.RawValue{}, bson.RawValue{}, err
+	}
+	if len(values) != 2 {
+		return bson.RawValue{}, bson.RawValue{}, errors.New("legacy table: pair is not of 2 elements")
+	}
+	return values[0], values[1], nil
+}
+
+func parseLegacyTable(data bson.RawValue) ([]TableRecord, error) {
+	table, ok := data.ArrayOK()
+	if !ok {
+		return nil, errors.New("legacy table is not an array")
+	}
+	entries, err := table.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []TableRecord{}
+	for _, entry := range entries {
+		rawFrom, rawList, err := legacyPair(entry)
+		if err != nil {
+			return nil, err
+		}
+		from := telepathy.Channel{}
+		if err := rawFrom.Unmarshal(&from); err != nil {
+			return nil, err
+		}
+		list, ok := rawList.ArrayOK()
+		if !ok {
+			return nil, errors.New("legacy table: channel list is not an array")
+		}
+		tos, err := list.Values()
+		if err != nil {
+			return nil, err
+		}
+		for _, rawTo := range tos {
+			rawCh, rawAlias, err := legacyPair(rawTo)
+			if err != nil {
+				return nil, err
+			}
+			record := TableRecord{From: from}
+			if err := rawCh.Unmarshal(&record.To); err != nil {
+				return nil, err
+			}
+			if err := rawAlias.Unmarshal(&record.Alias); err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
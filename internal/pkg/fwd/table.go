@@ -1,13 +1,10 @@
 package fwd
 
 import (
-	"errors"
 	"sync"
 
 	"gitlab.com/kavenc/telepathy/internal/pkg/randstr"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
@@ -18,8 +15,7 @@ const (
 	// Action identifiers
 	tableInsert = 0
 	tableDelete = 1
-	tableBSON   = 2
-	tableDirty  = 3
+	tableDump   = 2
 )
 
 // Alias is the alias information of a channel in forwarding table
@@ -35,6 +31,14 @@ type TableEntry struct {
 	Alias
 }
 
+// TableRecord is a forwarding pair stored in database
+// This is public only to be serialized
+type TableRecord struct {
+	From telepathy.Channel
+	To   telepathy.Channel
+	Alias
+}
+
 type channelList map[telepathy.Channel]Alias
 
 type tableOp struct {
@@ -47,7 +51,7 @@ type tableOp struct {
 type table struct {
 	data    sync.Map
 	opQueue chan tableOp
-	dirty   bool
+	onPanic func(recovered interface{}) // Panics of operations are recovered and passed to onPanic if set
 }
 
 type insertRet struct {
@@ -63,15 +67,29 @@ func newTable() *table {
 
 func (ft *table) start() {
 	for op := range ft.opQueue {
-		if op.action == tableInsert {
-			op.ret <- ft.insertImpl(op)
-		} else if op.action == tableDelete {
-			op.ret <- ft.deleteImpl(op)
-		} else if op.action == tableBSON {
-			op.ret <- ft.bsonImpl()
-		} else if op.action == tableDirty {
-			op.ret <- ft.dirtyImpl()
-		}
+		ft.handle(op)
+	}
+}
+
+// handle runs op and replies to it, a panicked op is replied with nil so that its caller is not blocked
+func (ft *table) handle(op tableOp) {
+	var ret interface{}
+	defer func() {
+		op.ret <- ret
+	}()
+	if ft.onPanic != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				ft.onPanic(r)
+			}
+		}()
+	}
+	if op.action == tableInsert {
+		ret = ft.insertImpl(op)
+	} else if op.action == tableDelete {
+		ret = ft.deleteImpl(op)
+	} else if op.action == tableDump {
+		ret = ft.dumpImpl()
 	}
 }
 
@@ -139,26 +157,14 @@ func (ft *table) getTo(from telepathy.Channel) channelList {
 	return ret
 }
 
-func (ft *table) bson() chan *bson.A {
-	op := tableOp{action: tableBSON, ret: make(chan interface{})}
+func (ft *table) dump() chan []TableRecord {
+	op := tableOp{action: tableDump, ret: make(chan interface{})}
 	ft.opQueue <- op
-	ret := make(chan *bson.A, 1)
+	ret := make(chan []TableRecord, 1)
 	go func() {
 		opRet := <-op.ret
-		bs, _ := opRet.(*bson.A)
-		ret <- bs
-	}()
-	return ret
-}
-
-func (ft *table) isDirty() chan bool {
-	op := tableOp{action: tableDirty, ret: make(chan interface{})}
-	ft.opQueue <- op
-	ret := make(chan bool, 1)
-	go func() {
-		opRet := <-op.ret
-		d, _ := opRet.(bool)
-		ret <- d
+		records, _ := opRet.([]TableRecord)
+		ret <- records
 	}()
 	return ret
 }
@@ -222,7 +228,6 @@ func (ft *table) insertImpl(op tableOp) insertRet {
 
 	toList[op.entry.Channel] = op.entry.Alias
 	ft.data.Store(op.key, toList)
-	ft.dirty = true
 	return insertRet{
 		ok:    true,
 		Alias: op.entry.Alias,
@@ -239,78 +244,34 @@ func (ft *table) deleteImpl(op tableOp) bool {
 	if exists {
 		delete(toList, op.entry.Channel)
 		ft.data.Store(op.key, toList)
-		ft.dirty = true
 	}
 	return exists
 }
 
-func (ft *table) bsonImpl() *bson.A {
-	tableBSON := bson.A{}
-
-	// Table to BSON
+func (ft *table) dumpImpl() []TableRecord {
+	records := []TableRecord{}
 	ft.data.Range(func(key interface{}, value interface{}) bool {
-		chListBSON := bson.A{}
 		from, _ := key.(telepathy.Channel)
 		toList, _ := value.(channelList)
 		for toCh, alias := range toList {
-			chListBSON = append(chListBSON, bson.A{toCh, alias})
+			records = append(records, TableRecord{From: from, To: toCh, Alias: alias})
 		}
-		tableBSON = append(tableBSON, bson.A{from, chListBSON})
 		return true
 	})
 
-	ft.dirty = false
-
-	return &tableBSON
-}
-
-func (ft *table) dirtyImpl() bool {
-	return ft.dirty
+	return records
 }
 
 // This function should only be used before start()
-func (ft *table) loadBSON(input bson.RawValue) error {
-	bsonArray, ok := input.ArrayOK()
-	if !ok {
-		return errors.New("bson.RawValue is not an array")
-	}
-
-	bsonElements, err := bsonArray.Elements()
-	if err != nil {
-		return err
-	}
-
-	for _, element := range bsonElements {
-		pair := element.Value().Array()
-		from := telepathy.Channel{}
-		err = pair.Index(0).Value().Unmarshal(&from)
-		if err != nil {
-			return err
-		}
-		rawArray := pair.Index(1).Value().Array()
-		rawList, err := rawArray.Elements()
-		if err != nil {
-			return err
-		}
-		list := make(channelList)
-		for _, rawCh := range rawList {
-			to := telepathy.Channel{}
-			alias := Alias{}
-			pair = rawCh.Value().Array()
-			err = pair.Index(0).Value().Unmarshal(&to)
-			if err != nil {
-				return err
-			}
-			err = pair.Index(1).Value().Unmarshal(&alias)
-			if err != nil {
-				return err
-			}
-			list[to] = alias
+func (ft *table) load(records []TableRecord) {
+	for _, record := range records {
+		var toList channelList
+		if load, ok := ft.data.Load(record.From); ok {
+			toList, _ = load.(channelList)
+		} else {
+			toList = make(channelList)
 		}
-		ft.data.Store(from, list)
+		toList[record.To] = record.Alias
+		ft.data.Store(record.From, toList)
 	}
-
-	ft.dirty = false
-
-	return nil
 }
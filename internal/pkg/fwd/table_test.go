@@ -1,7 +1,7 @@
 package fwd
 
 import (
-	"bytes"
+	"encoding/json"
 	"reflect"
 	"sync"
 	"testing"
@@ -35,6 +35,38 @@ func TestTableInsert(t *testing.T) {
 	}
 }
 
+func TestTableRecoverPanic(t *testing.T) {
+	tab := newTable()
+	recovered := make(chan interface{}, 1)
+	tab.onPanic = func(r interface{}) {
+		recovered <- r
+	}
+	go tab.start()
+	defer tab.stop()
+	from := telepathy.Channel{MessengerID: "msgA", ChannelID: "chA"}
+	to := TableEntry{
+		telepathy.Channel{MessengerID: "msgA", ChannelID: "chB"},
+		Alias{SrcAlias: "src", DstAlias: "dst"},
+	}
+
+	// A corrupted entry panics the insertion, which is replied as failed
+	tab.data.Store(from, "corrupted")
+	if ret := <-tab.insert(from, to); ret.ok {
+		t.Error("corrupted insert succeeded")
+	}
+	select {
+	case <-recovered:
+	default:
+		t.Error("panic not recovered")
+	}
+
+	// The table is still running
+	tab.data.Delete(from)
+	if ret := <-tab.insert(from, to); !ret.ok {
+		t.Error("insert failed after panic")
+	}
+}
+
 func TestTableInsertDuplicate(t *testing.T) {
 	tab := getTestTable()
 	defer tab.stop()
@@ -236,7 +268,7 @@ func mapContains(left, right *sync.Map) bool {
 	return ret
 }
 
-func TestTableBSON(t *testing.T) {
+func TestTableDump(t *testing.T) {
 	tab := getTestTable()
 	defer tab.stop()
 	from := telepathy.Channel{MessengerID: "msgA", ChannelID: "chA"}
@@ -259,23 +291,17 @@ func TestTableBSON(t *testing.T) {
 	}
 	<-tab.insert(from, to)
 
-	bs := <-tab.bson()
-	bsByte, err := bson.Marshal(bson.D{bson.E{Key: "table", Value: *bs}})
+	records := <-tab.dump()
+	encoded, err := json.Marshal(records)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	bsReader := bytes.NewReader(bsByte)
-
-	bsRaw, err := bson.NewFromIOReader(bsReader)
-	if err != nil {
+	decoded := []TableRecord{}
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
 		t.Fatalf(err.Error())
 	}
 	newTab := newTable()
-	bsValue := bsRaw.Lookup("table")
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
-	newTab.loadBSON(bsValue)
+	newTab.load(decoded)
 
 	go newTab.start()
 	loadedTo := newTab.getTo(from)
@@ -293,3 +319,27 @@ func TestTableBSON(t *testing.T) {
 	}
 	newTab.stop()
 }
+
+func TestParseLegacyTable(t *testing.T) {
+	from := telepathy.Channel{MessengerID: "msgA", ChannelID: "chA"}
+	to := telepathy.Channel{MessengerID: "msgB", ChannelID: "chB"}
+	alias := Alias{SrcAlias: "src", DstAlias: "dst"}
+	// Written the way the table was stored in the "fwd" collection
+	doc, err := bson.Marshal(bson.M{"ID": legacyID, legacyField: bson.A{bson.A{from, bson.A{bson.A{to, alias}}}}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	records, err := parseLegacyTable(bson.Raw(doc).Lookup(legacyField))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []TableRecord{{From: from, To: to, Alias: alias}}
+	if !reflect.DeepEqual(expected, records) {
+		t.Errorf("legacy table is not parsed: %v", records)
+	}
+
+	if _, err := parseLegacyTable(bson.Raw(doc).Lookup("ID")); err == nil {
+		t.Errorf("invalid legacy table is parsed")
+	}
+}
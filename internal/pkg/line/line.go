@@ -5,24 +5,38 @@
 package line
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"gitlab.com/kavenc/telepathy/internal/pkg/imgur"
 
 	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 const (
-	inMsgLen = 5
+	inMsgLen           = 5
+	maxTextLen         = 5000 // Max characters of a LINE text message
+	maxSendingMessages = 5    // Max number of messages in a LINE reply/push request
+
+	imageCacheExpiration = time.Hour // Uploaded images are reused for messages sent again or to multiple channels
+	imageCacheCleanup    = 10 * time.Minute
 )
 
+// Default outbound rate limit, LINE allows 2,000 push requests per second of a bot
+var defaultRateLimit = telepathy.RateLimit{Rate: 2000, Burst: 2000}
+
 // InitError indicates an error when initializing Discord messenger handler
 type InitError struct {
 	msg string
@@ -32,10 +46,12 @@ type InitError struct {
 type Messenger struct {
 	Secret        string
 	Token         string
+	InMsgBuffer   int // Size of the inbound message buffer, inMsgLen if not set
 	inMsgChannel  chan telepathy.InboundMessage
 	outMsgChannel <-chan telepathy.OutboundMessage
 	bot           *linebot.Client
 	replyTokenMap sync.Map
+	images        *cache.Cache // Images uploaded to imgur, keyed by MIME type and content hash
 	logger        *logrus.Entry
 }
 
@@ -55,6 +71,9 @@ func (m *Messenger) Start() {
 		m.logger.Panic(err.Error())
 	}
 	m.bot = bot
+	if m.images == nil {
+		m.images = cache.New(imageCacheExpiration, imageCacheCleanup)
+	}
 
 	m.logger.Info("started")
 	m.transmitter()
@@ -74,11 +93,25 @@ func (m *Messenger) SetLogger(logger *logrus.Entry) {
 // InMsgChannel provides inbound message channel
 func (m *Messenger) InMsgChannel() <-chan telepathy.InboundMessage {
 	if m.inMsgChannel == nil {
-		m.inMsgChannel = make(chan telepathy.InboundMessage, inMsgLen)
+		size := inMsgLen
+		if m.InMsgBuffer > 0 {
+			size = m.InMsgBuffer
+		}
+		m.inMsgChannel = make(chan telepathy.InboundMessage, size)
 	}
 	return m.inMsgChannel
 }
 
+// MaxTextLength implements telepathy.PluginTextLimiter
+func (m *Messenger) MaxTextLength() int {
+	return maxTextLen
+}
+
+// DefaultRateLimits implements telepathy.PluginRateLimiter
+func (m *Messenger) DefaultRateLimits() (telepathy.RateLimit, telepathy.RateLimit) {
+	return defaultRateLimit, telepathy.RateLimit{}
+}
+
 // AttachOutMsgChannel attaches outbound message channel
 func (m *Messenger) AttachOutMsgChannel(ch <-chan telepathy.OutboundMessage) {
 	m.outMsgChannel = ch
@@ -100,27 +133,36 @@ func (m *Messenger) transmitter() {
 	for message := range m.outMsgChannel {
 		messages := []linebot.SendingMessage{}
 
-		if message.Text == "" && message.Image == nil {
+		// Sent messages can not be changed on LINE
+		if message.Action != telepathy.ActionSend {
+			message.ReportResult("", telepathy.DeliveryError(telepathy.ErrNotSupported, fmt.Errorf("%s on %s", message.Action, m.ID())))
+			continue
+		}
+
+		// LINE does not support formatting
+		content := message.Text
+		if message.RichText != nil {
+			content = message.RichText.PlainText()
+		}
+		if content == "" && len(message.Attachments) == 0 {
 			continue
 		}
 
 		text := strings.Builder{}
 		if message.AsName != "" {
 			fmt.Fprintf(&text, "[ %s ]", message.AsName)
-			if message.Text != "" {
-				fmt.Fprintf(&text, "\n%s", message.Text)
+			if content != "" {
+				fmt.Fprintf(&text, "\n%s", content)
 			}
 		} else {
-			text.WriteString(message.Text)
+			text.WriteString(content)
 		}
 
 		if text.Len() > 0 {
 			messages = append(messages, linebot.NewTextMessage(text.String()))
 		}
 
-		if message.Image != nil {
-			messages = append(messages, linebot.NewTextMessage("(image)"))
-		}
+		messages = append(messages, m.attachmentMessages(message.Attachments, maxSendingMessages-len(messages))...)
 
 		// Try to use reply token
 		channelID := message.ToChannel.ChannelID
@@ -133,6 +175,7 @@ func (m *Messenger) transmitter() {
 			_, err := call.Do()
 
 			if err == nil {
+				message.ReportResult("", nil)
 				continue
 			}
 
@@ -150,8 +193,28 @@ func (m *Messenger) transmitter() {
 		if err != nil {
 			logger := m.logger.WithField("target", channelID)
 			logger.Error("push message failed: " + err.Error())
+			message.ReportResult("", deliveryError(err))
+			continue
 		}
+		message.ReportResult("", nil)
+	}
+}
+
+// deliveryError classifies errors returned by LINE messaging API
+func deliveryError(err error) error {
+	apiErr, ok := err.(*linebot.APIError)
+	if !ok {
+		return err
 	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests:
+		return &telepathy.RateLimitError{Err: err}
+	case http.StatusNotFound:
+		return telepathy.DeliveryError(telepathy.ErrChannelGone, err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return telepathy.DeliveryError(telepathy.ErrUnauthorized, err)
+	}
+	return err
 }
 
 func (m *Messenger) webhookHandler(response http.ResponseWriter, request *http.Request) {
@@ -167,50 +230,165 @@ func (m *Messenger) webhookHandler(response http.ResponseWriter, request *http.R
 	}
 
 	for _, event := range events {
-		if event.Type == linebot.EventTypeMessage {
-			message := telepathy.InboundMessage{FromChannel: telepathy.Channel{
-				MessengerID: m.ID(),
-			}}
-			profile, channelID := m.getSourceProfile(event.Source)
-			message.SourceProfile = profile
-			if message.SourceProfile == nil {
-				m.logger.Warn("ignored message with unknown source")
-				continue
+		switch event.Type {
+		case linebot.EventTypeMessage:
+			m.handleMessage(event)
+		case linebot.EventTypeJoin, linebot.EventTypeFollow:
+			m.handleMembership(telepathy.EventBotJoined, event.Source, nil)
+		case linebot.EventTypeLeave, linebot.EventTypeUnfollow:
+			m.handleMembership(telepathy.EventBotLeft, event.Source, nil)
+		case linebot.EventTypeMemberJoined:
+			for i := range event.Joined.Members {
+				m.handleMembership(telepathy.EventUserJoined, event.Source, &event.Joined.Members[i])
 			}
-			message.FromChannel.ChannelID = channelID
-			message.IsDirectMessage = message.SourceProfile.ID == channelID
-			item, _ := m.replyTokenMap.LoadOrStore(channelID, &sync.Pool{})
-			pool, _ := item.(*sync.Pool)
-			pool.Put(event.ReplyToken)
-			switch lineMessage := event.Message.(type) {
-			case *linebot.TextMessage:
-				message.Text = lineMessage.Text
-			case *linebot.StickerMessage:
-				message.Text = "(Sticker)"
-			case *linebot.ImageMessage:
-				response, err := m.bot.GetMessageContent(lineMessage.ID).Do()
-				if err != nil {
-					m.logger.Warn("fail to get image content")
-					continue
-				}
-				content, err := ioutil.ReadAll(response.Content)
-				response.Content.Close()
-				if err != nil {
-					m.logger.Warn("fail to read image content")
-					continue
-				}
-				message.Image = imgur.NewImage(
-					imgur.ByteContent{
-						Type:    response.ContentType,
-						Content: content,
-					})
-			default:
-				m.logger.Warnf("unsupported message type: %T", event.Message)
+		case linebot.EventTypeMemberLeft:
+			for i := range event.Left.Members {
+				m.handleMembership(telepathy.EventUserLeft, event.Source, &event.Left.Members[i])
+			}
+		}
+	}
+}
+
+func (m *Messenger) handleMessage(event *linebot.Event) {
+	message := telepathy.InboundMessage{FromChannel: telepathy.Channel{
+		MessengerID: m.ID(),
+	}}
+	profile, channelID := m.getSourceProfile(event.Source)
+	message.SourceProfile = profile
+	if message.SourceProfile == nil {
+		m.logger.Warn("ignored message with unknown source")
+		return
+	}
+	message.FromChannel.ChannelID = channelID
+	message.IsDirectMessage = message.SourceProfile.ID == channelID
+	item, _ := m.replyTokenMap.LoadOrStore(channelID, &sync.Pool{})
+	pool, _ := item.(*sync.Pool)
+	pool.Put(event.ReplyToken)
+	switch lineMessage := event.Message.(type) {
+	case *linebot.TextMessage:
+		message.Text = lineMessage.Text
+	case *linebot.StickerMessage:
+		message.Text = "(Sticker)"
+	case *linebot.ImageMessage:
+		if !m.attachContent(&message, lineMessage.ID, "image") {
+			return
+		}
+	case *linebot.VideoMessage:
+		if !m.attachContent(&message, lineMessage.ID, "video") {
+			return
+		}
+	case *linebot.AudioMessage:
+		if !m.attachContent(&message, lineMessage.ID, "audio") {
+			return
+		}
+	case *linebot.FileMessage:
+		if !m.attachContent(&message, lineMessage.ID, lineMessage.FileName) {
+			return
+		}
+	default:
+		m.logger.Warnf("unsupported message type: %T", event.Message)
+		return
+	}
+	m.inMsgChannel <- message
+}
+
+// handleMembership notifies membership changes of source
+// member is the user joined or left, nil if the bot itself joined or left
+func (m *Messenger) handleMembership(event telepathy.InboundEvent, source *linebot.EventSource, member *linebot.EventSource) {
+	message := telepathy.InboundMessage{
+		Event: event,
+		FromChannel: telepathy.Channel{
+			MessengerID: m.ID(),
+			ChannelID:   sourceChannelID(source),
+		},
+		IsDirectMessage: source.Type == linebot.EventSourceTypeUser,
+	}
+	if member != nil {
+		message.SourceProfile = &telepathy.MsgrUserProfile{
+			ID:          member.UserID,
+			DisplayName: member.UserID,
+		}
+		// Profiles of the users who left are no longer available
+		if event == telepathy.EventUserJoined {
+			memberSource := *source
+			memberSource.UserID = member.UserID
+			if profile, _ := m.getSourceProfile(&memberSource); profile != nil {
+				message.SourceProfile = profile
+			}
+		}
+	}
+	m.inMsgChannel <- message
+}
+
+// sourceChannelID returns the channel ID of source, in the same way as getSourceProfile
+// Profiles are not available once the bot left the channel
+func sourceChannelID(source *linebot.EventSource) string {
+	if source.GroupID != "" {
+		return source.GroupID
+	} else if source.UserID != "" {
+		return source.UserID
+	}
+	return source.RoomID
+}
+
+// attachContent downloads the content of a LINE message and adds it to message as an attachment
+// If name has no extension, it is decided by the content type
+func (m *Messenger) attachContent(message *telepathy.InboundMessage, id, name string) bool {
+	response, err := m.bot.GetMessageContent(id).Do()
+	if err != nil {
+		m.logger.Warnf("fail to get content of %s: %s", name, err.Error())
+		return false
+	}
+	content, err := ioutil.ReadAll(response.Content)
+	response.Content.Close()
+	if err != nil {
+		m.logger.Warnf("fail to read content of %s: %s", name, err.Error())
+		return false
+	}
+	if path.Ext(name) == "" {
+		if exts, _ := mime.ExtensionsByType(response.ContentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	message.Attachments = append(message.Attachments, telepathy.NewAttachment(name, response.ContentType, content))
+	return true
+}
+
+// attachmentMessages converts attachments to at most max LINE messages
+// Images are uploaded to imgur and sent as image messages,
+// other attachments are noted with their names since LINE requires hosted content to send them
+func (m *Messenger) attachmentMessages(attachments []telepathy.Attachment, max int) []linebot.SendingMessage {
+	messages := []linebot.SendingMessage{}
+	notes := []string{}
+	for _, att := range attachments {
+		if att.Type == telepathy.AttachmentImage && len(messages) < max-1 {
+			img := m.image(att)
+			fullURL, err := img.FullURL()
+			if err == nil {
+				thumbnailURL, _ := img.SmallThumbnailURL()
+				messages = append(messages, linebot.NewImageMessage(fullURL, thumbnailURL))
 				continue
 			}
-			m.inMsgChannel <- message
+			m.logger.Warnf("upload image failed: %s", err.Error())
 		}
+		notes = append(notes, fmt.Sprintf("(%s: %s)", att.Type, att.Name))
+	}
+	if len(notes) > 0 && max > 0 {
+		messages = append(messages, linebot.NewTextMessage(strings.Join(notes, "\n")))
+	}
+	return messages
+}
+
+// image returns the imgur image of att, which is uploaded once for the same content
+func (m *Messenger) image(att telepathy.Attachment) *imgur.Image {
+	sum := sha256.Sum256(att.Content)
+	key := att.MIMEType + "/" + hex.EncodeToString(sum[:])
+	if img, ok := m.images.Get(key); ok {
+		return img.(*imgur.Image)
 	}
+	img := imgur.NewImage(imgur.ByteContent{Type: att.MIMEType, Content: att.Content})
+	m.images.SetDefault(key, img)
+	return img
 }
 
 func (m *Messenger) getSourceProfile(source *linebot.EventSource) (*telepathy.MsgrUserProfile, string) {
@@ -0,0 +1,48 @@
+package slackmsg
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// adminTeam is an authorized team in the admin API, access tokens are never exposed
+type adminTeam struct {
+	TeamID    string `json:"team_id"`
+	BotID     string `json:"bot_id"`
+	BotUserID string `json:"bot_user_id"`
+}
+
+// AdminHandlers implements telepathy.PluginAdminHandler
+func (m *Messenger) AdminHandlers() map[string]telepathy.HTTPHandler {
+	return map[string]telepathy.HTTPHandler{
+		"slack-teams": m.adminTeams,
+	}
+}
+
+// adminTeams lists the authorized teams with GET, and removes the team given by team query with DELETE
+func (m *Messenger) adminTeams(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		teams := []adminTeam{}
+		for teamID, info := range m.botInfoMap.list() {
+			teams = append(teams, adminTeam{TeamID: teamID, BotID: info.BotID, BotUserID: info.BotUserID})
+		}
+		sort.Slice(teams, func(i, j int) bool { return teams[i].TeamID < teams[j].TeamID })
+		telepathy.WriteAdminJSON(response, http.StatusOK, teams)
+	case http.MethodDelete:
+		teamID := request.URL.Query().Get("team")
+		if _, ok := m.botInfoMap.get(teamID); !ok {
+			telepathy.WriteAdminError(response, http.StatusNotFound, errors.New("team is not authorized"))
+			return
+		}
+		m.botInfoMap.delete(teamID)
+		m.storeBotInfo(teamID, nil)
+		m.logger.Infof("team removed by admin API: %s", teamID)
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		telepathy.WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
@@ -2,16 +2,22 @@ package slackmsg
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
-	"github.com/mongodb/mongo-go-driver/mongo/options"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 const (
-	dbID         = "slackBotInfo"
-	collectionID = "slack"
+	kvTimeout = 10 * time.Second
+
+	// Bot info of all teams was stored as {"ID": "slackBotInfo", "Info": {<team id>: <bot info>}}
+	// in the "slack" collection before it is kept in KVStore
+	legacyCollection = "slack"
+	legacyID         = "slackBotInfo"
+	legacyField      = "Info"
 )
 
 type botInfo struct {
@@ -20,57 +26,132 @@ type botInfo struct {
 	AccessToken string
 }
 
-type botInfoMap map[string]botInfo
-
-func (m *Messenger) writeBotInfoToDB() chan interface{} {
-	ret := make(chan interface{}, 1)
-	logger := m.logger.WithField("phase", "writeBotInfoToDB")
-	m.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			data := bson.M{
-				"ID":   dbID,
-				"Info": m.botInfoMap,
-			}
-			collection := db.Collection(collectionID)
-			result, err := collection.ReplaceOne(ctx,
-				map[string]string{"ID": dbID}, data, options.Replace().SetUpsert(true))
-			if err != nil {
-				logger.Error("error when writing table back to DB: " + err.Error())
-			}
-			return result
-		},
-		Return: ret,
+// botInfoMap keeps the bot info of authorized teams, it is accessed by webhooks and the transmitter concurrently
+type botInfoMap struct {
+	lock    sync.RWMutex
+	teams   map[string]botInfo
+	loaded  bool
+	loadErr error
+}
+
+func (b *botInfoMap) get(teamID string) (botInfo, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	info, ok := b.teams[teamID]
+	return info, ok
+}
+
+func (b *botInfoMap) set(teamID string, info botInfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.teams == nil {
+		b.teams = make(map[string]botInfo)
 	}
+	b.teams[teamID] = info
+}
+
+func (b *botInfoMap) delete(teamID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.teams, teamID)
+}
 
+// list returns the bot info of all teams, keyed by team ID
+func (b *botInfoMap) list() map[string]botInfo {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	ret := make(map[string]botInfo, len(b.teams))
+	for teamID, info := range b.teams {
+		ret[teamID] = info
+	}
 	return ret
 }
 
-func (m *Messenger) readBotInfoFromDB() error {
-	ret := make(chan interface{}, 1)
-
-	m.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection(collectionID)
-			result := collection.FindOne(ctx, map[string]string{"ID": dbID})
-			raw, err := result.DecodeBytes()
-			if err != nil {
-				return err
-			}
-			return raw
-		},
-		Return: ret,
+// reset removes all teams, and marks the bot info not loaded
+func (b *botInfoMap) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.teams = make(map[string]botInfo)
+	b.loaded, b.loadErr = false, nil
+}
+
+func (b *botInfoMap) setLoaded(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.loaded, b.loadErr = true, err
+}
+
+// Health implements telepathy.PluginHealthReporter
+// Having no authorized team is not critical, as teams are authorized through the running webhooks
+func (m *Messenger) Health() map[string]telepathy.ComponentHealth {
+	m.botInfoMap.lock.RLock()
+	defer m.botInfoMap.lock.RUnlock()
+	teams := telepathy.ComponentHealth{Status: telepathy.HealthUp}
+	switch {
+	case !m.botInfoMap.loaded:
+		teams.Status = telepathy.HealthStarting
+	case m.botInfoMap.loadErr != nil:
+		teams.Status = telepathy.HealthDegraded
+		teams.Detail = fmt.Sprintf("load failed: %s", m.botInfoMap.loadErr.Error())
+	case len(m.botInfoMap.teams) == 0:
+		teams.Status = telepathy.HealthDegraded
+		teams.Detail = "no authorized team"
+	default:
+		teams.Detail = fmt.Sprintf("%d team(s) authorized", len(m.botInfoMap.teams))
+	}
+	return map[string]telepathy.ComponentHealth{"teams": teams}
+}
+
+// storeBotInfo persists the bot info of a team, a nil info removes it
+func (m *Messenger) storeBotInfo(teamID string, info *botInfo) {
+	logger := m.logger.WithField("phase", "storeBotInfo")
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	var err error
+	if info == nil {
+		err = m.kv.Delete(ctx, teamID)
+	} else {
+		err = m.kv.Put(ctx, teamID, *info)
+	}
+	if err != nil {
+		logger.Errorf("team: %s, %s", teamID, err.Error())
 	}
+}
 
-	// Wait until DB operation done
-	result := <-ret
-	if err, ok := result.(error); ok {
+func (m *Messenger) loadBotInfo() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	teams, err := m.kv.List(ctx, "")
+	if err != nil {
 		return err
 	}
 
-	raw, _ := result.(bson.Raw)
-	err := raw.Lookup("Info").Unmarshal(&m.botInfoMap)
-	if err != nil {
+	for _, teamID := range teams {
+		info := botInfo{}
+		if err := m.kv.Get(ctx, teamID, &info); err != nil {
+			return err
+		}
+		m.botInfoMap.set(teamID, info)
+	}
+	return nil
+}
+
+// LegacyDocuments implements telepathy.PluginLegacyImporter
+func (m *Messenger) LegacyDocuments() []telepathy.LegacyDocument {
+	return []telepathy.LegacyDocument{{Collection: legacyCollection, ID: legacyID, Field: legacyField}}
+}
+
+// ImportLegacy implements telepathy.PluginLegacyImporter
+func (m *Messenger) ImportLegacy(ctx context.Context, _ telepathy.LegacyDocument, data bson.RawValue) error {
+	teams := make(map[string]botInfo)
+	if err := data.Unmarshal(&teams); err != nil {
 		return err
 	}
+	for teamID, info := range teams {
+		if err := m.kv.Put(ctx, teamID, info); err != nil {
+			return err
+		}
+	}
+	m.logger.Infof("%d team(s) imported", len(teams))
 	return nil
 }
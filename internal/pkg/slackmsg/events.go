@@ -0,0 +1,125 @@
+package slackmsg
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// Events not supported by slackevents, they are parsed here
+const (
+	reactionAdded       = "reaction_added"
+	reactionRemoved     = "reaction_removed"
+	memberJoinedChannel = "member_joined_channel"
+	memberLeftChannel   = "member_left_channel"
+	channelDeleted      = "channel_deleted"
+	channelArchive      = "channel_archive"
+	groupDeleted        = "group_deleted"
+	groupArchive        = "group_archive"
+)
+
+var extraEventTypes = map[string]bool{
+	reactionAdded:       true,
+	reactionRemoved:     true,
+	memberJoinedChannel: true,
+	memberLeftChannel:   true,
+	channelDeleted:      true,
+	channelArchive:      true,
+	groupDeleted:        true,
+	groupArchive:        true,
+}
+
+// extraEvent holds the fields of all the extra events
+type extraEvent struct {
+	Type     string `json:"type"`
+	User     string `json:"user"`
+	Channel  string `json:"channel"`
+	Reaction string `json:"reaction"`
+	Item     struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	} `json:"item"`
+}
+
+type extraCallback struct {
+	TeamID string     `json:"team_id"`
+	Event  extraEvent `json:"event"`
+}
+
+// parseExtraEvent parses the webhook body if it is one of the extra events
+func parseExtraEvent(body []byte) (extraCallback, bool) {
+	callback := extraCallback{}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		return callback, false
+	}
+	return callback, extraEventTypes[callback.Event.Type]
+}
+
+func (m *Messenger) handleExtraEvent(callback extraCallback) {
+	logger := m.logger.WithField("phase", "handleExtraEvent")
+	teamID := callback.TeamID
+	info, ok := m.botInfoMap.get(teamID)
+	if !ok {
+		logger.Warnf("received from unknwon team: %s", teamID)
+		return
+	}
+
+	ev := callback.Event
+	message := telepathy.InboundMessage{
+		FromChannel: telepathy.Channel{MessengerID: m.ID()},
+	}
+	channelID := ev.Channel
+	isBot := ev.User == info.BotUserID
+	switch ev.Type {
+	case reactionAdded, reactionRemoved:
+		// Reactions on files are not bound to messages
+		if ev.Item.Type != "message" || isBot {
+			return
+		}
+		message.Event = telepathy.EventReactionAdded
+		if ev.Type == reactionRemoved {
+			message.Event = telepathy.EventReactionRemoved
+		}
+		channelID = ev.Item.Channel
+		message.MessageID = ev.Item.TS
+		message.Reaction = &telepathy.Reaction{Name: ev.Reaction}
+	case memberJoinedChannel:
+		message.Event = telepathy.EventUserJoined
+		if isBot {
+			message.Event = telepathy.EventBotJoined
+		}
+	case memberLeftChannel:
+		message.Event = telepathy.EventUserLeft
+		if isBot {
+			message.Event = telepathy.EventBotLeft
+		}
+	case channelArchive, groupArchive:
+		// Archived channels can be unarchived, so forwardings and subscriptions of them are kept
+		return
+	default:
+		// Channel is deleted, no more messages can be sent to it
+		message.Event = telepathy.EventBotLeft
+	}
+
+	uniqueChannelID, err := unqiueChannel{TeamID: teamID, ChannelID: channelID}.encode()
+	if err != nil {
+		logger.Errorf("failed to create uniqueChannel: %s", err.Error())
+		return
+	}
+	message.FromChannel.ChannelID = uniqueChannelID
+	// Direct message channel IDs start with D
+	message.IsDirectMessage = strings.HasPrefix(channelID, "D")
+
+	if ev.User != "" && !isBot {
+		bot := slack.New(info.AccessToken)
+		message.SourceProfile = &telepathy.MsgrUserProfile{
+			ID:          ev.User,
+			DisplayName: m.userName(bot)(ev.User),
+		}
+	}
+
+	m.inMsg <- message
+}
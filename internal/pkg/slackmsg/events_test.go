@@ -0,0 +1,64 @@
+package slackmsg
+
+import (
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestParseExtraEvent(t *testing.T) {
+	assert := assert.New(t)
+	body := `{"team_id":"T1","type":"event_callback","event":{"type":"reaction_added","user":"U1",
+		"reaction":"thumbsup","item":{"type":"message","channel":"C1","ts":"123.456"}}}`
+	callback, ok := parseExtraEvent([]byte(body))
+	assert.True(ok)
+	assert.Equal("T1", callback.TeamID)
+	assert.Equal("U1", callback.Event.User)
+	assert.Equal("thumbsup", callback.Event.Reaction)
+	assert.Equal("C1", callback.Event.Item.Channel)
+	assert.Equal("123.456", callback.Event.Item.TS)
+
+	callback, ok = parseExtraEvent([]byte(`{"team_id":"T1","type":"event_callback","event":{"type":"channel_deleted","channel":"C1"}}`))
+	assert.True(ok)
+	assert.Equal("C1", callback.Event.Channel)
+
+	_, ok = parseExtraEvent([]byte(`{"team_id":"T1","type":"event_callback","event":{"type":"message"}}`))
+	assert.False(ok)
+	_, ok = parseExtraEvent([]byte(`not json`))
+	assert.False(ok)
+}
+
+func TestLegacyBotInfo(t *testing.T) {
+	assert := assert.New(t)
+	// Written the way bot info was stored in the "slack" collection
+	teams := map[string]botInfo{"T1": {BotID: "B1", BotUserID: "U1", AccessToken: "token"}}
+	doc, err := bson.Marshal(bson.M{"ID": legacyID, legacyField: teams})
+	if !assert.NoError(err) {
+		return
+	}
+	decoded := make(map[string]botInfo)
+	assert.NoError(bson.Raw(doc).Lookup(legacyField).Unmarshal(&decoded))
+	assert.Equal(teams, decoded)
+}
+
+func TestHandleChannelEvents(t *testing.T) {
+	assert := assert.New(t)
+	m := &Messenger{inMsg: make(chan telepathy.InboundMessage, 1), logger: logrus.WithField("module", "test")}
+	m.botInfoMap.set("T1", botInfo{BotUserID: "U1"})
+
+	// Archived channels are not left, only deleted ones are
+	for _, eventType := range []string{channelArchive, groupArchive} {
+		m.handleExtraEvent(extraCallback{TeamID: "T1", Event: extraEvent{Type: eventType, Channel: "C1"}})
+		assert.Empty(m.inMsg, eventType)
+	}
+	for _, eventType := range []string{channelDeleted, groupDeleted} {
+		m.handleExtraEvent(extraCallback{TeamID: "T1", Event: extraEvent{Type: eventType, Channel: "C1"}})
+		if assert.Len(m.inMsg, 1, eventType) {
+			assert.Equal(telepathy.EventBotLeft, (<-m.inMsg).Event)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package slackmsg
+
+import (
+	"strings"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+const messengerID = "SLACK"
+
+var (
+	mrkdwnEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	mrkdwnUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+)
+
+var mrkdwnRules = []telepathy.MarkupRule{
+	{Delimiter: "```", Type: telepathy.RichCodeBlock, Multiline: true},
+	{Delimiter: "*", Type: telepathy.RichBold, WordBoundary: true},
+	{Delimiter: "_", Type: telepathy.RichItalic, WordBoundary: true},
+	{Delimiter: "`", Type: telepathy.RichCode},
+}
+
+// leadingMention returns the mention of userID which text starts with, or empty string if there is none
+func leadingMention(text, userID string) string {
+	prefix := "<@" + userID
+	if !strings.HasPrefix(text, prefix) {
+		return ""
+	}
+	end := strings.IndexByte(text, '>')
+	if end < 0 || (text[len(prefix)] != '>' && text[len(prefix)] != '|') {
+		return ""
+	}
+	return text[:end+1]
+}
+
+// parseMrkdwn parses slack mrkdwn into RichText
+// userName resolves the display names of mentioned users
+// Strikethrough has no counterpart on other messengers, and is kept as plain text
+func parseMrkdwn(text string, userName func(userID string) string) telepathy.RichText {
+	syntax := telepathy.MarkupSyntax{
+		Rules:       mrkdwnRules,
+		QuotePrefix: "&gt; ",
+		Unescape:    mrkdwnUnescaper.Replace,
+		Token: func(text string) (telepathy.RichNode, int, bool) {
+			if !strings.HasPrefix(text, "<") {
+				return telepathy.RichNode{}, 0, false
+			}
+			end := strings.IndexAny(text, ">\n")
+			if end < 0 || text[end] != '>' {
+				return telepathy.RichNode{}, 0, false
+			}
+			return parseSpecial(text[1:end], userName), end + 1, true
+		},
+	}
+	return syntax.Parse(text)
+}
+
+// parseSpecial parses the content of <...> in mrkdwn, which is a link, a mention or a special command
+func parseSpecial(content string, userName func(userID string) string) telepathy.RichNode {
+	target := content
+	label := ""
+	if sep := strings.IndexByte(content, '|'); sep >= 0 {
+		target = content[:sep]
+		label = mrkdwnUnescaper.Replace(content[sep+1:])
+	}
+
+	switch {
+	case strings.HasPrefix(target, "@"):
+		user := &telepathy.MsgrUserProfile{ID: target[1:], DisplayName: label}
+		if user.DisplayName == "" {
+			user.DisplayName = userName(user.ID)
+		}
+		return telepathy.RichNode{Type: telepathy.RichMention, User: user, MessengerID: messengerID}
+	case strings.HasPrefix(target, "#"):
+		if label == "" {
+			label = target[1:]
+		}
+		return telepathy.RichNode{Type: telepathy.RichPlain, Text: "#" + label}
+	case strings.HasPrefix(target, "!"):
+		// Special commands like <!here> or <!subteam^ID|@team>
+		if label == "" {
+			label = "@" + strings.SplitN(target[1:], "^", 2)[0]
+		}
+		return telepathy.RichNode{Type: telepathy.RichPlain, Text: label}
+	}
+
+	url := mrkdwnUnescaper.Replace(target)
+	if label == "" {
+		label = url
+	}
+	return telepathy.RichNode{Type: telepathy.RichLink, URL: url, Children: telepathy.PlainRichText(label)}
+}
+
+// renderMrkdwn renders RichText into slack mrkdwn
+func renderMrkdwn(text telepathy.RichText) string {
+	return text.Render(func(node telepathy.RichNode, content string) string {
+		switch node.Type {
+		case telepathy.RichPlain, telepathy.RichCode, telepathy.RichCodeBlock:
+			content = mrkdwnEscaper.Replace(content)
+		}
+
+		switch node.Type {
+		case telepathy.RichBold:
+			return "*" + content + "*"
+		case telepathy.RichItalic:
+			return "_" + content + "_"
+		case telepathy.RichCode:
+			return "`" + content + "`"
+		case telepathy.RichCodeBlock:
+			return "```" + content + "```"
+		case telepathy.RichLink:
+			if node.Children.PlainText() == node.URL {
+				return "<" + node.URL + ">"
+			}
+			return "<" + node.URL + "|" + strings.Replace(content, "|", "¦", -1) + ">"
+		case telepathy.RichMention:
+			if node.MessengerID == messengerID {
+				return "<@" + node.User.ID + ">"
+			}
+			return "@" + mrkdwnEscaper.Replace(node.User.DisplayName)
+		case telepathy.RichQuote:
+			return telepathy.QuoteLines(content, "> ")
+		}
+		return content
+	})
+}
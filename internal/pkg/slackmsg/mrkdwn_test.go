@@ -0,0 +1,64 @@
+package slackmsg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestParseMrkdwn(t *testing.T) {
+	assert := assert.New(t)
+	userName := func(id string) string { return "name of " + id }
+	text := parseMrkdwn("*bold* _it_ snake_case `a &lt; b` <@U1> <@U2|user> <https://example.com|link> <!here>\n&gt; quote", userName)
+	assert.Equal(telepathy.RichText{
+		{Type: telepathy.RichBold, Children: telepathy.PlainRichText("bold")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichItalic, Children: telepathy.PlainRichText("it")},
+		{Type: telepathy.RichPlain, Text: " snake_case "},
+		{Type: telepathy.RichCode, Text: "a < b"},
+		{Type: telepathy.RichPlain, Text: " "},
+		{
+			Type:        telepathy.RichMention,
+			User:        &telepathy.MsgrUserProfile{ID: "U1", DisplayName: "name of U1"},
+			MessengerID: messengerID,
+		},
+		{Type: telepathy.RichPlain, Text: " "},
+		{
+			Type:        telepathy.RichMention,
+			User:        &telepathy.MsgrUserProfile{ID: "U2", DisplayName: "user"},
+			MessengerID: messengerID,
+		},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichLink, URL: "https://example.com", Children: telepathy.PlainRichText("link")},
+		{Type: telepathy.RichPlain, Text: " @here\n"},
+		{Type: telepathy.RichQuote, Children: telepathy.PlainRichText("quote")},
+	}, text)
+}
+
+func TestRenderMrkdwn(t *testing.T) {
+	assert := assert.New(t)
+	text := telepathy.RichText{
+		{Type: telepathy.RichBold, Children: telepathy.RichText{
+			{Type: telepathy.RichItalic, Children: telepathy.PlainRichText("a < b")},
+		}},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichLink, URL: "https://example.com", Children: telepathy.PlainRichText("link")},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichMention, User: &telepathy.MsgrUserProfile{ID: "123", DisplayName: "user"}, MessengerID: "DISCORD"},
+		{Type: telepathy.RichPlain, Text: " "},
+		{Type: telepathy.RichMention, User: &telepathy.MsgrUserProfile{ID: "U1", DisplayName: "slacker"}, MessengerID: messengerID},
+		{Type: telepathy.RichPlain, Text: "\n"},
+		{Type: telepathy.RichQuote, Children: telepathy.PlainRichText("line1\nline2")},
+	}
+	assert.Equal("*_a &lt; b_* <https://example.com|link> @user <@U1>\n> line1\n> line2", renderMrkdwn(text))
+}
+
+func TestLeadingMention(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("<@U1>", leadingMention("<@U1> fwd info", "U1"))
+	assert.Equal("<@U1|bot>", leadingMention("<@U1|bot>", "U1"))
+	assert.Equal("", leadingMention("<@U12> fwd info", "U1"))
+	assert.Equal("", leadingMention("<@U1", "U1"))
+	assert.Equal("", leadingMention("hi <@U1>", "U1"))
+}
@@ -0,0 +1,27 @@
+package slackmsg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlopes/slack"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// IsChannelAdmin implements telepathy.PluginRoleProvider
+// Slack has no channel admins, admins and owners of the workspace are the admins of all its channels
+func (m *Messenger) IsChannelAdmin(ctx context.Context, channel telepathy.Channel, userID string) (bool, error) {
+	unique, err := newUniqueChannel(channel.ChannelID)
+	if err != nil {
+		return false, err
+	}
+	info, ok := m.botInfoMap.get(unique.TeamID)
+	if !ok {
+		return false, fmt.Errorf("unauthorized team: %s", unique.TeamID)
+	}
+	user, err := slack.New(info.AccessToken).GetUserInfoContext(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return user.IsAdmin || user.IsOwner || user.IsPrimaryOwner, nil
+}
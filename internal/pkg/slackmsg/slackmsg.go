@@ -18,21 +18,24 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/nlopes/slack"
 	"github.com/nlopes/slack/slackevents"
 	"github.com/sirupsen/logrus"
-	"gitlab.com/kavenc/telepathy/internal/pkg/imgur"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 const (
-	inMsgLen = 10
-	dbReqLen = 1
+	inMsgLen   = 10
+	maxTextLen = 4000 // Max characters of a Slack message as recommended by Slack, longer messages are truncated
 )
 
+// Default outbound rate limit of each channel, Slack allows 1 message per second in a channel with short bursts
+// Slack does not limit chat.postMessage of a workspace as a whole
+var defaultChannelRateLimit = telepathy.RateLimit{Rate: 1, Burst: 3}
+
 var validSubType = map[string]bool{
 	"":           true,
 	"file_share": true,
@@ -43,16 +46,18 @@ type Messenger struct {
 	SigningSecret []byte
 	ClientID      string
 	ClientSecret  string
+	InMsgBuffer   int // Size of the inbound message buffer, inMsgLen if not set
 	botInfoMap    botInfoMap
+	events        sync.WaitGroup // Extra events being handled after acknowledged
 	inMsg         chan telepathy.InboundMessage
 	outMsg        <-chan telepathy.OutboundMessage
-	dbReq         chan telepathy.DatabaseRequest
+	kv            *telepathy.KVStore
 	logger        *logrus.Entry
 }
 
 // ID implements telepathy.Plugin
 func (m *Messenger) ID() string {
-	return "SLACK"
+	return messengerID
 }
 
 // SetLogger implements telepathy.Plugin
@@ -62,10 +67,12 @@ func (m *Messenger) SetLogger(logger *logrus.Entry) {
 
 // Start implements telepathy.Plugin
 func (m *Messenger) Start() {
-	m.botInfoMap = botInfoMap{}
-	if err := m.readBotInfoFromDB(); err != nil {
+	m.botInfoMap.reset()
+	err := m.loadBotInfo()
+	if err != nil {
 		m.logger.Warnf("load bot info failed: %s", err.Error())
 	}
+	m.botInfoMap.setLoaded(err)
 	m.logger.Info("started")
 	m.transmitter()
 	m.logger.Info("terminated")
@@ -73,19 +80,41 @@ func (m *Messenger) Start() {
 
 // Stop implements telepathy.Plugin
 func (m *Messenger) Stop() {
+	// Webhooks are shut down before plugins stop, so no more events are added
+	m.events.Wait()
 	close(m.inMsg)
-	<-m.writeBotInfoToDB()
-	close(m.dbReq)
 }
 
 // InMsgChannel implements telepathy.PluginMessenger
 func (m *Messenger) InMsgChannel() <-chan telepathy.InboundMessage {
 	if m.inMsg == nil {
-		m.inMsg = make(chan telepathy.InboundMessage, inMsgLen)
+		size := inMsgLen
+		if m.InMsgBuffer > 0 {
+			size = m.InMsgBuffer
+		}
+		m.inMsg = make(chan telepathy.InboundMessage, size)
 	}
 	return m.inMsg
 }
 
+// MaxTextLength implements telepathy.PluginTextLimiter
+func (m *Messenger) MaxTextLength() int {
+	return maxTextLen
+}
+
+// DefaultRateLimits implements telepathy.PluginRateLimiter
+func (m *Messenger) DefaultRateLimits() (telepathy.RateLimit, telepathy.RateLimit) {
+	return telepathy.RateLimit{}, defaultChannelRateLimit
+}
+
+// RenderText implements telepathy.PluginTextRenderer
+func (m *Messenger) RenderText(message telepathy.OutboundMessage) string {
+	if message.RichText != nil {
+		return renderMrkdwn(message.RichText)
+	}
+	return message.Text
+}
+
 // AttachOutMsgChannel implements telepathy.PluginMessenger
 func (m *Messenger) AttachOutMsgChannel(ch <-chan telepathy.OutboundMessage) {
 	m.outMsg = ch
@@ -104,12 +133,9 @@ func (m *Messenger) SetWebhookURL(map[string]*url.URL) {
 
 }
 
-// DBRequestChannel implements PluginDatabaseUser
-func (m *Messenger) DBRequestChannel() <-chan telepathy.DatabaseRequest {
-	if m.dbReq == nil {
-		m.dbReq = make(chan telepathy.DatabaseRequest, dbReqLen)
-	}
-	return m.dbReq
+// AttachKVStore implements telepathy.PluginKVUser
+func (m *Messenger) AttachKVStore(kv *telepathy.KVStore) {
+	m.kv = kv
 }
 
 func (m *Messenger) transmitter() {
@@ -119,32 +145,120 @@ func (m *Messenger) transmitter() {
 		channel, err := newUniqueChannel(chID)
 		if err != nil {
 			logger.Errorf("invalid target ID: %s (%s)", chID, err.Error())
+			message.ReportResult("", telepathy.DeliveryError(telepathy.ErrChannelGone, err))
 			continue
 		}
 
-		info, ok := m.botInfoMap[channel.TeamID]
+		info, ok := m.botInfoMap.get(channel.TeamID)
 		if !ok {
 			logger.Errorf("unauthorized team: %s", channel.TeamID)
+			message.ReportResult("", telepathy.DeliveryError(telepathy.ErrUnauthorized, fmt.Errorf("team %s", channel.TeamID)))
 			continue
 		}
 
-		var options []slack.MsgOption
-		text := strings.Builder{}
-		text.WriteString(message.Text)
-		if message.Image != nil {
-			text.WriteString("(image)")
+		bot := slack.New(info.AccessToken)
+		text := m.RenderText(message)
+
+		switch message.Action {
+		case telepathy.ActionEdit:
+			// Messages are updated as the bot, AsName can not be changed
+			_, _, _, err = bot.UpdateMessage(channel.ChannelID, message.MessageID, slack.MsgOptionText(text, false))
+		case telepathy.ActionDelete:
+			_, _, err = bot.DeleteMessage(channel.ChannelID, message.MessageID)
+		}
+		if message.Action != telepathy.ActionSend {
+			if err != nil {
+				logger.Errorf("msg %s failed: %s", message.Action, err.Error())
+				message.ReportResult("", deliveryError(err))
+			} else {
+				message.ReportResult(message.MessageID, nil)
+			}
+			continue
 		}
 
-		options = append(options, slack.MsgOptionText(text.String(), false))
-		if message.AsName != "" {
-			options = append(options, slack.MsgOptionUsername(message.AsName))
+		msgID := ""
+		if text != "" {
+			options := []slack.MsgOption{slack.MsgOptionText(text, false)}
+			if message.AsName != "" {
+				options = append(options, slack.MsgOptionUsername(message.AsName))
+			}
+			// Slack identifies messages in a channel with their timestamps
+			_, msgID, err = bot.PostMessage(channel.ChannelID, options...)
+			if err != nil {
+				logger.Errorf("msg send failed: %s", err.Error())
+				message.ReportResult("", deliveryError(err))
+				continue
+			}
 		}
 
-		bot := slack.New(info.AccessToken)
-		bot.PostMessage(channel.ChannelID, options...)
+		// Files are uploaded as the bot itself, the sender is noted in the comment
+		// if there is no text message showing the sender name
+		// Once a part of the message is posted, failed uploads are not reported as failure,
+		// since sending the message again would duplicate the posted part
+		for i, att := range message.Attachments {
+			params := slack.FileUploadParameters{
+				Filename: att.Name,
+				Title:    att.Name,
+				Reader:   bytes.NewReader(att.Content),
+				Channels: []string{channel.ChannelID},
+			}
+			if i == 0 && text == "" && message.AsName != "" {
+				params.InitialComment = fmt.Sprintf("[ %s ]", message.AsName)
+			}
+			var file *slack.File
+			file, err = bot.UploadFile(params)
+			if err != nil {
+				logger.Errorf("file upload failed: %s", err.Error())
+				if i == 0 && text == "" {
+					break
+				}
+				err = nil
+				continue
+			}
+			if i == 0 && text == "" {
+				msgID = fileTimestamp(file, channel.ChannelID)
+			}
+		}
+		if err != nil {
+			message.ReportResult("", deliveryError(err))
+			continue
+		}
+		message.ReportResult(msgID, nil)
 	}
 }
 
+// fileTimestamp returns the timestamp of the message sharing file in channelID,
+// which identifies the message like the ones of text messages
+// Empty string is returned if the share is not known yet
+func fileTimestamp(file *slack.File, channelID string) string {
+	for _, shares := range []map[string][]slack.ShareFileInfo{file.Shares.Public, file.Shares.Private} {
+		if infos := shares[channelID]; len(infos) > 0 {
+			return infos[0].Ts
+		}
+	}
+	return ""
+}
+
+// deliveryError classifies errors returned by slack Web API
+func deliveryError(err error) error {
+	if rlErr, ok := err.(*slack.RateLimitedError); ok {
+		return &telepathy.RateLimitError{RetryAfter: rlErr.RetryAfter, Err: err}
+	}
+	switch err.Error() {
+	case "channel_not_found":
+		return telepathy.DeliveryError(telepathy.ErrChannelGone, err)
+	case "not_in_channel", "is_archived":
+		// The bot may be invited again, or the channel unarchived, so the channel is not gone
+		return telepathy.DeliveryError(telepathy.ErrUnauthorized, err)
+	case "message_not_found":
+		return telepathy.DeliveryError(telepathy.ErrMessageGone, err)
+	case "invalid_auth", "not_authed", "account_inactive", "token_revoked",
+		"cant_update_message", "cant_delete_message", "edit_window_closed":
+		return telepathy.DeliveryError(telepathy.ErrUnauthorized, err)
+	}
+	return err
+}
+
 func (m *Messenger) verifyRequest(header http.Header, body []byte) bool {
 	timestamp, ok := header["X-Slack-Request-Timestamp"]
 	if !ok || len(timestamp) > 1 {
@@ -179,34 +293,57 @@ func (m *Messenger) verifyRequest(header http.Header, body []byte) bool {
 	return true
 }
 
-func (m *Messenger) createImgContent(bot *slack.Client, file slackevents.File) *imgur.ByteContent {
-	logger := m.logger.WithField("phase", "createImgContent")
-	imgBuffer := bytes.Buffer{}
-	err := bot.GetFile(file.URLPrivateDownload, &imgBuffer)
-	if err != nil {
-		logger.Error("download attached image failed: " + err.Error())
-		return nil
+// createAttachment downloads file, returns false if the download failed
+func (m *Messenger) createAttachment(bot *slack.Client, file slackevents.File) (telepathy.Attachment, bool) {
+	logger := m.logger.WithField("phase", "createAttachment")
+	mimeType := file.Mimetype
+	if mimeType == "" {
+		mimeType = telepathy.MIMETypeByName(file.Name)
 	}
-	content := imgur.ByteContent{
-		Content: imgBuffer.Bytes(),
+	attachment := telepathy.Attachment{
+		Type:     telepathy.AttachmentTypeOf(mimeType),
+		Name:     file.Name,
+		MIMEType: mimeType,
+		Size:     int64(file.Size),
 	}
-	ext := file.Filetype
-	if ext == "" {
-		logger.Warnf("unknown attach image type: %s", ext)
-		ext = "png"
+	buffer := bytes.Buffer{}
+	err := bot.GetFile(file.URLPrivateDownload, &buffer)
+	if err != nil {
+		logger.Error("download attachment failed: " + err.Error())
+		return attachment, false
 	}
-	content.Type = "image/" + ext
-	return &content
+	attachment.Content = buffer.Bytes()
+	return attachment, true
 }
 
 func (m *Messenger) handleMessage(teamID string, ev *slackevents.MessageEvent) {
 	logger := m.logger.WithField("phase", "handleMessage")
-	info, ok := m.botInfoMap[teamID]
+	info, ok := m.botInfoMap.get(teamID)
 	if !ok {
 		logger.Warnf("received from unknwon team: %s", teamID)
 		return
 	}
 
+	// Edits and deletions carry the original message in the event
+	event := telepathy.EventNewMessage
+	switch ev.SubType {
+	case "message_changed":
+		// Unfurling links also changes messages, which are not edited by users
+		if ev.Message == nil || ev.Message.Edited == nil {
+			return
+		}
+		event = telepathy.EventMessageEdited
+		ev = innerMessage(ev, ev.Message)
+	case "message_deleted":
+		if ev.PreviousMessage == nil {
+			return
+		}
+		event = telepathy.EventMessageDeleted
+		ev = innerMessage(ev, ev.PreviousMessage)
+		ev.Text = ""
+		ev.Files = nil
+	}
+
 	if ev.BotID == info.BotID {
 		// skip self messages
 		return
@@ -247,32 +384,51 @@ func (m *Messenger) handleMessage(teamID string, ev *slackevents.MessageEvent) {
 		return
 	}
 	message := telepathy.InboundMessage{
+		Event:     event,
+		MessageID: ev.TimeStamp,
 		FromChannel: telepathy.Channel{
 			MessengerID: m.ID(),
 			ChannelID:   uniqueChannelID,
 		},
 		SourceProfile:   &srcProfile,
 		Text:            ev.Text,
+		RichText:        parseMrkdwn(ev.Text, m.userName(bot)),
 		IsDirectMessage: ev.ChannelType == "im",
+		BotMention:      leadingMention(ev.Text, info.BotUserID),
 	}
 
-	// handle image upload/share
-	if len(ev.Files) > 0 {
-		for _, file := range ev.Files {
-			if strings.HasPrefix(file.Mimetype, "image") {
-				content := m.createImgContent(bot, file)
-				if content != nil {
-					message.Image = imgur.NewImage(*content)
-				}
-				// TODO: support multiple image sharing
-				break
-			}
+	// handle file upload/share, files failed to download are dropped
+	for _, file := range ev.Files {
+		if attachment, ok := m.createAttachment(bot, file); ok {
+			message.Attachments = append(message.Attachments, attachment)
 		}
 	}
 
 	m.inMsg <- message
 }
 
+// innerMessage returns the message carried by an edit or deletion event
+// Channel information is only available in the outer event
+func innerMessage(outer, inner *slackevents.MessageEvent) *slackevents.MessageEvent {
+	msg := *inner
+	msg.Channel = outer.Channel
+	msg.ChannelType = outer.ChannelType
+	return &msg
+}
+
+// userName returns a function resolving display names of users
+// User ID is used as the name if it can not be resolved
+func (m *Messenger) userName(bot *slack.Client) func(string) string {
+	return func(userID string) string {
+		user, err := bot.GetUserInfo(userID)
+		if err != nil {
+			m.logger.WithField("user", userID).Warnf("get user failed: %s", err.Error())
+			return userID
+		}
+		return user.Profile.DisplayName
+	}
+}
+
 func (m *Messenger) webhook(response http.ResponseWriter, request *http.Request) {
 	logger := m.logger.WithField("phase", "webhook")
 	body, err := ioutil.ReadAll(request.Body)
@@ -288,6 +444,18 @@ func (m *Messenger) webhook(response http.ResponseWriter, request *http.Request)
 		return
 	}
 
+	// Extra events are acknowledged before handled, so that Slack does not retry them
+	// while user names are resolved or the inbound channel is full
+	if callback, ok := parseExtraEvent(body); ok {
+		m.events.Add(1)
+		go func() {
+			defer m.events.Done()
+			m.handleExtraEvent(callback)
+		}()
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
 	eventsAPIEvent, err := slackevents.ParseEvent(
 		json.RawMessage(body), slackevents.OptionNoVerifyToken())
 	if err != nil {
@@ -314,8 +482,8 @@ func (m *Messenger) webhook(response http.ResponseWriter, request *http.Request)
 		case *slackevents.MessageEvent:
 			m.handleMessage(eventsAPIEvent.TeamID, ev)
 		case *slackevents.TokensRevokedEvent:
-			delete(m.botInfoMap, eventsAPIEvent.TeamID)
-			go func() { <-m.writeBotInfoToDB() }()
+			m.botInfoMap.delete(eventsAPIEvent.TeamID)
+			go m.storeBotInfo(eventsAPIEvent.TeamID, nil)
 		}
 	}
 }
@@ -340,7 +508,7 @@ func (m *Messenger) oauth(response http.ResponseWriter, request *http.Request) {
 				return
 			}
 
-			if oldInfo, ok := m.botInfoMap[oauthResp.TeamID]; ok {
+			if oldInfo, ok := m.botInfoMap.get(oauthResp.TeamID); ok {
 				logger.Warnf("TeamID exists: %s, Info: %+v", oauthResp.TeamID, oldInfo)
 			}
 			info := botInfo{
@@ -348,8 +516,8 @@ func (m *Messenger) oauth(response http.ResponseWriter, request *http.Request) {
 				BotUserID:   oauthResp.Bot.BotUserID}
 			userInfo, _ := slack.New(info.AccessToken).GetUserInfo(info.BotUserID)
 			info.BotID = userInfo.Profile.BotID
-			m.botInfoMap[oauthResp.TeamID] = info
-			go func() { <-m.writeBotInfoToDB() }()
+			m.botInfoMap.set(oauthResp.TeamID, info)
+			go m.storeBotInfo(oauthResp.TeamID, &info)
 
 			response.Write([]byte("Telepathy has been added to your team"))
 			response.WriteHeader(http.StatusOK)
@@ -0,0 +1,32 @@
+package slackmsg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestDeliveryError(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(errors.Is(deliveryError(errors.New("channel_not_found")), telepathy.ErrChannelGone))
+	for _, code := range []string{"not_in_channel", "is_archived"} {
+		err := deliveryError(errors.New(code))
+		assert.False(errors.Is(err, telepathy.ErrChannelGone), code)
+		assert.True(errors.Is(err, telepathy.ErrUnauthorized), code)
+	}
+	assert.True(errors.Is(deliveryError(errors.New("message_not_found")), telepathy.ErrMessageGone))
+}
+
+func TestFileTimestamp(t *testing.T) {
+	assert := assert.New(t)
+	file := &slack.File{ID: "F1"}
+	assert.Equal("", fileTimestamp(file, "C1"))
+	file.Shares.Private = map[string][]slack.ShareFileInfo{"G1": {{Ts: "123.456"}}}
+	file.Shares.Public = map[string][]slack.ShareFileInfo{"C1": {{Ts: "789.012"}}}
+	assert.Equal("123.456", fileTimestamp(file, "G1"))
+	assert.Equal("789.012", fileTimestamp(file, "C1"))
+}
@@ -0,0 +1,241 @@
+package telepathy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminRoot        = "/admin/"
+	adminServiceID   = "telepathy.admin"
+	adminSendTimeout = 30 * time.Second
+	adminBodyLimit   = 1 << 20
+	// Channels no message is received from in this period are no longer listed as seen
+	adminSeenExpireTime = 7 * 24 * time.Hour
+)
+
+// PluginAdminHandler defines necessary functions if a plugin exposes endpoints in the admin API
+// Handlers are mounted at /admin/<pattern>, and only requests with the admin token reach them
+// Endpoints should respond JSON with WriteAdminJSON and WriteAdminError
+type PluginAdminHandler interface {
+	AdminHandlers() map[string]HTTPHandler
+}
+
+// WriteAdminJSON writes value as the JSON response of an admin endpoint
+func WriteAdminJSON(response http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		WriteAdminError(response, http.StatusInternalServerError, err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(body)
+}
+
+// WriteAdminError writes err as the JSON response of an admin endpoint: {"error": "<message>"}
+func WriteAdminError(response http.ResponseWriter, status int, err error) {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(body)
+}
+
+// ParseAdminChannel parses a channel name, formatted as Channel.Name, given to admin endpoints
+func ParseAdminChannel(name string) (Channel, error) {
+	if !strings.Contains(name, channelDelimiter) {
+		return Channel{}, fmt.Errorf("invalid channel: %s, should be <messenger-id>%s<channel-id>", name, channelDelimiter)
+	}
+	channel := NewChannel(name)
+	if channel.MessengerID == "" || channel.ChannelID == "" {
+		return Channel{}, fmt.Errorf("invalid channel: %s, should be <messenger-id>%s<channel-id>", name, channelDelimiter)
+	}
+	return *channel, nil
+}
+
+// requireAdmin wraps handler to reject requests without the bearer token
+func requireAdmin(token string, handler HTTPHandler) HTTPHandler {
+	return func(response http.ResponseWriter, request *http.Request) {
+		given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			response.Header().Set("WWW-Authenticate", `Bearer realm="telepathy"`)
+			WriteAdminError(response, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		handler(response, request)
+	}
+}
+
+// adminService serves the admin endpoints of the session: plugins, channels and messages
+// It records the channels of inbound messages as an inbound middleware, and sends messages as a producer
+type adminService struct {
+	health   func() HealthReport
+	settings *channelSettings
+	outMsg   chan OutboundMessage
+	seen     *cache.Cache // adminSeen of channels keyed by channel name
+	logger   *logrus.Entry
+}
+
+// adminSeen records when a message is last received from a channel
+type adminSeen struct {
+	channel Channel
+	at      time.Time
+}
+
+type adminChannel struct {
+	Channel  string            `json:"channel"`
+	LastSeen *time.Time        `json:"last_seen,omitempty"`
+	Prefix   string            `json:"prefix,omitempty"`
+	Disabled []string          `json:"disabled,omitempty"`
+	Aliases  map[string]string `json:"aliases,omitempty"`
+}
+
+type adminMessage struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+func newAdminService(health func() HealthReport, settings *channelSettings) *adminService {
+	return &adminService{
+		health:   health,
+		settings: settings,
+		outMsg:   make(chan OutboundMessage),
+		seen:     cache.New(adminSeenExpireTime, time.Hour),
+	}
+}
+
+func (a *adminService) ID() string {
+	return adminServiceID
+}
+
+func (a *adminService) SetLogger(logger *logrus.Entry) {
+	a.logger = logger
+}
+
+func (a *adminService) Start() {}
+
+// Stop is called after the web server is shut down, so no message is sent after outMsg is closed
+func (a *adminService) Stop() {
+	close(a.outMsg)
+}
+
+func (a *adminService) OutMsgChannel() <-chan OutboundMessage {
+	return a.outMsg
+}
+
+// MiddlewareOrder runs the middleware first, to see all messages before they are dropped by others
+func (a *adminService) MiddlewareOrder() int {
+	return math.MinInt32
+}
+
+func (a *adminService) InboundMiddleware(msg InboundMessage) []InboundMessage {
+	a.seen.SetDefault(msg.FromChannel.Name(), adminSeen{channel: msg.FromChannel, at: time.Now()})
+	return []InboundMessage{msg}
+}
+
+func (a *adminService) AdminHandlers() map[string]HTTPHandler {
+	return map[string]HTTPHandler{
+		"plugins":  a.plugins,
+		"channels": a.channels,
+		"messages": a.messages,
+	}
+}
+
+func (a *adminService) plugins(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	WriteAdminJSON(response, http.StatusOK, a.health().Plugins)
+}
+
+// channels lists the channels with settings, and the channels messages are received from in adminSeenExpireTime
+func (a *adminService) channels(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	channels := make(map[Channel]*adminChannel)
+	entry := func(channel Channel) *adminChannel {
+		if _, ok := channels[channel]; !ok {
+			channels[channel] = &adminChannel{Channel: channel.Name()}
+		}
+		return channels[channel]
+	}
+	for _, item := range a.seen.Items() {
+		seen, _ := item.Object.(adminSeen)
+		entry(seen.channel).LastSeen = &seen.at
+	}
+	for channel, conf := range a.settings.all() {
+		ret := entry(channel)
+		ret.Prefix = conf.prefix
+		ret.Disabled = sortedKeys(conf.disabled)
+		ret.Aliases = conf.aliases
+	}
+
+	list := make([]*adminChannel, 0, len(channels))
+	for _, channel := range channels {
+		list = append(list, channel)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Channel < list[j].Channel })
+	WriteAdminJSON(response, http.StatusOK, list)
+}
+
+// messages sends a message to any channel, and responds the message ID once it is delivered
+func (a *adminService) messages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	msg := adminMessage{}
+	if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, adminBodyLimit)).Decode(&msg); err != nil {
+		WriteAdminError(response, http.StatusBadRequest, err)
+		return
+	}
+	channel, err := ParseAdminChannel(msg.Channel)
+	if err != nil {
+		WriteAdminError(response, http.StatusBadRequest, err)
+		return
+	}
+	if msg.Text == "" {
+		WriteAdminError(response, http.StatusBadRequest, errors.New("text is required"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), adminSendTimeout)
+	defer cancel()
+	results := make(chan DeliveryResult, 1)
+	out := OutboundMessage{
+		ToChannel: channel,
+		Text:      msg.Text,
+		OnResult:  func(result DeliveryResult) { results <- result },
+	}
+	select {
+	case a.outMsg <- out:
+	case <-ctx.Done():
+		WriteAdminError(response, http.StatusGatewayTimeout, errors.New("timeout sending the message"))
+		return
+	}
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			WriteAdminError(response, http.StatusBadGateway, result.Err)
+			return
+		}
+		a.logger.Infof("message sent to %s by admin API", channel.Name())
+		WriteAdminJSON(response, http.StatusOK, map[string]string{"message_id": result.MessageID})
+	case <-ctx.Done():
+		WriteAdminError(response, http.StatusGatewayTimeout, errors.New("timeout waiting for the delivery result"))
+	}
+}
@@ -0,0 +1,119 @@
+package telepathy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdminServer(admin *adminService, token string) *httpServer {
+	server, _ := newWebServer("http://localhost", "8080")
+	server.adminToken = token
+	for pattern, handler := range admin.AdminHandlers() {
+		server.registerAdmin(pattern, handler)
+	}
+	server.finalize()
+	return server
+}
+
+func adminRequest(server *httpServer, method, path, token, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdminAuth(t *testing.T) {
+	assert := assert.New(t)
+	admin := newAdminService(func() HealthReport {
+		return HealthReport{Plugins: map[string]PluginHealth{"plugin": {State: PluginRunning}}}
+	}, newChannelSettings())
+
+	server := newAdminServer(admin, "secret")
+	assert.Equal(http.StatusUnauthorized, adminRequest(server, http.MethodGet, "/admin/plugins", "", "").Code)
+	assert.Equal(http.StatusUnauthorized, adminRequest(server, http.MethodGet, "/admin/plugins", "wrong", "").Code)
+	recorder := adminRequest(server, http.MethodGet, "/admin/plugins", "secret", "")
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.JSONEq(`{"plugin": {"state": "running"}}`, recorder.Body.String())
+	assert.Equal(http.StatusMethodNotAllowed, adminRequest(server, http.MethodPost, "/admin/plugins", "secret", "").Code)
+
+	// Not mounted without token, falls back to the root response
+	server = newAdminServer(admin, "")
+	assert.Equal("Telepathy Bot is Running", adminRequest(server, http.MethodGet, "/admin/plugins", "", "").Body.String())
+	assert.Error(server.registerAdmin("plugins", nil))
+}
+
+func TestAdminChannels(t *testing.T) {
+	assert := assert.New(t)
+	settings := newChannelSettings()
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	other := Channel{MessengerID: "msg", ChannelID: "other"}
+	settings.channels[ch] = channelConfig{prefix: "!t", disabled: map[string]bool{"fwd": true}}
+	admin := newAdminService(nil, settings)
+	admin.InboundMiddleware(InboundMessage{FromChannel: other})
+	// Channels not seen for a while are not listed
+	gone := Channel{MessengerID: "msg", ChannelID: "gone"}
+	admin.seen.Set(gone.Name(), adminSeen{channel: gone, at: time.Now()}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	server := newAdminServer(admin, "secret")
+
+	recorder := adminRequest(server, http.MethodGet, "/admin/channels", "secret", "")
+	assert.Equal(http.StatusOK, recorder.Code)
+	channels := []adminChannel{}
+	assert.NoError(json.Unmarshal(recorder.Body.Bytes(), &channels))
+	if assert.Len(channels, 2) {
+		assert.Equal(adminChannel{Channel: "msg@ch", Prefix: "!t", Disabled: []string{"fwd"}}, channels[0])
+		assert.Equal("msg@other", channels[1].Channel)
+		assert.NotNil(channels[1].LastSeen)
+	}
+}
+
+func TestAdminMessages(t *testing.T) {
+	assert := assert.New(t)
+	admin := newAdminService(nil, newChannelSettings())
+	admin.SetLogger(logrus.WithField("plugin", adminServiceID))
+	server := newAdminServer(admin, "secret")
+	go func() {
+		for msg := range admin.OutMsgChannel() {
+			if msg.ToChannel.ChannelID == "gone" {
+				msg.ReportResult("", DeliveryError(ErrChannelGone, errors.New("gone")))
+				continue
+			}
+			msg.ReportResult("id-"+msg.Text, nil)
+		}
+	}()
+
+	recorder := adminRequest(server, http.MethodPost, "/admin/messages", "secret", `{"channel": "msg@ch", "text": "hi"}`)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.JSONEq(`{"message_id": "id-hi"}`, recorder.Body.String())
+
+	recorder = adminRequest(server, http.MethodPost, "/admin/messages", "secret", `{"channel": "msg@gone", "text": "hi"}`)
+	assert.Equal(http.StatusBadGateway, recorder.Code)
+	assert.Contains(recorder.Body.String(), "error")
+
+	assert.Equal(http.StatusBadRequest, adminRequest(server, http.MethodPost, "/admin/messages", "secret", `{"channel": "ch", "text": "hi"}`).Code)
+	assert.Equal(http.StatusBadRequest, adminRequest(server, http.MethodPost, "/admin/messages", "secret", `{"channel": "msg@ch"}`).Code)
+	assert.Equal(http.StatusBadRequest, adminRequest(server, http.MethodPost, "/admin/messages", "secret", `{`).Code)
+	admin.Stop()
+}
+
+func TestParseAdminChannel(t *testing.T) {
+	assert := assert.New(t)
+	channel, err := ParseAdminChannel("DISCORD@123")
+	assert.NoError(err)
+	assert.Equal(Channel{MessengerID: "DISCORD", ChannelID: "123"}, channel)
+	for _, name := range []string{"", "DISCORD", "@123", "DISCORD@"} {
+		_, err := ParseAdminChannel(name)
+		assert.Error(err, name)
+	}
+}
@@ -0,0 +1,229 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/kavenc/argo"
+)
+
+const maxAliasDepth = 8 // Max number of aliases expanded for a command
+
+var regexAliasParam = regexp.MustCompile(`\$(@|[0-9]+)`)
+
+// aliases returns the aliases defined in channel
+func (m *cmdManager) aliases(channel Channel) map[string]string {
+	if m.settings == nil {
+		return nil
+	}
+	return m.settings.get(channel).aliases
+}
+
+// isTrigger returns true if word triggers a command in channel, either a top level command or an alias
+func (m *cmdManager) isTrigger(channel Channel, word string) bool {
+	if m.isCommand(word) {
+		return true
+	}
+	_, ok := m.aliases(channel)[word]
+	return ok
+}
+
+// expandAliases replaces the leading alias of args with its command, until args starts with a command
+// args is in the form returned by commandArgs, commands always take precedence over aliases
+func (m *cmdManager) expandAliases(aliases map[string]string, args []string) ([]string, error) {
+	expanded := make(map[string]bool)
+	for len(args) > 1 && !m.isCommand(args[1]) {
+		name := args[1]
+		command, ok := aliases[name]
+		if !ok {
+			break
+		}
+		if expanded[name] {
+			return nil, fmt.Errorf("alias %s refers to itself", name)
+		}
+		if len(expanded) == maxAliasDepth {
+			return nil, fmt.Errorf("alias %s is nested too deep", name)
+		}
+		expanded[name] = true
+		expandedArgs, err := expandAlias(command, args[2:])
+		if err != nil {
+			return nil, fmt.Errorf("alias %s is invalid: %s", name, err.Error())
+		}
+		args = append([]string{args[0]}, expandedArgs...)
+	}
+	return args, nil
+}
+
+// expandAlias fills params into the placeholders of command: $1, $2, ... for each param and $@ for all params
+// params are appended to command if it has no placeholders
+func expandAlias(command string, params []string) ([]string, error) {
+	tokens, err := tokenizeCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	placeholder := false
+	args := make([]string, 0, len(tokens)+len(params))
+	for _, token := range tokens {
+		if token == "$@" {
+			placeholder = true
+			args = append(args, params...)
+			continue
+		}
+		if !regexAliasParam.MatchString(token) {
+			args = append(args, token)
+			continue
+		}
+		placeholder = true
+		token = regexAliasParam.ReplaceAllStringFunc(token, func(param string) string {
+			if param == "$@" {
+				return strings.Join(params, " ")
+			}
+			n, _ := strconv.Atoi(param[1:])
+			if n < 1 || n > len(params) {
+				return ""
+			}
+			return params[n-1]
+		})
+		// Placeholders of missing params are removed
+		if token != "" {
+			args = append(args, token)
+		}
+	}
+	if !placeholder {
+		args = append(args, params...)
+	}
+	return args, nil
+}
+
+// aliasCommand manages the command aliases of each channel
+// It is attached as a top level command by Session
+func (m *cmdManager) aliasCommand() *argo.Action {
+	cmd := &argo.Action{
+		Trigger:    "alias",
+		ShortDescr: "Command aliases of current channel",
+	}
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "add",
+		ShortDescr: "Add an alias of a command",
+		LongDescr:  "Placeholders in the command are replaced with the args of the alias: $1, $2, ... for each arg and $@ for all args. Args are appended to the command if there are no placeholders",
+		MinConsume: 2,
+		MaxConsume: -1,
+		ArgNames:   []string{"name", "command"},
+		Do:         CommandRequireRole(RoleAdmin, m.cmdAliasAdd),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "del",
+		ShortDescr: "Remove an alias",
+		MinConsume: 1,
+		ArgNames:   []string{"name"},
+		Do:         CommandRequireRole(RoleAdmin, m.cmdAliasDel),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "list",
+		ShortDescr: "List the aliases of current channel",
+		Do:         m.cmdAliasList,
+	})
+
+	return cmd
+}
+
+func (m *cmdManager) cmdAliasAdd(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		m.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	args := state.Args()
+	name, command := args[0], args[1:]
+	if m.isCommand(name) {
+		fmt.Fprintf(&state.OutputStr, "Can not override command: %s", name)
+		return nil
+	}
+	if regexAliasParam.MatchString(name) {
+		fmt.Fprintf(&state.OutputStr, "Invalid alias name: %s", name)
+		return nil
+	}
+	// The prefix is optional
+	if len(command) > 1 && (command[0] == extraArgs.Prefix || command[0] == m.cmdRoot.Trigger) {
+		command = command[1:]
+	}
+
+	channel := extraArgs.Message.FromChannel
+	var reason string
+	err := m.settings.update(extraArgs.Ctx, channel, func(conf *channelConfig) error {
+		conf.aliases[name] = quoteArgs(command)
+		if _, ok := conf.aliases[command[0]]; !ok && !m.isCommand(command[0]) {
+			reason = fmt.Sprintf("Unknown command: %s", command[0])
+			return errors.New(reason)
+		}
+		if _, err := m.expandAliases(conf.aliases, []string{m.cmdRoot.Trigger, name}); err != nil {
+			reason = fmt.Sprintf("Invalid alias: %s", err.Error())
+			return err
+		}
+		return nil
+	})
+	if reason != "" {
+		state.OutputStr.WriteString(reason)
+		return nil
+	}
+	if err != nil {
+		m.logger.Errorf("failed to store channel settings: %s", err.Error())
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "Alias %s is added: %s", name, quoteArgs(command))
+	return nil
+}
+
+func (m *cmdManager) cmdAliasDel(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		m.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	name := state.Args()[0]
+	channel := extraArgs.Message.FromChannel
+	if _, ok := m.aliases(channel)[name]; !ok {
+		fmt.Fprintf(&state.OutputStr, "Alias not found: %s", name)
+		return nil
+	}
+	err := m.settings.update(extraArgs.Ctx, channel, func(conf *channelConfig) error {
+		delete(conf.aliases, name)
+		return nil
+	})
+	if err != nil {
+		m.logger.Errorf("failed to store channel settings: %s", err.Error())
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "Alias %s is removed", name)
+	return nil
+}
+
+func (m *cmdManager) cmdAliasList(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		m.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	aliases := m.aliases(extraArgs.Message.FromChannel)
+	if len(aliases) == 0 {
+		state.OutputStr.WriteString("No aliases in this channel.")
+		return nil
+	}
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	state.OutputStr.WriteString("Aliases in this channel:")
+	for _, name := range names {
+		fmt.Fprintf(&state.OutputStr, "\n%s: %s", name, aliases[name])
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package telepathy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandAlias(t *testing.T) {
+	cases := []struct {
+		command string
+		params  []string
+		args    []string
+	}{
+		{"twitch stream somebody", nil, []string{"twitch", "stream", "somebody"}},
+		{"twitch stream", []string{"a", "b"}, []string{"twitch", "stream", "a", "b"}},
+		{"twitch stream $1", []string{"a", "b"}, []string{"twitch", "stream", "a"}},
+		{"twitch $2 $1", []string{"a", "b"}, []string{"twitch", "b", "a"}},
+		{"twitch $3 x", []string{"a"}, []string{"twitch", "x"}},
+		{"fwd to $@", []string{"a", "b"}, []string{"fwd", "to", "a", "b"}},
+		{"fwd to $@", nil, []string{"fwd", "to"}},
+		{`echo "$1 !" #$2`, []string{"a b", "c"}, []string{"echo", "a b !", "#c"}},
+		{"echo $1", []string{"a b"}, []string{"echo", "a b"}},
+	}
+	for _, c := range cases {
+		args, err := expandAlias(c.command, c.params)
+		assert.NoError(t, err, c.command)
+		assert.Equal(t, c.args, args, c.command)
+	}
+}
+
+func TestCmdExpandAliases(t *testing.T) {
+	assert := assert.New(t)
+	cmdMgr := newCmdManager("teru", 1, time.Second, make(chan InboundMessage))
+	cmdMgr.attachCommandInterface("test", &argo.Action{Trigger: "twitch"})
+	aliases := map[string]string{
+		"ts":     "twitch stream $1",
+		"tss":    "ts $1",
+		"twitch": "ts",
+		"loop":   "loop2",
+		"loop2":  "loop",
+	}
+
+	args, err := cmdMgr.expandAliases(aliases, []string{"teru", "tss", "a"})
+	assert.NoError(err)
+	assert.Equal([]string{"teru", "twitch", "stream", "a"}, args)
+
+	// Commands can not be overridden
+	args, err = cmdMgr.expandAliases(aliases, []string{"teru", "twitch", "user"})
+	assert.NoError(err)
+	assert.Equal([]string{"teru", "twitch", "user"}, args)
+
+	_, err = cmdMgr.expandAliases(aliases, []string{"teru", "loop"})
+	assert.Error(err)
+}
+
+func TestAliasCommand(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	cmdMgr := newCmdManager("teru", 1, time.Second, make(chan InboundMessage))
+	cmdMgr.settings = newChannelSettings()
+	cmdMgr.settings.kv = store
+	close(cmdMgr.settings.loaded)
+	cmdMgr.attachCommandInterface("test", &argo.Action{Trigger: "twitch"})
+
+	action := cmdMgr.aliasCommand()
+	assert.NoError(action.Finalize())
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	extArgs := CmdExtraArgs{
+		Prefix:  "teru",
+		Ctx:     context.Background(),
+		Message: InboundMessage{FromChannel: ch},
+	}
+	parse := func(args ...string) string {
+		state := argo.State{}
+		assert.NoError(action.Parse(&state, append([]string{"alias"}, args...), extArgs))
+		return state.OutputStr.String()
+	}
+
+	assert.Equal("This command requires admin permission.\n", parse("add", "ts", "twitch", "stream"))
+
+	extArgs.Role = RoleAdmin
+	assert.Equal("Alias ts is added: twitch stream $1", parse("add", "ts", "teru", "twitch", "stream", "$1"))
+	assert.Equal("Can not override command: twitch", parse("add", "twitch", "ts"))
+	assert.Equal("Unknown command: fwd", parse("add", "f", "fwd", "info"))
+	assert.Equal("Invalid alias: alias loop refers to itself", parse("add", "loop", "loop"))
+	assert.Equal(map[string]string{"ts": "twitch stream $1"}, cmdMgr.aliases(ch))
+	assert.Equal("Aliases in this channel:\nts: twitch stream $1", parse("list"))
+
+	assert.Equal("Alias not found: tss", parse("del", "tss"))
+	assert.Equal("Alias ts is removed", parse("del", "ts"))
+	assert.Equal("No aliases in this channel.", parse("list"))
+	keys, err := store.List(context.Background(), "")
+	assert.NoError(err)
+	assert.Empty(keys)
+
+	store.close()
+	<-done
+}
+
+func TestCmdAlias(t *testing.T) {
+	assert := assert.New(t)
+	cmdCh := make(chan InboundMessage)
+	cmdMgr := newCmdManager("teru", 1, time.Second, cmdCh)
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	cmdMgr.settings = newChannelSettings()
+	cmdMgr.settings.channels[ch] = channelConfig{aliases: map[string]string{"e": "echo $@ !", "x": "admin"}}
+	close(cmdMgr.settings.loaded)
+	cmdMgr.perm = newPermissions(nil)
+	cmdMgr.perm.acl[ch] = map[string]Role{"admin": RoleAdmin}
+	close(cmdMgr.perm.loaded)
+
+	cmdMgr.attachCommandInterface("test", &argo.Action{
+		Trigger:    "echo",
+		MaxConsume: -1,
+		Do: func(state *argo.State, extras ...interface{}) error {
+			state.OutputStr.WriteString(state.Args()[0])
+			for _, arg := range state.Args()[1:] {
+				state.OutputStr.WriteString(" " + arg)
+			}
+			return nil
+		},
+	})
+	cmdMgr.attachCommandInterface("test", &argo.Action{Trigger: "admin"})
+	go cmdMgr.start(context.Background())
+
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "teru e hello world"}
+	assert.Equal("hello world !", (<-cmdMgr.msgOut).Text)
+
+	// Aliases work as commands in direct messages
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "e hi", IsDirectMessage: true}
+	assert.Equal("hi !", (<-cmdMgr.msgOut).Text)
+
+	// ACL applies to the expanded command
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "teru x"}
+	assert.Equal("This command requires admin permission in this channel.", (<-cmdMgr.msgOut).Text)
+
+	close(cmdCh)
+	<-cmdMgr.done
+}
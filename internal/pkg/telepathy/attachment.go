@@ -0,0 +1,77 @@
+package telepathy
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// AttachmentType is the kind of content of an Attachment
+type AttachmentType string
+
+// Supported attachment types
+const (
+	AttachmentImage AttachmentType = "image"
+	AttachmentVideo AttachmentType = "video"
+	AttachmentAudio AttachmentType = "audio"
+	AttachmentFile  AttachmentType = "file" // Generic file
+)
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Type     AttachmentType
+	Name     string // File name
+	MIMEType string
+	Size     int64  // Size in bytes
+	Content  []byte // Content of the file, messengers drop the attachments failed to download
+}
+
+// NewAttachment creates an Attachment with content
+// If mimeType is empty, it is guessed from the extension of name
+// The type of the attachment is decided by mimeType
+func NewAttachment(name, mimeType string, content []byte) Attachment {
+	if mimeType == "" {
+		mimeType = MIMETypeByName(name)
+	}
+	return Attachment{
+		Type:     AttachmentTypeOf(mimeType),
+		Name:     name,
+		MIMEType: mimeType,
+		Size:     int64(len(content)),
+		Content:  content,
+	}
+}
+
+// AttachmentTypeOf returns the AttachmentType for mimeType
+func AttachmentTypeOf(mimeType string) AttachmentType {
+	switch strings.SplitN(mimeType, "/", 2)[0] {
+	case "image":
+		return AttachmentImage
+	case "video":
+		return AttachmentVideo
+	case "audio":
+		return AttachmentAudio
+	}
+	return AttachmentFile
+}
+
+// MIMETypeByName guesses the MIME type from the extension of a file name
+// "application/octet-stream" is returned if the extension is unknown
+func MIMETypeByName(name string) string {
+	mimeType := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	if mimeType == "" {
+		return "application/octet-stream"
+	}
+	// Drop parameters like charset
+	return strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+}
+
+// hasAttachment checks whether there is any attachment of type t
+func hasAttachment(attachments []Attachment, t AttachmentType) bool {
+	for _, att := range attachments {
+		if att.Type == t {
+			return true
+		}
+	}
+	return false
+}
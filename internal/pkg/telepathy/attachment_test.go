@@ -0,0 +1,33 @@
+package telepathy_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+func TestNewAttachment(t *testing.T) {
+	assert := assert.New(t)
+	att := telepathy.NewAttachment("photo.PNG", "", []byte("content"))
+	assert.Equal(telepathy.AttachmentImage, att.Type)
+	assert.Equal("image/png", att.MIMEType)
+	assert.Equal(int64(7), att.Size)
+
+	att = telepathy.NewAttachment("clip", "video/mp4", nil)
+	assert.Equal(telepathy.AttachmentVideo, att.Type)
+	assert.Equal(int64(0), att.Size)
+
+	att = telepathy.NewAttachment("unknown.unknownext", "", nil)
+	assert.Equal(telepathy.AttachmentFile, att.Type)
+	assert.Equal("application/octet-stream", att.MIMEType)
+}
+
+func TestAttachmentTypeOf(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(telepathy.AttachmentImage, telepathy.AttachmentTypeOf("image/jpeg"))
+	assert.Equal(telepathy.AttachmentVideo, telepathy.AttachmentTypeOf("video/mp4"))
+	assert.Equal(telepathy.AttachmentAudio, telepathy.AttachmentTypeOf("audio/mpeg"))
+	assert.Equal(telepathy.AttachmentFile, telepathy.AttachmentTypeOf("application/pdf"))
+	assert.Equal(telepathy.AttachmentFile, telepathy.AttachmentTypeOf(""))
+}
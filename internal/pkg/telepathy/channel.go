@@ -1,6 +1,7 @@
 package telepathy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,7 +15,9 @@ const channelDelimiter = "@"
 const channelServiceID = "telepathy.channel"
 
 type channelService struct {
-	logger *logrus.Entry
+	settings      *channelSettings
+	defaultPrefix string
+	logger        *logrus.Entry
 }
 
 // Channel is an abstract type for a communication session of a messenger APP
@@ -32,7 +35,14 @@ func (c *channelService) SetLogger(logger *logrus.Entry) {
 }
 
 func (c *channelService) Start() {
-	return
+	if c.settings == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settingsLoadTimeout)
+	defer cancel()
+	if err := c.settings.load(ctx); err != nil {
+		c.logger.Errorf("failed to load plugin settings: %s", err.Error())
+	}
 }
 
 func (c *channelService) Stop() {
@@ -51,9 +61,135 @@ func (c *channelService) Command(_ <-chan interface{}) *argo.Action {
 		Do:         cmdChannelInfo,
 	})
 
+	if c.settings != nil {
+		cmd.AddSubAction(argo.Action{
+			Trigger:    "prefix",
+			ShortDescr: "Show or set the command prefix of current channel",
+			LongDescr:  "The default prefix always works, setting the default prefix removes the prefix of current channel",
+			MaxConsume: 1,
+			ArgNames:   []string{"new-prefix"},
+			Do:         c.cmdPrefix,
+		})
+	}
+
 	return cmd
 }
 
+func (c *channelService) cmdPrefix(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		c.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	channel := extraArgs.Message.FromChannel
+	args := state.Args()
+	if len(args) == 0 {
+		prefix := c.settings.prefix(channel)
+		if prefix == "" {
+			prefix = c.defaultPrefix
+		}
+		fmt.Fprintf(&state.OutputStr, "Command prefix of this channel: %s", prefix)
+		return nil
+	}
+	if !CommandEnsureRole(state, extraArgs, RoleAdmin) {
+		return nil
+	}
+
+	prefix := args[0]
+	if prefix == c.defaultPrefix {
+		prefix = ""
+	}
+	if err := c.settings.setPrefix(extraArgs.Ctx, channel, prefix); err != nil {
+		c.logger.Errorf("failed to store channel settings: %s", err.Error())
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "Command prefix of this channel is set to: %s", args[0])
+	return nil
+}
+
+func (c *channelService) AttachKVStore(kv *KVStore) {
+	if c.settings != nil {
+		c.settings.kv = kv
+	}
+}
+
+// pluginCommand manages the plugins enabled in each channel
+// It is attached as a top level command by Session
+func (c *channelService) pluginCommand() *argo.Action {
+	cmd := &argo.Action{
+		Trigger:    "plugin",
+		ShortDescr: "Enable or disable plugins in current channel",
+	}
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "enable",
+		ShortDescr: "Enable a plugin in current channel",
+		MinConsume: 1,
+		ArgNames:   []string{"plugin-id"},
+		Do:         CommandRequireRole(RoleAdmin, c.cmdPluginSwitch(true)),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "disable",
+		ShortDescr: "Disable a plugin in current channel",
+		MinConsume: 1,
+		ArgNames:   []string{"plugin-id"},
+		Do:         CommandRequireRole(RoleAdmin, c.cmdPluginSwitch(false)),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "list",
+		ShortDescr: "List plugins and their status in current channel",
+		Do:         c.cmdPluginList,
+	})
+
+	return cmd
+}
+
+func (c *channelService) cmdPluginSwitch(enabled bool) func(*argo.State, ...interface{}) error {
+	return func(state *argo.State, extras ...interface{}) error {
+		extraArgs, ok := extras[0].(CmdExtraArgs)
+		if !ok {
+			c.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+			return errors.New("failed to parse extraArgs")
+		}
+		id := state.Args()[0]
+		err := c.settings.setEnabled(extraArgs.Ctx, extraArgs.Message.FromChannel, id, enabled)
+		if err == ErrPluginNotSwitchable {
+			fmt.Fprintf(&state.OutputStr, "Plugin %s can not be enabled or disabled, see \"%s plugin list\"", id, extraArgs.Prefix)
+			return nil
+		}
+		if err != nil {
+			c.logger.Errorf("failed to store plugin settings: %s", err.Error())
+			return err
+		}
+		status := "disabled"
+		if enabled {
+			status = "enabled"
+		}
+		fmt.Fprintf(&state.OutputStr, "Plugin %s is %s in this channel", id, status)
+		return nil
+	}
+}
+
+func (c *channelService) cmdPluginList(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		c.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	plugins := c.settings.list(extraArgs.Message.FromChannel)
+	state.OutputStr.WriteString("Plugins in this channel:")
+	for _, id := range sortedKeys(plugins) {
+		status := "disabled"
+		if plugins[id] {
+			status = "enabled"
+		}
+		fmt.Fprintf(&state.OutputStr, "\n%s: %s", id, status)
+	}
+	return nil
+}
+
 func cmdChannelInfo(state *argo.State, extras ...interface{}) error {
 	extraArgs, ok := extras[0].(CmdExtraArgs)
 	if !ok {
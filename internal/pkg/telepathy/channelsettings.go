@@ -0,0 +1,226 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// settingsLoadTimeout is the timeout of loading settings of internal plugins on boot
+const settingsLoadTimeout = 30 * time.Second
+
+// ErrPluginNotSwitchable is returned when enabling or disabling a plugin which can not be switched per channel
+var ErrPluginNotSwitchable = errors.New("plugin can not be enabled or disabled per channel")
+
+// channelSettings keeps the settings of each channel: the disabled plugins, the command prefix and aliases
+// Settings are cached in memory and persisted to the KV store of channelService,
+// keyed by channel name with channelSettingsRecord as value
+// Lookups are blocked until the settings are loaded, so that no message slips through on boot
+// Updates are serialized by updating, and lock is not held while persisting, so lookups are not blocked by I/O
+type channelSettings struct {
+	lock       sync.RWMutex
+	updating   sync.Mutex
+	switchable map[string]bool
+	channels   map[Channel]channelConfig
+	kv         *KVStore
+	loaded     chan interface{}
+	loadOnce   sync.Once
+}
+
+// channelConfig is the cached settings of a channel, it is replaced instead of modified when updated
+type channelConfig struct {
+	disabled map[string]bool
+	prefix   string
+	aliases  map[string]string
+}
+
+type channelSettingsRecord struct {
+	Channel  Channel
+	Disabled []string
+	Prefix   string
+	Aliases  map[string]string
+}
+
+func newChannelSettings() *channelSettings {
+	return &channelSettings{
+		switchable: make(map[string]bool),
+		channels:   make(map[Channel]channelConfig),
+		loaded:     make(chan interface{}),
+	}
+}
+
+func (c channelConfig) empty() bool {
+	return len(c.disabled) == 0 && c.prefix == "" && len(c.aliases) == 0
+}
+
+// clone returns a deep copy of c for modification
+func (c channelConfig) clone() channelConfig {
+	ret := channelConfig{
+		disabled: make(map[string]bool),
+		prefix:   c.prefix,
+		aliases:  make(map[string]string),
+	}
+	for id := range c.disabled {
+		ret.disabled[id] = true
+	}
+	for name, command := range c.aliases {
+		ret.aliases[name] = command
+	}
+	return ret
+}
+
+// addSwitchable marks plugin id as able to be enabled or disabled per channel
+func (s *channelSettings) addSwitchable(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.switchable[id] = true
+}
+
+// load reads all settings from kv and unblocks lookups
+// Only the first call loads, as the service calls it again when it is restarted
+func (s *channelSettings) load(ctx context.Context) (err error) {
+	s.loadOnce.Do(func() {
+		defer close(s.loaded)
+		err = s.loadRecords(ctx)
+	})
+	return err
+}
+
+func (s *channelSettings) loadRecords(ctx context.Context) error {
+	keys, err := s.kv.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		record := channelSettingsRecord{}
+		if err := s.kv.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		conf := channelConfig{
+			disabled: make(map[string]bool),
+			prefix:   record.Prefix,
+			aliases:  record.Aliases,
+		}
+		for _, id := range record.Disabled {
+			conf.disabled[id] = true
+		}
+		s.channels[record.Channel] = conf
+	}
+	return nil
+}
+
+// get returns the settings of channel
+func (s *channelSettings) get(channel Channel) channelConfig {
+	<-s.loaded
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.channels[channel]
+}
+
+// update modifies the settings of channel with modify, and persists the result
+// The settings are not changed if modify or persisting fails
+func (s *channelSettings) update(ctx context.Context, channel Channel, modify func(*channelConfig) error) error {
+	s.updating.Lock()
+	defer s.updating.Unlock()
+	s.lock.RLock()
+	conf := s.channels[channel].clone()
+	s.lock.RUnlock()
+	if err := modify(&conf); err != nil {
+		return err
+	}
+
+	var err error
+	if conf.empty() {
+		err = s.kv.Delete(ctx, channel.Name())
+	} else {
+		err = s.kv.Put(ctx, channel.Name(), channelSettingsRecord{
+			Channel:  channel,
+			Disabled: sortedKeys(conf.disabled),
+			Prefix:   conf.prefix,
+			Aliases:  conf.aliases,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if conf.empty() {
+		delete(s.channels, channel)
+	} else {
+		s.channels[channel] = conf
+	}
+	return nil
+}
+
+// all returns the settings of all channels with settings, without waiting for the settings to be loaded
+func (s *channelSettings) all() map[Channel]channelConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make(map[Channel]channelConfig, len(s.channels))
+	for channel, conf := range s.channels {
+		ret[channel] = conf
+	}
+	return ret
+}
+
+// isEnabled returns false if plugin id is disabled in channel
+func (s *channelSettings) isEnabled(channel Channel, id string) bool {
+	return !s.get(channel).disabled[id]
+}
+
+// setEnabled enables or disables plugin id in channel
+func (s *channelSettings) setEnabled(ctx context.Context, channel Channel, id string, enabled bool) error {
+	s.lock.RLock()
+	switchable := s.switchable[id]
+	s.lock.RUnlock()
+	return s.update(ctx, channel, func(conf *channelConfig) error {
+		if !switchable {
+			return ErrPluginNotSwitchable
+		}
+		if enabled {
+			delete(conf.disabled, id)
+		} else {
+			conf.disabled[id] = true
+		}
+		return nil
+	})
+}
+
+// list returns all switchable plugins with their status in channel
+func (s *channelSettings) list(channel Channel) map[string]bool {
+	disabled := s.get(channel).disabled
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make(map[string]bool)
+	for id := range s.switchable {
+		ret[id] = !disabled[id]
+	}
+	return ret
+}
+
+// prefix returns the command prefix of channel, empty if not set
+func (s *channelSettings) prefix(channel Channel) string {
+	return s.get(channel).prefix
+}
+
+// setPrefix sets the command prefix of channel, the prefix is removed if it is empty
+func (s *channelSettings) setPrefix(ctx context.Context, channel Channel, prefix string) error {
+	return s.update(ctx, channel, func(conf *channelConfig) error {
+		conf.prefix = prefix
+		return nil
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,242 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelSettings(t *testing.T) {
+	assert := assert.New(t)
+	backend := newMemoryDB()
+	store, done := startTestKVStore(backend)
+	ctx := context.Background()
+
+	settings := newChannelSettings()
+	settings.kv = store
+	settings.addSwitchable("fwd")
+	settings.addSwitchable("twitch")
+	assert.NoError(settings.load(ctx))
+
+	ch := Channel{MessengerID: "msg", ChannelID: "a@b"}
+	other := Channel{MessengerID: "msg", ChannelID: "other"}
+	assert.True(settings.isEnabled(ch, "fwd"))
+	assert.Equal(ErrPluginNotSwitchable, settings.setEnabled(ctx, ch, "unknown", false))
+
+	assert.NoError(settings.setEnabled(ctx, ch, "fwd", false))
+	assert.False(settings.isEnabled(ch, "fwd"))
+	assert.True(settings.isEnabled(ch, "twitch"))
+	assert.True(settings.isEnabled(other, "fwd"))
+	assert.Equal(map[string]bool{"fwd": false, "twitch": true}, settings.list(ch))
+
+	// Settings are reloaded from the store
+	reloaded := newChannelSettings()
+	reloaded.kv = store
+	assert.NoError(reloaded.load(ctx))
+	assert.False(reloaded.isEnabled(ch, "fwd"))
+
+	// Loading again when the service is restarted keeps the settings
+	assert.NoError(settings.load(ctx))
+	assert.False(settings.isEnabled(ch, "fwd"))
+
+	// Record is removed once all plugins are enabled again
+	assert.NoError(settings.setEnabled(ctx, ch, "fwd", true))
+	assert.True(settings.isEnabled(ch, "fwd"))
+	keys, err := store.List(ctx, "")
+	assert.NoError(err)
+	assert.Empty(keys)
+
+	store.close()
+	<-done
+}
+
+func TestPluginCommand(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	svc := &channelService{settings: newChannelSettings()}
+	svc.AttachKVStore(store)
+	svc.settings.addSwitchable("fwd")
+	close(svc.settings.loaded)
+
+	action := svc.pluginCommand()
+	assert.NoError(action.Finalize())
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	extArgs := CmdExtraArgs{
+		Prefix:  "teru",
+		Ctx:     context.Background(),
+		Message: InboundMessage{FromChannel: ch},
+		Role:    RoleAdmin,
+	}
+
+	state := argo.State{}
+	assert.NoError(action.Parse(&state, []string{"plugin", "disable", "fwd"}, extArgs))
+	assert.Equal("Plugin fwd is disabled in this channel", state.OutputStr.String())
+	assert.False(svc.settings.isEnabled(ch, "fwd"))
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"plugin", "list"}, extArgs))
+	assert.Equal("Plugins in this channel:\nfwd: disabled", state.OutputStr.String())
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"plugin", "disable", "telepathy.channel"}, extArgs))
+	assert.Contains(state.OutputStr.String(), "can not be enabled or disabled")
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"plugin", "enable", "fwd"}, extArgs))
+	assert.True(svc.settings.isEnabled(ch, "fwd"))
+
+	store.close()
+	<-done
+}
+
+func TestRouterDisabledPlugin(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.settings = newChannelSettings()
+	router.cmd.settings = router.settings
+	disabledCh := Channel{MessengerID: "msg", ChannelID: "disabled"}
+	router.settings.channels[disabledCh] = channelConfig{disabled: map[string]bool{"A": true}}
+	close(router.settings.loaded)
+
+	recvr := make(chan InboundMessage)
+	router.attachReceiver("recvr", recvr)
+	consumerA := router.attachConsumer("A")
+	consumerB := router.attachConsumer("B")
+	cmd := &argo.Action{Trigger: "a"}
+	cmd.AddSubAction(argo.Action{Trigger: "act"})
+	assert.NoError(router.cmd.attachCommandInterface("A", cmd))
+	transmitter := router.attachTransmitter("msg")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan interface{})
+	go func() {
+		router.start(ctx, time.Second, time.Second)
+		close(done)
+	}()
+
+	msg := InboundMessage{FromChannel: disabledCh, Text: "test"}
+	left := InboundMessage{FromChannel: disabledCh, Event: EventBotLeft}
+	recvr <- msg
+	recvr <- left
+	recvr <- InboundMessage{FromChannel: disabledCh, Text: "teru a act"}
+
+	assert.Equal(msg, <-consumerB)
+	assert.Equal(left, <-consumerB)
+	reply := <-transmitter
+	assert.Equal("Plugin A is disabled in this channel.", reply.Text)
+	close(recvr)
+	<-done
+
+	// EventBotLeft is still delivered to disabled plugins
+	assert.Equal(1, len(consumerA))
+	assert.Equal(left, <-consumerA)
+}
+
+func TestRouterDisabledProducer(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.settings = newChannelSettings()
+	disabledCh := Channel{MessengerID: "msg", ChannelID: "disabled"}
+	enabledCh := Channel{MessengerID: "msg", ChannelID: "enabled"}
+	router.settings.channels[disabledCh] = channelConfig{disabled: map[string]bool{"A": true}}
+	close(router.settings.loaded)
+
+	prod := make(chan OutboundMessage)
+	router.attachProducer("A", prod)
+	transmitter := router.attachTransmitter("msg")
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	// Messages of a disabled plugin are not sent to the channel
+	results := make(chan DeliveryResult, 1)
+	prod <- OutboundMessage{ToChannel: disabledCh, Text: "dropped", OnResult: func(result DeliveryResult) { results <- result }}
+	assert.True(errors.Is((<-results).Err, ErrPluginDisabled))
+	prod <- OutboundMessage{ToChannel: enabledCh, Text: "sent"}
+	assert.Equal("sent", (<-transmitter).Text)
+	close(prod)
+	<-done
+	assert.Empty(transmitter)
+}
+
+func TestChannelSettingsUpdateLock(t *testing.T) {
+	assert := assert.New(t)
+	db := &blockingDB{memoryDB: newMemoryDB(), released: make(chan interface{})}
+	store, done := startTestKVStore(db)
+	settings := newChannelSettings()
+	settings.kv = store
+	settings.addSwitchable("fwd")
+	close(settings.loaded)
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+
+	updated := make(chan error)
+	go func() {
+		updated <- settings.setEnabled(context.Background(), ch, "fwd", false)
+	}()
+
+	// Lookups are not blocked while the update is persisted
+	lookup := make(chan bool)
+	go func() {
+		lookup <- settings.isEnabled(ch, "fwd")
+	}()
+	select {
+	case enabled := <-lookup:
+		assert.True(enabled)
+	case <-time.After(time.Second):
+		assert.Fail("lookup blocked by update")
+	}
+
+	close(db.released)
+	assert.NoError(<-updated)
+	assert.False(settings.isEnabled(ch, "fwd"))
+	store.close()
+	<-done
+}
+
+func TestChannelPrefixCommand(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	svc := &channelService{settings: newChannelSettings(), defaultPrefix: "teru"}
+	svc.AttachKVStore(store)
+	close(svc.settings.loaded)
+
+	action := svc.Command(make(chan interface{}))
+	assert.NoError(action.Finalize())
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	extArgs := CmdExtraArgs{
+		Ctx:     context.Background(),
+		Message: InboundMessage{FromChannel: ch},
+	}
+
+	state := argo.State{}
+	assert.NoError(action.Parse(&state, []string{"channel", "prefix", "!t"}, extArgs))
+	assert.Equal("This command requires admin permission.\n", state.OutputStr.String())
+
+	extArgs.Role = RoleAdmin
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"channel", "prefix", "!t"}, extArgs))
+	assert.Equal("!t", svc.settings.prefix(ch))
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"channel", "prefix"}, extArgs))
+	assert.Equal("Command prefix of this channel: !t", state.OutputStr.String())
+
+	// Setting the default prefix removes the channel prefix
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"channel", "prefix", "teru"}, extArgs))
+	assert.Equal("", svc.settings.prefix(ch))
+	keys, err := store.List(context.Background(), "")
+	assert.NoError(err)
+	assert.Empty(keys)
+
+	store.close()
+	<-done
+}
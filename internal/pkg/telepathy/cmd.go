@@ -2,18 +2,25 @@ package telepathy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 	"gitlab.com/kavenc/argo"
 )
 
 const (
-	cmdMsgOutLen = 5
+	cmdMsgOutLen   = 5
+	cmdHelpTrigger = "help" // Trigger of the help action injected by argo
+
+	cmdUnknownLabel = "unknown" // Metrics label of unknown commands
+	cmdReplyLabel   = "reply"   // Metrics label of the replies of conversations
 )
 
 // CmdExtraArgs carries extra info for command handlers
@@ -21,6 +28,10 @@ type CmdExtraArgs struct {
 	Prefix  string
 	Ctx     context.Context
 	Message InboundMessage
+	Role    Role // Role of the user running the command
+
+	cooldowns     *cooldowns
+	conversations *conversations
 }
 
 type commandMessage struct {
@@ -34,42 +45,161 @@ type commandHandler struct {
 }
 
 type cmdManager struct {
-	cmdRoot   argo.Action
-	cmdIn     <-chan InboundMessage
-	msgOut    chan OutboundMessage
-	workerNum uint
-	timeout   time.Duration
-	done      chan interface{}
-	logger    *logrus.Entry
+	cmdRoot       argo.Action
+	owners        map[string]string // Plugin IDs of top level commands, keyed by trigger
+	settings      *channelSettings
+	perm          *permissions
+	cooldowns     *cooldowns
+	conversations *conversations
+	pager         *pager
+	metrics       cmdMetrics
+	cmdIn         <-chan InboundMessage
+	msgOut        chan OutboundMessage
+	workerNum     uint
+	timeout       time.Duration
+	done          chan interface{}
+	logger        *logrus.Entry
 }
 
-var regexCmdSplitter = regexp.MustCompile(" +")
-
 func newCmdManager(prefix string, workerNum uint, timeout time.Duration, cmdMsgCh <-chan InboundMessage) *cmdManager {
 	return &cmdManager{
 		cmdRoot: argo.Action{
 			Trigger: prefix,
 		},
-		cmdIn:     cmdMsgCh,
-		msgOut:    make(chan OutboundMessage, cmdMsgOutLen),
-		workerNum: workerNum,
-		timeout:   timeout,
-		done:      make(chan interface{}),
-		logger:    logrus.WithField("module", "cmdManager"),
+		owners:        make(map[string]string),
+		cooldowns:     newCooldowns(),
+		conversations: newConversations(),
+		pager:         newPager(),
+		cmdIn:         cmdMsgCh,
+		msgOut:        make(chan OutboundMessage, cmdMsgOutLen),
+		workerNum:     workerNum,
+		timeout:       timeout,
+		done:          make(chan interface{}),
+		logger:        logrus.WithField("module", "cmdManager"),
+	}
+}
+
+// cmdMetrics are the metrics of command executions, the zero value ignores all updates
+type cmdMetrics struct {
+	executions *Counter
+	duration   *Histogram
+}
+
+func (m *cmdManager) setMetrics(metrics *Metrics) {
+	m.metrics = cmdMetrics{
+		executions: metrics.Counter("command_executions_total", "Command executions by top level command and status: ok, invalid, error or timeout", "command", "status"),
+		duration:   metrics.Histogram("command_duration_seconds", "Time taken to execute commands", DefaultBuckets, "command"),
 	}
 }
 
-func (m *cmdManager) attachCommandInterface(cmd *argo.Action) error {
+func (m *cmdManager) attachCommandInterface(id string, cmd *argo.Action) error {
 	err := m.cmdRoot.AddSubAction(*cmd)
 	if err != nil {
 		return err
 	}
+	m.owners[cmd.Trigger] = id
 	m.logger.Infof("attached command: %s", cmd.Trigger)
 	return nil
 }
 
-func (m *cmdManager) isCmdMsg(text string) bool {
-	return strings.HasPrefix(text, m.cmdRoot.Trigger+" ")
+// commandArgs splits a command message into args, with the root trigger as the first arg
+// Commands are triggered by the prefix, the prefix set for the channel, mentioning the bot,
+// or starting direct messages with the name of a command or an alias
+// ok is false if msg is not a command, err is set if msg is a command but can not be tokenized
+func (m *cmdManager) commandArgs(msg InboundMessage) (args []string, ok bool, err error) {
+	text, ok := m.trimTrigger(msg)
+	if !ok {
+		return nil, false, nil
+	}
+	args, err = tokenizeCommand(text)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(args) == 0 && msg.BotMention != "" {
+		// Mentioning the bot alone shows the help
+		args = []string{cmdHelpTrigger}
+	}
+	return append([]string{m.cmdRoot.Trigger}, args...), true, nil
+}
+
+// trimTrigger returns the text after the trigger of a command message
+func (m *cmdManager) trimTrigger(msg InboundMessage) (string, bool) {
+	text := msg.Text
+	if msg.BotMention != "" && strings.HasPrefix(text, msg.BotMention) {
+		text = strings.TrimLeft(strings.TrimPrefix(text, msg.BotMention), " ")
+		// The prefix is optional after the mention
+		if rest, ok := trimPrefix(text, m.cmdRoot.Trigger); ok {
+			return rest, true
+		}
+		// Other messages mentioning the bot are not commands
+		if text == "" || m.isTrigger(msg.FromChannel, firstWord(text)) {
+			return text, true
+		}
+	}
+	if rest, ok := trimPrefix(text, m.cmdRoot.Trigger); ok {
+		return rest, true
+	}
+	if m.settings != nil {
+		if prefix := m.settings.prefix(msg.FromChannel); prefix != "" {
+			if rest, ok := trimPrefix(text, prefix); ok {
+				return rest, true
+			}
+		}
+	}
+	if msg.IsDirectMessage && m.isTrigger(msg.FromChannel, firstWord(text)) {
+		return text, true
+	}
+	return "", false
+}
+
+// trimPrefix returns the text after prefix, which should be followed by a space
+func trimPrefix(text, prefix string) (string, bool) {
+	if !strings.HasPrefix(text, prefix+" ") {
+		return "", false
+	}
+	return text[len(prefix)+1:], true
+}
+
+func firstWord(text string) string {
+	if words := strings.Fields(text); len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// isCommand returns true if trigger is a top level command
+func (m *cmdManager) isCommand(trigger string) bool {
+	_, ok := m.owners[trigger]
+	return ok || trigger == cmdHelpTrigger
+}
+
+// isCmdMsg returns true if msg is handled by cmdManager, either a command or a reply of a conversation
+func (m *cmdManager) isCmdMsg(msg InboundMessage) bool {
+	_, ok, _ := m.commandArgs(msg)
+	return ok || m.conversations.isPending(msg)
+}
+
+// prefix returns the prefix shown to users in channel
+func (m *cmdManager) prefix(channel Channel) string {
+	if m.settings != nil {
+		if prefix := m.settings.prefix(channel); prefix != "" {
+			return prefix
+		}
+	}
+	return m.cmdRoot.Trigger
+}
+
+// disabledOwner returns the ID of the plugin owning the command in args,
+// if the plugin is disabled in channel
+func (m *cmdManager) disabledOwner(channel Channel, args []string) (string, bool) {
+	if m.settings == nil || len(args) < 2 {
+		return "", false
+	}
+	id, ok := m.owners[args[1]]
+	if !ok || m.settings.isEnabled(channel, id) {
+		return "", false
+	}
+	return id, true
 }
 
 func (m *cmdManager) worker(ctx context.Context, id uint) {
@@ -77,43 +207,103 @@ func (m *cmdManager) worker(ctx context.Context, id uint) {
 
 	// worker function for handling command messages
 	for msg := range m.cmdIn {
-		args := regexCmdSplitter.Split(msg.Text, -1)
-		timeout, cancel := context.WithTimeout(ctx, m.timeout)
-		done := make(chan interface{})
-
-		go func() {
-			state := argo.State{}
-			err := m.cmdRoot.Parse(&state, args, CmdExtraArgs{
-				Prefix:  m.cmdRoot.Trigger,
-				Message: msg,
-				Ctx:     timeout,
-			})
-			if err != nil {
-				if _, ok := err.(argo.Err); ok {
-					fmt.Fprintf(&state.OutputStr, "Invalid command: %s", err.Error())
-				} else {
-					logger.Errorf("command parsing failed: %s", err.Error())
-					logger.Errorf("msg: %s", msg.Text)
-					logger.Errorf("partial OutputStr: ")
-					logger.Errorf(state.OutputStr.String())
-					state.OutputStr.Reset()
-					state.OutputStr.WriteString("Internal Error! Please try again later.")
+		args, ok, err := m.commandArgs(msg)
+		if !ok {
+			// Replies of conversations
+			if handler, ok := m.conversations.take(msg); ok {
+				m.run(ctx, logger, msg, cmdReplyLabel, handler)
+			}
+			continue
+		}
+		if err == nil {
+			args, err = m.expandAliases(m.aliases(msg.FromChannel), args)
+		}
+		if err != nil {
+			reply := msg.Reply()
+			reply.Text = fmt.Sprintf("Invalid command: %s", err.Error())
+			m.msgOut <- reply
+			continue
+		}
+		if id, disabled := m.disabledOwner(msg.FromChannel, args); disabled {
+			reply := msg.Reply()
+			reply.Text = fmt.Sprintf("Plugin %s is disabled in this channel.", id)
+			m.msgOut <- reply
+			continue
+		}
+		m.run(ctx, logger, msg, m.commandLabel(args), func(state *argo.State, extraArgs CmdExtraArgs) error {
+			if m.perm != nil {
+				if required := m.perm.required(msg.FromChannel, args[1:]); extraArgs.Role < required {
+					fmt.Fprintf(&state.OutputStr, "This command requires %s permission in this channel.", required)
+					return nil
 				}
 			}
-			if state.OutputStr.Len() != 0 {
-				msg := msg.Reply()
-				msg.Text = state.OutputStr.String()
-				m.msgOut <- msg
+			return m.cmdRoot.Parse(state, args, extraArgs)
+		})
+	}
+}
+
+// commandLabel returns the top level command in args to label metrics, unknown commands are not distinguished
+func (m *cmdManager) commandLabel(args []string) string {
+	if len(args) > 1 && m.isCommand(args[1]) {
+		return args[1]
+	}
+	return cmdUnknownLabel
+}
+
+// run handles msg with do within the command timeout, and replies the output
+// command labels the metrics of the execution
+func (m *cmdManager) run(ctx context.Context, logger *logrus.Entry, msg InboundMessage, command string, do ReplyHandler) {
+	timeout, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	done := make(chan interface{})
+	start := time.Now()
+	status, result := "timeout", "ok"
+
+	go func() {
+		state := argo.State{}
+		role := RoleUser
+		if m.perm != nil {
+			role = m.perm.role(timeout, msg)
+		}
+		prefix := m.prefix(msg.FromChannel)
+		err := do(&state, CmdExtraArgs{
+			Prefix:  prefix,
+			Message: msg,
+			Ctx:     timeout,
+			Role:    role,
+
+			cooldowns:     m.cooldowns,
+			conversations: m.conversations,
+		})
+		if err != nil {
+			if _, ok := err.(argo.Err); ok {
+				result = "invalid"
+				fmt.Fprintf(&state.OutputStr, "Invalid command: %s", err.Error())
+			} else {
+				result = "error"
+				logger.Errorf("command parsing failed: %s", err.Error())
+				logger.Errorf("msg: %s", msg.Text)
+				logger.Errorf("partial OutputStr: ")
+				logger.Errorf(state.OutputStr.String())
+				state.OutputStr.Reset()
+				state.OutputStr.WriteString("Internal Error! Please try again later.")
 			}
-			close(done)
-		}()
-		select {
-		case <-done:
-		case <-timeout.Done():
-			logger.Warnf("timeout/cacnelled: %s", args)
 		}
-		cancel()
+		if state.OutputStr.Len() != 0 {
+			msg := msg.Reply()
+			msg.Text = m.pager.paginate(msg.ToChannel, state.OutputStr.String(), prefix)
+			m.msgOut <- msg
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		status = result
+	case <-timeout.Done():
+		logger.Warnf("timeout/cacnelled: %s", msg.Text)
 	}
+	m.metrics.executions.Inc(command, status)
+	m.metrics.duration.Observe(time.Since(start).Seconds(), command)
 }
 
 func (m *cmdManager) start(ctx context.Context) {
@@ -142,3 +332,201 @@ func CommandEnsureDM(state *argo.State, extraArgs CmdExtraArgs) bool {
 	}
 	return true
 }
+
+var (
+	errUnterminatedQuote = errors.New("unterminated quote")
+
+	// Quotes auto-formatted by messengers and keyboards, taken as plain quotes
+	smartQuotes = map[rune]rune{'“': '"', '”': '"', '„': '"', '‘': '\'', '’': '\''}
+	// Characters escaped by Slack
+	slackEntities = []struct {
+		entity string
+		char   rune
+	}{{"&amp;", '&'}, {"&lt;", '<'}, {"&gt;", '>'}}
+	slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+	regexLinkURL   = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*://|mailto:)[^\s]+$`)
+)
+
+// commandScanner reads the runes of a command, normalizing the auto-formatting of messengers
+type commandScanner struct {
+	text string
+	pos  int
+}
+
+func (s *commandScanner) done() bool {
+	return s.pos >= len(s.text)
+}
+
+// next returns the next rune, escaped is true if the rune is from a Slack entity and should be taken literally
+func (s *commandScanner) next() (r rune, escaped bool) {
+	rest := s.text[s.pos:]
+	for _, e := range slackEntities {
+		if strings.HasPrefix(rest, e.entity) {
+			s.pos += len(e.entity)
+			return e.char, true
+		}
+	}
+	r = s.nextRaw()
+	if quote, ok := smartQuotes[r]; ok {
+		r = quote
+	}
+	return r, false
+}
+
+// nextRaw returns the next rune as is
+func (s *commandScanner) nextRaw() rune {
+	r, size := utf8.DecodeRuneInString(s.text[s.pos:])
+	s.pos += size
+	return r
+}
+
+// quoted reads a quoted string into arg until the closing quote
+// Backslashes in double quotes escape the characters which are special in double quotes
+func (s *commandScanner) quoted(arg *strings.Builder, quote rune) error {
+	for !s.done() {
+		pos := s.pos
+		r, escaped := s.next()
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+		case r == quote:
+			return nil
+		case r == '\\' && quote == '"' && !s.done():
+			escapePos := s.pos
+			if next := s.nextRaw(); strings.ContainsRune(cmdQuoteEscapes, next) {
+				arg.WriteRune(next)
+			} else {
+				s.pos = escapePos
+				arg.WriteRune(r)
+			}
+		default:
+			// Smart quotes are only normalized for quoting
+			arg.WriteString(s.text[pos:s.pos])
+		}
+	}
+	return errUnterminatedQuote
+}
+
+// codeSpan reads a code span or a code block of Discord and Slack into arg, the content is taken literally
+// It returns false if the span is not closed
+func (s *commandScanner) codeSpan(arg *strings.Builder) bool {
+	start := s.pos - 1
+	fence := "`"
+	if strings.HasPrefix(s.text[start:], "```") {
+		fence = "```"
+	}
+	end := strings.Index(s.text[start+len(fence):], fence)
+	if end < 0 {
+		return false
+	}
+	content := s.text[start+len(fence) : start+len(fence)+end]
+	if fence == "```" {
+		content = strings.TrimPrefix(content, "\n")
+	}
+	arg.WriteString(slackUnescaper.Replace(content))
+	s.pos = start + 2*len(fence) + end
+	return true
+}
+
+// link reads the URL of a link wrapped in angle brackets into arg,
+// either <url|label> formatted by Slack or <url> used on Discord to suppress embeds
+// It returns false if the text is not a link
+func (s *commandScanner) link(arg *strings.Builder) bool {
+	end := strings.IndexByte(s.text[s.pos:], '>')
+	if end < 0 {
+		return false
+	}
+	url := s.text[s.pos : s.pos+end]
+	if bar := strings.IndexByte(url, '|'); bar >= 0 {
+		url = url[:bar]
+	}
+	if !regexLinkURL.MatchString(url) {
+		return false
+	}
+	arg.WriteString(slackUnescaper.Replace(url))
+	s.pos += end + 1
+	return true
+}
+
+// Characters escaped by backslashes in double quotes
+const cmdQuoteEscapes = "\"\\&“”„"
+
+// tokenizeCommand splits text into args like a shell:
+// args are separated by whitespaces including new lines, and whitespaces are kept in quotes
+// Double quotes work anywhere in an arg, single quotes only start at the beginning of an arg,
+// so that apostrophes can be used as is
+// Backslashes escape the next character outside quotes
+// Smart quotes, Slack links and entities, and code spans are also handled
+func tokenizeCommand(text string) ([]string, error) {
+	s := commandScanner{text: text}
+	args := []string{}
+	arg := strings.Builder{}
+	started := false
+	for !s.done() {
+		pos := s.pos
+		r, escaped := s.next()
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+		case unicode.IsSpace(r):
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+			continue
+		case r == '\\':
+			if !s.done() {
+				r = s.nextRaw()
+			}
+			arg.WriteRune(r)
+		case r == '"' || (r == '\'' && !started):
+			if err := s.quoted(&arg, r); err != nil {
+				return nil, err
+			}
+		case r == '`':
+			if !s.codeSpan(&arg) {
+				arg.WriteRune(r)
+			}
+		case r == '<':
+			if !s.link(&arg) {
+				arg.WriteRune(r)
+			}
+		default:
+			arg.WriteString(s.text[pos:s.pos])
+		}
+		started = true
+	}
+	if started {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// quoteArgs joins args into a command which is tokenized back to args by tokenizeCommand
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func quoteArg(arg string) string {
+	special := func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("'‘’<`"+cmdQuoteEscapes, r)
+	}
+	if arg != "" && strings.IndexFunc(arg, special) < 0 {
+		return arg
+	}
+	quoted := strings.Builder{}
+	quoted.WriteRune('"')
+	for _, r := range arg {
+		if strings.ContainsRune(cmdQuoteEscapes, r) {
+			quoted.WriteRune('\\')
+		}
+		quoted.WriteRune(r)
+	}
+	quoted.WriteRune('"')
+	return quoted.String()
+}
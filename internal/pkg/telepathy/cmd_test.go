@@ -39,7 +39,7 @@ func TestCmdTrigger(t *testing.T) {
 		},
 	})
 
-	cmdMgr.attachCommandInterface(subCmd)
+	cmdMgr.attachCommandInterface("test", subCmd)
 	go cmdMgr.start(context.Background())
 
 	cmdCh <- cmdMsg
@@ -56,12 +56,12 @@ func TestCmdIsCmdMsg(t *testing.T) {
 	cmdCh := make(chan InboundMessage)
 	cmdMgr := newCmdManager("test", 1, time.Second, cmdCh)
 
-	assert.True(cmdMgr.isCmdMsg("test abc"))
-	assert.True(cmdMgr.isCmdMsg("test      abc"))
-	assert.False(cmdMgr.isCmdMsg("test"))
-	assert.False(cmdMgr.isCmdMsg("  test"))
-	assert.False(cmdMgr.isCmdMsg("tes"))
-	assert.False(cmdMgr.isCmdMsg("test	")) // Tab
+	assert.True(cmdMgr.isCmdMsg(InboundMessage{Text: "test abc"}))
+	assert.True(cmdMgr.isCmdMsg(InboundMessage{Text: "test      abc"}))
+	assert.False(cmdMgr.isCmdMsg(InboundMessage{Text: "test"}))
+	assert.False(cmdMgr.isCmdMsg(InboundMessage{Text: "  test"}))
+	assert.False(cmdMgr.isCmdMsg(InboundMessage{Text: "tes"}))
+	assert.False(cmdMgr.isCmdMsg(InboundMessage{Text: "test	"})) // Tab
 
 	go cmdMgr.start(context.Background())
 	close(cmdCh)
@@ -94,7 +94,7 @@ func TestCmdTimeout(t *testing.T) {
 		},
 	})
 
-	cmdMgr.attachCommandInterface(subCmd)
+	cmdMgr.attachCommandInterface("test", subCmd)
 	go cmdMgr.start(context.Background())
 
 	cmdCh <- cmdMsg
@@ -126,7 +126,7 @@ func TestCmdReturnError(t *testing.T) {
 		},
 	})
 
-	cmdMgr.attachCommandInterface(subCmd)
+	cmdMgr.attachCommandInterface("test", subCmd)
 	go cmdMgr.start(context.Background())
 
 	cmdCh <- cmdMsg
@@ -138,6 +138,35 @@ func TestCmdReturnError(t *testing.T) {
 	<-cmdMgr.done
 }
 
+func TestCmdMetrics(t *testing.T) {
+	assert := assert.New(t)
+	cmdCh := make(chan InboundMessage)
+	cmdMgr := newCmdManager("test", 3, time.Second, cmdCh)
+	metrics := newMetrics()
+	cmdMgr.setMetrics(metrics)
+
+	cmdMgr.attachCommandInterface("test", &argo.Action{
+		Trigger: "fail",
+		Do: func(state *argo.State, extras ...interface{}) error {
+			return errors.New("error")
+		},
+	})
+	go cmdMgr.start(context.Background())
+
+	fromCh := Channel{MessengerID: "msg", ChannelID: "ch"}
+	for _, text := range []string{"test fail", "test fail", "test help"} {
+		cmdCh <- InboundMessage{FromChannel: fromCh, Text: text}
+		<-cmdMgr.msgOut
+	}
+	close(cmdCh)
+	<-cmdMgr.done
+
+	output := scrape(metrics)
+	assert.Contains(output, `telepathy_command_executions_total{command="fail",status="error"} 2`)
+	assert.Contains(output, `telepathy_command_executions_total{command="help",status="ok"} 1`)
+	assert.Contains(output, `telepathy_command_duration_seconds_count{command="fail"} 2`)
+}
+
 func TestCmdDuplicated(t *testing.T) {
 	assert := assert.New(t)
 	cmdCh := make(chan InboundMessage)
@@ -146,9 +175,9 @@ func TestCmdDuplicated(t *testing.T) {
 	subCmd := &argo.Action{Trigger: "subcmd"}
 	dupCmd := &argo.Action{Trigger: "subcmd"}
 
-	err := cmdMgr.attachCommandInterface(subCmd)
+	err := cmdMgr.attachCommandInterface("test", subCmd)
 	assert.NoError(err)
-	err = cmdMgr.attachCommandInterface(dupCmd)
+	err = cmdMgr.attachCommandInterface("dup", dupCmd)
 	assert.Error(err)
 	_, ok := err.(argo.DuplicatedSubActionError)
 	assert.True(ok)
@@ -178,7 +207,7 @@ func TestCmdEnsureDM(t *testing.T) {
 		},
 	})
 
-	cmdMgr.attachCommandInterface(subCmd)
+	cmdMgr.attachCommandInterface("test", subCmd)
 	go cmdMgr.start(context.Background())
 	fromCh := Channel{
 		MessengerID: "msg",
@@ -204,3 +233,100 @@ func TestCmdEnsureDM(t *testing.T) {
 	close(cmdCh)
 	<-cmdMgr.done
 }
+
+func TestCmdCommandArgs(t *testing.T) {
+	assert := assert.New(t)
+	cmdMgr := newCmdManager("teru", 1, time.Second, make(chan InboundMessage))
+	cmdMgr.attachCommandInterface("fwd", &argo.Action{Trigger: "fwd"})
+	cmdMgr.settings = newChannelSettings()
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	cmdMgr.settings.channels[ch] = channelConfig{prefix: "!t"}
+	close(cmdMgr.settings.loaded)
+
+	other := Channel{MessengerID: "msg", ChannelID: "other"}
+	tests := []struct {
+		msg  InboundMessage
+		args []string
+	}{
+		{InboundMessage{FromChannel: ch, Text: "teru fwd info"}, []string{"teru", "fwd", "info"}},
+		{InboundMessage{FromChannel: ch, Text: "!t  fwd info"}, []string{"teru", "fwd", "info"}},
+		{InboundMessage{FromChannel: other, Text: "!t fwd info"}, nil},
+		{InboundMessage{FromChannel: ch, Text: "<@1> fwd info", BotMention: "<@1>"}, []string{"teru", "fwd", "info"}},
+		{InboundMessage{FromChannel: ch, Text: "<@1> teru fwd info", BotMention: "<@1>"}, []string{"teru", "fwd", "info"}},
+		{InboundMessage{FromChannel: ch, Text: "<@1>", BotMention: "<@1>"}, []string{"teru", "help"}},
+		{InboundMessage{FromChannel: ch, Text: "<@1> how are you", BotMention: "<@1>"}, nil},
+		{InboundMessage{FromChannel: ch, Text: "fwd info", IsDirectMessage: true}, []string{"teru", "fwd", "info"}},
+		{InboundMessage{FromChannel: ch, Text: "help", IsDirectMessage: true}, []string{"teru", "help"}},
+		{InboundMessage{FromChannel: ch, Text: "hello", IsDirectMessage: true}, nil},
+		{InboundMessage{FromChannel: ch, Text: "fwd info"}, nil},
+		{InboundMessage{FromChannel: ch, Text: "teru fwd set \"a b\""}, []string{"teru", "fwd", "set", "a b"}},
+	}
+	for _, test := range tests {
+		args, ok, err := cmdMgr.commandArgs(test.msg)
+		assert.NoError(err, test.msg.Text)
+		assert.Equal(test.args != nil, ok, test.msg.Text)
+		assert.Equal(test.args, args, test.msg.Text)
+	}
+
+	_, ok, err := cmdMgr.commandArgs(InboundMessage{FromChannel: ch, Text: "teru fwd set \"a b"})
+	assert.True(ok)
+	assert.Equal(errUnterminatedQuote, err)
+}
+
+func TestTokenizeCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		args []string
+		err  error
+	}{
+		{"", []string{}, nil},
+		{"fwd  info", []string{"fwd", "info"}, nil},
+		{" fwd\tinfo\n", []string{"fwd", "info"}, nil},
+		{`echo "a b" 'c d'`, []string{"echo", "a b", "c d"}, nil},
+		{`echo key="a b"`, []string{"echo", "key=a b"}, nil},
+		{`echo "" ''`, []string{"echo", "", ""}, nil},
+		{`echo "a \"b\" \\ \n"`, []string{"echo", `a "b" \ \n`}, nil},
+		{`echo 'a \'`, []string{"echo", `a \`}, nil},
+		{`echo a\ b \"c`, []string{"echo", "a b", `"c`}, nil},
+		{"echo \"line 1\nline 2\"", []string{"echo", "line 1\nline 2"}, nil},
+		{"echo don't", []string{"echo", "don't"}, nil},
+		{`echo "a b`, nil, errUnterminatedQuote},
+		{`echo 'a b`, nil, errUnterminatedQuote},
+		// Smart quotes
+		{"echo “a b” ‘c d’", []string{"echo", "a b", "c d"}, nil},
+		{"echo don’t", []string{"echo", "don’t"}, nil},
+		{"echo \"a ‘b’\"", []string{"echo", "a ‘b’"}, nil},
+		// Slack links and entities
+		{"fwd <https://example.com/a?b=1&amp;c=2|example.com/a>", []string{"fwd", "https://example.com/a?b=1&c=2"}, nil},
+		{"fwd <mailto:a@example.com|a@example.com>", []string{"fwd", "mailto:a@example.com"}, nil},
+		{"echo <@U123> <#C123|general>", []string{"echo", "<@U123>", "<#C123|general>"}, nil},
+		{"echo a &amp;&amp; b &lt;c&gt;", []string{"echo", "a", "&&", "b", "<c>"}, nil},
+		{"echo \"&quot; &amp;\"", []string{"echo", "&quot; &"}, nil},
+		// Discord links and code spans
+		{"fwd <https://example.com>", []string{"fwd", "https://example.com"}, nil},
+		{"echo `a \"b` c", []string{"echo", "a \"b", "c"}, nil},
+		{"echo ```\nline 1\nline 2```", []string{"echo", "line 1\nline 2"}, nil},
+		{"echo a`b", []string{"echo", "a`b"}, nil},
+	}
+	for _, test := range tests {
+		args, err := tokenizeCommand(test.text)
+		assert.Equal(t, test.err, err, test.text)
+		assert.Equal(t, test.args, args, test.text)
+	}
+}
+
+func TestQuoteArgs(t *testing.T) {
+	tests := [][]string{
+		{"fwd", "info"},
+		{"echo", "a b", ""},
+		{"echo", `"a" \b`, "'c'", "‘d’", "“e”"},
+		{"echo", "line 1\nline 2", "a&amp;b", "<https://example.com>", "`code`"},
+	}
+	for _, args := range tests {
+		tokenized, err := tokenizeCommand(quoteArgs(args))
+		assert.NoError(t, err)
+		assert.Equal(t, args, tokenized, quoteArgs(args))
+	}
+	assert.Equal(t, "fwd info", quoteArgs([]string{"fwd", "info"}))
+	assert.Equal(t, `echo "a b" "\"c\""`, quoteArgs([]string{"echo", "a b", `"c"`}))
+}
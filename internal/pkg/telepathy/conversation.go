@@ -0,0 +1,124 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+)
+
+const conversationCancel = "cancel" // Reply to cancel a conversation
+
+// ReplyHandler handles the reply of a conversation started by CommandAsk
+// It works like the Do function of argo.Action, except that extraArgs.Message is the reply
+// and state.Args() is empty
+type ReplyHandler func(state *argo.State, extraArgs CmdExtraArgs) error
+
+type conversationKey struct {
+	channel Channel
+	user    string
+}
+
+type conversation struct {
+	handler ReplyHandler
+	expire  time.Time
+}
+
+// conversations keeps the pending conversations, keyed by channel and user
+// Each user has at most one conversation in a channel
+type conversations struct {
+	lock    sync.Mutex
+	pending map[conversationKey]conversation
+	now     func() time.Time
+}
+
+func newConversations() *conversations {
+	return &conversations{
+		pending: make(map[conversationKey]conversation),
+		now:     time.Now,
+	}
+}
+
+func conversationKeyOf(msg InboundMessage) (conversationKey, bool) {
+	if msg.SourceProfile == nil {
+		return conversationKey{}, false
+	}
+	return conversationKey{channel: msg.FromChannel, user: msg.SourceProfile.ID}, true
+}
+
+// ask waits for the next message of the sender of msg in the same channel, replacing the pending conversation
+func (c *conversations) ask(msg InboundMessage, timeout time.Duration, handler ReplyHandler) error {
+	key, ok := conversationKeyOf(msg)
+	if !ok {
+		return errors.New("failed to identify the user to converse with")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for key, conv := range c.pending {
+		if !conv.expire.After(now) {
+			delete(c.pending, key)
+		}
+	}
+	c.pending[key] = conversation{handler: handler, expire: now.Add(timeout)}
+	return nil
+}
+
+// isPending returns true if msg is a reply of a pending conversation
+func (c *conversations) isPending(msg InboundMessage) bool {
+	key, ok := conversationKeyOf(msg)
+	if !ok {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.pending[key]
+	return ok && conv.expire.After(c.now())
+}
+
+// take ends the conversation replied by msg, and returns its handler
+func (c *conversations) take(msg InboundMessage) (ReplyHandler, bool) {
+	key, ok := conversationKeyOf(msg)
+	if !ok {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.pending[key]
+	if !ok {
+		return nil, false
+	}
+	delete(c.pending, key)
+	if !conv.expire.After(c.now()) {
+		return nil, false
+	}
+	if strings.EqualFold(strings.TrimSpace(msg.Text), conversationCancel) {
+		return replyCancelled, true
+	}
+	return conv.handler, true
+}
+
+func replyCancelled(state *argo.State, _ CmdExtraArgs) error {
+	state.OutputStr.WriteString("Cancelled.")
+	return nil
+}
+
+// CommandAsk asks the user running the command a question,
+// and handles the next message of the user in the same channel with handler
+// The conversation ends if the user does not reply within timeout, or replies "cancel"
+// Command messages are still handled as commands during the conversation
+// Call CommandAsk again in handler to continue the conversation
+func CommandAsk(state *argo.State, extraArgs CmdExtraArgs, question string, timeout time.Duration, handler ReplyHandler) error {
+	if extraArgs.conversations == nil {
+		return errors.New("conversations are not supported")
+	}
+	if err := extraArgs.conversations.ask(extraArgs.Message, timeout, handler); err != nil {
+		return err
+	}
+	state.OutputStr.WriteString(question)
+	fmt.Fprintf(&state.OutputStr, "\n(Reply \"%s\" to cancel)", conversationCancel)
+	return nil
+}
@@ -0,0 +1,94 @@
+package telepathy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversations(t *testing.T) {
+	assert := assert.New(t)
+	c := newConversations()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	msg := func(user, text string) InboundMessage {
+		return InboundMessage{FromChannel: ch, SourceProfile: &MsgrUserProfile{ID: user}, Text: text}
+	}
+	handler := func(state *argo.State, extraArgs CmdExtraArgs) error {
+		return nil
+	}
+
+	assert.Error(c.ask(InboundMessage{FromChannel: ch}, time.Minute, handler))
+	assert.NoError(c.ask(msg("a", ""), time.Minute, handler))
+	assert.True(c.isPending(msg("a", "reply")))
+	assert.False(c.isPending(msg("b", "reply")))
+	assert.False(c.isPending(InboundMessage{FromChannel: Channel{MessengerID: "msg"}, SourceProfile: &MsgrUserProfile{ID: "a"}}))
+
+	_, ok := c.take(msg("a", "reply"))
+	assert.True(ok)
+	_, ok = c.take(msg("a", "reply"))
+	assert.False(ok)
+
+	// Expired
+	assert.NoError(c.ask(msg("a", ""), time.Minute, handler))
+	now = now.Add(2 * time.Minute)
+	assert.False(c.isPending(msg("a", "reply")))
+	_, ok = c.take(msg("a", "reply"))
+	assert.False(ok)
+	assert.Empty(c.pending)
+}
+
+func TestCmdConversation(t *testing.T) {
+	assert := assert.New(t)
+	cmdCh := make(chan InboundMessage)
+	cmdMgr := newCmdManager("teru", 1, time.Second, cmdCh)
+
+	askAge := func(name string) ReplyHandler {
+		return func(state *argo.State, extraArgs CmdExtraArgs) error {
+			fmt.Fprintf(&state.OutputStr, "%s is %s", name, extraArgs.Message.Text)
+			return nil
+		}
+	}
+	cmdMgr.attachCommandInterface("test", &argo.Action{
+		Trigger: "wizard",
+		Do: func(state *argo.State, extras ...interface{}) error {
+			extraArgs, _ := extras[0].(CmdExtraArgs)
+			return CommandAsk(state, extraArgs, "Name?", time.Minute, func(state *argo.State, extraArgs CmdExtraArgs) error {
+				return CommandAsk(state, extraArgs, "Age?", time.Minute, askAge(extraArgs.Message.Text))
+			})
+		},
+	})
+	go cmdMgr.start(context.Background())
+
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	msg := func(user, text string) InboundMessage {
+		return InboundMessage{FromChannel: ch, SourceProfile: &MsgrUserProfile{ID: user}, Text: text}
+	}
+	assert.False(cmdMgr.isCmdMsg(msg("a", "alice")))
+
+	cmdCh <- msg("a", "teru wizard")
+	assert.Equal("Name?\n(Reply \"cancel\" to cancel)", (<-cmdMgr.msgOut).Text)
+	assert.True(cmdMgr.isCmdMsg(msg("a", "alice")))
+	assert.False(cmdMgr.isCmdMsg(msg("b", "alice")))
+
+	cmdCh <- msg("a", "alice")
+	assert.Equal("Age?\n(Reply \"cancel\" to cancel)", (<-cmdMgr.msgOut).Text)
+	cmdCh <- msg("a", "20")
+	assert.Equal("alice is 20", (<-cmdMgr.msgOut).Text)
+	assert.False(cmdMgr.isCmdMsg(msg("a", "alice")))
+
+	cmdCh <- msg("a", "teru wizard")
+	<-cmdMgr.msgOut
+	cmdCh <- msg("a", " Cancel ")
+	assert.Equal("Cancelled.", (<-cmdMgr.msgOut).Text)
+	assert.False(cmdMgr.isCmdMsg(msg("a", "alice")))
+
+	close(cmdCh)
+	<-cmdMgr.done
+}
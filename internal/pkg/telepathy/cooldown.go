@@ -0,0 +1,120 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+)
+
+const cooldownSweepInterval = time.Minute
+
+// Cooldown limits how often a command can be run, zero durations are not limited
+type Cooldown struct {
+	Global  time.Duration // Min interval between runs of the command by anyone
+	Channel time.Duration // Min interval between runs of the command in a channel
+	User    time.Duration // Min interval between runs of the command by a user in a channel
+}
+
+type cooldownKey struct {
+	command uint64
+	channel Channel
+	user    string
+}
+
+// cooldowns tracks the runs of commands with Cooldown
+// Commands are identified by the IDs assigned by CommandCooldown
+type cooldowns struct {
+	lock      sync.Mutex
+	until     map[cooldownKey]time.Time // Commands are not allowed to run until the time
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+var cooldownCommandID uint64
+
+func newCooldowns() *cooldowns {
+	return &cooldowns{
+		until: make(map[cooldownKey]time.Time),
+		now:   time.Now,
+	}
+}
+
+// take records a run of command by user in channel, if the command is not cooling down
+// It returns the time to wait before the command can be run again otherwise
+func (c *cooldowns) take(command uint64, cooldown Cooldown, channel Channel, user string) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	c.sweep(now)
+
+	limits := []struct {
+		key      cooldownKey
+		interval time.Duration
+	}{
+		{cooldownKey{command: command}, cooldown.Global},
+		{cooldownKey{command: command, channel: channel}, cooldown.Channel},
+		{cooldownKey{command: command, channel: channel, user: user}, cooldown.User},
+	}
+	var wait time.Duration
+	for _, limit := range limits {
+		if limit.interval <= 0 {
+			continue
+		}
+		if left := c.until[limit.key].Sub(now); left > wait {
+			wait = left
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, limit := range limits {
+		if limit.interval > 0 {
+			c.until[limit.key] = now.Add(limit.interval)
+		}
+	}
+	return 0
+}
+
+// sweep removes expired records, so that the records do not grow with every user
+func (c *cooldowns) sweep(now time.Time) {
+	if now.Before(c.nextSweep) {
+		return
+	}
+	for key, until := range c.until {
+		if !until.After(now) {
+			delete(c.until, key)
+		}
+	}
+	c.nextSweep = now.Add(cooldownSweepInterval)
+}
+
+// CommandCooldown wraps the Do function of argo.Action,
+// so that the action can only be run once within the intervals of cooldown
+// Operators are not limited
+func CommandCooldown(cooldown Cooldown, do func(*argo.State, ...interface{}) error) func(*argo.State, ...interface{}) error {
+	id := atomic.AddUint64(&cooldownCommandID, 1)
+	return func(state *argo.State, extras ...interface{}) error {
+		extraArgs, ok := extras[0].(CmdExtraArgs)
+		if !ok {
+			return errors.New("failed to parse extraArgs")
+		}
+		if extraArgs.cooldowns == nil || extraArgs.Role >= RoleOperator {
+			return do(state, extras...)
+		}
+		user := ""
+		if extraArgs.Message.SourceProfile != nil {
+			user = extraArgs.Message.SourceProfile.ID
+		}
+		wait := extraArgs.cooldowns.take(id, cooldown, extraArgs.Message.FromChannel, user)
+		if wait > 0 {
+			fmt.Fprintf(&state.OutputStr, "This command is cooling down, try again in %ds.\n", int(math.Ceil(wait.Seconds())))
+			return nil
+		}
+		return do(state, extras...)
+	}
+}
@@ -0,0 +1,67 @@
+package telepathy
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCooldownsTake(t *testing.T) {
+	assert := assert.New(t)
+	c := newCooldowns()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	cooldown := Cooldown{Channel: 10 * time.Second, User: time.Minute}
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	other := Channel{MessengerID: "msg", ChannelID: "other"}
+
+	assert.Zero(c.take(1, cooldown, ch, "a"))
+	assert.Equal(time.Minute, c.take(1, cooldown, ch, "a"))
+	assert.Equal(10*time.Second, c.take(1, cooldown, ch, "b"))
+	assert.Zero(c.take(1, cooldown, other, "a"))
+	assert.Zero(c.take(2, cooldown, ch, "a"))
+
+	now = now.Add(20 * time.Second)
+	assert.Zero(c.take(1, cooldown, ch, "b"))
+	assert.Equal(40*time.Second, c.take(1, cooldown, ch, "a"))
+
+	// Expired records are removed
+	now = now.Add(2 * time.Minute)
+	assert.Zero(c.take(3, Cooldown{}, ch, "a"))
+	assert.Empty(c.until)
+}
+
+func TestCommandCooldown(t *testing.T) {
+	assert := assert.New(t)
+	called := 0
+	action := argo.Action{
+		Trigger: "cmd",
+		Do: CommandCooldown(Cooldown{Global: time.Minute}, func(state *argo.State, extras ...interface{}) error {
+			called++
+			return nil
+		}),
+	}
+	assert.NoError(action.Finalize())
+	extArgs := CmdExtraArgs{
+		Message:   InboundMessage{FromChannel: Channel{MessengerID: "msg", ChannelID: "ch"}, SourceProfile: &MsgrUserProfile{ID: "user"}},
+		cooldowns: newCooldowns(),
+	}
+
+	state := argo.State{}
+	assert.NoError(action.Parse(&state, []string{"cmd"}, extArgs))
+	assert.Equal(1, called)
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"cmd"}, extArgs))
+	assert.Equal(1, called)
+	assert.Equal("This command is cooling down, try again in 60s.\n", state.OutputStr.String())
+
+	// Operators are not limited
+	extArgs.Role = RoleOperator
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"cmd"}, extArgs))
+	assert.Equal(2, called)
+}
@@ -2,10 +2,11 @@ package telepathy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
-	"github.com/mongodb/mongo-go-driver/mongo"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,40 +15,100 @@ const (
 	dBTimeout = time.Minute
 )
 
+// Supported database backends, used as SessionConfig.DatabaseType
+const (
+	DBTypeMongo  = "mongo"
+	DBTypeFile   = "file"
+	DBTypeMemory = "memory"
+)
+
+// ErrDocumentNotFound is returned by Database.Load if the requested document does not exist
+var ErrDocumentNotFound = errors.New("document not found")
+
+// Database defines the storage operations that can be done in DatabaseRequest.Action
+// Data is stored as documents, each document is identified by its collection and key
+// Stored values must be serializable by both encoding/json and bson
+type Database interface {
+	// Load reads the document identified by collection and key into value
+	// ErrDocumentNotFound is returned if the document does not exist
+	Load(ctx context.Context, collection, key string, value interface{}) error
+
+	// Store writes value as the document identified by collection and key
+	// An existing document will be replaced
+	Store(ctx context.Context, collection, key string, value interface{}) error
+
+	// Delete removes the document identified by collection and key
+	// Deleting a document that does not exist is not an error
+	Delete(ctx context.Context, collection, key string) error
+
+	// Keys lists the keys of all documents in the collection
+	Keys(ctx context.Context, collection string) ([]string, error)
+}
+
+// databaseBackend is a Database which can be managed by databaseHandler
+type databaseBackend interface {
+	Database
+	connect(ctx context.Context) error
+	disconnect(ctx context.Context) error
+	name() string
+}
+
 // DatabaseRequest defines a request for database
 // When a DatabaseRequest is handled, the Action function is called
 // and the return value will be pushed to Return channel
 // The Action function is guaranteed to be run atomically without other DatabaseRequest
 type DatabaseRequest struct {
-	Action func(context.Context, *mongo.Database) interface{}
+	Action func(context.Context, Database) interface{}
 	Return chan interface{}
 }
 
 type databaseHandler struct {
-	dbName       string
-	client       *mongo.Client
-	database     *mongo.Database
+	backend      databaseBackend
 	timeout      time.Duration
 	reqQueue     chan DatabaseRequest
 	requesterMap map[string]<-chan DatabaseRequest
 	logger       *logrus.Entry
+	duration     *Histogram
+	timeouts     *Counter
+	healthLock   sync.Mutex
+	status       ComponentHealth
 }
 
-func newDatabaseHandler(mongourl string, dbname string) (*databaseHandler, error) {
-	logger := logrus.WithField("module", "database")
-	handler := databaseHandler{dbName: dbname}
-	var err error
-	handler.client, err = mongo.NewClient(mongourl)
-	if err != nil {
-		logger.Error("failed to create mongo client")
-		return nil, err
+func newDatabaseBackend(config SessionConfig) (databaseBackend, error) {
+	switch config.DatabaseType {
+	case DBTypeMongo, "":
+		return newMongoDB(config.MongoURL, config.DatabaseName)
+	case DBTypeFile:
+		return newFileDB(config.DatabaseFile)
+	case DBTypeMemory:
+		return newMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("Invalid database type: %s", config.DatabaseType)
+	}
+}
+
+func newDatabaseHandler(backend databaseBackend) *databaseHandler {
+	return &databaseHandler{
+		backend:      backend,
+		timeout:      dBTimeout,
+		reqQueue:     make(chan DatabaseRequest, dBReqLen),
+		requesterMap: make(map[string]<-chan DatabaseRequest),
+		logger:       logrus.WithField("module", "database"),
+		status:       ComponentHealth{Status: HealthStarting, Critical: true},
 	}
-	handler.reqQueue = make(chan DatabaseRequest, dBReqLen)
-	handler.logger = logger
-	handler.requesterMap = make(map[string]<-chan DatabaseRequest)
-	handler.timeout = dBTimeout
+}
+
+// health returns whether the database is connected
+func (h *databaseHandler) health() ComponentHealth {
+	h.healthLock.Lock()
+	defer h.healthLock.Unlock()
+	return h.status
+}
 
-	return &handler, nil
+func (h *databaseHandler) setStatus(status HealthStatus, detail string) {
+	h.healthLock.Lock()
+	defer h.healthLock.Unlock()
+	h.status = ComponentHealth{Status: status, Critical: true, Detail: detail}
 }
 
 func (h *databaseHandler) attachRequester(id string, ch <-chan DatabaseRequest) {
@@ -57,6 +118,13 @@ func (h *databaseHandler) attachRequester(id string, ch <-chan DatabaseRequest)
 	h.requesterMap[id] = ch
 }
 
+func (h *databaseHandler) setMetrics(m *Metrics) {
+	m.GaugeFunc("database_queue_length", "Database requests waiting to be handled",
+		func() float64 { return float64(len(h.reqQueue)) })
+	h.duration = m.Histogram("database_request_duration_seconds", "Time taken to handle database requests", DefaultBuckets)
+	h.timeouts = m.Counter("database_request_timeouts_total", "Database requests timeout or cancelled")
+}
+
 func (h *databaseHandler) worker(ctx context.Context) {
 	wg := sync.WaitGroup{}
 	wg.Add(len(h.requesterMap))
@@ -75,37 +143,42 @@ func (h *databaseHandler) worker(ctx context.Context) {
 	}()
 
 	for request := range h.reqQueue {
+		start := time.Now()
 		timeout, cancel := context.WithTimeout(ctx, h.timeout)
 		done := make(chan interface{})
-		go func() {
-			ret := request.Action(timeout, h.database)
+		go func(request DatabaseRequest) {
+			ret := request.Action(timeout, h.backend)
 			request.Return <- ret
 			close(done)
-		}()
+		}(request)
 
 		select {
 		case <-timeout.Done():
 			h.logger.Warnf("request timeout/cancelled")
+			h.timeouts.Inc()
 		case <-done:
 		}
 		cancel()
+		h.duration.Observe(time.Since(start).Seconds())
 	}
 }
 
 func (h *databaseHandler) start(ctx context.Context) error {
 	timeCtx, cancel := context.WithTimeout(ctx, h.timeout)
-	err := h.client.Connect(timeCtx)
+	err := h.backend.connect(timeCtx)
 	cancel()
 	if err != nil {
+		h.setStatus(HealthDown, fmt.Sprintf("connect failed: %s", err.Error()))
 		return err
 	}
 
-	h.database = h.client.Database(h.dbName)
-	h.logger.Infof("started. Database name: %s", h.dbName)
+	h.setStatus(HealthUp, h.backend.name())
+	h.logger.Infof("started. Database: %s", h.backend.name())
 	h.worker(ctx)
 
+	h.setStatus(HealthDown, "disconnected")
 	timeCtx, cancel = context.WithTimeout(ctx, h.timeout)
-	err = h.client.Disconnect(timeCtx)
+	err = h.backend.disconnect(timeCtx)
 	cancel()
 	if err != nil {
 		return err
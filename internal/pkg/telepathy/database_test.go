@@ -2,22 +2,25 @@ package telepathy
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
-
 	"github.com/stretchr/testify/assert"
 )
 
 const (
-	testDBURL  = "mongodb://mongo:27017/test"
-	testDBName = "testDBName"
+	testDBName       = "testDBName"
+	testMongoURLEnv  = "TELEPATHY_TEST_MONGO_URL"
+	testCollection   = "testCollection"
+	testDBFileSuffix = "telepathy.db"
 )
 
 type dbTester struct {
+	timeout time.Duration // Timeout of the handler if not zero, set before start
 	handler *databaseHandler
 	reqChA  chan DatabaseRequest
 	reqChB  chan DatabaseRequest
@@ -25,21 +28,59 @@ type dbTester struct {
 	done    chan interface{}
 }
 
+type testDoc struct {
+	Key   string
+	Value []string
+}
+
+// testBackends returns factories of all database backends to be tested
+// MongoDB is tested only if TELEPATHY_TEST_MONGO_URL is set
+func testBackends(t *testing.T) map[string]func() databaseBackend {
+	dir, err := ioutil.TempDir("", "telepathy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, testDBFileSuffix)
+	backends := map[string]func() databaseBackend{
+		DBTypeMemory: func() databaseBackend {
+			return newMemoryDB()
+		},
+		DBTypeFile: func() databaseBackend {
+			db, err := newFileDB(path)
+			assert.NoError(t, err)
+			return db
+		},
+	}
+	if url := os.Getenv(testMongoURLEnv); url != "" {
+		backends[DBTypeMongo] = func() databaseBackend {
+			db, err := newMongoDB(url, testDBName)
+			assert.NoError(t, err)
+			return db
+		}
+	}
+	return backends
+}
+
 func TestDBConnection(t *testing.T) {
-	assert := assert.New(t)
-	handler, err := newDatabaseHandler(testDBURL, testDBName)
-	if assert.NoError(err) {
-		assert.NotNil(handler)
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			handler := newDatabaseHandler(backend())
+			assert.NotNil(t, handler)
+			assert.NoError(t, handler.start(context.Background()))
+		})
 	}
-	assert.NoError(handler.start(context.Background()))
+}
+
+func TestDBInvalidType(t *testing.T) {
+	_, err := newDatabaseBackend(SessionConfig{DatabaseType: "invalid"})
+	assert.Error(t, err)
+	_, err = newDatabaseBackend(SessionConfig{DatabaseType: DBTypeFile})
+	assert.Error(t, err)
 }
 
 func TestDBAttach(t *testing.T) {
 	assert := assert.New(t)
-	handler, err := newDatabaseHandler(testDBURL, testDBName)
-	if assert.NoError(err) {
-		assert.NotNil(handler)
-	}
+	handler := newDatabaseHandler(newMemoryDB())
 	reqCh := make(chan DatabaseRequest)
 	handler.attachRequester("testReq", reqCh)
 	reqChOther := make(chan DatabaseRequest)
@@ -56,22 +97,18 @@ func TestDBAttach(t *testing.T) {
 
 func TestDBAttachDuplicate(t *testing.T) {
 	assert := assert.New(t)
-	handler, err := newDatabaseHandler(testDBURL, testDBName)
-	if assert.NoError(err) {
-		assert.NotNil(handler)
-	}
+	handler := newDatabaseHandler(newMemoryDB())
 	reqCh := make(chan DatabaseRequest)
 	handler.attachRequester("testReq", reqCh)
 	reqChOther := make(chan DatabaseRequest)
 	assert.Panics(func() { handler.attachRequester("testReq", reqChOther) })
 }
 
-func (tester *dbTester) start(t *testing.T) {
+func (tester *dbTester) start(t *testing.T, backend databaseBackend) {
 	assert := assert.New(t)
-	var err error
-	tester.handler, err = newDatabaseHandler(testDBURL, testDBName)
-	if assert.NoError(err) {
-		assert.NotNil(tester.handler)
+	tester.handler = newDatabaseHandler(backend)
+	if tester.timeout > 0 {
+		tester.handler.timeout = tester.timeout
 	}
 	tester.reqChA = make(chan DatabaseRequest, 5)
 	tester.reqChB = make(chan DatabaseRequest, 5)
@@ -93,211 +130,123 @@ func (tester *dbTester) stop() {
 	<-tester.done
 }
 
-func TestDBSimpleReadWrite(t *testing.T) {
-	assert := assert.New(t)
-	tester := dbTester{}
-
-	testVal := "value"
-	tester.start(t)
+func dbWrite(t *testing.T, reqCh chan<- DatabaseRequest, collection string, doc testDoc) {
 	retCh := make(chan interface{})
-	tester.reqChA <- DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			_, err := collection.InsertOne(ctx, bson.M{"Key": testVal})
-			assert.NoError(err)
-			return testVal
+	reqCh <- DatabaseRequest{
+		Action: func(ctx context.Context, db Database) interface{} {
+			return db.Store(ctx, collection, doc.Key, doc)
 		},
 		Return: retCh,
 	}
 	ret := <-retCh
 	close(retCh)
-	value, ok := ret.(string)
-	assert.True(ok)
-
-	retCh = make(chan interface{})
-	tester.reqChB <- DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			result := collection.FindOne(ctx, map[string]string{"Key": value})
-			if !assert.NoError(result.Err()) {
-				return ""
-			}
-			raw, err := result.DecodeBytes()
-			if !assert.NoError(err) {
-				return ""
-			}
-			readValue, err := raw.LookupErr("Key")
-			if !assert.NoError(err) {
-				return ""
-			}
-			ret, ok := readValue.StringValueOK()
-			if !assert.True(ok) {
-				return ""
-			}
-			delResult, err := collection.DeleteMany(ctx, map[string]string{"Key": value})
-			assert.NoError(err)
-			assert.Equal(int64(1), delResult.DeletedCount)
-			return ret
-		},
-		Return: retCh,
-	}
-
-	ret = <-retCh
-	close(retCh)
-	value, ok = ret.(string)
-	assert.True(ok)
-	assert.Equal(testVal, value)
-	tester.stop()
+	assert.Nil(t, ret)
 }
 
-func TestDBSimpleReadWriteReconn(t *testing.T) {
+func dbReadDelete(t *testing.T, reqCh chan<- DatabaseRequest, collection string, key string) testDoc {
 	assert := assert.New(t)
-	tester := dbTester{}
-
-	testVal := "value"
-	tester.start(t)
 	retCh := make(chan interface{})
-	tester.reqChA <- DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			_, err := collection.InsertOne(ctx, bson.M{"Key": testVal})
+	reqCh <- DatabaseRequest{
+		Action: func(ctx context.Context, db Database) interface{} {
+			doc := testDoc{}
+			if !assert.NoError(db.Load(ctx, collection, key, &doc)) {
+				return doc
+			}
+			keys, err := db.Keys(ctx, collection)
 			assert.NoError(err)
-			return testVal
+			assert.Contains(keys, key)
+			assert.NoError(db.Delete(ctx, collection, key))
+			assert.Equal(ErrDocumentNotFound, db.Load(ctx, collection, key, &testDoc{}))
+			return doc
 		},
 		Return: retCh,
 	}
 	ret := <-retCh
 	close(retCh)
-	value, ok := ret.(string)
+	doc, ok := ret.(testDoc)
 	assert.True(ok)
+	return doc
+}
 
-	tester.stop()
-
-	tester.start(t)
-	retCh = make(chan interface{})
-	tester.reqChB <- DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			result := collection.FindOne(ctx, map[string]string{"Key": value})
-			if !assert.NoError(result.Err()) {
-				return ""
-			}
-			raw, err := result.DecodeBytes()
-			if !assert.NoError(err) {
-				return ""
-			}
-			readValue, err := raw.LookupErr("Key")
-			if !assert.NoError(err) {
-				return ""
-			}
-			ret, ok := readValue.StringValueOK()
-			if !assert.True(ok) {
-				return ""
-			}
-			delResult, err := collection.DeleteMany(ctx, map[string]string{"Key": value})
-			assert.NoError(err)
-			assert.Equal(int64(1), delResult.DeletedCount)
-			return ret
-		},
-		Return: retCh,
+func TestDBSimpleReadWrite(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tester := dbTester{}
+			testVal := testDoc{Key: "key", Value: []string{"value", "list"}}
+			tester.start(t, backend())
+			dbWrite(t, tester.reqChA, testCollection, testVal)
+			assert.Equal(t, testVal, dbReadDelete(t, tester.reqChB, testCollection, testVal.Key))
+			tester.stop()
+		})
 	}
+}
 
-	ret = <-retCh
-	close(retCh)
-	value, ok = ret.(string)
-	assert.True(ok)
-	assert.Equal(testVal, value)
-	tester.stop()
+func TestDBSimpleReadWriteReconn(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		if name == DBTypeMemory {
+			// memory database does not persist between connections
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			tester := dbTester{}
+			testVal := testDoc{Key: "key", Value: []string{"value"}}
+			tester.start(t, backend())
+			dbWrite(t, tester.reqChA, testCollection, testVal)
+			tester.stop()
+
+			tester.start(t, backend())
+			assert.Equal(t, testVal, dbReadDelete(t, tester.reqChB, testCollection, testVal.Key))
+			tester.stop()
+		})
+	}
 }
 
 func TestDBMultiAccess(t *testing.T) {
-	assert := assert.New(t)
-	tester := dbTester{}
-	tester.start(t)
-	testFunc := func(reqChan chan<- DatabaseRequest, collection string, testVal string) {
-		retCh := make(chan interface{})
-		reqChan <- DatabaseRequest{
-			Action: func(ctx context.Context, db *mongo.Database) interface{} {
-				collection := db.Collection(collection)
-				_, err := collection.InsertOne(ctx, bson.M{"Key": testVal})
-				assert.NoError(err)
-				return testVal
-			},
-			Return: retCh,
-		}
-		ret := <-retCh
-		close(retCh)
-		value, ok := ret.(string)
-		assert.True(ok)
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			tester := dbTester{}
+			tester.start(t, backend())
+			testFunc := func(reqChan chan<- DatabaseRequest, collection string, testVal string) {
+				doc := testDoc{Key: testVal, Value: []string{testVal}}
+				dbWrite(t, reqChan, collection, doc)
+				assert.Equal(t, doc, dbReadDelete(t, reqChan, collection, doc.Key))
+			}
 
-		retCh = make(chan interface{})
-		reqChan <- DatabaseRequest{
-			Action: func(ctx context.Context, db *mongo.Database) interface{} {
-				collection := db.Collection(collection)
-				result := collection.FindOne(ctx, map[string]string{"Key": value})
-				if !assert.NoError(result.Err()) {
-					return ""
-				}
-				raw, err := result.DecodeBytes()
-				if !assert.NoError(err) {
-					return ""
+			wg := sync.WaitGroup{}
+			wg.Add(3)
+			go func() {
+				for i := 0; i < 10; i++ {
+					testFunc(tester.reqChA, "collectionA", "testA")
 				}
-				readValue, err := raw.LookupErr("Key")
-				if !assert.NoError(err) {
-					return ""
+				wg.Done()
+			}()
+
+			go func() {
+				for i := 0; i < 10; i++ {
+					testFunc(tester.reqChB, "collectionB", "testB")
 				}
-				ret, ok := readValue.StringValueOK()
-				if !assert.True(ok) {
-					return ""
+				wg.Done()
+			}()
+
+			go func() {
+				for i := 0; i < 10; i++ {
+					testFunc(tester.reqChC, "collectionC", "testC")
 				}
-				delResult, err := collection.DeleteMany(ctx, map[string]string{"Key": value})
-				assert.NoError(err)
-				assert.Equal(int64(1), delResult.DeletedCount)
-				return ret
-			},
-			Return: retCh,
-		}
-		ret = <-retCh
-		close(retCh)
-		value, ok = ret.(string)
-		assert.True(ok)
-		assert.Equal(testVal, value)
+				wg.Done()
+			}()
+			wg.Wait()
+			tester.stop()
+		})
 	}
-
-	wg := sync.WaitGroup{}
-	wg.Add(3)
-	go func() {
-		for i := 0; i < 10; i++ {
-			testFunc(tester.reqChA, "collectionA", "testA")
-		}
-		wg.Done()
-	}()
-
-	go func() {
-		for i := 0; i < 10; i++ {
-			testFunc(tester.reqChB, "collectionB", "testB")
-		}
-		wg.Done()
-	}()
-
-	go func() {
-		for i := 0; i < 10; i++ {
-			testFunc(tester.reqChC, "collectionC", "testC")
-		}
-		wg.Done()
-	}()
-	wg.Wait()
-	tester.stop()
 }
 
 func TestDBTimeout(t *testing.T) {
 	assert := assert.New(t)
-	tester := dbTester{}
-	tester.start(t)
-	tester.handler.timeout = 10 * time.Second
+	tester := dbTester{timeout: 10 * time.Second}
+	tester.start(t, newMemoryDB())
 	retCh := make(chan interface{})
 	tester.reqChA <- DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
+		Action: func(ctx context.Context, db Database) interface{} {
 			<-ctx.Done()
 			return true
 		},
@@ -0,0 +1,91 @@
+package telepathy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileDB keeps all documents in memory and writes them to a single JSON file on every change
+// The file is written to a temporary file and then renamed, so a crash never leaves a partial file
+type fileDB struct {
+	memoryDB
+	path      string
+	flushLock sync.Mutex
+}
+
+func newFileDB(path string) (*fileDB, error) {
+	if path == "" {
+		return nil, errors.New("database file path is not specified")
+	}
+	return &fileDB{
+		memoryDB: memoryDB{collections: make(map[string]map[string]json.RawMessage)},
+		path:     path,
+	}, nil
+}
+
+func (db *fileDB) name() string {
+	return DBTypeFile + ":" + db.path
+}
+
+func (db *fileDB) connect(context.Context) error {
+	content, err := ioutil.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return json.Unmarshal(content, &db.collections)
+}
+
+func (db *fileDB) disconnect(context.Context) error {
+	return db.flush()
+}
+
+func (db *fileDB) Store(ctx context.Context, collection, key string, value interface{}) error {
+	if err := db.memoryDB.Store(ctx, collection, key, value); err != nil {
+		return err
+	}
+	return db.flush()
+}
+
+func (db *fileDB) Delete(ctx context.Context, collection, key string) error {
+	if err := db.memoryDB.Delete(ctx, collection, key); err != nil {
+		return err
+	}
+	return db.flush()
+}
+
+// flush writes all collections to file
+// flushLock ensures the latest snapshot is always the last one renamed into place
+func (db *fileDB) flush() error {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	db.lock.RLock()
+	content, err := json.Marshal(db.collections)
+	db.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(content); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), db.path)
+}
@@ -0,0 +1,77 @@
+package telepathy
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// memoryDB keeps JSON encoded documents in memory
+// Contents are lost when the session terminates
+type memoryDB struct {
+	lock        sync.RWMutex
+	collections map[string]map[string]json.RawMessage
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		collections: make(map[string]map[string]json.RawMessage),
+	}
+}
+
+func (db *memoryDB) name() string {
+	return DBTypeMemory
+}
+
+func (db *memoryDB) connect(context.Context) error {
+	return nil
+}
+
+func (db *memoryDB) disconnect(context.Context) error {
+	return nil
+}
+
+func (db *memoryDB) Load(_ context.Context, collection, key string, value interface{}) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	doc, ok := db.collections[collection][key]
+	if !ok {
+		return ErrDocumentNotFound
+	}
+	return json.Unmarshal(doc, value)
+}
+
+func (db *memoryDB) Store(_ context.Context, collection, key string, value interface{}) error {
+	doc, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	coll, ok := db.collections[collection]
+	if !ok {
+		coll = make(map[string]json.RawMessage)
+		db.collections[collection] = coll
+	}
+	coll[key] = doc
+	return nil
+}
+
+func (db *memoryDB) Delete(_ context.Context, collection, key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.collections[collection], key)
+	return nil
+}
+
+func (db *memoryDB) Keys(_ context.Context, collection string) ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	keys := make([]string, 0, len(db.collections[collection]))
+	for key := range db.collections[collection] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
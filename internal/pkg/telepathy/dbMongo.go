@@ -0,0 +1,102 @@
+package telepathy
+
+import (
+	"context"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+)
+
+// mongoDB stores each document as {"ID": key, "Value": value} in MongoDB collections
+type mongoDB struct {
+	dbName   string
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+type mongoKey struct {
+	ID string `bson:"ID"`
+}
+
+func newMongoDB(mongourl string, dbname string) (*mongoDB, error) {
+	client, err := mongo.NewClient(mongourl)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDB{dbName: dbname, client: client}, nil
+}
+
+func (db *mongoDB) name() string {
+	return DBTypeMongo + ":" + db.dbName
+}
+
+func (db *mongoDB) connect(ctx context.Context) error {
+	if err := db.client.Connect(ctx); err != nil {
+		return err
+	}
+	db.database = db.client.Database(db.dbName)
+	return nil
+}
+
+func (db *mongoDB) disconnect(ctx context.Context) error {
+	return db.client.Disconnect(ctx)
+}
+
+func (db *mongoDB) Load(ctx context.Context, collection, key string, value interface{}) error {
+	result := db.database.Collection(collection).FindOne(ctx, bson.M{"ID": key})
+	raw, err := result.DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return ErrDocumentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	rawValue, err := raw.LookupErr("Value")
+	if err != nil {
+		return err
+	}
+	return rawValue.Unmarshal(value)
+}
+
+// loadLegacy reads the field of a document stored before KVStore
+func (db *mongoDB) loadLegacy(ctx context.Context, doc LegacyDocument) (bson.RawValue, error) {
+	result := db.database.Collection(doc.Collection).FindOne(ctx, bson.M{"ID": doc.ID})
+	raw, err := result.DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return bson.RawValue{}, ErrDocumentNotFound
+	}
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	return raw.LookupErr(doc.Field)
+}
+
+func (db *mongoDB) Store(ctx context.Context, collection, key string, value interface{}) error {
+	_, err := db.database.Collection(collection).ReplaceOne(ctx,
+		bson.M{"ID": key}, bson.M{"ID": key, "Value": value}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (db *mongoDB) Delete(ctx context.Context, collection, key string) error {
+	_, err := db.database.Collection(collection).DeleteOne(ctx, bson.M{"ID": key})
+	return err
+}
+
+func (db *mongoDB) Keys(ctx context.Context, collection string) ([]string, error) {
+	cursor, err := db.database.Collection(collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []string{}
+	for cursor.Next(ctx) {
+		doc := mongoKey{}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		keys = append(keys, doc.ID)
+	}
+	return keys, cursor.Err()
+}
@@ -0,0 +1,75 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors used to classify delivery failures of OutboundMessages
+// Messengers wrap these errors with details, use errors.Is to check the type
+var (
+	ErrRateLimited       = errors.New("rate limited")
+	ErrChannelGone       = errors.New("channel not found")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrMessengerNotFound = errors.New("messenger not found")
+	ErrDeliveryTimeout   = errors.New("delivery timeout")
+	ErrMessageGone       = errors.New("message not found")
+	ErrNotSupported      = errors.New("action not supported")
+	ErrPluginDisabled    = errors.New("plugin disabled in channel")
+)
+
+// RateLimitError is reported by messengers if the messenger API rejects a message due to rate limiting
+// errors.Is(err, ErrRateLimited) is true for RateLimitError
+type RateLimitError struct {
+	RetryAfter time.Duration // Time to wait before sending again, 0 if unknown
+	Err        error         // Error returned by the messenger API
+}
+
+func (e *RateLimitError) Error() string {
+	msg := ErrRateLimited.Error()
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap makes RateLimitError match ErrRateLimited
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// DeliveryResult reports the result of sending an OutboundMessage
+type DeliveryResult struct {
+	Message   OutboundMessage // The delivered message, as sent by the messenger
+	MessageID string          // ID assigned by the messenger, empty if not supported or failed
+	Err       error           // nil if the message is delivered successfully
+}
+
+// DeliveryCallback is called when the delivery result of an OutboundMessage is known
+// It is called from the messenger or router routine, so it should not block
+type DeliveryCallback func(DeliveryResult)
+
+// DeliveryError wraps err as one of the delivery error types above
+func DeliveryError(kind error, err error) error {
+	if err == nil {
+		return kind
+	}
+	return fmt.Errorf("%w: %s", kind, err.Error())
+}
+
+// ReportResult reports the delivery result to the producer if OnResult is set
+// This should be called by messengers once per OutboundMessage they handle
+func (om OutboundMessage) ReportResult(msgID string, err error) {
+	if om.OnResult == nil {
+		return
+	}
+	om.OnResult(DeliveryResult{
+		Message:   om,
+		MessageID: msgID,
+		Err:       err,
+	})
+}
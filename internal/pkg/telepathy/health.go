@@ -0,0 +1,231 @@
+package telepathy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// HealthStatus is the status of a component reported on /healthz and /readyz
+type HealthStatus string
+
+// Statuses of components
+const (
+	HealthStarting HealthStatus = "starting" // Not ready yet, e.g. connecting
+	HealthUp       HealthStatus = "up"
+	HealthDegraded HealthStatus = "degraded" // Working with problems, the session is still healthy and ready
+	HealthDown     HealthStatus = "down"
+)
+
+// ComponentHealth is the health of a component of the session or a plugin
+// The session is not ready while any component is starting or down, and is unhealthy if a critical component is down
+type ComponentHealth struct {
+	Status   HealthStatus `json:"status"`
+	Critical bool         `json:"critical,omitempty"`
+	Detail   string       `json:"detail,omitempty"`
+}
+
+// PluginState is the running state of a plugin
+type PluginState string
+
+// States of plugins
+const (
+	PluginStarting   PluginState = "starting" // Start is not called yet
+	PluginRunning    PluginState = "running"
+	PluginExited     PluginState = "exited"     // Start returned before the session is stopped, e.g. plugins only serving commands
+	PluginRestarting PluginState = "restarting" // Start panicked, waiting to be restarted
+	PluginStopped    PluginState = "stopped"
+)
+
+// PluginHealth is the health of a plugin, Components are reported by PluginHealthReporter
+// Panics of the plugin are reported as the "supervisor" component, which is degraded after repeated failures
+type PluginHealth struct {
+	State      PluginState                `json:"state"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// HealthReport is the health of the session served on /healthz and /readyz as JSON
+// /healthz responds 503 if Live is false, and /readyz responds 503 if Ready is false
+type HealthReport struct {
+	Live     bool                    `json:"live"`
+	Ready    bool                    `json:"ready"`
+	Database ComponentHealth         `json:"database"`
+	Plugins  map[string]PluginHealth `json:"plugins"`
+}
+
+// sessionHealth keeps the states of plugins, and collects the health of the session
+type sessionHealth struct {
+	lock     sync.Mutex
+	states   map[string]PluginState
+	stopping bool
+	failures map[string]*pluginFailures
+	database func() ComponentHealth
+	plugins  map[string]Plugin
+}
+
+// pluginFailures records the panics recovered from a plugin
+type pluginFailures struct {
+	count    int
+	last     string
+	degraded bool
+}
+
+func newSessionHealth(database func() ComponentHealth, plugins map[string]Plugin) *sessionHealth {
+	states := make(map[string]PluginState, len(plugins))
+	for id := range plugins {
+		states[id] = PluginStarting
+	}
+	return &sessionHealth{
+		states:   states,
+		failures: make(map[string]*pluginFailures),
+		database: database,
+		plugins:  plugins,
+	}
+}
+
+func (h *sessionHealth) setState(id string, state PluginState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.states[id] = state
+}
+
+// exited records that Start of the plugin returned
+// Internal services return once loaded and keep serving until stopped, so they are still running
+func (h *sessionHealth) exited(id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch {
+	case h.stopping:
+		h.states[id] = PluginStopped
+	case isInternalPlugin(id):
+		h.states[id] = PluginRunning
+	default:
+		h.states[id] = PluginExited
+	}
+}
+
+// failed records a panic of the plugin, degraded is true after repeated failures
+func (h *sessionHealth) failed(id string, err error, degraded bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	failures, ok := h.failures[id]
+	if !ok {
+		failures = &pluginFailures{}
+		h.failures[id] = failures
+	}
+	failures.count++
+	failures.last = err.Error()
+	failures.degraded = failures.degraded || degraded
+}
+
+// recovered records that the plugin has been running long enough after failures
+func (h *sessionHealth) recovered(id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if failures, ok := h.failures[id]; ok {
+		failures.degraded = false
+	}
+}
+
+// stop records that the session is stopping, plugins exited after that are stopped
+// Start of internal services has returned, so they are stopped as well
+func (h *sessionHealth) stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stopping = true
+	for id, state := range h.states {
+		if state == PluginExited || (state == PluginRunning && isInternalPlugin(id)) {
+			h.states[id] = PluginStopped
+		}
+	}
+}
+
+func (h *sessionHealth) report() HealthReport {
+	h.lock.Lock()
+	report := HealthReport{
+		Live:     true,
+		Ready:    !h.stopping,
+		Database: h.database(),
+		Plugins:  make(map[string]PluginHealth, len(h.states)),
+	}
+	for id, state := range h.states {
+		report.Plugins[id] = PluginHealth{State: state}
+		if state == PluginStarting {
+			report.Ready = false
+		}
+	}
+	failures := make(map[string]ComponentHealth, len(h.failures))
+	for id, failure := range h.failures {
+		supervisor := ComponentHealth{
+			Status: HealthUp,
+			Detail: fmt.Sprintf("%d failure(s), last: %s", failure.count, failure.last),
+		}
+		if failure.degraded {
+			supervisor.Status = HealthDegraded
+		}
+		failures[id] = supervisor
+	}
+	h.lock.Unlock()
+
+	report.check(report.Database)
+	for id, plugin := range h.plugins {
+		components := make(map[string]ComponentHealth)
+		if reporter, ok := plugin.(PluginHealthReporter); ok {
+			for name, component := range reporter.Health() {
+				components[name] = component
+			}
+		}
+		if supervisor, ok := failures[id]; ok {
+			components[supervisorComponent] = supervisor
+		}
+		if len(components) == 0 {
+			continue
+		}
+		health := report.Plugins[id]
+		health.Components = components
+		report.Plugins[id] = health
+		for _, component := range components {
+			report.check(component)
+		}
+	}
+	return report
+}
+
+// check updates Live and Ready with the health of a component
+func (r *HealthReport) check(component ComponentHealth) {
+	if component.Status == HealthStarting || component.Status == HealthDown {
+		r.Ready = false
+	}
+	if component.Critical && component.Status == HealthDown {
+		r.Live = false
+	}
+}
+
+func (h *sessionHealth) serveHealthz(response http.ResponseWriter, _ *http.Request) {
+	report := h.report()
+	writeHealthReport(response, report, report.Live)
+}
+
+func (h *sessionHealth) serveReadyz(response http.ResponseWriter, _ *http.Request) {
+	report := h.report()
+	writeHealthReport(response, report, report.Ready)
+}
+
+func writeHealthReport(response http.ResponseWriter, report HealthReport, ok bool) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	if !ok {
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}
+	response.Write(body)
+}
@@ -0,0 +1,106 @@
+package telepathy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type healthReporter struct {
+	components map[string]ComponentHealth
+}
+
+func (r *healthReporter) ID() string                { return "reporter" }
+func (r *healthReporter) SetLogger(_ *logrus.Entry) {}
+func (r *healthReporter) Start()                    {}
+func (r *healthReporter) Stop()                     {}
+func (r *healthReporter) Health() map[string]ComponentHealth {
+	return r.components
+}
+
+func TestSessionHealth(t *testing.T) {
+	assert := assert.New(t)
+	database := ComponentHealth{Status: HealthStarting, Critical: true}
+	reporter := &healthReporter{components: map[string]ComponentHealth{
+		"conn": {Status: HealthUp, Critical: true},
+	}}
+	channels := &channelService{}
+	health := newSessionHealth(func() ComponentHealth { return database }, map[string]Plugin{"reporter": reporter, channelServiceID: channels})
+
+	check := func(live, ready bool) {
+		report := health.report()
+		assert.Equal(live, report.Live)
+		assert.Equal(ready, report.Ready)
+	}
+	check(true, false)
+	database.Status = HealthUp
+	check(true, false)
+	health.setState("reporter", PluginRunning)
+	check(true, false)
+	// Internal services keep running after Start returns
+	health.setState(channelServiceID, PluginRunning)
+	health.exited(channelServiceID)
+	check(true, true)
+	assert.Equal(PluginRunning, health.report().Plugins[channelServiceID].State)
+
+	// Degraded components do not affect the session, and non-critical ones down affect only readiness
+	reporter.components["subs"] = ComponentHealth{Status: HealthDown}
+	reporter.components["conn"] = ComponentHealth{Status: HealthDegraded, Critical: true}
+	check(true, false)
+	reporter.components["subs"] = ComponentHealth{Status: HealthDegraded}
+	check(true, true)
+
+	health.exited("reporter")
+	check(true, true)
+	assert.Equal(PluginExited, health.report().Plugins["reporter"].State)
+
+	reporter.components["conn"] = ComponentHealth{Status: HealthDown, Critical: true}
+	check(false, false)
+	reporter.components["conn"] = ComponentHealth{Status: HealthUp, Critical: true}
+	database.Status = HealthDown
+	check(false, false)
+
+	database.Status = HealthUp
+	health.stop()
+	check(true, false)
+	assert.Equal(PluginStopped, health.report().Plugins["reporter"].State)
+	assert.Equal(PluginStopped, health.report().Plugins[channelServiceID].State)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	database := ComponentHealth{Status: HealthUp, Critical: true}
+	health := newSessionHealth(func() ComponentHealth { return database }, map[string]Plugin{"reporter": &healthReporter{}})
+	server, err := newWebServer("http://localhost", "8080")
+	assert.NoError(err)
+	server.health = health
+	server.finalize()
+
+	get := func(path string) (int, HealthReport) {
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		report := HealthReport{}
+		assert.Equal("application/json", recorder.Header().Get("Content-Type"))
+		assert.NoError(json.Unmarshal(recorder.Body.Bytes(), &report))
+		return recorder.Code, report
+	}
+
+	code, report := get(healthzPath)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(PluginStarting, report.Plugins["reporter"].State)
+	code, _ = get(readyzPath)
+	assert.Equal(http.StatusServiceUnavailable, code)
+
+	health.setState("reporter", PluginRunning)
+	code, _ = get(readyzPath)
+	assert.Equal(http.StatusOK, code)
+
+	database.Status = HealthDown
+	code, report = get(healthzPath)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(HealthDown, report.Database.Status)
+}
@@ -2,9 +2,11 @@ package telepathy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,8 +20,39 @@ type HTTPHandler func(http.ResponseWriter, *http.Request)
 
 type httpServer struct {
 	http.Server
-	uRL         *url.URL
-	webhookList map[string]HTTPHandler
+	uRL          *url.URL
+	webhookList  map[string]HTTPHandler
+	metrics      *Metrics
+	requests     *Counter
+	health       *sessionHealth
+	adminToken   string
+	adminList    map[string]HTTPHandler
+	metricsToken string // Bearer token required to scrape metrics, none if empty
+}
+
+// statusRecorder records the status code written by webhook handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (server *httpServer) setMetrics(m *Metrics) {
+	server.metrics = m
+	server.requests = m.Counter("webhook_requests_total", "Webhook requests by response status code", "webhook", "status")
 }
 
 func (server *httpServer) registerWebhook(pattern string, handler HTTPHandler) (*url.URL, error) {
@@ -44,14 +77,60 @@ func (server *httpServer) registerWebhook(pattern string, handler HTTPHandler) (
 	return retURL, nil
 }
 
+// registerAdmin registers an admin endpoint at /admin/<pattern>
+// Admin endpoints are served only if the admin token is set
+func (server *httpServer) registerAdmin(pattern string, handler HTTPHandler) error {
+	if !validHook.MatchString(pattern) {
+		return fmt.Errorf("Pattern: %s is invalid", pattern)
+	}
+	if server.adminList == nil {
+		server.adminList = make(map[string]HTTPHandler)
+	}
+	if _, ok := server.adminList[pattern]; ok {
+		return fmt.Errorf("Pattern: %s has been registered", pattern)
+	}
+	server.adminList[pattern] = handler
+	return nil
+}
+
 func (server *httpServer) serveMux() *http.ServeMux {
 	mux := http.ServeMux{}
 	for pattern, handler := range server.webhookList {
-		mux.HandleFunc(webhookRoot+pattern, handler)
+		mux.HandleFunc(webhookRoot+pattern, server.countRequests(pattern, handler))
+	}
+	if server.health != nil {
+		mux.HandleFunc(healthzPath, server.health.serveHealthz)
+		mux.HandleFunc(readyzPath, server.health.serveReadyz)
+	}
+	if server.metrics != nil {
+		if server.metricsToken != "" {
+			mux.HandleFunc(metricsPath, requireAdmin(server.metricsToken, server.metrics.ServeHTTP))
+		} else {
+			mux.HandleFunc(metricsPath, server.metrics.ServeHTTP)
+		}
+	}
+	if server.adminToken != "" {
+		for pattern, handler := range server.adminList {
+			mux.HandleFunc(adminRoot+pattern, requireAdmin(server.adminToken, handler))
+		}
 	}
 	return &mux
 }
 
+func (server *httpServer) countRequests(pattern string, handler HTTPHandler) HTTPHandler {
+	if server.requests == nil {
+		return handler
+	}
+	return func(response http.ResponseWriter, request *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: response}
+		handler(recorder, request)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		server.requests.Inc(pattern, strconv.Itoa(recorder.status))
+	}
+}
+
 func newWebServer(urlstr string, port string) (*httpServer, error) {
 	server := httpServer{}
 	var err error
@@ -73,6 +152,17 @@ func (server *httpServer) finalize() {
 	server.Handler = mux
 }
 
+// start listens on the port and serves requests in background
+// Requests are accepted once start returns
+func (server *httpServer) start() error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(listener)
+	return nil
+}
+
 func (server *httpServer) webhookURL() *url.URL {
 	copyURL, _ := url.Parse(server.uRL.String())
 	copyURL.Path = webhookRoot
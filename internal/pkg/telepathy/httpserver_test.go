@@ -53,7 +53,7 @@ func TestWebhookTrigger(t *testing.T) {
 	assert.NoError(err)
 
 	server.finalize()
-	go server.ListenAndServe()
+	assert.NoError(server.start())
 
 	resp, err := http.Post(url.String(), "text/plain", strings.NewReader("test"))
 	assert.NoError(err)
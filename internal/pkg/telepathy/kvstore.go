@@ -0,0 +1,175 @@
+package telepathy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kvCollectionPrefix = "kv."
+	kvReqLen           = 5
+)
+
+// ErrKeyNotFound is returned by KVStore.Get if the key does not exist or has expired
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKVStoreClosed is returned by KVStore operations after the session is terminated
+var ErrKVStoreClosed = errors.New("kv store closed")
+
+// KVStore is a key-value store namespaced for a plugin
+// Every operation is persisted to the database immediately
+// Values are serialized with encoding/json, and decoded into the type provided by the caller
+type KVStore struct {
+	collection string
+	reqCh      chan DatabaseRequest
+	lock       sync.RWMutex
+	closed     bool
+}
+
+// kvEntry is the document stored in database for each key
+type kvEntry struct {
+	Value    string // JSON encoded value
+	ExpireAt int64  // Unix time in nano seconds, 0 if the entry never expires
+}
+
+func newKVStore(namespace string) *KVStore {
+	return &KVStore{
+		collection: kvCollectionPrefix + namespace,
+		reqCh:      make(chan DatabaseRequest, kvReqLen),
+	}
+}
+
+func (e kvEntry) expired(now time.Time) bool {
+	return e.ExpireAt != 0 && now.UnixNano() >= e.ExpireAt
+}
+
+func (kv *KVStore) close() {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.closed = true
+	close(kv.reqCh)
+}
+
+// do runs action as a DatabaseRequest and waits for its return value
+func (kv *KVStore) do(ctx context.Context, action func(context.Context, Database) interface{}) (interface{}, error) {
+	retCh := make(chan interface{}, 1)
+	kv.lock.RLock()
+	if kv.closed {
+		kv.lock.RUnlock()
+		return nil, ErrKVStoreClosed
+	}
+	select {
+	case kv.reqCh <- DatabaseRequest{Action: action, Return: retCh}:
+		kv.lock.RUnlock()
+	case <-ctx.Done():
+		kv.lock.RUnlock()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case ret := <-retCh:
+		if err, ok := ret.(error); ok {
+			return nil, err
+		}
+		return ret, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Get reads the value of key into value, which should be a pointer
+// ErrKeyNotFound is returned if the key does not exist or has expired
+func (kv *KVStore) Get(ctx context.Context, key string, value interface{}) error {
+	ret, err := kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		entry := kvEntry{}
+		err := db.Load(ctx, kv.collection, key, &entry)
+		if err == ErrDocumentNotFound {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if entry.expired(time.Now()) {
+			if err := db.Delete(ctx, kv.collection, key); err != nil {
+				return err
+			}
+			return ErrKeyNotFound
+		}
+		return entry.Value
+	})
+	if err != nil {
+		return err
+	}
+	encoded, _ := ret.(string)
+	return json.Unmarshal([]byte(encoded), value)
+}
+
+// Put stores value as the value of key, the key never expires
+func (kv *KVStore) Put(ctx context.Context, key string, value interface{}) error {
+	return kv.PutWithTTL(ctx, key, value, 0)
+}
+
+// PutWithTTL stores value as the value of key
+// The key expires after ttl, if ttl <= 0, the key never expires
+func (kv *KVStore) PutWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	entry := kvEntry{Value: string(encoded)}
+	if ttl > 0 {
+		entry.ExpireAt = time.Now().Add(ttl).UnixNano()
+	}
+	_, err = kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		return db.Store(ctx, kv.collection, key, entry)
+	})
+	return err
+}
+
+// Delete removes key from the store
+// Deleting a key that does not exist is not an error
+func (kv *KVStore) Delete(ctx context.Context, key string) error {
+	_, err := kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		return db.Delete(ctx, kv.collection, key)
+	})
+	return err
+}
+
+// List returns all unexpired keys starting with prefix
+// Expired keys found during listing are removed
+func (kv *KVStore) List(ctx context.Context, prefix string) ([]string, error) {
+	ret, err := kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		keys, err := db.Keys(ctx, kv.collection)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		list := []string{}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entry := kvEntry{}
+			if err := db.Load(ctx, kv.collection, key, &entry); err != nil {
+				return err
+			}
+			if entry.expired(now) {
+				if err := db.Delete(ctx, kv.collection, key); err != nil {
+					return err
+				}
+				continue
+			}
+			list = append(list, key)
+		}
+		return list
+	})
+	if err != nil {
+		return nil, err
+	}
+	list, _ := ret.([]string)
+	return list, nil
+}
@@ -0,0 +1,115 @@
+package telepathy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type kvTestValue struct {
+	Name  string
+	Count int
+}
+
+func startTestKVStore(backend databaseBackend) (*KVStore, chan interface{}) {
+	handler := newDatabaseHandler(backend)
+	store := newKVStore("test")
+	handler.attachRequester(store.collection, store.reqCh)
+	done := make(chan interface{})
+	go func() {
+		handler.start(context.Background())
+		close(done)
+	}()
+	return store, done
+}
+
+func TestKVStoreGetPut(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+
+	value := kvTestValue{Name: "name", Count: 3}
+	assert.NoError(store.Put(ctx, "key", value))
+
+	get := kvTestValue{}
+	assert.NoError(store.Get(ctx, "key", &get))
+	assert.Equal(value, get)
+
+	assert.Equal(ErrKeyNotFound, store.Get(ctx, "not-exist", &get))
+
+	assert.NoError(store.Delete(ctx, "key"))
+	assert.Equal(ErrKeyNotFound, store.Get(ctx, "key", &get))
+
+	store.close()
+	<-done
+	assert.Equal(ErrKVStoreClosed, store.Put(ctx, "key", value))
+}
+
+func TestKVStoreList(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+
+	assert.NoError(store.Put(ctx, "a/1", 1))
+	assert.NoError(store.Put(ctx, "a/2", 2))
+	assert.NoError(store.Put(ctx, "b/1", 3))
+
+	keys, err := store.List(ctx, "a/")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"a/1", "a/2"}, keys)
+
+	keys, err = store.List(ctx, "")
+	assert.NoError(err)
+	assert.Len(keys, 3)
+
+	store.close()
+	<-done
+}
+
+func TestKVStoreTTL(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+
+	assert.NoError(store.PutWithTTL(ctx, "short", "value", 100*time.Millisecond))
+	assert.NoError(store.PutWithTTL(ctx, "long", "value", time.Hour))
+
+	var get string
+	assert.NoError(store.Get(ctx, "short", &get))
+	assert.Equal("value", get)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(ErrKeyNotFound, store.Get(ctx, "short", &get))
+	keys, err := store.List(ctx, "")
+	assert.NoError(err)
+	assert.Equal([]string{"long"}, keys)
+
+	store.close()
+	<-done
+}
+
+func TestKVStoreNamespace(t *testing.T) {
+	assert := assert.New(t)
+	backend := newMemoryDB()
+	handler := newDatabaseHandler(backend)
+	storeA := newKVStore("A")
+	storeB := newKVStore("B")
+	handler.attachRequester(storeA.collection, storeA.reqCh)
+	handler.attachRequester(storeB.collection, storeB.reqCh)
+	done := make(chan interface{})
+	go func() {
+		handler.start(context.Background())
+		close(done)
+	}()
+	ctx := context.Background()
+
+	assert.NoError(storeA.Put(ctx, "key", "A"))
+	var get string
+	assert.Equal(ErrKeyNotFound, storeB.Get(ctx, "key", &get))
+
+	storeA.close()
+	storeB.close()
+	<-done
+}
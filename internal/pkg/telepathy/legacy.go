@@ -0,0 +1,105 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	legacyCollection    = "telepathy.legacy"
+	legacyImportTimeout = time.Minute
+)
+
+// LegacyDocument is a document stored by a plugin in MongoDB before plugins persist data with KVStore
+// The document is formatted as {"ID": ID, <Field>: <data>} in Collection
+type LegacyDocument struct {
+	Collection string
+	ID         string
+	Field      string
+}
+
+// legacyDatabase is a Database which may keep LegacyDocuments, only MongoDB was supported before KVStore
+type legacyDatabase interface {
+	Database
+	loadLegacy(ctx context.Context, doc LegacyDocument) (bson.RawValue, error)
+}
+
+// legacyRecord is stored in legacyCollection once the LegacyDocuments of a plugin are imported
+type legacyRecord struct {
+	ImportedAt int64 // Unix time in nano seconds
+}
+
+// legacyImporter imports the LegacyDocuments of a plugin into its KVStore before the plugin starts
+// The legacy documents are kept, and are not imported again once the import succeeded
+type legacyImporter struct {
+	id     string
+	plugin PluginLegacyImporter
+	kv     *KVStore
+	done   bool
+	logger *logrus.Entry
+}
+
+// run imports the legacy documents found, it is a no-op once succeeded
+func (i *legacyImporter) run() error {
+	if i == nil || i.done {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), legacyImportTimeout)
+	defer cancel()
+
+	ret, err := i.kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		legacy, ok := db.(legacyDatabase)
+		if !ok {
+			return nil
+		}
+		record := legacyRecord{}
+		err := db.Load(ctx, legacyCollection, i.id, &record)
+		if err == nil {
+			return nil
+		}
+		if err != ErrDocumentNotFound {
+			return err
+		}
+		docs := make(map[LegacyDocument]bson.RawValue)
+		for _, doc := range i.plugin.LegacyDocuments() {
+			data, err := legacy.loadLegacy(ctx, doc)
+			if errors.Is(err, ErrDocumentNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			docs[doc] = data
+		}
+		return docs
+	})
+	if err != nil {
+		return err
+	}
+	docs, ok := ret.(map[LegacyDocument]bson.RawValue)
+	if !ok {
+		i.done = true
+		return nil
+	}
+
+	for doc, data := range docs {
+		if err := i.plugin.ImportLegacy(ctx, doc, data); err != nil {
+			return err
+		}
+	}
+	_, err = i.kv.do(ctx, func(ctx context.Context, db Database) interface{} {
+		return db.Store(ctx, legacyCollection, i.id, legacyRecord{ImportedAt: time.Now().UnixNano()})
+	})
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		i.logger.Infof("%d legacy document(s) imported", len(docs))
+	}
+	i.done = true
+	return nil
+}
@@ -0,0 +1,95 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyTestDB is a memoryDB keeping legacy documents like MongoDB
+type legacyTestDB struct {
+	*memoryDB
+	docs map[LegacyDocument]bson.RawValue
+}
+
+func (db *legacyTestDB) loadLegacy(_ context.Context, doc LegacyDocument) (bson.RawValue, error) {
+	data, ok := db.docs[doc]
+	if !ok {
+		return bson.RawValue{}, ErrDocumentNotFound
+	}
+	return data, nil
+}
+
+type legacyTestPlugin struct {
+	kv       *KVStore
+	imported map[string]int32
+	err      error
+}
+
+func (p *legacyTestPlugin) AttachKVStore(kv *KVStore) {
+	p.kv = kv
+}
+
+func (p *legacyTestPlugin) LegacyDocuments() []LegacyDocument {
+	return []LegacyDocument{
+		{Collection: "test", ID: "doc", Field: "Data"},
+		{Collection: "test", ID: "missing", Field: "Data"},
+	}
+}
+
+func (p *legacyTestPlugin) ImportLegacy(ctx context.Context, doc LegacyDocument, data bson.RawValue) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.imported[doc.ID] = data.Int32()
+	return p.kv.Put(ctx, doc.ID, data.Int32())
+}
+
+func TestLegacyImport(t *testing.T) {
+	assert := assert.New(t)
+	raw, err := bson.Marshal(bson.M{"ID": "doc", "Data": int32(3)})
+	if !assert.NoError(err) {
+		return
+	}
+	db := &legacyTestDB{
+		memoryDB: newMemoryDB(),
+		docs:     map[LegacyDocument]bson.RawValue{{Collection: "test", ID: "doc", Field: "Data"}: bson.Raw(raw).Lookup("Data")},
+	}
+	store, done := startTestKVStore(db)
+	plugin := &legacyTestPlugin{kv: store, imported: make(map[string]int32), err: errors.New("failed")}
+	importer := &legacyImporter{id: "test", plugin: plugin, kv: store, logger: logrus.WithField("plugin", "test")}
+
+	// Failed imports are tried again
+	assert.Error(importer.run())
+	plugin.err = nil
+	assert.NoError(importer.run())
+	assert.Equal(map[string]int32{"doc": 3}, plugin.imported)
+	value := 0
+	assert.NoError(store.Get(context.Background(), "doc", &value))
+	assert.Equal(3, value)
+
+	// Imported only once, even in a new session
+	delete(plugin.imported, "doc")
+	importer = &legacyImporter{id: "test", plugin: plugin, kv: store, logger: importer.logger}
+	assert.NoError(importer.run())
+	assert.Empty(plugin.imported)
+
+	store.close()
+	<-done
+}
+
+func TestLegacyImportOtherDatabase(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	plugin := &legacyTestPlugin{kv: store, imported: make(map[string]int32)}
+	importer := &legacyImporter{id: "test", plugin: plugin, kv: store, logger: logrus.WithField("plugin", "test")}
+	assert.NoError(importer.run())
+	assert.Empty(plugin.imported)
+	assert.True(importer.done)
+	store.close()
+	<-done
+}
@@ -1,6 +1,8 @@
 package telepathy
 
-import "gitlab.com/kavenc/telepathy/internal/pkg/imgur"
+import (
+	"regexp"
+)
 
 // MsgrUserProfile holds the information of a messenger user
 type MsgrUserProfile struct {
@@ -8,21 +10,71 @@ type MsgrUserProfile struct {
 	DisplayName string
 }
 
+// InboundEvent is the kind of event an InboundMessage notifies
+type InboundEvent string
+
+// Supported inbound events
+const (
+	EventNewMessage      InboundEvent = ""                 // A new message is posted
+	EventMessageEdited   InboundEvent = "edited"           // Message MessageID is edited, Text is the new content
+	EventMessageDeleted  InboundEvent = "deleted"          // Message MessageID is deleted, the content is not available
+	EventReactionAdded   InboundEvent = "reaction_added"   // Reaction is added to message MessageID by SourceProfile
+	EventReactionRemoved InboundEvent = "reaction_removed" // Reaction is removed from message MessageID by SourceProfile
+	EventBotJoined       InboundEvent = "bot_joined"       // Bot is added to FromChannel
+	EventBotLeft         InboundEvent = "bot_left"         // Bot is removed from FromChannel, or FromChannel is deleted
+	EventUserJoined      InboundEvent = "user_joined"      // SourceProfile joined FromChannel
+	EventUserLeft        InboundEvent = "user_left"        // SourceProfile left FromChannel
+)
+
+// Reaction is an emoji reaction to a message
+type Reaction struct {
+	Emoji string // Unicode emoji, empty if the messenger only provides the name
+	Name  string // Short name or custom emoji name without colons, empty if the messenger only provides Emoji
+}
+
+// String returns the emoji, or the name in :name: form if the emoji is not available
+func (r Reaction) String() string {
+	if r.Emoji != "" {
+		return r.Emoji
+	}
+	return ":" + r.Name + ":"
+}
+
 // InboundMessage models a message send to Telepthy bot
 type InboundMessage struct {
+	Event           InboundEvent
+	MessageID       string // ID of the message on the messenger, empty if not supported
 	FromChannel     Channel
-	SourceProfile   *MsgrUserProfile
+	SourceProfile   *MsgrUserProfile // May be nil for EventMessageDeleted and bot membership events
 	Text            string
+	RichText        RichText // Formatting parsed from Text, nil if the messenger does not support formatting
 	IsDirectMessage bool
-	Image           *imgur.Image
+	BotMention      string // Mention of the bot which Text starts with, set if the message is addressed to the bot
+	Attachments     []Attachment
+	Reaction        *Reaction // Reaction of EventReactionAdded and EventReactionRemoved
 }
 
+// OutboundAction is the operation requested by an OutboundMessage
+type OutboundAction string
+
+// Supported outbound actions
+// Messengers not supporting an action report ErrNotSupported
+const (
+	ActionSend   OutboundAction = ""       // Send a new message
+	ActionEdit   OutboundAction = "edit"   // Replace the content of message MessageID with Text
+	ActionDelete OutboundAction = "delete" // Delete message MessageID
+)
+
 // OutboundMessage models a message send to user (through messenger)
 type OutboundMessage struct {
-	ToChannel Channel
-	AsName    string       // Sent the message as the specified user name
-	Text      string       // Message content
-	Image     *imgur.Image // Image to be sent along with the message
+	Action      OutboundAction
+	MessageID   string // Target message of ActionEdit and ActionDelete, as reported in DeliveryResult
+	ToChannel   Channel
+	AsName      string           // Sent the message as the specified user name
+	Text        string           // Message content
+	RichText    RichText         // Optional formatted content, rendered by the messenger in place of Text
+	Attachments []Attachment     // Files to be sent along with the message, if supported by the messenger
+	OnResult    DeliveryCallback // Optional, called with the delivery result of the message
 }
 
 // Reply constructs an OutboundMessage targeting to the channel where the InboundMessage came from
@@ -31,3 +83,76 @@ func (im InboundMessage) Reply() OutboundMessage {
 		ToChannel: im.FromChannel,
 	}
 }
+
+// MsgFilter defines which InboundMessages should be delivered to a consumer
+// A message is delivered only if it matches all the specified conditions
+// Unspecified (zero value) conditions match any message
+type MsgFilter struct {
+	Events            []InboundEvent            // Message is one of these events
+	MessengerIDs      []string                  // Message comes from one of these messengers
+	Channels          []Channel                 // Message comes from one of these channels
+	DirectMessageOnly bool                      // Message is a direct message
+	HasImage          bool                      // Message carries an image attachment
+	TextPattern       *regexp.Regexp            // Message text matches the pattern
+	Func              func(InboundMessage) bool // Custom condition, evaluated last
+}
+
+// Match checks whether the InboundMessage satisfies the filter
+func (f *MsgFilter) Match(msg InboundMessage) bool {
+	if len(f.Events) > 0 {
+		found := false
+		for _, event := range f.Events {
+			if event == msg.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.MessengerIDs) > 0 {
+		found := false
+		for _, id := range f.MessengerIDs {
+			if id == msg.FromChannel.MessengerID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Channels) > 0 {
+		found := false
+		for _, ch := range f.Channels {
+			if ch == msg.FromChannel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.DirectMessageOnly && !msg.IsDirectMessage {
+		return false
+	}
+
+	if f.HasImage && !hasAttachment(msg.Attachments, AttachmentImage) {
+		return false
+	}
+
+	if f.TextPattern != nil && !f.TextPattern.MatchString(msg.Text) {
+		return false
+	}
+
+	if f.Func != nil && !f.Func(msg) {
+		return false
+	}
+
+	return true
+}
@@ -1,6 +1,7 @@
 package telepathy_test
 
 import (
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,3 +19,57 @@ func TestMessageReply(t *testing.T) {
 	outMsg := msg.Reply()
 	assert.Equal(t, from, outMsg.ToChannel)
 }
+
+func TestMsgFilter(t *testing.T) {
+	assert := assert.New(t)
+	from := telepathy.Channel{
+		MessengerID: "msg",
+		ChannelID:   "ch",
+	}
+	msg := telepathy.InboundMessage{FromChannel: from, Text: "hello world"}
+
+	filter := telepathy.MsgFilter{}
+	assert.True(filter.Match(msg))
+
+	filter = telepathy.MsgFilter{MessengerIDs: []string{"other", "msg"}}
+	assert.True(filter.Match(msg))
+	filter = telepathy.MsgFilter{MessengerIDs: []string{"other"}}
+	assert.False(filter.Match(msg))
+
+	filter = telepathy.MsgFilter{Channels: []telepathy.Channel{from}}
+	assert.True(filter.Match(msg))
+	filter = telepathy.MsgFilter{Channels: []telepathy.Channel{{MessengerID: "msg", ChannelID: "other"}}}
+	assert.False(filter.Match(msg))
+
+	filter = telepathy.MsgFilter{Events: []telepathy.InboundEvent{telepathy.EventNewMessage}}
+	assert.True(filter.Match(msg))
+	editedMsg := msg
+	editedMsg.Event = telepathy.EventMessageEdited
+	assert.False(filter.Match(editedMsg))
+
+	filter = telepathy.MsgFilter{DirectMessageOnly: true}
+	assert.False(filter.Match(msg))
+	filter = telepathy.MsgFilter{HasImage: true}
+	assert.False(filter.Match(msg))
+	imgMsg := msg
+	imgMsg.Attachments = []telepathy.Attachment{telepathy.NewAttachment("image.png", "", nil)}
+	assert.True(filter.Match(imgMsg))
+
+	filter = telepathy.MsgFilter{TextPattern: regexp.MustCompile("^hello")}
+	assert.True(filter.Match(msg))
+	filter = telepathy.MsgFilter{TextPattern: regexp.MustCompile("^world")}
+	assert.False(filter.Match(msg))
+
+	filter = telepathy.MsgFilter{
+		MessengerIDs: []string{"msg"},
+		Func:         func(telepathy.InboundMessage) bool { return false },
+	}
+	assert.False(filter.Match(msg))
+}
+
+func TestReactionString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("👍", telepathy.Reaction{Emoji: "👍"}.String())
+	assert.Equal("👍", telepathy.Reaction{Emoji: "👍", Name: "thumbsup"}.String())
+	assert.Equal(":thumbsup:", telepathy.Reaction{Name: "thumbsup"}.String())
+}
@@ -0,0 +1,191 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath         = "/metrics"
+	metricsPrefix       = "telepathy_"
+	pluginMetricsPrefix = metricsPrefix + "plugin_"
+)
+
+// DefaultBuckets are the histogram buckets for latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Metrics registers metrics exposed on /metrics of the web server in Prometheus text format
+// Registering a metric with an existing name returns the existing metric,
+// it panics if the type or labels differ, or the name is invalid
+// Methods of a nil *Metrics return nil metrics, which ignore all updates
+type Metrics struct {
+	registry *prometheus.Registry
+	prefix   string
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		registry: prometheus.NewRegistry(),
+		prefix:   metricsPrefix,
+	}
+}
+
+// forPlugin returns Metrics which registers metrics named telepathy_plugin_<plugin id>_<name>
+func (m *Metrics) forPlugin(id string) *Metrics {
+	if m == nil {
+		return nil
+	}
+	return &Metrics{
+		registry: m.registry,
+		prefix:   pluginMetricsPrefix + invalidNameChars.ReplaceAllString(id, "_") + "_",
+	}
+}
+
+// register registers collector, or returns the collector registered with the same name
+func (m *Metrics) register(collector prometheus.Collector) prometheus.Collector {
+	err := m.registry.Register(collector)
+	if err == nil {
+		return collector
+	}
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		return registered.ExistingCollector
+	}
+	panic(fmt.Sprintf("register metric failed: %s", err.Error()))
+}
+
+// Counter registers a counter, labels are the names of the labels
+func (m *Metrics) Counter(name, help string, labels ...string) *Counter {
+	if m == nil {
+		return nil
+	}
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: m.prefix + name, Help: help}, labels)
+	registered, ok := m.register(vec).(*prometheus.CounterVec)
+	if !ok {
+		panic(fmt.Sprintf("metric registered with different type: %s", m.prefix+name))
+	}
+	// Metrics without labels are exposed before updated
+	if len(labels) == 0 {
+		registered.WithLabelValues()
+	}
+	return &Counter{vec: registered}
+}
+
+// Gauge registers a gauge, labels are the names of the labels
+func (m *Metrics) Gauge(name, help string, labels ...string) *Gauge {
+	if m == nil {
+		return nil
+	}
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: m.prefix + name, Help: help}, labels)
+	registered, ok := m.register(vec).(*prometheus.GaugeVec)
+	if !ok {
+		panic(fmt.Sprintf("metric registered with different type: %s", m.prefix+name))
+	}
+	if len(labels) == 0 {
+		registered.WithLabelValues()
+	}
+	return &Gauge{vec: registered}
+}
+
+// GaugeFunc registers a gauge without labels, whose value is read with value when scraped
+func (m *Metrics) GaugeFunc(name, help string, value func() float64) {
+	if m == nil {
+		return
+	}
+	m.register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: m.prefix + name, Help: help}, value))
+}
+
+// Histogram registers a histogram with the upper bounds of buckets in ascending order,
+// labels are the names of the labels
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if m == nil {
+		return nil
+	}
+	// The bucket label is checked only when a series is created
+	for _, label := range labels {
+		if label == "le" {
+			panic(fmt.Sprintf("invalid label name of %s: %s", m.prefix+name, label))
+		}
+	}
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: m.prefix + name, Help: help, Buckets: buckets}, labels)
+	registered, ok := m.register(vec).(*prometheus.HistogramVec)
+	if !ok {
+		panic(fmt.Sprintf("metric registered with different type: %s", m.prefix+name))
+	}
+	if len(labels) == 0 {
+		registered.WithLabelValues()
+	}
+	return &Histogram{vec: registered}
+}
+
+// registerRuntime registers the metrics of the Go runtime and the process
+func (m *Metrics) registerRuntime() {
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// ServeHTTP writes all metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(response, request)
+}
+
+// Counter is a metric which only increases
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+// Inc increases the counter of labelValues by 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter of labelValues by delta, negative delta is ignored
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if c == nil || delta < 0 {
+		return
+	}
+	c.vec.WithLabelValues(labelValues...).Add(delta)
+}
+
+// Gauge is a metric which can go up and down
+type Gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+// Set sets the gauge of labelValues to value
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.vec.WithLabelValues(labelValues...).Set(value)
+}
+
+// Add adds delta to the gauge of labelValues
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.vec.WithLabelValues(labelValues...).Add(delta)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// Observe adds an observation of labelValues
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.vec.WithLabelValues(labelValues...).Observe(value)
+}
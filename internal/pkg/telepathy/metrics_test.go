@@ -0,0 +1,125 @@
+package telepathy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(m *Metrics) string {
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	return recorder.Body.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	assert := assert.New(t)
+	m := newMetrics()
+
+	counter := m.Counter("msgs_total", "Messages\nreceived", "messenger")
+	counter.Inc("a")
+	counter.Add(2, "b\"")
+	counter.Add(-1, "a")
+	m.Gauge("queue", "Queue length").Set(3)
+	m.GaugeFunc("func", "Read on scrape", func() float64 { return 1.5 })
+	histogram := m.Histogram("latency_seconds", "Latency", []float64{0.1, 1}, "command")
+	histogram.Observe(0.05, "ping")
+	histogram.Observe(0.5, "ping")
+	histogram.Observe(5, "ping")
+
+	assert.Equal(`# HELP telepathy_func Read on scrape
+# TYPE telepathy_func gauge
+telepathy_func 1.5
+# HELP telepathy_latency_seconds Latency
+# TYPE telepathy_latency_seconds histogram
+telepathy_latency_seconds_bucket{command="ping",le="0.1"} 1
+telepathy_latency_seconds_bucket{command="ping",le="1"} 2
+telepathy_latency_seconds_bucket{command="ping",le="+Inf"} 3
+telepathy_latency_seconds_sum{command="ping"} 5.55
+telepathy_latency_seconds_count{command="ping"} 3
+# HELP telepathy_msgs_total Messages\nreceived
+# TYPE telepathy_msgs_total counter
+telepathy_msgs_total{messenger="a"} 1
+telepathy_msgs_total{messenger="b\""} 2
+# HELP telepathy_queue Queue length
+# TYPE telepathy_queue gauge
+telepathy_queue 3
+`, scrape(m))
+}
+
+func TestMetricsRegister(t *testing.T) {
+	assert := assert.New(t)
+	m := newMetrics()
+
+	counter := m.Counter("total", "", "label")
+	assert.True(counter.vec == m.Counter("total", "", "label").vec)
+	assert.Panics(func() { m.Gauge("total", "", "label") })
+	assert.Panics(func() { m.Counter("total", "", "other") })
+	assert.Panics(func() { m.Counter("invalid-name", "") })
+	assert.Panics(func() { m.Histogram("hist", "", DefaultBuckets, "le") })
+	assert.Panics(func() { counter.Inc() })
+
+	plugin := m.forPlugin("twitch.tv")
+	plugin.Counter("total", "Plugin total").Inc()
+	assert.Contains(scrape(m), "telepathy_plugin_twitch_tv_total 1\n")
+}
+
+func TestMetricsNil(t *testing.T) {
+	assert := assert.New(t)
+	var m *Metrics
+
+	assert.NotPanics(func() {
+		m.forPlugin("plugin").Counter("total", "").Inc()
+		m.Gauge("gauge", "").Set(1)
+		m.GaugeFunc("func", "", func() float64 { return 0 })
+		m.Histogram("hist", "", DefaultBuckets).Observe(1)
+	})
+}
+
+func TestWebhookMetrics(t *testing.T) {
+	assert := assert.New(t)
+	server, err := newWebServer("http://localhost", "8080")
+	assert.NoError(err)
+	server.setMetrics(newMetrics())
+
+	_, err = server.registerWebhook("ok-hook", func(http.ResponseWriter, *http.Request) {})
+	assert.NoError(err)
+	_, err = server.registerWebhook("bad-hook", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	assert.NoError(err)
+	server.finalize()
+
+	for _, hook := range []string{"ok-hook", "ok-hook", "bad-hook"} {
+		server.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, webhookRoot+hook, nil))
+	}
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.True(strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(recorder.Body.String(), `telepathy_webhook_requests_total{status="200",webhook="ok-hook"} 2`)
+	assert.Contains(recorder.Body.String(), `telepathy_webhook_requests_total{status="400",webhook="bad-hook"} 1`)
+}
+
+func TestMetricsToken(t *testing.T) {
+	assert := assert.New(t)
+	server, err := newWebServer("http://localhost", "8080")
+	assert.NoError(err)
+	server.setMetrics(newMetrics())
+	server.metricsToken = "token"
+	server.finalize()
+
+	// Metrics are served with the metrics token only, if set
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	request.Header.Set("Authorization", "Bearer token")
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(http.StatusOK, recorder.Code)
+}
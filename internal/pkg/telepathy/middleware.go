@@ -0,0 +1,97 @@
+package telepathy
+
+import (
+	"sort"
+)
+
+// InboundHandler processes an InboundMessage passing through the router
+// The returned messages replace the input message in the pipeline:
+// return the (modified) message to pass it on, nil to drop it,
+// or multiple messages to fan it out
+// If Text is changed but RichText is not, RichText is dropped so that messengers send the changed Text
+type InboundHandler func(InboundMessage) []InboundMessage
+
+// OutboundHandler processes an OutboundMessage passing through the router
+// The returned messages follow the same rules as InboundHandler
+type OutboundHandler func(OutboundMessage) []OutboundMessage
+
+type inboundMiddleware struct {
+	id      string
+	order   int
+	handler InboundHandler
+}
+
+type outboundMiddleware struct {
+	id      string
+	order   int
+	handler OutboundHandler
+}
+
+type inboundChain []inboundMiddleware
+type outboundChain []outboundMiddleware
+
+// sort orders the chain by ascending order, ties are broken by id
+func (c inboundChain) sort() {
+	sort.SliceStable(c, func(i, j int) bool {
+		if c[i].order != c[j].order {
+			return c[i].order < c[j].order
+		}
+		return c[i].id < c[j].id
+	})
+}
+
+func (c outboundChain) sort() {
+	sort.SliceStable(c, func(i, j int) bool {
+		if c[i].order != c[j].order {
+			return c[i].order < c[j].order
+		}
+		return c[i].id < c[j].id
+	})
+}
+
+// sameRichText checks whether b is a, not only equal in content
+func sameRichText(a, b RichText) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// process passes msg through the chain
+// Each message produced by a middleware is handled by the next middleware separately
+func (c inboundChain) process(msg InboundMessage) []InboundMessage {
+	msgs := []InboundMessage{msg}
+	for _, m := range c {
+		next := []InboundMessage{}
+		for _, msg := range msgs {
+			for _, out := range m.handler(msg) {
+				if out.Text != msg.Text && sameRichText(out.RichText, msg.RichText) {
+					out.RichText = nil
+				}
+				next = append(next, out)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		msgs = next
+	}
+	return msgs
+}
+
+func (c outboundChain) process(msg OutboundMessage) []OutboundMessage {
+	msgs := []OutboundMessage{msg}
+	for _, m := range c {
+		next := []OutboundMessage{}
+		for _, msg := range msgs {
+			for _, out := range m.handler(msg) {
+				if out.Text != msg.Text && sameRichText(out.RichText, msg.RichText) {
+					out.RichText = nil
+				}
+				next = append(next, out)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		msgs = next
+	}
+	return msgs
+}
@@ -0,0 +1,103 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gitlab.com/kavenc/argo"
+)
+
+const (
+	cmdPageLen     = 1800 // Max characters of a page of long command outputs
+	cmdPageMax     = 1900 // Outputs longer than this are paginated, the rest is left for the hint of pages
+	cmdPageTimeout = 10 * time.Minute
+	cmdMoreTrigger = "more"
+)
+
+type pendingPages struct {
+	pages  []string
+	expire time.Time
+}
+
+// pager keeps the remaining pages of the last long command output in each channel
+type pager struct {
+	lock    sync.Mutex
+	pending map[Channel]pendingPages
+	now     func() time.Time
+}
+
+func newPager() *pager {
+	return &pager{
+		pending: make(map[Channel]pendingPages),
+		now:     time.Now,
+	}
+}
+
+// paginate returns the first page of text, and keeps the rest to be shown with the more command
+// text is returned as is if it is short enough
+func (p *pager) paginate(channel Channel, text, prefix string) string {
+	if utf8.RuneCountInString(text) <= cmdPageMax {
+		return text
+	}
+	pages := splitText(text, cmdPageLen)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	for channel, pending := range p.pending {
+		if !pending.expire.After(now) {
+			delete(p.pending, channel)
+		}
+	}
+	p.pending[channel] = pendingPages{pages: pages[1:], expire: now.Add(cmdPageTimeout)}
+	return pages[0] + pageHint(len(pages)-1, prefix)
+}
+
+// next returns the next page of the last long output in channel
+func (p *pager) next(channel Channel, prefix string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pending, ok := p.pending[channel]
+	if !ok || !pending.expire.After(p.now()) {
+		delete(p.pending, channel)
+		return "", false
+	}
+	page, rest := pending.pages[0], pending.pages[1:]
+	if len(rest) == 0 {
+		delete(p.pending, channel)
+		return page, true
+	}
+	p.pending[channel] = pendingPages{pages: rest, expire: pending.expire}
+	return page + pageHint(len(rest), prefix), true
+}
+
+func pageHint(rest int, prefix string) string {
+	return fmt.Sprintf("\n(%d more page(s), send \"%s %s\" to continue)", rest, prefix, cmdMoreTrigger)
+}
+
+// moreCommand shows the remaining pages of long command outputs
+// It is attached as a top level command by Session
+func (m *cmdManager) moreCommand() *argo.Action {
+	return &argo.Action{
+		Trigger:    cmdMoreTrigger,
+		ShortDescr: "Show the next page of the last long output in current channel",
+		Do:         m.cmdMore,
+	}
+}
+
+func (m *cmdManager) cmdMore(state *argo.State, extras ...interface{}) error {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		m.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return errors.New("failed to parse extraArgs")
+	}
+	page, ok := m.pager.next(extraArgs.Message.FromChannel, extraArgs.Prefix)
+	if !ok {
+		state.OutputStr.WriteString("No more pages.")
+		return nil
+	}
+	state.OutputStr.WriteString(page)
+	return nil
+}
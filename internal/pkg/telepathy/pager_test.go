@@ -0,0 +1,70 @@
+package telepathy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPager(t *testing.T) {
+	assert := assert.New(t)
+	p := newPager()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+
+	assert.Equal("short", p.paginate(ch, "short", "teru"))
+	_, ok := p.next(ch, "teru")
+	assert.False(ok)
+
+	line := strings.Repeat("a", cmdPageLen-1)
+	text := strings.Join([]string{line, line, line}, "\n")
+	assert.Equal(line+"\n(2 more page(s), send \"teru more\" to continue)", p.paginate(ch, text, "teru"))
+	page, ok := p.next(ch, "!t")
+	assert.True(ok)
+	assert.Equal(line+"\n(1 more page(s), send \"!t more\" to continue)", page)
+	page, ok = p.next(ch, "teru")
+	assert.True(ok)
+	assert.Equal(line, page)
+	_, ok = p.next(ch, "teru")
+	assert.False(ok)
+
+	// Pages expire
+	p.paginate(ch, text, "teru")
+	now = now.Add(cmdPageTimeout)
+	_, ok = p.next(ch, "teru")
+	assert.False(ok)
+	assert.Empty(p.pending)
+}
+
+func TestCmdMore(t *testing.T) {
+	assert := assert.New(t)
+	cmdCh := make(chan InboundMessage)
+	cmdMgr := newCmdManager("teru", 1, time.Second, cmdCh)
+	line := strings.Repeat("a", cmdPageLen)
+	cmdMgr.attachCommandInterface("test", &argo.Action{
+		Trigger: "long",
+		Do: func(state *argo.State, extras ...interface{}) error {
+			state.OutputStr.WriteString(line + "\n" + line)
+			return nil
+		},
+	})
+	cmdMgr.attachCommandInterface("test", cmdMgr.moreCommand())
+	go cmdMgr.start(context.Background())
+
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "teru more"}
+	assert.Equal("No more pages.", (<-cmdMgr.msgOut).Text)
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "teru long"}
+	assert.Equal(line+"\n(1 more page(s), send \"teru more\" to continue)", (<-cmdMgr.msgOut).Text)
+	cmdCh <- InboundMessage{FromChannel: ch, Text: "teru more"}
+	assert.Equal(line, (<-cmdMgr.msgOut).Text)
+
+	close(cmdCh)
+	<-cmdMgr.done
+}
@@ -0,0 +1,401 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/kavenc/argo"
+)
+
+const (
+	permissionServiceID = "telepathy.permission"
+
+	// Users of messengers which can not resolve roles are not trusted unless configured,
+	// they still run admin commands in their direct messages
+	defaultUnresolvedRole = RoleUser
+)
+
+// Role is the permission level of a user running commands
+type Role int
+
+// Roles in ascending order of permission
+const (
+	RoleUser     Role = iota // Everyone
+	RoleAdmin                // Administrator of the channel, guild or workspace, and users in direct messages
+	RoleOperator             // Operator of the bot, configured with SessionConfig.Operators
+)
+
+var roleNames = map[Role]string{
+	RoleUser:     "user",
+	RoleAdmin:    "admin",
+	RoleOperator: "operator",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole converts the name of a role to Role
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return RoleUser, fmt.Errorf("unknown role: %s", name)
+}
+
+// OperatorID returns the form of a user used in SessionConfig.Operators
+func OperatorID(messengerID, userID string) string {
+	return messengerID + channelDelimiter + userID
+}
+
+// permissions resolves the roles of users and keeps the ACL of each channel
+// ACL maps command paths (e.g. "fwd del-to") to the roles required to run them
+// ACLs are cached in memory and persisted to the KV store of permissionService,
+// keyed by channel name with aclRecord as value
+type permissions struct {
+	lock         sync.RWMutex
+	operators    map[string]bool
+	providers    map[string]PluginRoleProvider
+	defaultRoles map[string]Role // Roles of users in messengers without providers
+	acl          map[Channel]map[string]Role
+	kv           *KVStore
+	loaded       chan interface{}
+	loadOnce     sync.Once
+	logger       *logrus.Entry
+}
+
+type aclRecord struct {
+	Channel Channel
+	Rules   map[string]Role
+}
+
+func newPermissions(operators []string) *permissions {
+	p := &permissions{
+		operators:    make(map[string]bool),
+		providers:    make(map[string]PluginRoleProvider),
+		defaultRoles: make(map[string]Role),
+		acl:          make(map[Channel]map[string]Role),
+		loaded:       make(chan interface{}),
+		logger:       logrus.WithField("module", "permission"),
+	}
+	for _, operator := range operators {
+		p.operators[operator] = true
+	}
+	return p
+}
+
+func (p *permissions) attachProvider(messengerID string, provider PluginRoleProvider) {
+	p.providers[messengerID] = provider
+}
+
+// setDefaultRole sets the role of users in messengerID if the messenger can not resolve roles
+func (p *permissions) setDefaultRole(messengerID string, role Role) {
+	p.defaultRoles[messengerID] = role
+}
+
+// role resolves the role of the sender of msg
+func (p *permissions) role(ctx context.Context, msg InboundMessage) Role {
+	if msg.SourceProfile == nil {
+		return RoleUser
+	}
+	if p.operators[OperatorID(msg.FromChannel.MessengerID, msg.SourceProfile.ID)] {
+		return RoleOperator
+	}
+	// Users own their direct message channels
+	if msg.IsDirectMessage {
+		return RoleAdmin
+	}
+	provider, ok := p.providers[msg.FromChannel.MessengerID]
+	if !ok {
+		if role, ok := p.defaultRoles[msg.FromChannel.MessengerID]; ok {
+			return role
+		}
+		return defaultUnresolvedRole
+	}
+	admin, err := provider.IsChannelAdmin(ctx, msg.FromChannel, msg.SourceProfile.ID)
+	if err != nil {
+		p.logger.Warnf("failed to check admin of %s: %s", msg.FromChannel.Name(), err.Error())
+		return RoleUser
+	}
+	if admin {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
+// load reads all ACLs from kv and unblocks lookups
+// Only the first call loads, as the service calls it again when it is restarted
+func (p *permissions) load(ctx context.Context) (err error) {
+	p.loadOnce.Do(func() {
+		defer close(p.loaded)
+		err = p.loadACL(ctx)
+	})
+	return err
+}
+
+func (p *permissions) loadACL(ctx context.Context) error {
+	keys, err := p.kv.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, key := range keys {
+		record := aclRecord{}
+		if err := p.kv.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		p.acl[record.Channel] = record.Rules
+	}
+	return nil
+}
+
+// required returns the role required to run the command args in channel
+// The rule of the longest matching command path is used
+func (p *permissions) required(channel Channel, args []string) Role {
+	<-p.loaded
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	rules := p.acl[channel]
+	for i := len(args); i > 0; i-- {
+		if role, ok := rules[strings.Join(args[:i], " ")]; ok {
+			return role
+		}
+	}
+	return RoleUser
+}
+
+// setRule sets the role required to run command in channel, the rule is removed if ok is false
+func (p *permissions) setRule(ctx context.Context, channel Channel, command string, role Role, ok bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rules := make(map[string]Role)
+	for path, role := range p.acl[channel] {
+		rules[path] = role
+	}
+	if ok {
+		rules[command] = role
+	} else {
+		delete(rules, command)
+	}
+
+	var err error
+	if len(rules) == 0 {
+		err = p.kv.Delete(ctx, channel.Name())
+	} else {
+		err = p.kv.Put(ctx, channel.Name(), aclRecord{Channel: channel, Rules: rules})
+	}
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		delete(p.acl, channel)
+	} else {
+		p.acl[channel] = rules
+	}
+	return nil
+}
+
+func (p *permissions) rules(channel Channel) map[string]Role {
+	<-p.loaded
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	rules := make(map[string]Role)
+	for path, role := range p.acl[channel] {
+		rules[path] = role
+	}
+	return rules
+}
+
+// CommandEnsureRole checks if the user running the command has at least role
+func CommandEnsureRole(state *argo.State, extraArgs CmdExtraArgs, role Role) bool {
+	if extraArgs.Role < role {
+		fmt.Fprintf(&state.OutputStr, "This command requires %s permission.\n", role)
+		return false
+	}
+	return true
+}
+
+// CommandRequireRole wraps the Do function of argo.Action,
+// so that the action is only run by users with at least role
+func CommandRequireRole(role Role, do func(*argo.State, ...interface{}) error) func(*argo.State, ...interface{}) error {
+	return func(state *argo.State, extras ...interface{}) error {
+		extraArgs, ok := extras[0].(CmdExtraArgs)
+		if !ok {
+			return errors.New("failed to parse extraArgs")
+		}
+		if !CommandEnsureRole(state, extraArgs, role) {
+			return nil
+		}
+		return do(state, extras...)
+	}
+}
+
+// permissionService provides the commands to manage channel ACLs
+type permissionService struct {
+	perm   *permissions
+	logger *logrus.Entry
+}
+
+func (s *permissionService) ID() string {
+	return permissionServiceID
+}
+
+func (s *permissionService) SetLogger(logger *logrus.Entry) {
+	s.logger = logger
+}
+
+func (s *permissionService) Start() {
+	ctx, cancel := context.WithTimeout(context.Background(), settingsLoadTimeout)
+	defer cancel()
+	if err := s.perm.load(ctx); err != nil {
+		s.logger.Errorf("failed to load ACL: %s", err.Error())
+	}
+}
+
+func (s *permissionService) Stop() {
+
+}
+
+func (s *permissionService) AttachKVStore(kv *KVStore) {
+	s.perm.kv = kv
+}
+
+func (s *permissionService) Command(_ <-chan interface{}) *argo.Action {
+	cmd := &argo.Action{
+		Trigger:    "perm",
+		ShortDescr: "Command permissions of current channel",
+	}
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "set",
+		ShortDescr: "Set the role required to run a command",
+		LongDescr:  "Roles: user, admin, operator. Rules can only make commands stricter than their defaults",
+		MinConsume: 2,
+		MaxConsume: -1,
+		ArgNames:   []string{"role", "command"},
+		Do:         CommandRequireRole(RoleAdmin, s.cmdSet),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "unset",
+		ShortDescr: "Remove the rule of a command",
+		MinConsume: 1,
+		MaxConsume: -1,
+		ArgNames:   []string{"command"},
+		Do:         CommandRequireRole(RoleAdmin, s.cmdUnset),
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "list",
+		ShortDescr: "List the rules of current channel",
+		Do:         s.cmdList,
+	})
+
+	cmd.AddSubAction(argo.Action{
+		Trigger:    "whoami",
+		ShortDescr: "Show your role in current channel",
+		Do:         s.cmdWhoami,
+	})
+
+	return cmd
+}
+
+func (s *permissionService) extraArgs(extras []interface{}) (CmdExtraArgs, error) {
+	extraArgs, ok := extras[0].(CmdExtraArgs)
+	if !ok {
+		s.logger.Errorf("failed to parse extraArgs: %T", extras[0])
+		return extraArgs, errors.New("failed to parse extraArgs")
+	}
+	return extraArgs, nil
+}
+
+func (s *permissionService) cmdSet(state *argo.State, extras ...interface{}) error {
+	extraArgs, err := s.extraArgs(extras)
+	if err != nil {
+		return err
+	}
+	args := state.Args()
+	role, err := ParseRole(args[0])
+	if err != nil {
+		fmt.Fprintf(&state.OutputStr, "Invalid role: %s", args[0])
+		return nil
+	}
+	// Users can not lock themselves out
+	if role > extraArgs.Role {
+		fmt.Fprintf(&state.OutputStr, "Can not require a role higher than yours (%s)", extraArgs.Role)
+		return nil
+	}
+	command := strings.Join(args[1:], " ")
+	if err := s.perm.setRule(extraArgs.Ctx, extraArgs.Message.FromChannel, command, role, true); err != nil {
+		s.logger.Errorf("failed to store ACL: %s", err.Error())
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "\"%s\" now requires %s permission", command, role)
+	return nil
+}
+
+func (s *permissionService) cmdUnset(state *argo.State, extras ...interface{}) error {
+	extraArgs, err := s.extraArgs(extras)
+	if err != nil {
+		return err
+	}
+	channel := extraArgs.Message.FromChannel
+	command := strings.Join(state.Args(), " ")
+	role, ok := s.perm.rules(channel)[command]
+	if !ok {
+		fmt.Fprintf(&state.OutputStr, "No rule for \"%s\"", command)
+		return nil
+	}
+	if role > extraArgs.Role {
+		fmt.Fprintf(&state.OutputStr, "Can not remove a rule requiring a role higher than yours (%s)", extraArgs.Role)
+		return nil
+	}
+	if err := s.perm.setRule(extraArgs.Ctx, channel, command, role, false); err != nil {
+		s.logger.Errorf("failed to store ACL: %s", err.Error())
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "Rule of \"%s\" is removed", command)
+	return nil
+}
+
+func (s *permissionService) cmdList(state *argo.State, extras ...interface{}) error {
+	extraArgs, err := s.extraArgs(extras)
+	if err != nil {
+		return err
+	}
+	rules := s.perm.rules(extraArgs.Message.FromChannel)
+	if len(rules) == 0 {
+		state.OutputStr.WriteString("No rules in this channel.")
+		return nil
+	}
+	commands := make([]string, 0, len(rules))
+	for command := range rules {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	state.OutputStr.WriteString("Rules in this channel:")
+	for _, command := range commands {
+		fmt.Fprintf(&state.OutputStr, "\n%s: %s", command, rules[command])
+	}
+	return nil
+}
+
+func (s *permissionService) cmdWhoami(state *argo.State, extras ...interface{}) error {
+	extraArgs, err := s.extraArgs(extras)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&state.OutputStr, "Your role in this channel: %s", extraArgs.Role)
+	return nil
+}
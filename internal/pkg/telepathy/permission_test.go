@@ -0,0 +1,193 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/kavenc/argo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRoleProvider struct {
+	PluginMessenger
+	admins map[string]bool
+	err    error
+}
+
+func (p *testRoleProvider) IsChannelAdmin(_ context.Context, _ Channel, userID string) (bool, error) {
+	return p.admins[userID], p.err
+}
+
+func TestRoleString(t *testing.T) {
+	assert := assert.New(t)
+	for _, role := range []Role{RoleUser, RoleAdmin, RoleOperator} {
+		parsed, err := ParseRole(role.String())
+		assert.NoError(err)
+		assert.Equal(role, parsed)
+	}
+	_, err := ParseRole("root")
+	assert.Error(err)
+}
+
+func TestPermissionsRole(t *testing.T) {
+	assert := assert.New(t)
+	perm := newPermissions([]string{OperatorID("msg", "op")})
+	provider := &testRoleProvider{admins: map[string]bool{"admin": true}}
+	perm.attachProvider("msg", provider)
+	ctx := context.Background()
+
+	msg := func(userID string, dm bool) InboundMessage {
+		return InboundMessage{
+			FromChannel:     Channel{MessengerID: "msg", ChannelID: "ch"},
+			SourceProfile:   &MsgrUserProfile{ID: userID},
+			IsDirectMessage: dm,
+		}
+	}
+	assert.Equal(RoleOperator, perm.role(ctx, msg("op", false)))
+	assert.Equal(RoleAdmin, perm.role(ctx, msg("admin", false)))
+	assert.Equal(RoleUser, perm.role(ctx, msg("user", false)))
+	assert.Equal(RoleAdmin, perm.role(ctx, msg("user", true)))
+
+	provider.err = errors.New("api failed")
+	assert.Equal(RoleUser, perm.role(ctx, msg("admin", false)))
+
+	// Users in messengers which can not resolve roles are users unless configured
+	other := msg("op", false)
+	other.FromChannel.MessengerID = "other"
+	assert.Equal(RoleUser, perm.role(ctx, other))
+	perm.setDefaultRole("other", RoleAdmin)
+	assert.Equal(RoleAdmin, perm.role(ctx, other))
+}
+
+func TestPermissionsACL(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+	perm := newPermissions(nil)
+	perm.kv = store
+	assert.NoError(perm.load(ctx))
+
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	assert.NoError(perm.setRule(ctx, ch, "fwd", RoleAdmin, true))
+	assert.NoError(perm.setRule(ctx, ch, "fwd info", RoleUser, true))
+	assert.Equal(RoleAdmin, perm.required(ch, []string{"fwd", "del-to", "a"}))
+	assert.Equal(RoleUser, perm.required(ch, []string{"fwd", "info"}))
+	assert.Equal(RoleUser, perm.required(ch, []string{"twitch", "user"}))
+	assert.Equal(RoleUser, perm.required(Channel{MessengerID: "msg"}, []string{"fwd"}))
+
+	reloaded := newPermissions(nil)
+	reloaded.kv = store
+	assert.NoError(reloaded.load(ctx))
+	assert.Equal(map[string]Role{"fwd": RoleAdmin, "fwd info": RoleUser}, reloaded.rules(ch))
+
+	// Loading again when the service is restarted keeps the ACL
+	assert.NoError(perm.load(ctx))
+	assert.Equal(RoleAdmin, perm.required(ch, []string{"fwd", "del-to", "a"}))
+
+	assert.NoError(perm.setRule(ctx, ch, "fwd", RoleUser, false))
+	assert.NoError(perm.setRule(ctx, ch, "fwd info", RoleUser, false))
+	keys, err := store.List(ctx, "")
+	assert.NoError(err)
+	assert.Empty(keys)
+
+	store.close()
+	<-done
+}
+
+func TestCommandRequireRole(t *testing.T) {
+	assert := assert.New(t)
+	called := false
+	action := argo.Action{
+		Trigger: "cmd",
+		Do: CommandRequireRole(RoleAdmin, func(state *argo.State, extras ...interface{}) error {
+			called = true
+			return nil
+		}),
+	}
+	assert.NoError(action.Finalize())
+
+	state := argo.State{}
+	assert.NoError(action.Parse(&state, []string{"cmd"}, CmdExtraArgs{Role: RoleUser}))
+	assert.False(called)
+	assert.Equal("This command requires admin permission.\n", state.OutputStr.String())
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"cmd"}, CmdExtraArgs{Role: RoleOperator}))
+	assert.True(called)
+}
+
+func TestCmdACL(t *testing.T) {
+	assert := assert.New(t)
+	cmdCh := make(chan InboundMessage)
+	cmdMgr := newCmdManager("test", 1, time.Second, cmdCh)
+	cmdMgr.perm = newPermissions([]string{OperatorID("msg", "op")})
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	cmdMgr.perm.acl[ch] = map[string]Role{"subcmd": RoleOperator}
+	close(cmdMgr.perm.loaded)
+
+	subCmd := &argo.Action{Trigger: "subcmd"}
+	subCmd.AddSubAction(argo.Action{
+		Trigger: "act",
+		Do: func(state *argo.State, extras ...interface{}) error {
+			extraArgs, _ := extras[0].(CmdExtraArgs)
+			state.OutputStr.WriteString(extraArgs.Role.String())
+			return nil
+		},
+	})
+	cmdMgr.attachCommandInterface("test", subCmd)
+	go cmdMgr.start(context.Background())
+
+	cmdCh <- InboundMessage{FromChannel: ch, SourceProfile: &MsgrUserProfile{ID: "user"}, Text: "test subcmd act"}
+	assert.Equal("This command requires operator permission in this channel.", (<-cmdMgr.msgOut).Text)
+
+	cmdCh <- InboundMessage{FromChannel: ch, SourceProfile: &MsgrUserProfile{ID: "op"}, Text: "test subcmd act"}
+	assert.Equal("operator", (<-cmdMgr.msgOut).Text)
+
+	close(cmdCh)
+	<-cmdMgr.done
+}
+
+func TestPermissionCommand(t *testing.T) {
+	assert := assert.New(t)
+	store, done := startTestKVStore(newMemoryDB())
+	svc := &permissionService{perm: newPermissions(nil)}
+	svc.AttachKVStore(store)
+	close(svc.perm.loaded)
+
+	action := svc.Command(make(chan interface{}))
+	assert.NoError(action.Finalize())
+	ch := Channel{MessengerID: "msg", ChannelID: "ch"}
+	extArgs := CmdExtraArgs{
+		Ctx:     context.Background(),
+		Message: InboundMessage{FromChannel: ch},
+		Role:    RoleAdmin,
+	}
+
+	state := argo.State{}
+	assert.NoError(action.Parse(&state, []string{"perm", "set", "operator", "fwd"}, extArgs))
+	assert.Equal("Can not require a role higher than yours (admin)", state.OutputStr.String())
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"perm", "set", "admin", "fwd", "info"}, extArgs))
+	assert.Equal(map[string]Role{"fwd info": RoleAdmin}, svc.perm.rules(ch))
+
+	state = argo.State{}
+	assert.NoError(action.Parse(&state, []string{"perm", "list"}, extArgs))
+	assert.Equal("Rules in this channel:\nfwd info: admin", state.OutputStr.String())
+
+	state = argo.State{}
+	extArgs.Role = RoleUser
+	assert.NoError(action.Parse(&state, []string{"perm", "unset", "fwd", "info"}, extArgs))
+	assert.Equal("This command requires admin permission.\n", state.OutputStr.String())
+
+	state = argo.State{}
+	extArgs.Role = RoleAdmin
+	assert.NoError(action.Parse(&state, []string{"perm", "unset", "fwd", "info"}, extArgs))
+	assert.Empty(svc.perm.rules(ch))
+
+	store.close()
+	<-done
+}
@@ -1,8 +1,10 @@
 package telepathy
 
 import (
+	"context"
 	"net/url"
 
+	"github.com/mongodb/mongo-go-driver/bson"
 	"gitlab.com/kavenc/argo"
 
 	"github.com/sirupsen/logrus"
@@ -19,6 +21,9 @@ type Plugin interface {
 
 	// Start is the main routine of the plugin
 	// this function only returns when the plugin is terminated
+	// If Start panics, it is called again with backoff, and the plugin is wired again before that
+	// Resources acquired by Start, e.g. connections, event handlers and goroutines, should be released
+	// with defer, so that the restarted Start does not run along with the ones of the panicked Start
 	Start()
 
 	// Stop triggers termination of the plugin
@@ -34,9 +39,40 @@ type PluginMessenger interface {
 
 	// AttachOutMsgChannel is used to attach outbound message
 	// that should be sent out by the messenger plugin
+	// Edits and deletions of sent messages are requested with OutboundMessage.Action
 	AttachOutMsgChannel(<-chan OutboundMessage)
 }
 
+// PluginRoleProvider defines necessary functions if a messenger plugin can tell
+// whether a user is an administrator of a channel, or the guild/workspace of the channel
+// It is used to resolve the Role of users running commands
+type PluginRoleProvider interface {
+	PluginMessenger
+	IsChannelAdmin(ctx context.Context, channel Channel, userID string) (bool, error)
+}
+
+// PluginTextLimiter defines necessary functions if a messenger plugin limits the length of messages
+// Outbound messages longer than the limit are split into multiple messages at line boundaries
+type PluginTextLimiter interface {
+	PluginMessenger
+	MaxTextLength() int
+}
+
+// PluginTextRenderer defines necessary functions if a messenger plugin sends other than Text of messages,
+// e.g. RichText rendered in its own markup. RenderText returns the text of msg as sent by the messenger,
+// which is measured against the limit of PluginTextLimiter
+type PluginTextRenderer interface {
+	PluginMessenger
+	RenderText(msg OutboundMessage) string
+}
+
+// PluginRateLimiter defines necessary functions if a messenger plugin provides default outbound rate limits
+// The limits are applied unless the rate limits of the messenger are configured in SessionConfig
+type PluginRateLimiter interface {
+	PluginMessenger
+	DefaultRateLimits() (messenger RateLimit, channel RateLimit)
+}
+
 // PluginCommandHandler defines the necessary functions if a plugin implements command intefaces
 // The input parameter channel will be closed once the command parser is terminated
 // and no more command will be triggered
@@ -55,6 +91,13 @@ type PluginMsgConsumer interface {
 	AttachInMsgChannel(<-chan InboundMessage)
 }
 
+// PluginMsgFilteredConsumer defines necessary functions if a message consumer only handles
+// some of the inbound messages. Only messages matching the filter are delivered to the plugin
+type PluginMsgFilteredConsumer interface {
+	PluginMsgConsumer
+	MsgFilter() MsgFilter
+}
+
 // PluginMsgProducer defeins necessary functions if a plugin would send out messages
 type PluginMsgProducer interface {
 	OutMsgChannel() <-chan OutboundMessage
@@ -64,3 +107,59 @@ type PluginMsgProducer interface {
 type PluginDatabaseUser interface {
 	DBRequestChannel() <-chan DatabaseRequest
 }
+
+// PluginKVUser defines necessary functions if a plugin persists data with a key-value store
+// The KVStore is namespaced with the plugin ID, and is available until the plugin is terminated
+type PluginKVUser interface {
+	AttachKVStore(*KVStore)
+}
+
+// PluginLegacyImporter defines necessary functions if a plugin stored data in MongoDB before KVStore
+// Each of LegacyDocuments found is passed to ImportLegacy before the plugin starts, which should put the data
+// into the attached KVStore. The plugin is not started until the import succeeds, and is never imported again
+type PluginLegacyImporter interface {
+	PluginKVUser
+	LegacyDocuments() []LegacyDocument
+	ImportLegacy(ctx context.Context, doc LegacyDocument, data bson.RawValue) error
+}
+
+// PluginMetricsUser defines necessary functions if a plugin exports custom metrics on /metrics
+// Metrics registered with the attached Metrics are named telepathy_plugin_<plugin id>_<name>
+type PluginMetricsUser interface {
+	AttachMetrics(*Metrics)
+}
+
+// PluginHealthReporter defines necessary functions if a plugin reports the health of its components,
+// e.g. the connection to a messenger service, on /healthz and /readyz
+// Health is called on every request to the endpoints, and should return without blocking
+type PluginHealthReporter interface {
+	Health() map[string]ComponentHealth
+}
+
+// PluginPanicHandler defines necessary functions if a plugin runs code in goroutines other than the one calling Start,
+// e.g. event handlers called by client libraries or routines started by Start, where panics are not recovered by the session
+// The plugin should recover panics there and pass them to the attached function, which records the failure
+type PluginPanicHandler interface {
+	AttachPanicHandler(func(recovered interface{}))
+}
+
+// PluginMiddleware defines necessary functions if a plugin intercepts messages passing through the router
+// Middlewares are chained in ascending MiddlewareOrder, plugins with the same order are sorted by ID
+// A middleware plugin should implement PluginInboundMiddleware and/or PluginOutboundMiddleware
+type PluginMiddleware interface {
+	MiddlewareOrder() int
+}
+
+// PluginInboundMiddleware defines necessary functions if a plugin intercepts InboundMessages
+// before they are dispatched to the command manager and message consumers
+type PluginInboundMiddleware interface {
+	PluginMiddleware
+	InboundMiddleware(InboundMessage) []InboundMessage
+}
+
+// PluginOutboundMiddleware defines necessary functions if a plugin intercepts OutboundMessages
+// before they are dispatched to the messengers
+type PluginOutboundMiddleware interface {
+	PluginMiddleware
+	OutboundMiddleware(OutboundMessage) []OutboundMessage
+}
@@ -0,0 +1,378 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	laneQueueLen          = 100
+	defaultRateLimitPause = time.Second
+)
+
+var errLaneTerminated = errors.New("router terminated")
+
+// RateLimit defines a token bucket rate limit
+// A zero Rate means unlimited
+type RateLimit struct {
+	Rate  float64 // Tokens refilled per second
+	Burst int     // Max tokens in the bucket, which is at least 1
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if the limit is unlimited
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// readyAt returns the time when a token is available
+func (b *tokenBucket) readyAt(now time.Time) time.Time {
+	if b == nil {
+		return now
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return now
+	}
+	return now.Add(time.Duration((1 - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// take consumes a token, it should be called only if a token is ready
+func (b *tokenBucket) take(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.tokens--
+}
+
+// full checks whether the bucket is refilled completely, so that it can be discarded
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+type laneChannel struct {
+	pending []OutboundMessage
+	bucket  *tokenBucket
+}
+
+// outboundLane delivers OutboundMessages to a messenger under its rate limits
+// Messages are queued per destination channel, and delivered in order once the
+// messenger-wide and the channel limits allow. Destination channels take turns to send
+// Rate limits reported by the messenger pause the channel for the reported duration,
+// and the rejected messages are sent again ahead of the others queued for the channel
+type outboundLane struct {
+	id           string
+	out          chan<- OutboundMessage
+	queue        chan OutboundMessage
+	wake         chan interface{}
+	bucket       *tokenBucket
+	channelLimit RateLimit
+	channels     map[string]*laneChannel
+	order        []string // destination channels with pending messages
+	lock         sync.Mutex
+	paused       map[string]time.Time
+	requeued     []OutboundMessage // rate limited messages to be sent again, guarded by lock
+	terminated   bool              // rate limited messages are passed to the retry queue once terminated
+	logger       *logrus.Entry
+}
+
+func newOutboundLane(id string, out chan<- OutboundMessage, limit, channelLimit RateLimit, logger *logrus.Entry) *outboundLane {
+	return &outboundLane{
+		id:           id,
+		out:          out,
+		queue:        make(chan OutboundMessage, laneQueueLen),
+		wake:         make(chan interface{}, 1),
+		bucket:       newTokenBucket(limit),
+		channelLimit: channelLimit,
+		channels:     make(map[string]*laneChannel),
+		paused:       make(map[string]time.Time),
+		logger:       logger.WithField("messenger", id),
+	}
+}
+
+// pause stops sending to channelID for d
+func (l *outboundLane) pause(channelID string, d time.Duration) {
+	l.lock.Lock()
+	until := time.Now().Add(d)
+	if until.After(l.paused[channelID]) {
+		l.paused[channelID] = until
+	}
+	l.lock.Unlock()
+	select {
+	case l.wake <- nil:
+	default:
+	}
+}
+
+func (l *outboundLane) pausedUntil(channelID string) time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.paused[channelID]
+}
+
+// requeue queues msg rejected by rate limits to be sent again, returns false if the lane is terminated
+func (l *outboundLane) requeue(msg OutboundMessage) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.terminated {
+		return false
+	}
+	l.requeued = append(l.requeued, msg)
+	return true
+}
+
+// restore puts the requeued messages back to the head of their channels, in the order they were sent
+func (l *outboundLane) restore() {
+	l.lock.Lock()
+	requeued := l.requeued
+	l.requeued = nil
+	l.lock.Unlock()
+	for i := len(requeued) - 1; i >= 0; i-- {
+		l.pushFront(requeued[i])
+	}
+}
+
+func (l *outboundLane) channel(chID string) *laneChannel {
+	ch, ok := l.channels[chID]
+	if !ok {
+		ch = &laneChannel{bucket: newTokenBucket(l.channelLimit)}
+		l.channels[chID] = ch
+	}
+	if len(ch.pending) == 0 {
+		l.order = append(l.order, chID)
+	}
+	return ch
+}
+
+func (l *outboundLane) push(msg OutboundMessage) {
+	ch := l.channel(msg.ToChannel.ChannelID)
+	ch.pending = append(ch.pending, msg)
+}
+
+func (l *outboundLane) pushFront(msg OutboundMessage) {
+	ch := l.channel(msg.ToChannel.ChannelID)
+	ch.pending = append([]OutboundMessage{msg}, ch.pending...)
+}
+
+// next pops the next message allowed to be sent
+// If no message can be sent now, the time to wait is returned
+func (l *outboundLane) next(now time.Time) (OutboundMessage, bool, time.Duration) {
+	if common := l.bucket.readyAt(now); common.After(now) {
+		return OutboundMessage{}, false, common.Sub(now)
+	}
+
+	earliest := time.Time{}
+	for i, chID := range l.order {
+		ch := l.channels[chID]
+		ready := ch.bucket.readyAt(now)
+		if paused := l.pausedUntil(chID); paused.After(ready) {
+			ready = paused
+		}
+		if ready.After(now) {
+			if earliest.IsZero() || ready.Before(earliest) {
+				earliest = ready
+			}
+			continue
+		}
+
+		msg := ch.pending[0]
+		ch.pending = ch.pending[1:]
+		ch.bucket.take(now)
+		l.bucket.take(now)
+		// Move the channel to the end, so that other channels get their turns
+		l.order = append(l.order[:i], l.order[i+1:]...)
+		if len(ch.pending) > 0 {
+			l.order = append(l.order, chID)
+		}
+		return msg, true, 0
+	}
+	return OutboundMessage{}, false, earliest.Sub(now)
+}
+
+// cleanup discards the states of idle channels
+func (l *outboundLane) cleanup(now time.Time) {
+	for chID, ch := range l.channels {
+		if len(ch.pending) == 0 && ch.bucket.full(now) {
+			delete(l.channels, chID)
+		}
+	}
+	l.lock.Lock()
+	for chID, until := range l.paused {
+		if !until.After(now) {
+			delete(l.paused, chID)
+		}
+	}
+	l.lock.Unlock()
+}
+
+// send delivers msg to the messenger, returns false if timed out
+func (l *outboundLane) send(ctx context.Context, msg OutboundMessage, timeout time.Duration) bool {
+	report := msg.OnResult
+	chID := msg.ToChannel.ChannelID
+	original := msg
+	msg.OnResult = func(result DeliveryResult) {
+		if errors.Is(result.Err, ErrRateLimited) {
+			pause := defaultRateLimitPause
+			var rlErr *RateLimitError
+			if errors.As(result.Err, &rlErr) && rlErr.RetryAfter > 0 {
+				pause = rlErr.RetryAfter
+			}
+			l.logger.Warnf("rate limited on %s, paused for %s", chID, pause)
+			// The message is not a failed attempt, so it is sent again without the retry queue
+			requeued := l.requeue(original)
+			l.pause(chID, pause)
+			if requeued {
+				return
+			}
+		}
+		result.Message.OnResult = report
+		if report != nil {
+			report(result)
+		}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case l.out <- msg:
+		return true
+	case <-timeoutCtx.Done():
+		l.logger.Warnf("transmitter out timeout/cancelled: %s", l.id)
+		msg.ReportResult("", DeliveryError(ErrDeliveryTimeout, timeoutCtx.Err()))
+		return false
+	}
+}
+
+// terminate reports all pending and requeued messages as failed
+// Messages rate limited after that are reported to the retry queue directly
+func (l *outboundLane) terminate(err error) {
+	l.lock.Lock()
+	l.terminated = true
+	l.lock.Unlock()
+	l.restore()
+	l.fail(err)
+}
+
+// fail reports all pending messages as failed
+func (l *outboundLane) fail(err error) {
+	for _, chID := range l.order {
+		for _, msg := range l.channels[chID].pending {
+			msg.ReportResult("", err)
+		}
+		l.channels[chID].pending = nil
+	}
+	l.order = nil
+}
+
+// start delivers messages from l.queue until it is closed
+// Messages still held back by rate limits at that time are reported as failed,
+// so that the retry queue keeps them for the next session
+func (l *outboundLane) start(ctx context.Context, timeout time.Duration) {
+	closed := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		l.restore()
+		if len(l.order) == 0 {
+			if closed {
+				l.terminate(DeliveryError(ErrRateLimited, errLaneTerminated))
+				return
+			}
+			select {
+			case msg, ok := <-l.queue:
+				if !ok {
+					closed = true
+					continue
+				}
+				l.push(msg)
+			case <-l.wake:
+				continue
+			}
+		}
+
+		// Collect queued messages without blocking
+	collect:
+		for !closed {
+			select {
+			case msg, ok := <-l.queue:
+				if !ok {
+					closed = true
+					break
+				}
+				l.push(msg)
+			default:
+				break collect
+			}
+		}
+
+		now := time.Now()
+		msg, ok, wait := l.next(now)
+		if ok {
+			if !l.send(ctx, msg, timeout) && closed {
+				// Do not wait for an unresponsive messenger on termination
+				l.fail(DeliveryError(ErrDeliveryTimeout, errLaneTerminated))
+			}
+			continue
+		}
+
+		if closed {
+			l.terminate(DeliveryError(ErrRateLimited, errLaneTerminated))
+			return
+		}
+
+		l.cleanup(now)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case msg, ok := <-l.queue:
+			if !ok {
+				closed = true
+				break
+			}
+			l.push(msg)
+		case <-l.wake:
+		case <-timer.C:
+		}
+	}
+}
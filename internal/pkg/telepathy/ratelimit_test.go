@@ -0,0 +1,198 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newTokenBucket(RateLimit{}))
+
+	now := time.Now()
+	bucket := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	assert.Equal(now, bucket.readyAt(now))
+	bucket.take(now)
+	assert.Equal(now, bucket.readyAt(now))
+	bucket.take(now)
+	assert.Equal(now.Add(100*time.Millisecond), bucket.readyAt(now))
+	assert.False(bucket.full(now))
+
+	later := now.Add(100 * time.Millisecond)
+	assert.Equal(later, bucket.readyAt(later))
+	assert.True(bucket.full(now.Add(time.Second)))
+}
+
+// runLaneTest starts a router with messenger "msgr" and sends msgs in order
+// It returns the messages received by the messenger after the router is terminated
+func runLaneTest(router *router, msgs []OutboundMessage) []OutboundMessage {
+	prod := make(chan OutboundMessage, len(msgs))
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+	for _, msg := range msgs {
+		prod <- msg
+	}
+
+	received := []OutboundMessage{}
+	for range msgs {
+		received = append(received, <-trans)
+	}
+	close(prod)
+	<-done
+	return received
+}
+
+func laneTestMsg(channelID, text string) OutboundMessage {
+	return OutboundMessage{
+		ToChannel: Channel{MessengerID: "msgr", ChannelID: channelID},
+		Text:      text,
+	}
+}
+
+func TestRouterRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.setRateLimit("msgr", RateLimit{Rate: 20, Burst: 1})
+
+	start := time.Now()
+	received := runLaneTest(router, []OutboundMessage{
+		laneTestMsg("A", "1"),
+		laneTestMsg("A", "2"),
+		laneTestMsg("A", "3"),
+		laneTestMsg("A", "4"),
+	})
+
+	texts := []string{}
+	for _, msg := range received {
+		texts = append(texts, msg.Text)
+	}
+	assert.Equal([]string{"1", "2", "3", "4"}, texts)
+	// The first message is sent immediately, the following ones are 50ms apart
+	assert.True(time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestRouterChannelRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.setChannelRateLimit("msgr", RateLimit{Rate: 10, Burst: 1})
+
+	received := runLaneTest(router, []OutboundMessage{
+		laneTestMsg("A", "A1"),
+		laneTestMsg("A", "A2"),
+		laneTestMsg("B", "B1"),
+		laneTestMsg("B", "B2"),
+	})
+
+	texts := []string{}
+	for _, msg := range received {
+		texts = append(texts, msg.Text)
+	}
+	// Channel B is not blocked by channel A, and messages of each channel are in order
+	assert.Equal(4, len(texts))
+	assert.Equal([]string{"A1", "B1"}, texts[:2])
+	assert.Equal([]string{"A2", "B2"}, texts[2:])
+}
+
+func TestLaneRateLimitReported(t *testing.T) {
+	assert := assert.New(t)
+	out := make(chan OutboundMessage, 1)
+	lane := newOutboundLane("msgr", out, RateLimit{}, RateLimit{}, newRouter().logger)
+
+	results := make(chan DeliveryResult, 1)
+	msg := laneTestMsg("A", "first")
+	msg.OnResult = func(result DeliveryResult) { results <- result }
+	assert.True(lane.send(context.Background(), msg, time.Second))
+	lane.push(laneTestMsg("A", "second"))
+
+	// Reported rate limit pauses the destination channel, and the message is queued again
+	sent := <-out
+	sent.ReportResult("", &RateLimitError{RetryAfter: time.Hour})
+	assert.Empty(results)
+	assert.True(lane.pausedUntil("A").After(time.Now().Add(59 * time.Minute)))
+	assert.True(lane.pausedUntil("B").IsZero())
+
+	now := time.Now()
+	lane.restore()
+	_, ok, wait := lane.next(now)
+	assert.False(ok)
+	assert.True(wait > 59*time.Minute)
+
+	lane.push(laneTestMsg("B", "not paused"))
+	next, ok, _ := lane.next(now)
+	assert.True(ok)
+	assert.Equal("not paused", next.Text)
+
+	// The rate limited message is sent ahead of the others once the pause ends
+	next, ok, _ = lane.next(now.Add(2 * time.Hour))
+	assert.True(ok)
+	assert.Equal("first", next.Text)
+	next.ReportResult("msgID", nil)
+	assert.Equal("msgID", (<-results).MessageID)
+
+	// Rate limited after the lane is terminated, the message is reported to the retry queue
+	lane.terminate(DeliveryError(ErrRateLimited, errLaneTerminated))
+	assert.True(lane.send(context.Background(), msg, time.Second))
+	(<-out).ReportResult("", &RateLimitError{})
+	assert.True(errors.Is((<-results).Err, ErrRateLimited))
+}
+
+func TestRouterRateLimitRequeue(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.retry.setPolicy("", RetryPolicy{MaxAttempts: 1})
+	// Messages are 50ms apart, so the first one is rejected before the second one is sent
+	router.setChannelRateLimit("msgr", RateLimit{Rate: 20, Burst: 1})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	results := make(chan DeliveryResult, 2)
+	for _, text := range []string{"1", "2"} {
+		msg := laneTestMsg("A", text)
+		msg.OnResult = func(result DeliveryResult) { results <- result }
+		prod <- msg
+	}
+
+	// The rate limited message is sent again before the next one, without spending attempts
+	texts := []string{}
+	for len(texts) < 3 {
+		msg := <-trans
+		texts = append(texts, msg.Text)
+		if len(texts) == 1 {
+			msg.ReportResult("", &RateLimitError{RetryAfter: 10 * time.Millisecond})
+		} else {
+			msg.ReportResult("msgID", nil)
+		}
+	}
+	assert.Equal([]string{"1", "1", "2"}, texts)
+	assert.NoError((<-results).Err)
+	assert.NoError((<-results).Err)
+	close(prod)
+	<-done
+}
+
+func TestRouterDefaultRateLimits(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.setRateLimit("configured", RateLimit{Rate: 1})
+	router.setDefaultRateLimits("configured", RateLimit{Rate: 2}, RateLimit{Rate: 3})
+	router.setDefaultRateLimits("default", RateLimit{Rate: 2}, RateLimit{Rate: 3})
+	assert.Equal(RateLimit{Rate: 1}, router.rateLimits["configured"])
+	assert.Equal(RateLimit{Rate: 3}, router.channelRateLimits["configured"])
+	assert.Equal(RateLimit{Rate: 2}, router.rateLimits["default"])
+	assert.Equal(RateLimit{Rate: 3}, router.channelRateLimits["default"])
+}
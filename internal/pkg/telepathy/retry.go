@@ -0,0 +1,490 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retryStoreNamespace = "telepathy.retry"
+	retryKeyPrefix      = "retry/"
+	deadLetterKeyPrefix = "dead/"
+	deadLetterLimit     = 1000 // Max number of dead-lettered messages kept, the oldest ones are removed first
+	retryStoreTimeout   = 5 * time.Second
+
+	defaultRetryMaxAttempts = 5
+	defaultRetryBaseDelay   = time.Second
+	defaultRetryMaxDelay    = 5 * time.Minute
+)
+
+// RetryPolicy defines how failed OutboundMessages are retried
+// Zero value fields are replaced with default values
+type RetryPolicy struct {
+	MaxAttempts int           // Max number of delivery attempts, including the first one, 1 to disable retry
+	BaseDelay   time.Duration // Delay before the first retry, doubled for each further retry
+	MaxDelay    time.Duration // Upper bound of the delay between retries
+}
+
+// retryRecord is the persisted form of a queued or dead-lettered OutboundMessage
+// OnResult callbacks can not be persisted, so the results of reloaded messages are not reported
+type retryRecord struct {
+	Action      OutboundAction
+	MessageID   string
+	ToChannel   Channel
+	AsName      string
+	Text        string
+	RichText    RichText
+	Attachments []Attachment
+	Attempts    int
+	NextAttempt int64 // Unix time in nano seconds
+	LastError   string
+	Rest        []retryRecord // Following parts of a split message
+}
+
+func newRetryRecord(msg OutboundMessage) retryRecord {
+	return retryRecord{
+		Action:      msg.Action,
+		MessageID:   msg.MessageID,
+		ToChannel:   msg.ToChannel,
+		AsName:      msg.AsName,
+		Text:        msg.Text,
+		RichText:    msg.RichText,
+		Attachments: msg.Attachments,
+	}
+}
+
+func (r retryRecord) message() OutboundMessage {
+	return OutboundMessage{
+		Action:      r.Action,
+		MessageID:   r.MessageID,
+		ToChannel:   r.ToChannel,
+		AsName:      r.AsName,
+		Text:        r.Text,
+		RichText:    r.RichText,
+		Attachments: r.Attachments,
+	}
+}
+
+// retryOp is a pending update of the persisted records, record is nil for deletion
+type retryOp struct {
+	key    string
+	record *retryRecord
+}
+
+type retryEntry struct {
+	id       string // empty until the entry is persisted, which is when it is tracked or loaded
+	msg      OutboundMessage
+	rest     []OutboundMessage // Parts sent after msg is settled, if msg is a part of a split message
+	attempts int
+	next     time.Time
+	lastErr  error
+}
+
+// retryQueue keeps OutboundMessages failed with transient errors and sends them again with
+// exponential backoff. Messages which failed MaxAttempts times are moved to dead-letter store
+// Messages are persisted with kv, if attached, from being tracked until settled, and reloaded when the router starts
+// A message delivered when the router stopped may be sent again in the next session
+// Delivery results are reported from messenger routines, so the records are written by persister
+type retryQueue struct {
+	kv            *KVStore
+	defaultPolicy RetryPolicy
+	policies      map[string]RetryPolicy
+	lock          sync.Mutex
+	entries       map[*retryEntry]bool
+	seq           uint64
+	ops           []retryOp
+	opsClosed     bool // Set once persister returns, ops are no longer written after that
+	notify        chan interface{}
+	opNotify      chan interface{}
+	due           chan OutboundMessage
+	logger        *logrus.Entry
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{
+		policies: make(map[string]RetryPolicy),
+		entries:  make(map[*retryEntry]bool),
+		notify:   make(chan interface{}, 1),
+		opNotify: make(chan interface{}, 1),
+		due:      make(chan OutboundMessage),
+		logger:   logrus.WithField("module", "retry"),
+	}
+}
+
+// setPolicy sets the retry policy for messengerID, empty messengerID sets the default policy
+func (q *retryQueue) setPolicy(messengerID string, policy RetryPolicy) {
+	if messengerID == "" {
+		q.defaultPolicy = policy
+		return
+	}
+	q.policies[messengerID] = policy
+}
+
+func (q *retryQueue) policy(messengerID string) RetryPolicy {
+	policy, ok := q.policies[messengerID]
+	if !ok {
+		policy = q.defaultPolicy
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaultRetryBaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = defaultRetryMaxDelay
+	}
+	return policy
+}
+
+// delay returns the backoff delay after the given number of attempts
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// retryable checks whether a delivery error may be resolved by sending again
+func retryable(err error) bool {
+	return !errors.Is(err, ErrChannelGone) &&
+		!errors.Is(err, ErrUnauthorized) &&
+		!errors.Is(err, ErrMessengerNotFound) &&
+		!errors.Is(err, ErrMessageGone) &&
+		!errors.Is(err, ErrNotSupported) &&
+		!errors.Is(err, ErrPluginDisabled)
+}
+
+// track prepares msg for its first delivery attempt
+// rest are the following parts if msg is split, each of them is sent once the previous part
+// is delivered or given up, so that the parts are sent in order even if some of them are retried
+// msg is persisted with rest until it is settled, so that queued parts are sent in the next session
+func (q *retryQueue) track(msg OutboundMessage, rest ...OutboundMessage) OutboundMessage {
+	entry := &retryEntry{msg: msg, rest: rest, next: time.Now()}
+	q.lock.Lock()
+	q.assignID(entry)
+	q.lock.Unlock()
+	q.store(retryKeyPrefix+entry.id, entry)
+	return q.attempt(entry)
+}
+
+// assignID sets the ID of entry used as key of its record, q.lock must be held
+func (q *retryQueue) assignID(entry *retryEntry) {
+	if entry.id == "" {
+		q.seq++
+		entry.id = fmt.Sprintf("%d-%d", time.Now().UnixNano(), q.seq)
+	}
+}
+
+// attempt returns the message to be sent for entry,
+// with OnResult replaced to handle the delivery result
+func (q *retryQueue) attempt(entry *retryEntry) OutboundMessage {
+	q.lock.Lock()
+	entry.attempts++
+	q.lock.Unlock()
+	msg := entry.msg
+	msg.OnResult = func(result DeliveryResult) {
+		q.handleResult(entry, result)
+	}
+	return msg
+}
+
+func (q *retryQueue) handleResult(entry *retryEntry, result DeliveryResult) {
+	report := entry.msg.OnResult
+	result.Message.OnResult = report
+
+	if result.Err == nil || !retryable(result.Err) {
+		// The following part is persisted before the record of entry is removed
+		q.sendNext(entry)
+		q.remove(entry)
+		if report != nil {
+			report(result)
+		}
+		return
+	}
+
+	policy := q.policy(entry.msg.ToChannel.MessengerID)
+	rateLimited := errors.Is(result.Err, ErrRateLimited)
+	q.lock.Lock()
+	if rateLimited {
+		// Messages rejected by rate limits are not attempted, so they do not spend attempts
+		entry.attempts--
+	}
+	attempts := entry.attempts
+	entry.lastErr = result.Err
+	q.lock.Unlock()
+	if !rateLimited && attempts >= policy.MaxAttempts {
+		q.deadLetter(entry)
+		if report != nil {
+			report(result)
+		}
+		return
+	}
+
+	q.logger.Warnf("delivery failed (%d/%d) on %s: %s",
+		attempts, policy.MaxAttempts, entry.msg.ToChannel.Name(), result.Err.Error())
+	delay := policy.delay(attempts)
+	var rlErr *RateLimitError
+	if errors.As(result.Err, &rlErr) && rlErr.RetryAfter > delay {
+		delay = rlErr.RetryAfter
+	}
+	q.schedule(entry, time.Now().Add(delay))
+}
+
+// schedule queues entry to be sent at next
+func (q *retryQueue) schedule(entry *retryEntry, next time.Time) {
+	q.lock.Lock()
+	entry.next = next
+	q.assignID(entry)
+	q.entries[entry] = true
+	q.lock.Unlock()
+
+	q.store(retryKeyPrefix+entry.id, entry)
+	select {
+	case q.notify <- nil:
+	default:
+	}
+}
+
+// sendNext schedules the part following entry to be sent immediately
+func (q *retryQueue) sendNext(entry *retryEntry) {
+	q.lock.Lock()
+	rest := entry.rest
+	entry.rest = nil
+	q.lock.Unlock()
+	if len(rest) == 0 {
+		return
+	}
+	q.schedule(&retryEntry{msg: rest[0], rest: rest[1:]}, time.Now())
+}
+
+// remove deletes the persisted record of entry, if any
+func (q *retryQueue) remove(entry *retryEntry) {
+	q.lock.Lock()
+	id := entry.id
+	q.lock.Unlock()
+	if id == "" {
+		return
+	}
+	q.enqueueOp(retryOp{key: retryKeyPrefix + id})
+}
+
+// deadLetter moves entry to dead-letter store, the following parts are still sent
+func (q *retryQueue) deadLetter(entry *retryEntry) {
+	q.sendNext(entry)
+	q.lock.Lock()
+	q.assignID(entry)
+	q.lock.Unlock()
+	q.logger.Errorf("delivery failed after %d attempts on %s: %s",
+		entry.attempts, entry.msg.ToChannel.Name(), entry.lastErr.Error())
+	q.store(deadLetterKeyPrefix+entry.id, entry)
+	q.remove(entry)
+}
+
+// store queues the record of entry to be written with key
+func (q *retryQueue) store(key string, entry *retryEntry) {
+	if q.kv == nil {
+		return
+	}
+	q.lock.Lock()
+	record := newRetryRecord(entry.msg)
+	record.Attempts = entry.attempts
+	record.NextAttempt = entry.next.UnixNano()
+	if entry.lastErr != nil {
+		record.LastError = entry.lastErr.Error()
+	}
+	for _, msg := range entry.rest {
+		record.Rest = append(record.Rest, newRetryRecord(msg))
+	}
+	q.lock.Unlock()
+	q.enqueueOp(retryOp{key: key, record: &record})
+}
+
+// enqueueOp queues op to be written by persister, it never blocks
+// Ops of results reported after persister returned are dropped, the records are left as they were
+func (q *retryQueue) enqueueOp(op retryOp) {
+	if q.kv == nil {
+		return
+	}
+	q.lock.Lock()
+	if q.opsClosed {
+		q.lock.Unlock()
+		q.logger.Warnf("%s not persisted, the router is stopped", op.key)
+		return
+	}
+	q.ops = append(q.ops, op)
+	q.lock.Unlock()
+	select {
+	case q.opNotify <- nil:
+	default:
+	}
+}
+
+// flush writes the queued ops in order
+func (q *retryQueue) flush() {
+	q.lock.Lock()
+	ops := q.ops
+	q.ops = nil
+	q.lock.Unlock()
+	deadLettered := false
+	for _, op := range ops {
+		ctx, cancel := context.WithTimeout(context.Background(), retryStoreTimeout)
+		var err error
+		if op.record != nil {
+			err = q.kv.Put(ctx, op.key, *op.record)
+			deadLettered = deadLettered || strings.HasPrefix(op.key, deadLetterKeyPrefix)
+		} else {
+			err = q.kv.Delete(ctx, op.key)
+		}
+		cancel()
+		if err != nil {
+			q.logger.Errorf("persist %s failed: %s", op.key, err.Error())
+		}
+	}
+	if deadLettered {
+		q.trimDeadLetters()
+	}
+}
+
+// trimDeadLetters removes the oldest dead-lettered messages beyond deadLetterLimit
+// Keys are ordered by the time the messages are tracked or queued
+func (q *retryQueue) trimDeadLetters() {
+	ctx, cancel := context.WithTimeout(context.Background(), retryStoreTimeout)
+	defer cancel()
+	keys, err := q.kv.List(ctx, deadLetterKeyPrefix)
+	if err != nil {
+		q.logger.Errorf("list dead letters failed: %s", err.Error())
+		return
+	}
+	if len(keys) <= deadLetterLimit {
+		return
+	}
+	sort.Strings(keys)
+	for _, key := range keys[:len(keys)-deadLetterLimit] {
+		if err := q.kv.Delete(ctx, key); err != nil {
+			q.logger.Errorf("remove dead letter %s failed: %s", key, err.Error())
+		}
+	}
+}
+
+// persister writes the records of queued and dead-lettered messages until stop is closed
+// Ops queued before stop is closed are all written before it returns
+func (q *retryQueue) persister(stop <-chan interface{}) {
+	for {
+		select {
+		case <-q.opNotify:
+			q.flush()
+		case <-stop:
+			q.lock.Lock()
+			q.opsClosed = true
+			q.lock.Unlock()
+			q.flush()
+			return
+		}
+	}
+}
+
+// load schedules messages persisted by previous sessions
+func (q *retryQueue) load(ctx context.Context) error {
+	if q.kv == nil {
+		return nil
+	}
+	keys, err := q.kv.List(ctx, retryKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		record := retryRecord{}
+		if err := q.kv.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		entry := &retryEntry{
+			id:       key[len(retryKeyPrefix):],
+			msg:      record.message(),
+			attempts: record.Attempts,
+			next:     time.Unix(0, record.NextAttempt),
+		}
+		if record.LastError != "" {
+			entry.lastErr = errors.New(record.LastError)
+		}
+		for _, rest := range record.Rest {
+			entry.rest = append(entry.rest, rest.message())
+		}
+		q.lock.Lock()
+		q.entries[entry] = true
+		q.lock.Unlock()
+	}
+	if len(keys) > 0 {
+		q.logger.Infof("loaded %d queued messages", len(keys))
+	}
+	return nil
+}
+
+// popDue removes and returns entries which are due, and the time of the next due entry
+func (q *retryQueue) popDue(now time.Time) ([]*retryEntry, time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	due := []*retryEntry{}
+	next := time.Time{}
+	for entry := range q.entries {
+		if !entry.next.After(now) {
+			due = append(due, entry)
+			delete(q.entries, entry)
+		} else if next.IsZero() || entry.next.Before(next) {
+			next = entry.next
+		}
+	}
+	return due, next
+}
+
+// start sends due messages to q.due until stop is closed
+func (q *retryQueue) start(stop <-chan interface{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		due, next := q.popDue(time.Now())
+		for i, entry := range due {
+			msg := q.attempt(entry)
+			select {
+			case q.due <- msg:
+			case <-stop:
+				// Put back the entries not sent, they are still persisted
+				q.lock.Lock()
+				entry.attempts--
+				for _, entry := range due[i:] {
+					q.entries[entry] = true
+				}
+				q.lock.Unlock()
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-q.notify:
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+	}
+}
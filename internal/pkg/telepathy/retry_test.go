@@ -0,0 +1,351 @@
+package telepathy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	assert := assert.New(t)
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	assert.Equal(time.Second, policy.delay(1))
+	assert.Equal(2*time.Second, policy.delay(2))
+	assert.Equal(4*time.Second, policy.delay(3))
+	assert.Equal(5*time.Second, policy.delay(4))
+	assert.Equal(5*time.Second, policy.delay(100))
+
+	queue := newRetryQueue()
+	queue.setPolicy("msgr", RetryPolicy{MaxAttempts: 2})
+	assert.Equal(2, queue.policy("msgr").MaxAttempts)
+	assert.Equal(defaultRetryBaseDelay, queue.policy("msgr").BaseDelay)
+	assert.Equal(defaultRetryMaxAttempts, queue.policy("other").MaxAttempts)
+}
+
+func TestRouterRetry(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.retry.setPolicy("", RetryPolicy{BaseDelay: 10 * time.Millisecond})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	// Fails twice and then succeeds
+	go func() {
+		count := 0
+		for msg := range trans {
+			count++
+			if count <= 2 {
+				msg.ReportResult("", DeliveryError(ErrDeliveryTimeout, nil))
+			} else {
+				msg.ReportResult("msgID", nil)
+			}
+		}
+	}()
+
+	results := make(chan DeliveryResult, 1)
+	prod <- OutboundMessage{
+		ToChannel: Channel{MessengerID: "msgr"},
+		Text:      "text",
+		OnResult:  func(result DeliveryResult) { results <- result },
+	}
+
+	select {
+	case result := <-results:
+		assert.NoError(result.Err)
+		assert.Equal("msgID", result.MessageID)
+		assert.Equal("text", result.Message.Text)
+	case <-time.After(time.Second):
+		assert.Fail("result not reported")
+	}
+	close(prod)
+	<-done
+}
+
+func TestRouterRetryDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	store, storeDone := startTestKVStore(newMemoryDB())
+	router := newRouter()
+	router.retry.kv = store
+	router.retry.setPolicy("msgr", RetryPolicy{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	attempts := 0
+	go func() {
+		for msg := range trans {
+			attempts++
+			msg.ReportResult("", errors.New("network error"))
+		}
+	}()
+
+	results := make(chan DeliveryResult, 1)
+	prod <- OutboundMessage{
+		ToChannel: Channel{MessengerID: "msgr"},
+		Text:      "text",
+		OnResult:  func(result DeliveryResult) { results <- result },
+	}
+
+	select {
+	case result := <-results:
+		assert.EqualError(result.Err, "network error")
+	case <-time.After(time.Second):
+		assert.Fail("result not reported")
+	}
+	close(prod)
+	<-done
+	assert.Equal(2, attempts)
+
+	ctx := context.Background()
+	keys, err := store.List(ctx, retryKeyPrefix)
+	assert.NoError(err)
+	assert.Empty(keys)
+	keys, err = store.List(ctx, deadLetterKeyPrefix)
+	assert.NoError(err)
+	if assert.Len(keys, 1) {
+		record := retryRecord{}
+		assert.NoError(store.Get(ctx, keys[0], &record))
+		assert.Equal("text", record.Text)
+		assert.Equal(2, record.Attempts)
+		assert.Equal("network error", record.LastError)
+	}
+
+	store.close()
+	<-storeDone
+}
+
+func TestRouterRetryNotRetryable(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.retry.setPolicy("", RetryPolicy{BaseDelay: 10 * time.Millisecond})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	attempts := 0
+	go func() {
+		for msg := range trans {
+			attempts++
+			msg.ReportResult("", DeliveryError(ErrChannelGone, nil))
+		}
+	}()
+
+	results := make(chan DeliveryResult, 1)
+	prod <- OutboundMessage{
+		ToChannel: Channel{MessengerID: "msgr"},
+		OnResult:  func(result DeliveryResult) { results <- result },
+	}
+	assert.True(errors.Is((<-results).Err, ErrChannelGone))
+	close(prod)
+	<-done
+	assert.Equal(1, attempts)
+}
+
+func TestRouterRetryLoad(t *testing.T) {
+	assert := assert.New(t)
+	store, storeDone := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+	record := retryRecord{
+		ToChannel: Channel{MessengerID: "msgr"},
+		Text:      "persisted",
+		Attempts:  1,
+		Rest:      []retryRecord{{ToChannel: Channel{MessengerID: "msgr"}, Text: "rest"}},
+	}
+	assert.NoError(store.Put(ctx, retryKeyPrefix+"id", record))
+
+	router := newRouter()
+	router.retry.kv = store
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	select {
+	case msg := <-trans:
+		assert.Equal("persisted", msg.Text)
+		msg.ReportResult("msgID", nil)
+	case <-time.After(time.Second):
+		assert.Fail("persisted message not sent")
+	}
+	// Following parts of a split message are persisted with the queued part
+	select {
+	case msg := <-trans:
+		assert.Equal("rest", msg.Text)
+		msg.ReportResult("msgID", nil)
+	case <-time.After(time.Second):
+		assert.Fail("following part not sent")
+	}
+	close(prod)
+	<-done
+
+	keys, err := store.List(ctx, retryKeyPrefix)
+	assert.NoError(err)
+	assert.Empty(keys)
+
+	store.close()
+	<-storeDone
+}
+
+// blockingDB is a memoryDB blocking Store until released
+type blockingDB struct {
+	*memoryDB
+	released chan interface{}
+}
+
+func (db *blockingDB) Store(ctx context.Context, collection, key string, value interface{}) error {
+	<-db.released
+	return db.memoryDB.Store(ctx, collection, key, value)
+}
+
+func TestRouterRetryPersistAsync(t *testing.T) {
+	assert := assert.New(t)
+	db := &blockingDB{memoryDB: newMemoryDB(), released: make(chan interface{})}
+	store, storeDone := startTestKVStore(db)
+	router := newRouter()
+	router.retry.kv = store
+	router.retry.setPolicy("", RetryPolicy{BaseDelay: time.Hour})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("msgr")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+	prod <- OutboundMessage{ToChannel: Channel{MessengerID: "msgr"}, Text: "queued"}
+
+	// Reporting the result does not wait for the record to be persisted
+	reported := make(chan interface{})
+	go func() {
+		(<-trans).ReportResult("", errors.New("network error"))
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		assert.Fail("result reporting blocked by persistence")
+	}
+
+	// Queued records are written before the router returns
+	close(db.released)
+	close(prod)
+	<-done
+	keys, err := store.List(context.Background(), retryKeyPrefix)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+	store.close()
+	<-storeDone
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	assert := assert.New(t)
+	queue := newRetryQueue()
+	queue.setPolicy("", RetryPolicy{MaxAttempts: 1})
+	results := make(chan DeliveryResult, 1)
+	msg := queue.track(OutboundMessage{
+		ToChannel: Channel{MessengerID: "msgr"},
+		OnResult:  func(result DeliveryResult) { results <- result },
+	})
+
+	// Rate limited messages are kept without spending attempts
+	msg.ReportResult("", &RateLimitError{RetryAfter: time.Hour})
+	assert.Empty(results)
+	due, next := queue.popDue(time.Now())
+	assert.Empty(due)
+	assert.True(next.After(time.Now().Add(59 * time.Minute)))
+	due, _ = queue.popDue(next)
+	if assert.Len(due, 1) {
+		assert.Equal(0, due[0].attempts)
+	}
+}
+
+func TestRetryPersistTracked(t *testing.T) {
+	assert := assert.New(t)
+	store, storeDone := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+	queue := newRetryQueue()
+	queue.kv = store
+	stop := make(chan interface{})
+	done := make(chan interface{})
+	go func() {
+		queue.persister(stop)
+		close(done)
+	}()
+
+	// Messages are persisted with the following parts before delivered
+	msg := queue.track(OutboundMessage{ToChannel: Channel{MessengerID: "msgr"}, Text: "first"},
+		OutboundMessage{ToChannel: Channel{MessengerID: "msgr"}, Text: "second"})
+	close(stop)
+	<-done
+	keys, err := store.List(ctx, retryKeyPrefix)
+	assert.NoError(err)
+	if assert.Len(keys, 1) {
+		record := retryRecord{}
+		assert.NoError(store.Get(ctx, keys[0], &record))
+		assert.Equal("first", record.Text)
+		if assert.Len(record.Rest, 1) {
+			assert.Equal("second", record.Rest[0].Text)
+		}
+	}
+
+	// Results reported after the router stopped leave the record to be sent in the next session
+	msg.ReportResult("msgID", nil)
+	keys, err = store.List(ctx, retryKeyPrefix)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+
+	store.close()
+	<-storeDone
+}
+
+func TestRetryTrimDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+	store, storeDone := startTestKVStore(newMemoryDB())
+	ctx := context.Background()
+	for i := 0; i < deadLetterLimit+2; i++ {
+		assert.NoError(store.Put(ctx, fmt.Sprintf("%s%05d", deadLetterKeyPrefix, i), retryRecord{}))
+	}
+	queue := newRetryQueue()
+	queue.kv = store
+	queue.trimDeadLetters()
+
+	// The oldest ones are removed
+	keys, err := store.List(ctx, deadLetterKeyPrefix)
+	assert.NoError(err)
+	assert.Len(keys, deadLetterLimit)
+	assert.NotContains(keys, deadLetterKeyPrefix+"00000")
+	assert.NotContains(keys, deadLetterKeyPrefix+"00001")
+	assert.Contains(keys, deadLetterKeyPrefix+"00002")
+
+	store.close()
+	<-storeDone
+}
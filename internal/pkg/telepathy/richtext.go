@@ -0,0 +1,256 @@
+package telepathy
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// RichNodeType is the type of a RichNode
+type RichNodeType int
+
+// Types of RichNode
+const (
+	RichPlain     RichNodeType = iota // Plain text in Text
+	RichBold                          // Bold Children
+	RichItalic                        // Italic Children
+	RichCode                          // Inline code in Text
+	RichCodeBlock                     // Multi-line code in Text
+	RichLink                          // Link to URL, Children is the link text
+	RichMention                       // Mention of User
+	RichQuote                         // Quoted Children
+)
+
+// RichNode is a node of messenger-neutral formatted text
+type RichNode struct {
+	Type        RichNodeType
+	Text        string           // Content of RichPlain, RichCode and RichCodeBlock
+	URL         string           // Target of RichLink
+	User        *MsgrUserProfile // Mentioned user of RichMention
+	MessengerID string           // Messenger of the mentioned user
+	Children    RichText         // Content of RichBold, RichItalic, RichLink and RichQuote
+}
+
+// RichText is formatted text consisting of a sequence of RichNodes
+// Messengers parse their native markup into RichText, and render RichText in their own markup
+type RichText []RichNode
+
+// RichTextRenderFunc renders node, content is the rendered Children,
+// or Text for nodes without children
+type RichTextRenderFunc func(node RichNode, content string) string
+
+// PlainRichText creates a RichText with text only
+func PlainRichText(text string) RichText {
+	return RichText{{Type: RichPlain, Text: text}}
+}
+
+// Render renders rt with render, which is called from the innermost nodes
+func (rt RichText) Render(render RichTextRenderFunc) string {
+	result := strings.Builder{}
+	for _, node := range rt {
+		content := node.Text
+		if node.Children != nil {
+			content = node.Children.Render(render)
+		}
+		result.WriteString(render(node, content))
+	}
+	return result.String()
+}
+
+// PlainText renders rt without formatting, for messengers which do not support formatting
+func (rt RichText) PlainText() string {
+	return rt.Render(renderPlain)
+}
+
+func renderPlain(node RichNode, content string) string {
+	switch node.Type {
+	case RichCodeBlock:
+		return "\n" + content + "\n"
+	case RichLink:
+		if content == "" || content == node.URL {
+			return node.URL
+		}
+		return content + " (" + node.URL + ")"
+	case RichMention:
+		return "@" + node.User.DisplayName
+	case RichQuote:
+		return QuoteLines(content, "> ")
+	}
+	return content
+}
+
+// QuoteLines adds prefix to each line of text
+func QuoteLines(text, prefix string) string {
+	return prefix + strings.Replace(text, "\n", "\n"+prefix, -1)
+}
+
+// MarkupRule defines an inline markup enclosed by delimiters
+type MarkupRule struct {
+	Delimiter    string       // Opening and closing delimiter
+	Type         RichNodeType // RichCode and RichCodeBlock keep the content unparsed
+	Multiline    bool         // Content may contain line breaks
+	WordBoundary bool         // Delimiters apply only at word boundaries, ex: snake_case is not italic
+}
+
+// MarkupSyntax defines the markup of a messenger and parses it into RichText
+type MarkupSyntax struct {
+	// Rules are tried in order, so longer delimiters should be listed first
+	Rules []MarkupRule
+	// QuotePrefix starts a quoted line
+	QuotePrefix string
+	// AutoLink converts URLs in plain text into links
+	AutoLink bool
+	// Token parses messenger specific tokens at the beginning of text, like mentions or escapes
+	// It returns the parsed node and its length in text, or ok = false if no token is found
+	Token func(text string) (node RichNode, length int, ok bool)
+	// Unescape is applied to plain text and code
+	Unescape func(string) string
+}
+
+var regexURL = regexp.MustCompile(`^https?://[^\s<>]+`)
+
+type richTextBuilder struct {
+	syntax *MarkupSyntax
+	text   RichText
+	plain  strings.Builder
+}
+
+func (b *richTextBuilder) unescape(text string) string {
+	if b.syntax.Unescape == nil {
+		return text
+	}
+	return b.syntax.Unescape(text)
+}
+
+func (b *richTextBuilder) flush() {
+	if b.plain.Len() == 0 {
+		return
+	}
+	b.text = append(b.text, RichNode{Type: RichPlain, Text: b.unescape(b.plain.String())})
+	b.plain.Reset()
+}
+
+func (b *richTextBuilder) add(node RichNode) {
+	if node.Type == RichPlain {
+		b.plain.WriteString(node.Text)
+		return
+	}
+	b.flush()
+	b.text = append(b.text, node)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Parse parses text in the markup into RichText
+func (s *MarkupSyntax) Parse(text string) RichText {
+	b := richTextBuilder{syntax: s}
+	for i := 0; i < len(text); {
+		lineStart := i == 0 || text[i-1] == '\n'
+		if lineStart && s.QuotePrefix != "" && strings.HasPrefix(text[i:], s.QuotePrefix) {
+			node, length := s.parseQuote(text[i:])
+			b.add(node)
+			i += length
+			continue
+		}
+
+		if s.Token != nil {
+			if node, length, ok := s.Token(text[i:]); ok && length > 0 {
+				b.add(node)
+				i += length
+				continue
+			}
+		}
+
+		prev, _ := utf8.DecodeLastRuneInString(text[:i])
+		if node, length, ok := s.parseRule(text[i:], i == 0 || !isWordRune(prev)); ok {
+			b.add(node)
+			i += length
+			continue
+		}
+
+		if s.AutoLink && (i == 0 || !isWordRune(prev)) {
+			if url := regexURL.FindString(text[i:]); url != "" {
+				url = strings.TrimRight(url, ".,;:!?)'\"")
+				b.add(RichNode{Type: RichLink, URL: url, Children: PlainRichText(url)})
+				i += len(url)
+				continue
+			}
+		}
+
+		b.plain.WriteByte(text[i])
+		i++
+	}
+	b.flush()
+	return b.text
+}
+
+// parseQuote parses consecutive quoted lines at the beginning of text
+func (s *MarkupSyntax) parseQuote(text string) (RichNode, int) {
+	lines := []string{}
+	i := 0
+	for {
+		end := strings.IndexByte(text[i:], '\n')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += i
+		}
+		lines = append(lines, text[i+len(s.QuotePrefix):end])
+		i = end
+		// Line break between quoted lines is consumed,
+		// but the one after the last quoted line is kept
+		if i < len(text) && strings.HasPrefix(text[i+1:], s.QuotePrefix) {
+			i++
+			continue
+		}
+		break
+	}
+	return RichNode{Type: RichQuote, Children: s.Parse(strings.Join(lines, "\n"))}, i
+}
+
+// parseRule tries to parse a MarkupRule at the beginning of text
+func (s *MarkupSyntax) parseRule(text string, boundary bool) (RichNode, int, bool) {
+	for _, rule := range s.Rules {
+		delim := rule.Delimiter
+		if !strings.HasPrefix(text, delim) || (rule.WordBoundary && !boundary) {
+			continue
+		}
+		rest := text[len(delim):]
+		end := strings.Index(rest, delim)
+		if end <= 0 {
+			continue
+		}
+		content := rest[:end]
+		if !rule.Multiline && strings.Contains(content, "\n") {
+			continue
+		}
+		verbatim := rule.Type == RichCode || rule.Type == RichCodeBlock
+		if !verbatim && (unicode.IsSpace(rune(content[0])) || unicode.IsSpace(rune(content[len(content)-1]))) {
+			continue
+		}
+		if rule.WordBoundary {
+			next, _ := utf8.DecodeRuneInString(rest[end+len(delim):])
+			if isWordRune(next) {
+				continue
+			}
+		}
+
+		node := RichNode{Type: rule.Type}
+		if verbatim {
+			if rule.Type == RichCodeBlock {
+				content = strings.TrimPrefix(strings.TrimSuffix(content, "\n"), "\n")
+			}
+			node.Text = content
+			if s.Unescape != nil {
+				node.Text = s.Unescape(content)
+			}
+		} else {
+			node.Children = s.Parse(content)
+		}
+		return node, len(delim) + end + len(delim), true
+	}
+	return RichNode{}, 0, false
+}
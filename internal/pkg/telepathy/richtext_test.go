@@ -0,0 +1,93 @@
+package telepathy_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+var testSyntax = telepathy.MarkupSyntax{
+	Rules: []telepathy.MarkupRule{
+		{Delimiter: "```", Type: telepathy.RichCodeBlock, Multiline: true},
+		{Delimiter: "**", Type: telepathy.RichBold},
+		{Delimiter: "_", Type: telepathy.RichItalic, WordBoundary: true},
+		{Delimiter: "`", Type: telepathy.RichCode},
+	},
+	QuotePrefix: "> ",
+	AutoLink:    true,
+	Token: func(text string) (telepathy.RichNode, int, bool) {
+		if !strings.HasPrefix(text, "@user") {
+			return telepathy.RichNode{}, 0, false
+		}
+		return telepathy.RichNode{
+			Type: telepathy.RichMention,
+			User: &telepathy.MsgrUserProfile{ID: "ID", DisplayName: "user"},
+		}, len("@user"), true
+	},
+	Unescape: func(text string) string {
+		return strings.Replace(text, "&amp;", "&", -1)
+	},
+}
+
+func TestMarkupSyntaxParse(t *testing.T) {
+	assert := assert.New(t)
+	plain := telepathy.PlainRichText
+
+	testCases := []struct {
+		text   string
+		result telepathy.RichText
+	}{
+		{"", nil},
+		{"plain &amp; text", plain("plain & text")},
+		{"**bold** text", telepathy.RichText{
+			{Type: telepathy.RichBold, Children: plain("bold")},
+			{Type: telepathy.RichPlain, Text: " text"},
+		}},
+		{"**_nested_**", telepathy.RichText{
+			{Type: telepathy.RichBold, Children: telepathy.RichText{
+				{Type: telepathy.RichItalic, Children: plain("nested")},
+			}},
+		}},
+		{"snake_case_name", plain("snake_case_name")},
+		{"not ** bold **", plain("not ** bold **")},
+		{"unclosed **bold", plain("unclosed **bold")},
+		{"`**code**`", telepathy.RichText{{Type: telepathy.RichCode, Text: "**code**"}}},
+		{"```\nline1\nline2\n```", telepathy.RichText{{Type: telepathy.RichCodeBlock, Text: "line1\nline2"}}},
+		{"**multi\nline**", plain("**multi\nline**")},
+		{"see https://example.com/a_b.", telepathy.RichText{
+			{Type: telepathy.RichPlain, Text: "see "},
+			{Type: telepathy.RichLink, URL: "https://example.com/a_b", Children: plain("https://example.com/a_b")},
+			{Type: telepathy.RichPlain, Text: "."},
+		}},
+		{"hi @user", telepathy.RichText{
+			{Type: telepathy.RichPlain, Text: "hi "},
+			{Type: telepathy.RichMention, User: &telepathy.MsgrUserProfile{ID: "ID", DisplayName: "user"}},
+		}},
+		{"> quote\n> **bold**\ntext", telepathy.RichText{
+			{Type: telepathy.RichQuote, Children: telepathy.RichText{
+				{Type: telepathy.RichPlain, Text: "quote\n"},
+				{Type: telepathy.RichBold, Children: plain("bold")},
+			}},
+			{Type: telepathy.RichPlain, Text: "\ntext"},
+		}},
+		{"text > not quote", plain("text > not quote")},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(testCase.result, testSyntax.Parse(testCase.text), testCase.text)
+	}
+}
+
+func TestRichTextPlainText(t *testing.T) {
+	assert := assert.New(t)
+	text := testSyntax.Parse("> **quoted** _text_\n> @user\n`code` [https://example.com]")
+	assert.Equal("> quoted text\n> @user\ncode [https://example.com]", text.PlainText())
+
+	text = telepathy.RichText{
+		{Type: telepathy.RichLink, URL: "https://example.com", Children: telepathy.PlainRichText("link")},
+		{Type: telepathy.RichCodeBlock, Text: "code"},
+	}
+	assert.Equal("link (https://example.com)\ncode\n", text.PlainText())
+}
@@ -2,6 +2,7 @@ package telepathy
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 
 const (
 	routerRecvOutLen    = 1
+	routerRecvQueueLen  = 20
 	routerTranOutLen    = 1
 	routerRecvHandleLen = 1
 	routerTranHandleLen = 1
@@ -25,24 +27,45 @@ const (
 // +------------------+  -- receiverIn ------> +--------+ -- receiverOut ----> +----------------+
 // | Messenger Plugin |                        | Router |                      | Service Plugin |
 // +------------------+  <-- transmitterOut -- +--------+ <-- transmitterIn -- +----------------+
+// Each receiverOut is fed by its own queue, so that a slow consumer does not block the others
+// Before dispatching, inbound and outbound messages are passed through the middleware chains
+// Outbound messages are delivered to each messenger by an outboundLane under its rate limits,
+// and messages failed with transient errors are sent again by the retry queue
+// Messages longer than the text limits of messengers are split before delivery, and the parts are sent in order
 type router struct {
-	receiverIn     map[string]<-chan InboundMessage
-	receiverOut    map[string]chan InboundMessage
-	transmitterIn  map[string]<-chan OutboundMessage
-	transmitterOut map[string]chan OutboundMessage
-	cmdOut         chan InboundMessage
-	cmd            *cmdManager
-	logger         *logrus.Entry
+	receiverIn        map[string]<-chan InboundMessage
+	receiverOut       map[string]chan InboundMessage
+	consumerFilter    map[string]MsgFilter
+	transmitterIn     map[string]<-chan OutboundMessage
+	transmitterOut    map[string]chan OutboundMessage
+	inMiddlewares     inboundChain
+	outMiddlewares    outboundChain
+	retry             *retryQueue
+	rateLimits        map[string]RateLimit
+	channelRateLimits map[string]RateLimit
+	textLimits        map[string]int
+	renderers         map[string]func(OutboundMessage) string
+	metrics           routerMetrics
+	cmdOut            chan InboundMessage
+	cmd               *cmdManager
+	settings          *channelSettings
+	logger            *logrus.Entry
 }
 
 func newRouter() *router {
 	rt := &router{
-		receiverIn:     make(map[string]<-chan InboundMessage),
-		receiverOut:    make(map[string]chan InboundMessage),
-		transmitterIn:  make(map[string]<-chan OutboundMessage),
-		transmitterOut: make(map[string]chan OutboundMessage),
-		cmdOut:         make(chan InboundMessage, routerCmdLen),
-		logger:         logrus.WithField("module", "router"),
+		receiverIn:        make(map[string]<-chan InboundMessage),
+		receiverOut:       make(map[string]chan InboundMessage),
+		consumerFilter:    make(map[string]MsgFilter),
+		transmitterIn:     make(map[string]<-chan OutboundMessage),
+		transmitterOut:    make(map[string]chan OutboundMessage),
+		cmdOut:            make(chan InboundMessage, routerCmdLen),
+		retry:             newRetryQueue(),
+		rateLimits:        make(map[string]RateLimit),
+		channelRateLimits: make(map[string]RateLimit),
+		textLimits:        make(map[string]int),
+		renderers:         make(map[string]func(OutboundMessage) string),
+		logger:            logrus.WithField("module", "router"),
 	}
 	cmd := newCmdManager("teru", 10, 5*time.Second, rt.cmdOut)
 	rt.attachProducer("telepathy.cmd", cmd.msgOut)
@@ -75,6 +98,31 @@ func (r *router) attachConsumer(id string) <-chan InboundMessage {
 	return r.receiverOut[id]
 }
 
+func (r *router) setConsumerFilter(id string, filter MsgFilter) {
+	if _, ok := r.receiverOut[id]; !ok {
+		r.logger.Panicf("consumer not attached: %s", id)
+	}
+	r.consumerFilter[id] = filter
+}
+
+func (r *router) attachInboundMiddleware(id string, order int, handler InboundHandler) {
+	for _, m := range r.inMiddlewares {
+		if m.id == id {
+			r.logger.Panicf("inbound middleware has already been attached: %s", id)
+		}
+	}
+	r.inMiddlewares = append(r.inMiddlewares, inboundMiddleware{id: id, order: order, handler: handler})
+}
+
+func (r *router) attachOutboundMiddleware(id string, order int, handler OutboundHandler) {
+	for _, m := range r.outMiddlewares {
+		if m.id == id {
+			r.logger.Panicf("outbound middleware has already been attached: %s", id)
+		}
+	}
+	r.outMiddlewares = append(r.outMiddlewares, outboundMiddleware{id: id, order: order, handler: handler})
+}
+
 func (r *router) attachTransmitter(id string) <-chan OutboundMessage {
 	_, ok := r.transmitterOut[id]
 	if ok {
@@ -84,6 +132,78 @@ func (r *router) attachTransmitter(id string) <-chan OutboundMessage {
 	return r.transmitterOut[id]
 }
 
+// setRateLimit sets the rate limit of all messages sent through messenger id
+func (r *router) setRateLimit(id string, limit RateLimit) {
+	r.rateLimits[id] = limit
+}
+
+// setChannelRateLimit sets the rate limit of each destination channel of messenger id
+func (r *router) setChannelRateLimit(id string, limit RateLimit) {
+	r.channelRateLimits[id] = limit
+}
+
+// setDefaultRateLimits sets the rate limits of messenger id which are not set yet
+func (r *router) setDefaultRateLimits(id string, limit, channelLimit RateLimit) {
+	if _, ok := r.rateLimits[id]; !ok {
+		r.rateLimits[id] = limit
+	}
+	if _, ok := r.channelRateLimits[id]; !ok {
+		r.channelRateLimits[id] = channelLimit
+	}
+}
+
+// routerMetrics are the metrics of message routing, the zero value ignores all updates
+type routerMetrics struct {
+	inbound  *Counter
+	outbound *Counter
+	delivery *Histogram
+	failures *Counter
+	timeouts *Counter
+	drops    *Counter
+}
+
+func (r *router) setMetrics(m *Metrics) {
+	r.metrics = routerMetrics{
+		inbound:  m.Counter("inbound_messages_total", "Inbound messages received from messengers", "messenger"),
+		outbound: m.Counter("outbound_messages_total", "Outbound messages dispatched to messengers, including retries", "messenger"),
+		delivery: m.Histogram("outbound_delivery_seconds", "Time from dispatching outbound messages to their final delivery results", DefaultBuckets, "messenger"),
+		failures: m.Counter("outbound_failures_total", "Outbound messages failed to be delivered", "messenger"),
+		timeouts: m.Counter("router_timeouts_total", "Messages not passed to plugins within the router timeout", "phase", "plugin"),
+		drops:    m.Counter("router_dropped_messages_total", "Inbound messages dropped as the queues of consumers are full", "plugin"),
+	}
+	r.cmd.setMetrics(m)
+}
+
+// trackDelivery wraps OnResult of msg to observe its delivery
+func (m routerMetrics) trackDelivery(msg OutboundMessage) OutboundMessage {
+	if m.delivery == nil {
+		return msg
+	}
+	id := msg.ToChannel.MessengerID
+	start := time.Now()
+	report := msg.OnResult
+	msg.OnResult = func(result DeliveryResult) {
+		m.delivery.Observe(time.Since(start).Seconds(), id)
+		if result.Err != nil {
+			m.failures.Inc(id)
+		}
+		if report != nil {
+			report(result)
+		}
+	}
+	return msg
+}
+
+// setTextLimit sets the max length of the text of messages sent through messenger id
+func (r *router) setTextLimit(id string, limit int) {
+	r.textLimits[id] = limit
+}
+
+// setRenderer sets the function rendering the text of messages sent through messenger id
+func (r *router) setRenderer(id string, render func(OutboundMessage) string) {
+	r.renderers[id] = render
+}
+
 func (r *router) receiver(ctx context.Context, timeout time.Duration) {
 	logger := r.logger.WithField("phase", "receiver")
 	logger.Info("started")
@@ -108,31 +228,65 @@ func (r *router) receiver(ctx context.Context, timeout time.Duration) {
 		close(inMsgCh)
 	}()
 
+	// Start delivering routines for each consumer
+	wgDeliver := sync.WaitGroup{}
+	wgDeliver.Add(len(r.receiverOut))
+	queues := make(map[string]chan InboundMessage)
+	for id, ch := range r.receiverOut {
+		queue := make(chan InboundMessage, routerRecvQueueLen)
+		queues[id] = queue
+		go func(id string, queue <-chan InboundMessage, ch chan<- InboundMessage) {
+			for msg := range queue {
+				timeout, cancel := context.WithTimeout(ctx, timeout)
+				select {
+				case ch <- msg:
+				case <-timeout.Done():
+					logger.Warnf("receiver out timeout/cancelled on: %s", id)
+					r.metrics.timeouts.Inc("receiver", id)
+				}
+				cancel()
+			}
+			close(ch)
+			wgDeliver.Done()
+		}(id, queue, ch)
+	}
+
 	// Inbound Message handling
-	for msg := range inMsgCh {
-		// Pass to cmd manager if it is a command message
-		if r.cmd.isCmdMsg(msg.Text) {
-			r.cmdOut <- msg
-			continue
-		}
+	for inMsg := range inMsgCh {
+		r.metrics.inbound.Inc(inMsg.FromChannel.MessengerID)
+		for _, msg := range r.inMiddlewares.process(inMsg) {
+			// Pass to cmd manager if it is a command message
+			// Edited commands are not triggered again
+			if msg.Event == EventNewMessage && r.cmd.isCmdMsg(msg) {
+				r.cmdOut <- msg
+				continue
+			}
 
-		// Forward message to all listeners
-		for id, ch := range r.receiverOut {
-			timeout, cancel := context.WithTimeout(ctx, timeout)
-			select {
-			case ch <- msg:
-			case <-timeout.Done():
-				logger.Warnf("receiver out timeout/cancelled on: %s", id)
+			// Forward message to all listeners which accept the message
+			for id, queue := range queues {
+				if filter, ok := r.consumerFilter[id]; ok && !filter.Match(msg) {
+					continue
+				}
+				// Plugins disabled in the channel still need EventBotLeft to clean up
+				if r.settings != nil && msg.Event != EventBotLeft && !r.settings.isEnabled(msg.FromChannel, id) {
+					continue
+				}
+				select {
+				case queue <- msg:
+				default:
+					logger.Warnf("receiver queue full, message dropped on: %s", id)
+					r.metrics.drops.Inc(id)
+				}
 			}
-			cancel()
 		}
 	}
 
 	// If reach here, the handling channel is emptied and closed
-	// Close all outbound channels
-	for _, ch := range r.receiverOut {
-		close(ch)
+	// Close all consumer queues and wait until they are drained
+	for _, queue := range queues {
+		close(queue)
 	}
+	wgDeliver.Wait()
 	close(r.cmdOut)
 
 	logger.Info("terminated")
@@ -146,14 +300,19 @@ func (r *router) transmitter(ctx context.Context, timeout time.Duration) {
 	outMsgCh := make(chan OutboundMessage, routerTranHandleLen)
 
 	// Collect outbound messages
-	forward := func(ch <-chan OutboundMessage) {
+	// Messages are dropped if the producing plugin is disabled in the destination channel
+	forward := func(id string, ch <-chan OutboundMessage) {
 		for msg := range ch {
+			if r.settings != nil && !r.settings.isEnabled(msg.ToChannel, id) {
+				msg.ReportResult("", DeliveryError(ErrPluginDisabled, fmt.Errorf("%s in %s", id, msg.ToChannel.Name())))
+				continue
+			}
 			outMsgCh <- msg
 		}
 		wg.Done()
 	}
-	for _, ch := range r.transmitterIn {
-		go forward(ch)
+	for id, ch := range r.transmitterIn {
+		go forward(id, ch)
 	}
 
 	// Close handling channel when all outbound message channels are closed
@@ -162,31 +321,99 @@ func (r *router) transmitter(ctx context.Context, timeout time.Duration) {
 		close(outMsgCh)
 	}()
 
-	// Outbound message handling
-	for msg := range outMsgCh {
+	// Start sending queued retries
+	if err := r.retry.load(ctx); err != nil {
+		logger.Errorf("load retry queue failed: %s", err.Error())
+	}
+	retryStop := make(chan interface{})
+	retryDone := make(chan interface{})
+	go func() {
+		r.retry.start(retryStop)
+		close(retryDone)
+	}()
+	persistStop := make(chan interface{})
+	persistDone := make(chan interface{})
+	go func() {
+		r.retry.persister(persistStop)
+		close(persistDone)
+	}()
+
+	// Start delivering routines for each messenger
+	wgLane := sync.WaitGroup{}
+	lanes := make(map[string]*outboundLane)
+	for id, ch := range r.transmitterOut {
+		lane := newOutboundLane(id, ch, r.rateLimits[id], r.channelRateLimits[id], logger)
+		lanes[id] = lane
+		wgLane.Add(1)
+		go func() {
+			lane.start(ctx, timeout)
+			wgLane.Done()
+		}()
+	}
+
+	dispatch := func(msg OutboundMessage) {
 		id := msg.ToChannel.MessengerID
-		ch, ok := r.transmitterOut[id]
+		lane, ok := lanes[id]
 		if !ok {
 			logger.Errorf("messenger not found: %s", id)
-			continue
+			msg.ReportResult("", DeliveryError(ErrMessengerNotFound, fmt.Errorf("%s", id)))
+			return
 		}
 
 		timeout, cancel := context.WithTimeout(ctx, timeout)
 		select {
-		case ch <- msg:
+		case lane.queue <- msg:
+			r.metrics.outbound.Inc(id)
 		case <-timeout.Done():
 			logger.Warnf("transmitter out timeout/cancelled: %s", id)
+			r.metrics.timeouts.Inc("transmitter", id)
+			msg.ReportResult("", DeliveryError(ErrDeliveryTimeout, timeout.Err()))
 		}
 		cancel()
 	}
 
+	// Outbound message handling
+	// Retried messages have passed the middlewares already
+loop:
+	for {
+		select {
+		case outMsg, ok := <-outMsgCh:
+			if !ok {
+				break loop
+			}
+			for _, msg := range r.outMiddlewares.process(outMsg) {
+				id := msg.ToChannel.MessengerID
+				parts := msg.split(r.textLimits[id], r.renderers[id])
+				for i := range parts {
+					parts[i] = r.metrics.trackDelivery(parts[i])
+				}
+				dispatch(r.retry.track(parts[0], parts[1:]...))
+			}
+		case msg := <-r.retry.due:
+			dispatch(msg)
+		}
+	}
+
+	// Messages still queued are persisted and will be sent in next session
+	close(retryStop)
+	<-retryDone
+	for _, lane := range lanes {
+		close(lane.queue)
+	}
+	wgLane.Wait()
+
 	for _, ch := range r.transmitterOut {
 		close(ch)
 	}
+	close(persistStop)
+	<-persistDone
 	logger.Info("terminated")
 }
 
 func (r *router) start(ctx context.Context, recvTimeout time.Duration, transTimeout time.Duration) {
+	r.inMiddlewares.sort()
+	r.outMiddlewares.sort()
+
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	go func() {
@@ -3,6 +3,7 @@ package telepathy
 import (
 	"bytes"
 	"context"
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -11,6 +12,12 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// withoutResult clears OnResult set by the router, so that the message can be compared
+func withoutResult(msg OutboundMessage) OutboundMessage {
+	msg.OnResult = nil
+	return msg
+}
+
 func TestRouterRecv(t *testing.T) {
 	assert := assert.New(t)
 	router := newRouter()
@@ -49,6 +56,7 @@ func TestRouterRecvTimeout(t *testing.T) {
 	recvr := make(chan InboundMessage)
 	router.attachReceiver("recvr", recvr)
 	router.attachConsumer("TimeoutConsumer")
+	consumer := router.attachConsumer("Consumer")
 
 	done := make(chan interface{})
 	go func() {
@@ -68,14 +76,12 @@ func TestRouterRecvTimeout(t *testing.T) {
 	logrus.SetOutput(&log)
 	defer logrus.SetOutput(os.Stderr)
 
-	for {
+	// The stalled consumer should not block the other one
+	for i := 0; i < 3; i++ {
 		start := time.Now()
 		recvr <- msg
-		end := time.Now()
-		if end.Sub(start) >= time.Second {
-			assert.WithinDuration(start, end, 1200*time.Millisecond)
-			break
-		}
+		assert.Equal(msg, <-consumer)
+		assert.WithinDuration(start, time.Now(), 200*time.Millisecond)
 	}
 	close(recvr)
 	<-done
@@ -83,6 +89,85 @@ func TestRouterRecvTimeout(t *testing.T) {
 	assert.Contains(log.String(), "TimeoutConsumer")
 }
 
+func TestRouterRecvFilter(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	recvr := make(chan InboundMessage)
+	router.attachReceiver("recvr", recvr)
+	consumerAll := router.attachConsumer("All")
+	consumerDM := router.attachConsumer("DM")
+	router.setConsumerFilter("DM", MsgFilter{DirectMessageOnly: true})
+	assert.Panics(func() { router.setConsumerFilter("NotExist", MsgFilter{}) })
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	msg := InboundMessage{
+		FromChannel: Channel{
+			MessengerID: "msg",
+			ChannelID:   "ch",
+		},
+		Text: "test",
+	}
+	dmMsg := msg
+	dmMsg.IsDirectMessage = true
+
+	recvr <- msg
+	recvr <- dmMsg
+	close(recvr)
+
+	var all, dm []InboundMessage
+	for msg := range consumerAll {
+		all = append(all, msg)
+	}
+	for msg := range consumerDM {
+		dm = append(dm, msg)
+	}
+	<-done
+
+	assert.Equal([]InboundMessage{msg, dmMsg}, all)
+	assert.Equal([]InboundMessage{dmMsg}, dm)
+}
+
+func TestRouterRecvEditedCmd(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	recvr := make(chan InboundMessage)
+	router.attachReceiver("recvr", recvr)
+	consumer := router.attachConsumer("consumer")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	cmdMsg := InboundMessage{
+		FromChannel: Channel{
+			MessengerID: "msg",
+			ChannelID:   "ch",
+		},
+		Text: "teru info",
+	}
+	editedMsg := cmdMsg
+	editedMsg.Event = EventMessageEdited
+
+	recvr <- cmdMsg
+	recvr <- editedMsg
+	close(recvr)
+
+	// Only the new command message is passed to the command manager
+	var received []InboundMessage
+	for msg := range consumer {
+		received = append(received, msg)
+	}
+	<-done
+	assert.Equal([]InboundMessage{editedMsg}, received)
+}
+
 func TestRouterTrans(t *testing.T) {
 	assert := assert.New(t)
 	router := newRouter()
@@ -118,8 +203,8 @@ func TestRouterTrans(t *testing.T) {
 
 	assert.Equal(1, len(transA))
 	assert.Equal(1, len(transB))
-	assert.Equal(msgA, <-transA)
-	assert.Equal(msgB, <-transB)
+	assert.Equal(msgA, withoutResult(<-transA))
+	assert.Equal(msgB, withoutResult(<-transB))
 }
 
 func TestRouterTransTimeout(t *testing.T) {
@@ -178,4 +263,207 @@ func TestRouterAttachDuplicated(t *testing.T) {
 	prod := make(chan OutboundMessage)
 	router.attachProducer("prod", prod)
 	assert.Panics(func() { router.attachProducer("prod", prod) })
+
+	passIn := func(msg InboundMessage) []InboundMessage { return []InboundMessage{msg} }
+	router.attachInboundMiddleware("mid", 0, passIn)
+	assert.Panics(func() { router.attachInboundMiddleware("mid", 1, passIn) })
+	passOut := func(msg OutboundMessage) []OutboundMessage { return []OutboundMessage{msg} }
+	router.attachOutboundMiddleware("mid", 0, passOut)
+	assert.Panics(func() { router.attachOutboundMiddleware("mid", 1, passOut) })
+}
+
+func TestRouterInboundMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	recvr := make(chan InboundMessage)
+	router.attachReceiver("recvr", recvr)
+	consumer := router.attachConsumer("cons")
+
+	// Attached in reverse order, should be chained by order
+	router.attachInboundMiddleware("suffix", 2, func(msg InboundMessage) []InboundMessage {
+		msg.Text += "-suffix"
+		return []InboundMessage{msg}
+	})
+	router.attachInboundMiddleware("fanout", 1, func(msg InboundMessage) []InboundMessage {
+		if msg.Text != "fanout" {
+			return []InboundMessage{msg}
+		}
+		msgA, msgB := msg, msg
+		msgA.Text = "A"
+		msgB.Text = "B"
+		return []InboundMessage{msgA, msgB}
+	})
+	router.attachInboundMiddleware("drop", 0, func(msg InboundMessage) []InboundMessage {
+		if msg.Text == "drop" {
+			return nil
+		}
+		return []InboundMessage{msg}
+	})
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	msg := InboundMessage{
+		FromChannel: Channel{
+			MessengerID: "msg",
+			ChannelID:   "ch",
+		},
+	}
+	for _, text := range []string{"drop", "fanout", "text"} {
+		msg.Text = text
+		recvr <- msg
+	}
+	close(recvr)
+
+	texts := []string{}
+	for msg := range consumer {
+		texts = append(texts, msg.Text)
+	}
+	<-done
+
+	assert.Equal([]string{"A-suffix", "B-suffix", "text-suffix"}, texts)
+}
+
+func TestRouterOutboundMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	transA := router.attachTransmitter("transA")
+	transB := router.attachTransmitter("transB")
+
+	// Mirror messages sent to transA to transB
+	router.attachOutboundMiddleware("mirror", 0, func(msg OutboundMessage) []OutboundMessage {
+		if msg.ToChannel.MessengerID != "transA" {
+			return []OutboundMessage{msg}
+		}
+		mirror := msg
+		mirror.ToChannel.MessengerID = "transB"
+		return []OutboundMessage{msg, mirror}
+	})
+	router.attachOutboundMiddleware("mask", 1, func(msg OutboundMessage) []OutboundMessage {
+		if msg.Text == "secret" {
+			msg.Text = "******"
+		}
+		return []OutboundMessage{msg}
+	})
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	prod <- OutboundMessage{
+		ToChannel: Channel{
+			MessengerID: "transA",
+		},
+		Text:     "secret",
+		RichText: PlainRichText("secret"),
+	}
+	close(prod)
+	<-done
+
+	// RichText is dropped since it no longer matches the masked Text
+	expected := OutboundMessage{
+		ToChannel: Channel{
+			MessengerID: "transA",
+		},
+		Text: "******",
+	}
+	assert.Equal(1, len(transA))
+	assert.Equal(expected, withoutResult(<-transA))
+	expected.ToChannel.MessengerID = "transB"
+	assert.Equal(1, len(transB))
+	assert.Equal(expected, withoutResult(<-transB))
+}
+
+func TestMiddlewareRichText(t *testing.T) {
+	assert := assert.New(t)
+	chain := inboundChain{
+		{id: "format", handler: func(msg InboundMessage) []InboundMessage {
+			if msg.Text == "format" {
+				msg.Text = "formatted"
+				msg.RichText = RichText{{Type: RichBold, Children: PlainRichText("formatted")}}
+			}
+			return []InboundMessage{msg}
+		}},
+	}
+	rich := PlainRichText("text")
+	msgs := chain.process(InboundMessage{Text: "text", RichText: rich})
+	assert.Equal(rich, msgs[0].RichText)
+	msgs = chain.process(InboundMessage{Text: "format", RichText: PlainRichText("format")})
+	assert.Equal(RichText{{Type: RichBold, Children: PlainRichText("formatted")}}, msgs[0].RichText)
+}
+
+func TestRouterTransResult(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	results := make(chan DeliveryResult, 1)
+	msg := OutboundMessage{
+		ToChannel: Channel{
+			MessengerID: "NotExist",
+		},
+		Text:     "smth",
+		OnResult: func(result DeliveryResult) { results <- result },
+	}
+	prod <- msg
+	close(prod)
+	<-done
+
+	result := <-results
+	assert.Equal("", result.MessageID)
+	assert.True(errors.Is(result.Err, ErrMessengerNotFound))
+	assert.False(errors.Is(result.Err, ErrChannelGone))
+	assert.Equal(msg.ToChannel, result.Message.ToChannel)
+}
+
+func TestRouterTransSplit(t *testing.T) {
+	assert := assert.New(t)
+	router := newRouter()
+	router.setTextLimit("trans", 5)
+	router.retry.setPolicy("", RetryPolicy{BaseDelay: 10 * time.Millisecond})
+	prod := make(chan OutboundMessage)
+	router.attachProducer("prod", prod)
+	trans := router.attachTransmitter("trans")
+
+	done := make(chan interface{})
+	go func() {
+		router.start(context.Background(), time.Second, time.Second)
+		close(done)
+	}()
+
+	ch := Channel{MessengerID: "trans"}
+	results := make(chan DeliveryResult, 1)
+	prod <- OutboundMessage{ToChannel: ch, Text: "abc\ndef\ng", OnResult: func(result DeliveryResult) { results <- result }}
+
+	// The next part is sent once the previous part is delivered, even if it is retried
+	part := <-trans
+	assert.Equal(OutboundMessage{ToChannel: ch, Text: "abc"}, withoutResult(part))
+	part.ReportResult("", DeliveryError(ErrDeliveryTimeout, nil))
+	part = <-trans
+	assert.Equal(OutboundMessage{ToChannel: ch, Text: "abc"}, withoutResult(part))
+	part.ReportResult("1", nil)
+	part = <-trans
+	assert.Equal(OutboundMessage{ToChannel: ch, Text: "def\ng"}, withoutResult(part))
+	part.ReportResult("2", nil)
+
+	result := <-results
+	assert.NoError(result.Err)
+	assert.Equal("1", result.MessageID)
+
+	close(prod)
+	<-done
 }
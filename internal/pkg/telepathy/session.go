@@ -12,28 +12,69 @@ import (
 
 // Session defines a Telepathy server session
 type Session struct {
-	ctx       context.Context
-	db        *databaseHandler
-	webServer *httpServer
-	router    *router
-	plugins   map[string]Plugin
-	done      chan interface{}
-	logger    *logrus.Entry
+	ctx             context.Context
+	db              *databaseHandler
+	webServer       *httpServer
+	router          *router
+	routerTimeout   time.Duration
+	shutdownTimeout time.Duration
+	plugins         map[string]Plugin
+	supervisors     map[string]*supervisor
+	restartPolicy   RestartPolicy
+	kvStores        []*KVStore
+	metrics         *Metrics
+	health          *sessionHealth
+	done            chan interface{}
+	logger          *logrus.Entry
 }
 
 // SessionConfig defines the configurations of a Telepathy session
 type SessionConfig struct {
 	Port         string // Port Number for Webhook handling server
 	RootURL      string // URL to telepathy server
+	DatabaseType string // Database backend: DBTypeMongo (default), DBTypeFile or DBTypeMemory
 	MongoURL     string // URL to the MongoDB Server
 	DatabaseName string // MongoDB database name
+	DatabaseFile string // Path to the database file, used by DBTypeFile
+
+	RetryPolicy            RetryPolicy            // Default retry policy of outbound messages
+	MessengerRetryPolicies map[string]RetryPolicy // Retry policies for specific messengers, keyed by messenger ID
+	MessengerRateLimits    map[string]RateLimit   // Outbound rate limits of messengers, keyed by messenger ID
+	ChannelRateLimits      map[string]RateLimit   // Outbound rate limits of each channel, keyed by messenger ID
+
+	CommandPrefix   string        // Prefix of commands, "teru" if not set
+	CommandTimeout  time.Duration // Timeout of command handlers, defaultTimeout if not set
+	RouterTimeout   time.Duration // Timeout of passing messages to plugins, defaultTimeout if not set
+	ShutdownTimeout time.Duration // Timeout of shutting down the webhook server, defaultTimeout if not set
+
+	Operators             []string        // Bot operators, formatted with OperatorID, who have RoleOperator in all channels
+	MessengerDefaultRoles map[string]Role // Roles of users in messengers which can not resolve roles, keyed by messenger ID, RoleUser if not set
+
+	RestartPolicy RestartPolicy // Restart policy of plugins panicked
+
+	AdminToken   string // Bearer token of the admin API, which is disabled if not set
+	MetricsToken string // Bearer token required to scrape metrics, metrics are served without token if not set
+}
+
+const defaultTimeout = 5 * time.Second
+
+func orDefaultTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
 }
 
 // NewSession creates a new Telepathy session
 func NewSession(config SessionConfig, plugins []Plugin) (*Session, error) {
 	session := Session{
-		plugins: make(map[string]Plugin),
-		logger:  logrus.WithField("module", "session"),
+		plugins:         make(map[string]Plugin),
+		supervisors:     make(map[string]*supervisor),
+		restartPolicy:   config.RestartPolicy,
+		routerTimeout:   orDefaultTimeout(config.RouterTimeout),
+		shutdownTimeout: orDefaultTimeout(config.ShutdownTimeout),
+		logger:          logrus.WithField("module", "session"),
+		metrics:         newMetrics(),
 	}
 
 	session.logger.Info("initializing")
@@ -45,15 +86,45 @@ func NewSession(config SessionConfig, plugins []Plugin) (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	session.metrics.registerRuntime()
+	session.webServer.setMetrics(session.metrics)
+	session.webServer.adminToken = config.AdminToken
+	session.webServer.metricsToken = config.MetricsToken
 
 	// Init database
-	session.db, err = newDatabaseHandler(config.MongoURL, config.DatabaseName)
+	backend, err := newDatabaseBackend(config)
 	if err != nil {
 		return nil, err
 	}
+	session.db = newDatabaseHandler(backend)
+	session.db.setMetrics(session.metrics)
 
 	// Init Router
 	session.router = newRouter()
+	if config.CommandPrefix != "" {
+		session.router.cmd.cmdRoot.Trigger = config.CommandPrefix
+	}
+	session.router.cmd.timeout = orDefaultTimeout(config.CommandTimeout)
+	session.router.setMetrics(session.metrics)
+	session.router.retry.setPolicy("", config.RetryPolicy)
+	for id, policy := range config.MessengerRetryPolicies {
+		session.router.retry.setPolicy(id, policy)
+	}
+	for id, limit := range config.MessengerRateLimits {
+		session.router.setRateLimit(id, limit)
+	}
+	for id, limit := range config.ChannelRateLimits {
+		session.router.setChannelRateLimit(id, limit)
+	}
+	session.router.settings = newChannelSettings()
+	session.router.cmd.settings = session.router.settings
+	session.router.cmd.perm = newPermissions(config.Operators)
+	for id, role := range config.MessengerDefaultRoles {
+		session.router.cmd.perm.setDefaultRole(id, role)
+	}
+	retryStore := newKVStore(retryStoreNamespace)
+	session.db.attachRequester(retryStore.collection, retryStore.reqCh)
+	session.router.retry.kv = retryStore
 
 	// install plugins
 	for _, p := range plugins {
@@ -64,21 +135,54 @@ func NewSession(config SessionConfig, plugins []Plugin) (*Session, error) {
 	}
 
 	// install internal plugins
-	chPlugin := &channelService{}
+	chPlugin := &channelService{
+		settings:      session.router.settings,
+		defaultPrefix: session.router.cmd.cmdRoot.Trigger,
+	}
 	if _, ok := session.plugins[chPlugin.ID()]; ok {
 		return nil, fmt.Errorf("Invalid Plugin ID: %s", chPlugin.ID())
 	}
 	session.plugins[chPlugin.ID()] = chPlugin
+	err = session.router.cmd.attachCommandInterface(chPlugin.ID(), chPlugin.pluginCommand())
+	if err != nil {
+		return nil, err
+	}
+	err = session.router.cmd.attachCommandInterface(chPlugin.ID(), session.router.cmd.aliasCommand())
+	if err != nil {
+		return nil, err
+	}
+	err = session.router.cmd.attachCommandInterface(chPlugin.ID(), session.router.cmd.moreCommand())
+	if err != nil {
+		return nil, err
+	}
+	permPlugin := &permissionService{perm: session.router.cmd.perm}
+	if _, ok := session.plugins[permPlugin.ID()]; ok {
+		return nil, fmt.Errorf("Invalid Plugin ID: %s", permPlugin.ID())
+	}
+	session.plugins[permPlugin.ID()] = permPlugin
+	adminPlugin := newAdminService(func() HealthReport { return session.health.report() }, session.router.settings)
+	if _, ok := session.plugins[adminPlugin.ID()]; ok {
+		return nil, fmt.Errorf("Invalid Plugin ID: %s", adminPlugin.ID())
+	}
+	session.plugins[adminPlugin.ID()] = adminPlugin
 
+	session.health = newSessionHealth(session.db.health, session.plugins)
+	session.webServer.health = session.health
 	session.initPlugin()
 
 	return &session, nil
 }
 
+// isInternalPlugin returns true for the plugins installed by Session
+func isInternalPlugin(id string) bool {
+	return id == channelServiceID || id == permissionServiceID || id == adminServiceID
+}
+
 func (s *Session) initPlugin() {
 	// For each plugin go through all implemented interfaces and
 	// fuse them with framework modules
 	logger := s.logger.WithField("phase", "init-plugin")
+	metrics := newSupervisorMetrics(s.metrics)
 	for id, p := range s.plugins {
 		logger.Infof("init plugin: %s", id)
 		// See plugin.go for interface definitions
@@ -87,18 +191,47 @@ func (s *Session) initPlugin() {
 			logger.Panicf("plugin id mismatch, map id: %s plugin id: %s", id, p.ID())
 		}
 		p.SetLogger(logrus.WithField("plugin", id))
+		sup := newSupervisor(p, s.restartPolicy, metrics)
+		sup.health = s.health
+		s.supervisors[id] = sup
 
 		// Go through all interface implementations
+		// Channels are attached again by the supervisor if the plugin is restarted
 		if pmsg, ok := p.(PluginMessenger); ok {
-			s.router.attachReceiver(id, pmsg.InMsgChannel())
-			pmsg.AttachOutMsgChannel(s.router.attachTransmitter(id))
+			s.router.attachReceiver(id, sup.relayInbound(pmsg.InMsgChannel()))
+			outMsgCh := s.router.attachTransmitter(id)
+			pmsg.AttachOutMsgChannel(outMsgCh)
+			sup.onRestart(func() {
+				sup.inRelay.switchTo(pmsg.InMsgChannel())
+				pmsg.AttachOutMsgChannel(outMsgCh)
+			})
+		}
+
+		if plimit, ok := p.(PluginTextLimiter); ok {
+			s.router.setTextLimit(id, plimit.MaxTextLength())
+		}
+
+		if prender, ok := p.(PluginTextRenderer); ok {
+			s.router.setRenderer(id, prender.RenderText)
+		}
+
+		if prate, ok := p.(PluginRateLimiter); ok {
+			limit, channelLimit := prate.DefaultRateLimits()
+			s.router.setDefaultRateLimits(id, limit, channelLimit)
+		}
+
+		if prole, ok := p.(PluginRoleProvider); ok {
+			s.router.cmd.perm.attachProvider(id, prole)
 		}
 
 		if pcmd, ok := p.(PluginCommandHandler); ok {
-			err := s.router.cmd.attachCommandInterface(pcmd.Command(s.router.cmd.done))
+			err := s.router.cmd.attachCommandInterface(id, pcmd.Command(s.router.cmd.done))
 			if err != nil {
 				logger.WithField("plugin", p.ID()).Panicf(err.Error())
 			}
+			if !isInternalPlugin(id) {
+				s.router.settings.addSwitchable(id)
+			}
 		}
 
 		if pwebh, ok := p.(PluginWebhookHandler); ok {
@@ -113,17 +246,59 @@ func (s *Session) initPlugin() {
 			pwebh.SetWebhookURL(urlMap)
 		}
 
+		if padmin, ok := p.(PluginAdminHandler); ok {
+			for pattern, handler := range padmin.AdminHandlers() {
+				if err := s.webServer.registerAdmin(pattern, handler); err != nil {
+					logger.Panicf(err.Error())
+				}
+			}
+		}
+
 		if pcon, ok := p.(PluginMsgConsumer); ok {
-			pcon.AttachInMsgChannel(s.router.attachConsumer(id))
+			inMsgCh := s.router.attachConsumer(id)
+			if pfilter, ok := p.(PluginMsgFilteredConsumer); ok {
+				s.router.setConsumerFilter(id, pfilter.MsgFilter())
+			}
+			pcon.AttachInMsgChannel(inMsgCh)
+			sup.onRestart(func() { pcon.AttachInMsgChannel(inMsgCh) })
+			s.router.settings.addSwitchable(id)
 		}
 
 		if ppro, ok := p.(PluginMsgProducer); ok {
-			s.router.attachProducer(id, ppro.OutMsgChannel())
+			s.router.attachProducer(id, sup.relayOutbound(ppro.OutMsgChannel()))
+			sup.onRestart(func() { sup.outRelay.switchTo(ppro.OutMsgChannel()) })
+		}
+
+		if pin, ok := p.(PluginInboundMiddleware); ok {
+			s.router.attachInboundMiddleware(id, pin.MiddlewareOrder(), pin.InboundMiddleware)
+		}
+
+		if pout, ok := p.(PluginOutboundMiddleware); ok {
+			s.router.attachOutboundMiddleware(id, pout.MiddlewareOrder(), pout.OutboundMiddleware)
 		}
 
 		if pdb, ok := p.(PluginDatabaseUser); ok {
 			s.db.attachRequester(id, pdb.DBRequestChannel())
 		}
+
+		if pkv, ok := p.(PluginKVUser); ok {
+			store := newKVStore(id)
+			s.db.attachRequester(store.collection, store.reqCh)
+			s.kvStores = append(s.kvStores, store)
+			pkv.AttachKVStore(store)
+			sup.onRestart(func() { pkv.AttachKVStore(store) })
+			if plegacy, ok := p.(PluginLegacyImporter); ok {
+				sup.importer = &legacyImporter{id: id, plugin: plegacy, kv: store, logger: sup.logger}
+			}
+		}
+
+		if pmetrics, ok := p.(PluginMetricsUser); ok {
+			pmetrics.AttachMetrics(s.metrics.forPlugin(id))
+		}
+
+		if ppanic, ok := p.(PluginPanicHandler); ok {
+			ppanic.AttachPanicHandler(sup.recover)
+		}
 	}
 }
 
@@ -133,8 +308,8 @@ func (s *Session) Start(ctx context.Context) {
 
 	wgBackend := sync.WaitGroup{}
 	// Start database
+	wgBackend.Add(1)
 	go func() {
-		wgBackend.Add(1)
 		err := s.db.start(ctx)
 		if err != nil {
 			s.db.logger.Errorf(err.Error())
@@ -142,36 +317,38 @@ func (s *Session) Start(ctx context.Context) {
 		wgBackend.Done()
 	}()
 
-	// Start plugins
+	// Start plugins, panicked plugins are restarted by supervisors
 	wgPlugin := sync.WaitGroup{}
-	startPlugin := func(f func()) {
+	for _, sup := range s.supervisors {
 		wgPlugin.Add(1)
-		f()
-		wgPlugin.Done()
-	}
-	for _, plugin := range s.plugins {
-		go startPlugin(plugin.Start)
+		go func(sup *supervisor) {
+			sup.run()
+			wgPlugin.Done()
+		}(sup)
 	}
 
 	// Start router
+	routerDone := make(chan interface{})
 	go func() {
-		wgBackend.Add(1)
-		s.router.start(ctx, 5*time.Second, 5*time.Second)
-		wgBackend.Done()
+		s.router.start(ctx, s.routerTimeout, s.routerTimeout)
+		close(routerDone)
 	}()
 
 	// Start Webhook handling server
 	s.logger.Info("starting web server")
 	s.webServer.finalize()
-	go s.webServer.ListenAndServe()
+	if err := s.webServer.start(); err != nil {
+		s.logger.Errorf("failed to start web server: %s", err.Error())
+	}
 
 	// Wait here until we received termination signal
 	<-s.done
 	s.logger.Info("terminating")
+	s.health.stop()
 
 	// Termination process
 	// Shutdown Http server
-	timeout, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout, stop := context.WithTimeout(context.Background(), s.shutdownTimeout)
 	err := s.webServer.Shutdown(timeout)
 	stop()
 	if err != nil {
@@ -181,12 +358,22 @@ func (s *Session) Start(ctx context.Context) {
 	s.logger.Info("httpserver shutdown")
 
 	// Terminate plugins
-	for _, plugin := range s.plugins {
-		plugin.Stop()
+	for _, sup := range s.supervisors {
+		sup.stop()
 	}
 	wgPlugin.Wait()
 	s.logger.Info("all plugins terminated")
 
+	// KV stores are no longer used after plugins are terminated
+	for _, store := range s.kvStores {
+		store.close()
+	}
+
+	// The retry store is used by the router until all queued messages are persisted
+	<-routerDone
+	s.logger.Info("router terminated")
+	s.router.retry.kv.close()
+
 	// Wait for backend service
 	wgBackend.Wait()
 	s.logger.Info("all backend services terminated")
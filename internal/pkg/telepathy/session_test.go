@@ -2,15 +2,15 @@ package telepathy_test
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
@@ -104,11 +104,28 @@ func newSessionConfig() *telepathy.SessionConfig {
 	return &telepathy.SessionConfig{
 		Port:         "80",
 		RootURL:      "http://localhost",
-		MongoURL:     "mongodb://mongo:27017/test",
-		DatabaseName: "SessionTest",
+		DatabaseType: telepathy.DBTypeMemory,
 	}
 }
 
+// waitReady waits until /readyz of the session responds 200, and returns the health report
+func waitReady(t *testing.T, config *telepathy.SessionConfig) telepathy.HealthReport {
+	report := telepathy.HealthReport{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(config.RootURL + "/readyz")
+		if err != nil {
+			continue
+		}
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return report
+		}
+	}
+	t.Fatalf("session is not ready: %+v", report)
+	return report
+}
+
 func TestSessionIntegration(t *testing.T) {
 	assert := assert.New(t)
 	config := newSessionConfig()
@@ -149,6 +166,11 @@ func TestSessionIntegration(t *testing.T) {
 		session.Start(context.Background())
 		close(done)
 	}()
+	report := waitReady(t, config)
+	assert.True(report.Live)
+	assert.Equal(telepathy.HealthUp, report.Database.Status)
+	assert.Contains(report.Plugins, "MSGR")
+	assert.Contains(report.Plugins, "SVC")
 
 	// Webhook -> Msgr -> Cmd -> SVC -> OutMsg
 	resp, err := http.Post(pluginMsgr.urls["test-hook"].String(), "text/plain",
@@ -172,10 +194,8 @@ func TestSessionIntegration(t *testing.T) {
 	testVal := "dbTest"
 	retCh := make(chan interface{})
 	pluginSvc.dbChannel <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			_, err := collection.InsertOne(ctx, bson.M{"Key": testVal})
-			assert.NoError(err)
+		Action: func(ctx context.Context, db telepathy.Database) interface{} {
+			assert.NoError(db.Store(ctx, "testCollection", "Key", testVal))
 			return testVal
 		},
 		Return: retCh,
@@ -187,27 +207,10 @@ func TestSessionIntegration(t *testing.T) {
 
 	retCh = make(chan interface{})
 	pluginSvc.dbChannel <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("testCollection")
-			result := collection.FindOne(ctx, map[string]string{"Key": value})
-			if !assert.NoError(result.Err()) {
-				return ""
-			}
-			raw, err := result.DecodeBytes()
-			if !assert.NoError(err) {
-				return ""
-			}
-			readValue, err := raw.LookupErr("Key")
-			if !assert.NoError(err) {
-				return ""
-			}
-			ret, ok := readValue.StringValueOK()
-			if !assert.True(ok) {
-				return ""
-			}
-			delResult, err := collection.DeleteMany(ctx, map[string]string{"Key": value})
-			assert.NoError(err)
-			assert.Equal(int64(1), delResult.DeletedCount)
+		Action: func(ctx context.Context, db telepathy.Database) interface{} {
+			ret := ""
+			assert.NoError(db.Load(ctx, "testCollection", "Key", &ret))
+			assert.NoError(db.Delete(ctx, "testCollection", "Key"))
 			return ret
 		},
 		Return: retCh,
@@ -245,7 +248,7 @@ func TestSessionCtxDatabase(t *testing.T) {
 
 	retCh := make(chan interface{})
 	pluginSvc.dbChannel <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
+		Action: func(ctx context.Context, db telepathy.Database) interface{} {
 			<-ctx.Done()
 			return "done"
 		},
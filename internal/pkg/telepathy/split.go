@@ -0,0 +1,133 @@
+package telepathy
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// splitText splits text into parts of at most limit characters at line boundaries
+// Lines longer than limit are split anywhere
+func splitText(text string, limit int) []string {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+	parts := []string{}
+	part := strings.Builder{}
+	partLen, started := 0, false
+	flush := func() {
+		if started {
+			parts = append(parts, part.String())
+		}
+		part.Reset()
+		partLen, started = 0, false
+	}
+	for _, line := range strings.Split(text, "\n") {
+		runes := []rune(line)
+		if started && partLen+1+len(runes) > limit {
+			flush()
+		}
+		if len(runes) > limit {
+			for len(runes) > limit {
+				parts = append(parts, string(runes[:limit]))
+				runes = runes[limit:]
+			}
+			if len(runes) == 0 {
+				continue
+			}
+		}
+		if started {
+			part.WriteByte('\n')
+			partLen++
+		}
+		part.WriteString(string(runes))
+		partLen += len(runes)
+		started = true
+	}
+	flush()
+	return parts
+}
+
+// split splits a message with text longer than limit characters into multiple messages
+// The length is measured on the text rendered by render, or Text if render is nil
+// Only ActionSend is split, and RichText is sent as plain text if it is split
+// AsName is shortened if it leaves less than half of limit for the text
+// Attachments are sent with the last message, and OnResult is called once all messages are reported,
+// with the ID of the first message and the first error
+func (om OutboundMessage) split(limit int, render func(OutboundMessage) string) []OutboundMessage {
+	if om.Action != ActionSend || limit <= 0 {
+		return []OutboundMessage{om}
+	}
+	length := func(msg OutboundMessage) int {
+		if render != nil {
+			return utf8.RuneCountInString(render(msg))
+		}
+		return utf8.RuneCountInString(msg.Text)
+	}
+	if length(om) <= limit {
+		return []OutboundMessage{om}
+	}
+
+	text := om.Text
+	if om.RichText != nil {
+		text = om.RichText.PlainText()
+	}
+	// Leave room for the text added by the messenger, e.g. the name of the sender
+	// A long name is shortened so that at least half of each part is left for the text
+	asName := om.AsName
+	overhead := func(asName string) int {
+		return length(OutboundMessage{Action: om.Action, ToChannel: om.ToChannel, AsName: asName})
+	}
+	room := limit - overhead(asName)
+	if minRoom := (limit + 1) / 2; room < minRoom && asName != "" {
+		name := []rune(asName)
+		// One character is taken by the ellipsis
+		keep := len(name) - (minRoom - room) - 1
+		asName = ""
+		if keep > 0 {
+			asName = string(name[:keep]) + "…"
+		}
+		room = limit - overhead(asName)
+	}
+	if room < 1 {
+		room = 1
+	}
+	parts := splitText(text, room)
+
+	msgs := make([]OutboundMessage, len(parts))
+	results := make([]DeliveryResult, len(parts))
+	lock := sync.Mutex{}
+	reported := 0
+	for i, part := range parts {
+		msg := om
+		msg.AsName = asName
+		msg.Text = part
+		msg.RichText = nil
+		if i != len(parts)-1 {
+			msg.Attachments = nil
+		}
+		if om.OnResult != nil {
+			i := i
+			msg.OnResult = func(result DeliveryResult) {
+				lock.Lock()
+				results[i] = result
+				reported++
+				done := reported == len(parts)
+				lock.Unlock()
+				if !done {
+					return
+				}
+				result = results[0]
+				for _, r := range results {
+					if r.Err != nil {
+						result.Err = r.Err
+						break
+					}
+				}
+				om.OnResult(result)
+			}
+		}
+		msgs[i] = msg
+	}
+	return msgs
+}
@@ -0,0 +1,122 @@
+package telepathy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		parts []string
+	}{
+		{"abc", 0, []string{"abc"}},
+		{"abc", 3, []string{"abc"}},
+		{"ab\ncd\nef", 5, []string{"ab\ncd", "ef"}},
+		{"ab\n\ncd", 4, []string{"ab\n", "cd"}},
+		{"abcdefg\nh", 3, []string{"abc", "def", "g\nh"}},
+		{"abcdef\ngh", 3, []string{"abc", "def", "gh"}},
+		{"一二三\n四五", 4, []string{"一二三", "四五"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.parts, splitText(test.text, test.limit), test.text)
+	}
+}
+
+func TestOutboundMessageSplit(t *testing.T) {
+	assert := assert.New(t)
+	results := []DeliveryResult{}
+	msg := OutboundMessage{
+		Text:        strings.Repeat("a", 10) + "\n" + strings.Repeat("b", 10),
+		Attachments: []Attachment{{}},
+		OnResult: func(result DeliveryResult) {
+			results = append(results, result)
+		},
+	}
+	assert.Len(msg.split(21, nil), 1)
+
+	msg.RichText = PlainRichText(msg.Text)
+	parts := msg.split(15, nil)
+	if !assert.Len(parts, 2) {
+		return
+	}
+	assert.Equal(strings.Repeat("a", 10), parts[0].Text)
+	assert.Nil(parts[0].RichText)
+	assert.Empty(parts[0].Attachments)
+	assert.Len(parts[1].Attachments, 1)
+
+	// OnResult is called once with the ID of the first message and the first error
+	parts[1].ReportResult("2", errors.New("failed"))
+	assert.Empty(results)
+	parts[0].ReportResult("1", nil)
+	if assert.Len(results, 1) {
+		assert.Equal("1", results[0].MessageID)
+		assert.EqualError(results[0].Err, "failed")
+	}
+
+	// Other actions are not split
+	msg.Action = ActionEdit
+	assert.Len(msg.split(15, nil), 1)
+}
+
+func TestOutboundMessageSplitRendered(t *testing.T) {
+	assert := assert.New(t)
+	render := func(msg OutboundMessage) string {
+		text := msg.Text
+		if msg.RichText != nil {
+			text = msg.RichText.Render(func(node RichNode, content string) string {
+				if node.Type == RichBold {
+					return "**" + content + "**"
+				}
+				return content
+			})
+		}
+		if msg.AsName != "" {
+			text = "[" + msg.AsName + "]\n" + text
+		}
+		return text
+	}
+	msg := OutboundMessage{
+		Text:     "*aaaaaaaa*",
+		RichText: RichText{{Type: RichBold, Children: PlainRichText("aaaaaaaa")}},
+	}
+	assert.Len(msg.split(12, render), 1)
+
+	// The plain text is sent if the rendered markup is too long
+	parts := msg.split(10, render)
+	if assert.Len(parts, 1) {
+		assert.Equal("aaaaaaaa", parts[0].Text)
+		assert.Nil(parts[0].RichText)
+	}
+
+	// Parts leave room for the name of the sender
+	msg = OutboundMessage{AsName: "bob", Text: "aaaa\nbbbb\ncccc"}
+	parts = msg.split(15, render)
+	if assert.Len(parts, 2) {
+		assert.Equal("aaaa\nbbbb", parts[0].Text)
+		assert.Equal("cccc", parts[1].Text)
+	}
+
+	// Names taking most of the limit are shortened
+	msg = OutboundMessage{AsName: "a very long name of the sender", Text: strings.Repeat("x", 30)}
+	parts = msg.split(20, render)
+	if assert.Len(parts, 3) {
+		for _, part := range parts {
+			assert.Equal("a very…", part.AsName)
+			assert.True(utf8.RuneCountInString(render(part)) <= 20)
+		}
+	}
+
+	// Names are dropped if there is no room even for a shortened one
+	msg = OutboundMessage{AsName: "bob", Text: strings.Repeat("x", 10)}
+	parts = msg.split(5, render)
+	if assert.Len(parts, 2) {
+		assert.Empty(parts[0].AsName)
+		assert.Equal("xxxxx", parts[0].Text)
+	}
+}
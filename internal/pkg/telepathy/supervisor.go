@@ -0,0 +1,319 @@
+package telepathy
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	supervisorComponent = "supervisor"
+
+	defaultRestartMaxFailures = 5
+	defaultRestartBaseDelay   = time.Second
+	defaultRestartMaxDelay    = time.Minute
+)
+
+// errPluginPanic wraps the panics recovered from plugins
+var errPluginPanic = errors.New("panic")
+
+// RestartPolicy defines how plugins are restarted after Start panics
+// Zero value fields are replaced with default values
+type RestartPolicy struct {
+	MaxFailures int           // Consecutive failures before the plugin is reported degraded, it is still restarted after that
+	BaseDelay   time.Duration // Delay before the first restart, doubled for each further consecutive failure
+	MaxDelay    time.Duration // Upper bound of the delay, a plugin running longer than MaxDelay is considered recovered
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.MaxFailures <= 0 {
+		p.MaxFailures = defaultRestartMaxFailures
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRestartBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRestartMaxDelay
+	}
+	return p
+}
+
+// delay returns the backoff delay after the given number of consecutive failures
+func (p RestartPolicy) delay(failures int) time.Duration {
+	return RetryPolicy{BaseDelay: p.BaseDelay, MaxDelay: p.MaxDelay}.delay(failures)
+}
+
+// supervisorMetrics are the metrics of plugin failures, the zero value ignores all updates
+type supervisorMetrics struct {
+	panics   *Counter
+	restarts *Counter
+}
+
+func newSupervisorMetrics(m *Metrics) supervisorMetrics {
+	return supervisorMetrics{
+		panics:   m.Counter("plugin_panics_total", "Panics recovered from plugins", "plugin"),
+		restarts: m.Counter("plugin_restarts_total", "Plugins restarted after panics", "plugin"),
+	}
+}
+
+// supervisor runs Start of a plugin, recovers panics and restarts the plugin with backoff
+// Legacy documents of the plugin are imported before the first Start, a failed import is retried the same way
+// Channels provided by the plugin are passed to the router through relays, and are wired again
+// with the channels the restarted plugin provides. A plugin panicked repeatedly is reported degraded
+type supervisor struct {
+	id       string
+	plugin   Plugin
+	policy   RestartPolicy
+	health   *sessionHealth
+	metrics  supervisorMetrics
+	inRelay  *inboundRelay
+	outRelay *outboundRelay
+	rewire   []func()
+	importer *legacyImporter
+	stopping chan interface{}
+	stopOnce sync.Once
+	logger   *logrus.Entry
+}
+
+func newSupervisor(plugin Plugin, policy RestartPolicy, metrics supervisorMetrics) *supervisor {
+	return &supervisor{
+		id:       plugin.ID(),
+		plugin:   plugin,
+		policy:   policy.withDefaults(),
+		metrics:  metrics,
+		stopping: make(chan interface{}),
+		logger:   logrus.WithFields(logrus.Fields{"module": "supervisor", "plugin": plugin.ID()}),
+	}
+}
+
+// relayInbound returns the channel passing messages from ch, the InMsgChannel of the plugin
+func (s *supervisor) relayInbound(ch <-chan InboundMessage) <-chan InboundMessage {
+	s.inRelay = newInboundRelay(ch)
+	return s.inRelay.out
+}
+
+// relayOutbound returns the channel passing messages from ch, the OutMsgChannel of the plugin
+func (s *supervisor) relayOutbound(ch <-chan OutboundMessage) <-chan OutboundMessage {
+	s.outRelay = newOutboundRelay(ch)
+	return s.outRelay.out
+}
+
+// onRestart registers f to wire the plugin again before it is restarted
+func (s *supervisor) onRestart(f func()) {
+	s.rewire = append(s.rewire, f)
+}
+
+// run starts the plugin, and returns once Start returns without panic or the session is stopping
+func (s *supervisor) run() {
+	if s.inRelay != nil {
+		go s.inRelay.start()
+	}
+	if s.outRelay != nil {
+		go s.outRelay.start()
+	}
+
+	failures := 0
+	for {
+		s.health.setState(s.id, PluginRunning)
+		started := time.Now()
+		var recovered *time.Timer
+		if failures > 0 {
+			recovered = time.AfterFunc(s.policy.MaxDelay, func() { s.health.recovered(s.id) })
+		}
+		err := s.start()
+		if recovered != nil {
+			recovered.Stop()
+		}
+		if err == nil {
+			s.health.exited(s.id)
+			return
+		}
+
+		if time.Since(started) >= s.policy.MaxDelay {
+			failures = 0
+		}
+		failures++
+		if errors.Is(err, errPluginPanic) {
+			s.metrics.panics.Inc(s.id)
+		}
+		s.health.failed(s.id, err, failures >= s.policy.MaxFailures)
+		s.health.setState(s.id, PluginRestarting)
+
+		// The plugin is not restarted once the session is stopping
+		select {
+		case <-s.stopping:
+			s.release()
+			return
+		default:
+		}
+		delay := s.policy.delay(failures)
+		s.logger.Errorf("restarting in %s after %d consecutive failure(s)", delay, failures)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.stopping:
+			timer.Stop()
+			s.release()
+			return
+		}
+
+		s.logger.Info("restarting")
+		for _, rewire := range s.rewire {
+			rewire()
+		}
+		s.metrics.restarts.Inc(s.id)
+	}
+}
+
+// start calls Start of the plugin, and recovers the panic as error
+func (s *supervisor) start() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errPluginPanic, r)
+			s.logger.Errorf("%s\n%s", err.Error(), debug.Stack())
+		}
+	}()
+	if err := s.importer.run(); err != nil {
+		s.logger.Errorf("legacy import failed: %s", err.Error())
+		return fmt.Errorf("legacy import: %w", err)
+	}
+	s.plugin.Start()
+	return nil
+}
+
+// recover records panics recovered by the plugin in goroutines other than the one calling Start
+// The plugin is still running, so it is not restarted
+func (s *supervisor) recover(r interface{}) {
+	err := fmt.Errorf("%w: %v", errPluginPanic, r)
+	s.logger.Errorf("%s\n%s", err.Error(), debug.Stack())
+	s.metrics.panics.Inc(s.id)
+	s.health.failed(s.id, err, false)
+}
+
+// stop stops the plugin, the plugin is no longer restarted after that
+func (s *supervisor) stop() {
+	s.stopOnce.Do(func() { close(s.stopping) })
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Errorf("panic while stopping: %v\n%s", r, debug.Stack())
+		}
+	}()
+	s.plugin.Stop()
+}
+
+// release closes the relays of a plugin terminated by panic, which would never close its channels
+func (s *supervisor) release() {
+	s.health.exited(s.id)
+	if s.inRelay != nil {
+		s.inRelay.release()
+	}
+	if s.outRelay != nil {
+		s.outRelay.release()
+	}
+}
+
+// inboundRelay passes messages from the InMsgChannel of a plugin to the router
+// out is closed once the source channel is closed, or the relay is released
+type inboundRelay struct {
+	out      chan InboundMessage
+	source   chan (<-chan InboundMessage)
+	released chan interface{}
+	once     sync.Once
+	done     chan interface{}
+	ch       <-chan InboundMessage
+}
+
+func newInboundRelay(ch <-chan InboundMessage) *inboundRelay {
+	return &inboundRelay{
+		out:      make(chan InboundMessage),
+		source:   make(chan (<-chan InboundMessage)),
+		released: make(chan interface{}),
+		done:     make(chan interface{}),
+		ch:       ch,
+	}
+}
+
+func (r *inboundRelay) start() {
+	defer close(r.done)
+	defer close(r.out)
+	ch := r.ch
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.out <- msg
+		case ch = <-r.source:
+		case <-r.released:
+			return
+		}
+	}
+}
+
+// switchTo passes messages from ch instead, unless the relay is closed
+func (r *inboundRelay) switchTo(ch <-chan InboundMessage) {
+	select {
+	case r.source <- ch:
+	case <-r.done:
+	}
+}
+
+func (r *inboundRelay) release() {
+	r.once.Do(func() { close(r.released) })
+}
+
+// outboundRelay passes messages from the OutMsgChannel of a plugin to the router
+// out is closed once the source channel is closed, or the relay is released
+type outboundRelay struct {
+	out      chan OutboundMessage
+	source   chan (<-chan OutboundMessage)
+	released chan interface{}
+	once     sync.Once
+	done     chan interface{}
+	ch       <-chan OutboundMessage
+}
+
+func newOutboundRelay(ch <-chan OutboundMessage) *outboundRelay {
+	return &outboundRelay{
+		out:      make(chan OutboundMessage),
+		source:   make(chan (<-chan OutboundMessage)),
+		released: make(chan interface{}),
+		done:     make(chan interface{}),
+		ch:       ch,
+	}
+}
+
+func (r *outboundRelay) start() {
+	defer close(r.done)
+	defer close(r.out)
+	ch := r.ch
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.out <- msg
+		case ch = <-r.source:
+		case <-r.released:
+			return
+		}
+	}
+}
+
+// switchTo passes messages from ch instead, unless the relay is closed
+func (r *outboundRelay) switchTo(ch <-chan OutboundMessage) {
+	select {
+	case r.source <- ch:
+	case <-r.done:
+	}
+}
+
+func (r *outboundRelay) release() {
+	r.once.Do(func() { close(r.released) })
+}
@@ -0,0 +1,268 @@
+package telepathy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// panicMessenger panics in the first panics Starts, and provides a new InMsgChannel each time
+type panicMessenger struct {
+	panics  int
+	inMsg   chan InboundMessage
+	running chan chan InboundMessage
+	done    chan interface{}
+}
+
+func newPanicMessenger(panics int) *panicMessenger {
+	return &panicMessenger{
+		panics:  panics,
+		inMsg:   make(chan InboundMessage),
+		running: make(chan chan InboundMessage, 1),
+		done:    make(chan interface{}),
+	}
+}
+
+func (m *panicMessenger) ID() string                                   { return "panic" }
+func (m *panicMessenger) SetLogger(_ *logrus.Entry)                    {}
+func (m *panicMessenger) InMsgChannel() <-chan InboundMessage          { return m.inMsg }
+func (m *panicMessenger) AttachOutMsgChannel(_ <-chan OutboundMessage) {}
+
+func (m *panicMessenger) Start() {
+	if m.panics > 0 {
+		m.panics--
+		m.inMsg = make(chan InboundMessage)
+		panic("boom")
+	}
+	m.running <- m.inMsg
+	<-m.done
+}
+
+func (m *panicMessenger) Stop() {
+	close(m.done)
+	close(m.inMsg)
+}
+
+func waitState(t *testing.T, health *sessionHealth, id string, state PluginState) {
+	for i := 0; i < 100; i++ {
+		if health.report().Plugins[id].State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("plugin %s is not %s", id, state)
+}
+
+func newTestSupervisor(plugin Plugin, policy RestartPolicy, metrics *Metrics) *supervisor {
+	sup := newSupervisor(plugin, policy, newSupervisorMetrics(metrics))
+	sup.health = newSessionHealth(func() ComponentHealth { return ComponentHealth{Status: HealthUp} },
+		map[string]Plugin{plugin.ID(): plugin})
+	return sup
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	assert := assert.New(t)
+	metrics := newMetrics()
+	plugin := newPanicMessenger(2)
+	sup := newTestSupervisor(plugin, RestartPolicy{MaxFailures: 2, BaseDelay: 10 * time.Millisecond}, metrics)
+	inMsg := sup.relayInbound(plugin.InMsgChannel())
+	sup.onRestart(func() { sup.inRelay.switchTo(plugin.InMsgChannel()) })
+
+	done := make(chan interface{})
+	go func() {
+		sup.run()
+		close(done)
+	}()
+
+	var ch chan InboundMessage
+	select {
+	case ch = <-plugin.running:
+	case <-time.After(time.Second):
+		t.Fatal("plugin is not restarted")
+	}
+
+	// Messages from the channel provided after restart are relayed
+	ch <- InboundMessage{Text: "relayed"}
+	assert.Equal("relayed", (<-inMsg).Text)
+
+	report := sup.health.report()
+	assert.Equal(PluginRunning, report.Plugins["panic"].State)
+	assert.Equal(ComponentHealth{Status: HealthDegraded, Detail: "2 failure(s), last: panic: boom"},
+		report.Plugins["panic"].Components[supervisorComponent])
+	assert.True(report.Live)
+	assert.True(report.Ready)
+	exposition := scrape(metrics)
+	assert.Contains(exposition, `telepathy_plugin_panics_total{plugin="panic"} 2`)
+	assert.Contains(exposition, `telepathy_plugin_restarts_total{plugin="panic"} 2`)
+
+	sup.health.stop()
+	sup.stop()
+	<-done
+	_, ok := <-inMsg
+	assert.False(ok)
+	assert.Equal(PluginStopped, sup.health.report().Plugins["panic"].State)
+}
+
+// resourceMessenger adds an event handler to a source shared by all Starts, like a client library
+// Start removes its handler with defer, and panics after adding it in the first run
+type resourceMessenger struct {
+	lock     sync.Mutex
+	handlers map[int]func(event string)
+	seq      int
+	inMsg    chan InboundMessage
+	panics   int
+	running  chan interface{}
+	done     chan interface{}
+}
+
+func (m *resourceMessenger) ID() string                                   { return "resource" }
+func (m *resourceMessenger) SetLogger(_ *logrus.Entry)                    {}
+func (m *resourceMessenger) InMsgChannel() <-chan InboundMessage          { return m.inMsg }
+func (m *resourceMessenger) AttachOutMsgChannel(_ <-chan OutboundMessage) {}
+
+func (m *resourceMessenger) addHandler(handler func(event string)) func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.seq++
+	id := m.seq
+	m.handlers[id] = handler
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.handlers, id)
+	}
+}
+
+// emit calls all handlers with event
+func (m *resourceMessenger) emit(event string) {
+	m.lock.Lock()
+	handlers := []func(string){}
+	for _, handler := range m.handlers {
+		handlers = append(handlers, handler)
+	}
+	m.lock.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+func (m *resourceMessenger) Start() {
+	remove := m.addHandler(func(event string) {
+		m.inMsg <- InboundMessage{Text: event}
+	})
+	defer remove()
+
+	if m.panics > 0 {
+		m.panics--
+		panic("boom")
+	}
+	m.running <- nil
+	<-m.done
+}
+
+func (m *resourceMessenger) Stop() {
+	close(m.done)
+}
+
+func TestSupervisorRestartResources(t *testing.T) {
+	assert := assert.New(t)
+	plugin := &resourceMessenger{
+		handlers: make(map[int]func(string)),
+		inMsg:    make(chan InboundMessage, 10),
+		panics:   2,
+		running:  make(chan interface{}),
+		done:     make(chan interface{}),
+	}
+	sup := newTestSupervisor(plugin, RestartPolicy{BaseDelay: 10 * time.Millisecond}, nil)
+	done := make(chan interface{})
+	go func() {
+		sup.run()
+		close(done)
+	}()
+	select {
+	case <-plugin.running:
+	case <-time.After(time.Second):
+		t.Fatal("plugin is not restarted")
+	}
+
+	// Handlers of the panicked Starts are removed, so events are handled once
+	plugin.emit("event")
+	assert.Equal("event", (<-plugin.inMsg).Text)
+	assert.Empty(plugin.inMsg)
+
+	sup.stop()
+	<-done
+	assert.Empty(plugin.handlers)
+}
+
+func TestSupervisorRecovered(t *testing.T) {
+	assert := assert.New(t)
+	plugin := newPanicMessenger(1)
+	sup := newTestSupervisor(plugin, RestartPolicy{MaxFailures: 1, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}, nil)
+	sup.relayInbound(plugin.InMsgChannel())
+	go sup.run()
+	<-plugin.running
+
+	assert.Equal(HealthDegraded, sup.health.report().Plugins["panic"].Components[supervisorComponent].Status)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(HealthUp, sup.health.report().Plugins["panic"].Components[supervisorComponent].Status)
+	sup.stop()
+}
+
+func TestSupervisorStop(t *testing.T) {
+	assert := assert.New(t)
+	plugin := newPanicMessenger(1)
+	sup := newTestSupervisor(plugin, RestartPolicy{BaseDelay: time.Hour}, nil)
+	inMsg := sup.relayInbound(plugin.InMsgChannel())
+	outMsg := sup.relayOutbound(make(chan OutboundMessage))
+
+	done := make(chan interface{})
+	go func() {
+		sup.run()
+		close(done)
+	}()
+	waitState(t, sup.health, "panic", PluginRestarting)
+
+	// Relays of the panicked plugin are closed when it is stopped during backoff
+	sup.health.stop()
+	sup.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("supervisor is not stopped")
+	}
+	_, ok := <-inMsg
+	assert.False(ok)
+	_, ok = <-outMsg
+	assert.False(ok)
+	assert.Equal(PluginStopped, sup.health.report().Plugins["panic"].State)
+}
+
+func TestSupervisorPanicHandler(t *testing.T) {
+	assert := assert.New(t)
+	metrics := newMetrics()
+	sup := newTestSupervisor(newPanicMessenger(0), RestartPolicy{}, metrics)
+	sup.recover(errors.New("nil pointer"))
+	sup.recover(errors.New("index out of range"))
+
+	assert.Equal(ComponentHealth{Status: HealthUp, Detail: "2 failure(s), last: panic: index out of range"},
+		sup.health.report().Plugins["panic"].Components[supervisorComponent])
+	assert.Contains(scrape(metrics), `telepathy_plugin_panics_total{plugin="panic"} 2`)
+}
+
+func TestRestartPolicy(t *testing.T) {
+	assert := assert.New(t)
+	policy := RestartPolicy{}.withDefaults()
+	assert.Equal(RestartPolicy{
+		MaxFailures: defaultRestartMaxFailures,
+		BaseDelay:   defaultRestartBaseDelay,
+		MaxDelay:    defaultRestartMaxDelay,
+	}, policy)
+	assert.Equal(time.Second, policy.delay(1))
+	assert.Equal(4*time.Second, policy.delay(3))
+	assert.Equal(time.Minute, policy.delay(10))
+}
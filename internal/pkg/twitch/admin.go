@@ -0,0 +1,91 @@
+package twitch
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// adminSub is a subscription of a channel in the admin API
+type adminSub struct {
+	Topic    string     `json:"topic"`
+	Key      string     `json:"key"`
+	Channel  string     `json:"channel"`
+	Verified bool       `json:"verified"`
+	Expire   *time.Time `json:"expire,omitempty"` // Lease expiry of the websub subscription
+}
+
+// AdminHandlers implements telepathy.PluginAdminHandler
+func (s *Service) AdminHandlers() map[string]telepathy.HTTPHandler {
+	return map[string]telepathy.HTTPHandler{
+		"twitch-subscriptions": s.adminSubs,
+	}
+}
+
+// adminSubs lists the subscriptions with GET,
+// and removes the subscription of a channel given by topic, key and channel queries with DELETE
+func (s *Service) adminSubs(response http.ResponseWriter, request *http.Request) {
+	if atomic.LoadInt32(&s.subscribed) != 1 {
+		telepathy.WriteAdminError(response, http.StatusServiceUnavailable, errors.New("subscriptions are not loaded"))
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		subs := []adminSub{}
+		now := time.Now()
+		for topic, subtable := range s.topics() {
+			for _, key := range subtable.getKeys() {
+				params := topicParams(topic, key)
+				load, verified := s.verifiedSubs.Load(subscriptionKey(topic, &params))
+				expire, _ := load.(time.Time)
+				verified = verified && expire.After(now)
+				channels, _ := subtable.getList(key)
+				for channel := range channels {
+					sub := adminSub{Topic: topic, Key: key, Channel: channel.Name(), Verified: verified}
+					if verified {
+						sub.Expire = &expire
+					}
+					subs = append(subs, sub)
+				}
+			}
+		}
+		sort.Slice(subs, func(i, j int) bool {
+			if subs[i].Topic != subs[j].Topic {
+				return subs[i].Topic < subs[j].Topic
+			}
+			if subs[i].Key != subs[j].Key {
+				return subs[i].Key < subs[j].Key
+			}
+			return subs[i].Channel < subs[j].Channel
+		})
+		telepathy.WriteAdminJSON(response, http.StatusOK, subs)
+	case http.MethodDelete:
+		query := request.URL.Query()
+		topic, key := query.Get("topic"), query.Get("key")
+		subtable, ok := s.topics()[topic]
+		if !ok {
+			telepathy.WriteAdminError(response, http.StatusBadRequest, errors.New("invalid topic"))
+			return
+		}
+		channel, err := telepathy.ParseAdminChannel(query.Get("channel"))
+		if err != nil {
+			telepathy.WriteAdminError(response, http.StatusBadRequest, err)
+			return
+		}
+		// The websub subscription is terminated on the next notification or renewal, as unsubscribing by commands
+		if _, removed := subtable.remove(key, channel); !removed {
+			telepathy.WriteAdminError(response, http.StatusNotFound, errors.New("subscription does not exist"))
+			return
+		}
+		s.deleteSub(request.Context(), topic, key, channel)
+		s.logger.Infof("subscription removed by admin API: %s %s %s", topic, key, channel.Name())
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		telepathy.WriteAdminError(response, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
@@ -110,8 +109,8 @@ func (s *Service) subscribeStream(ctx context.Context, userID string) <-chan int
 	ret := make(chan interface{})
 	go func() {
 		defer close(ret)
-		hubparams := make(url.Values)
-		hubparams.Add("user_id", userID)
+		defer s.recoverHandler()
+		hubparams := topicParams("streams", userID)
 		err := s.subscription(ctx, "streams", &hubparams, true)
 		if err != nil {
 			logger.Errorf(err.Error())
@@ -127,7 +126,7 @@ func (s *Service) streamChanged(request *http.Request, body []byte) int {
 	logger := s.logger.WithField("phase", "streamChanged")
 
 	userID := request.URL.Query().Get("user_id")
-	chList, ok := s.subTopics["streams"].getList(userID)
+	chList, ok := s.topics()["streams"].getList(userID)
 	if !ok {
 		// no subscribers, reply 410 to terminate the subscription
 		logger.Warnf("get callback but not subscribers, do unsub. user_id: %s", userID)
@@ -10,6 +10,12 @@ import (
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
+// Cooldown of commands calling Twitch API, to save the quota of Helix
+var apiCooldown = telepathy.Cooldown{
+	Channel: 5 * time.Second,
+	User:    15 * time.Second,
+}
+
 // Command implements telepathy.PluginCommandHandler
 func (s *Service) Command(done <-chan interface{}) *argo.Action {
 	s.cmdDone = done
@@ -23,7 +29,7 @@ func (s *Service) Command(done <-chan interface{}) *argo.Action {
 		ShortDescr: "Subscribe to stream change",
 		ArgNames:   []string{"user-name"},
 		MinConsume: 1,
-		Do:         s.subStream,
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, telepathy.CommandCooldown(apiCooldown, s.subStream)),
 	})
 
 	cmd.AddSubAction(argo.Action{
@@ -31,7 +37,7 @@ func (s *Service) Command(done <-chan interface{}) *argo.Action {
 		ShortDescr: "Unsubscribe to stream change",
 		ArgNames:   []string{"user-name"},
 		MinConsume: 1,
-		Do:         s.unsubStream,
+		Do:         telepathy.CommandRequireRole(telepathy.RoleAdmin, s.unsubStream),
 	})
 
 	cmd.AddSubAction(argo.Action{
@@ -45,7 +51,7 @@ func (s *Service) Command(done <-chan interface{}) *argo.Action {
 		ShortDescr: "Get user information",
 		ArgNames:   []string{"user-name"},
 		MinConsume: 1,
-		Do:         s.queryUser,
+		Do:         telepathy.CommandCooldown(apiCooldown, s.queryUser),
 	})
 
 	cmd.AddSubAction(argo.Action{
@@ -53,7 +59,7 @@ func (s *Service) Command(done <-chan interface{}) *argo.Action {
 		ShortDescr: "Get user's stream information",
 		ArgNames:   []string{"user-name"},
 		MinConsume: 1,
-		Do:         s.queryStream,
+		Do:         telepathy.CommandCooldown(apiCooldown, s.queryStream),
 	})
 
 	return cmd
@@ -82,13 +88,14 @@ func (s *Service) subStream(state *argo.State, extraArgs ...interface{}) error {
 	}
 
 	// Check if already subscribed
-	subtable := s.subTopics["streams"]
+	subtable := s.topics()["streams"]
 	channel := extArg.Message.FromChannel
 	userIDExists, channelExists := subtable.lookUpOrAdd(*userID, channel)
 	if channelExists {
 		fmt.Fprintf(&state.OutputStr, "Already subscribed to user: %s", userLogin)
 		return nil
 	}
+	s.storeSub(ctx, "streams", *userID, channel)
 
 	streamChan := s.api.streamByLogin(ctx, userLogin)
 	success := func() {
@@ -119,12 +126,14 @@ func (s *Service) subStream(state *argo.State, extraArgs ...interface{}) error {
 	case _, subOk := <-subResult:
 		if !subOk {
 			subtable.remove(*userID, channel)
+			s.deleteSub(context.Background(), "streams", *userID, channel)
 			return errors.New("subscribeStream failed")
 		}
 		success()
 		return nil
 	case <-ctx.Done():
 		subtable.remove(*userID, channel)
+		s.deleteSub(context.Background(), "streams", *userID, channel)
 		fmt.Fprintf(&state.OutputStr, "Request timeout, please try again later.")
 	}
 	return nil
@@ -151,13 +160,14 @@ func (s *Service) unsubStream(state *argo.State, extraArgs ...interface{}) error
 	}
 
 	// Check if subscribed
-	subtable := s.subTopics["streams"]
+	subtable := s.topics()["streams"]
 	channel := extArg.Message.FromChannel
 	_, channelRemoved := subtable.remove(*userID, channel)
 	if !channelRemoved {
 		fmt.Fprintf(&state.OutputStr, "This channel didn't subscribed to: %s", userLogin)
 		return nil
 	}
+	s.deleteSub(ctx, "streams", *userID, channel)
 
 	// Note: We dont really do unsubsscribe request here
 	// the subscription will be terminated when:
@@ -175,7 +185,7 @@ func (s *Service) listSubs(state *argo.State, extraArgs ...interface{}) error {
 	}
 	channel := extArg.Message.FromChannel
 	fmt.Fprint(&state.OutputStr, "== Twitch Stream Subs ==")
-	subs := s.subTopics["streams"].contains(channel)
+	subs := s.topics()["streams"].contains(channel)
 	if len(subs) == 0 {
 		return nil
 	}
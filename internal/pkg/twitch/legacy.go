@@ -0,0 +1,95 @@
+package twitch
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
+
+// Subscriptions of each topic were stored as {"ID": <topic>, "Table": [[key, [channel, ...]], ...]}
+// in the "twitch" collection before they are kept in KVStore
+const (
+	legacyCollection = "twitch"
+	legacyField      = "Table"
+)
+
+var legacyTopics = []string{"streams"}
+
+// LegacyDocuments implements telepathy.PluginLegacyImporter
+func (s *Service) LegacyDocuments() []telepathy.LegacyDocument {
+	docs := make([]telepathy.LegacyDocument, 0, len(legacyTopics))
+	for _, topic := range legacyTopics {
+		docs = append(docs, telepathy.LegacyDocument{Collection: legacyCollection, ID: topic, Field: legacyField})
+	}
+	return docs
+}
+
+// ImportLegacy implements telepathy.PluginLegacyImporter
+func (s *Service) ImportLegacy(ctx context.Context, doc telepathy.LegacyDocument, data bson.RawValue) error {
+	subs, err := parseLegacyTable(data)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for key, channels := range subs {
+		for _, channel := range channels {
+			err := s.kv.Put(ctx, recordKey(doc.ID, key, channel), subRecord{Key: key, Channel: channel})
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	s.logger.Infof("%d subscription(s) of %s imported", count, doc.ID)
+	return nil
+}
+
+// parseLegacyTable returns the subscribed channels of each key
+func parseLegacyTable(data bson.RawValue) (map[string][]telepathy.Channel, error) {
+	table, ok := data.ArrayOK()
+	if !ok {
+		return nil, errors.New("legacy table is not an array")
+	}
+	entries, err := table.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make(map[string][]telepathy.Channel)
+	for _, entry := range entries {
+		pair, ok := entry.ArrayOK()
+		if !ok {
+			return nil, errors.New("legacy table: entry is not an array")
+		}
+		values, err := pair.Values()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, errors.New("legacy table: entry is not of 2 elements")
+		}
+		key, ok := values[0].StringValueOK()
+		if !ok {
+			return nil, errors.New("legacy table: key is not a string")
+		}
+		list, ok := values[1].ArrayOK()
+		if !ok {
+			return nil, errors.New("legacy table: channel list is not an array")
+		}
+		rawChannels, err := list.Values()
+		if err != nil {
+			return nil, err
+		}
+		for _, rawChannel := range rawChannels {
+			channel := telepathy.Channel{}
+			if err := rawChannel.Unmarshal(&channel); err != nil {
+				return nil, err
+			}
+			subs[key] = append(subs[key], channel)
+		}
+	}
+	return subs, nil
+}
@@ -3,14 +3,12 @@ package twitch
 import (
 	"sync"
 
-	"github.com/mongodb/mongo-go-driver/bson"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 type table struct {
-	lock  sync.RWMutex
-	data  map[string]map[telepathy.Channel]bool
-	dirty bool
+	lock sync.RWMutex
+	data map[string]map[telepathy.Channel]bool
 }
 
 func newTable() *table {
@@ -19,12 +17,6 @@ func newTable() *table {
 	}
 }
 
-func (t *table) isDirty() bool {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
-	return t.dirty
-}
-
 func (t *table) getKeys() []string {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
@@ -42,13 +34,11 @@ func (t *table) lookUpOrAdd(key string, channel telepathy.Channel) (keyExists bo
 	if !keyExists {
 		chExists = false
 		t.data[key] = map[telepathy.Channel]bool{channel: true}
-		t.dirty = true
 		return
 	}
 	_, chExists = chmap[channel]
 	if !chExists {
 		chmap[channel] = true
-		t.dirty = true
 	}
 	return
 }
@@ -76,7 +66,6 @@ func (t *table) remove(key string, channel telepathy.Channel) (keyRemoved bool,
 	if !chExists {
 		return false, false
 	}
-	t.dirty = true
 	delete(chmap, channel)
 	if len(chmap) == 0 {
 		delete(t.data, key)
@@ -94,7 +83,6 @@ func (t *table) add(key string, channel telepathy.Channel) bool {
 	chmap, ok := t.data[key]
 	if !ok {
 		t.data[key] = map[telepathy.Channel]bool{channel: true}
-		t.dirty = true
 		return true
 	}
 
@@ -103,7 +91,6 @@ func (t *table) add(key string, channel telepathy.Channel) bool {
 	}
 
 	chmap[channel] = true
-	t.dirty = true
 	return true
 }
 
@@ -127,62 +114,3 @@ func (t *table) getList(key string) (map[telepathy.Channel]bool, bool) {
 	}
 	return copy, ok
 }
-
-func (t *table) bson() *bson.A {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	array := bson.A{}
-
-	for key, list := range t.data {
-		chArray := bson.A{}
-		for channel := range list {
-			chArray = append(chArray, channel)
-		}
-		array = append(array, bson.A{key, chArray})
-	}
-
-	t.dirty = false
-	return &array
-}
-
-func (t *table) fromBSON(raw bson.RawValue) error {
-	t.lock.Lock()
-	t.lock.Unlock()
-	array := raw.Array()
-
-	elements, err := array.Elements()
-	if err != nil {
-		return err
-	}
-
-	t.data = make(map[string]map[telepathy.Channel]bool)
-	for _, element := range elements {
-		pair := element.Value().Array()
-		var key string
-		err = pair.Index(0).Value().Unmarshal(&key)
-		if err != nil {
-			return err
-		}
-
-		chRawArray := pair.Index(1).Value().Array()
-		chElements, err := chRawArray.Elements()
-		if err != nil {
-			return err
-		}
-
-		list := make(map[telepathy.Channel]bool)
-		for _, rawCh := range chElements {
-			var ch telepathy.Channel
-			err = rawCh.Value().Unmarshal(&ch)
-			if err != nil {
-				return err
-			}
-			list[ch] = true
-		}
-
-		t.data[key] = list
-	}
-
-	t.dirty = false
-	return nil
-}
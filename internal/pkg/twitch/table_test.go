@@ -1,6 +1,31 @@
 package twitch
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+
+	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
+)
 
 func TestTableInsert(t *testing.T) {
 }
+
+func TestParseLegacyTable(t *testing.T) {
+	channel := telepathy.Channel{MessengerID: "msg", ChannelID: "ch"}
+	// Written the way subscriptions were stored in the "twitch" collection
+	doc, err := bson.Marshal(bson.M{"ID": "streams", legacyField: bson.A{bson.A{"123", bson.A{channel}}}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	subs, err := parseLegacyTable(bson.Raw(doc).Lookup(legacyField))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := map[string][]telepathy.Channel{"123": {channel}}
+	if !reflect.DeepEqual(expected, subs) {
+		t.Errorf("legacy table is not parsed: %v", subs)
+	}
+}
@@ -5,26 +5,31 @@ package twitch
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-	"github.com/mongodb/mongo-go-driver/mongo"
-	"github.com/mongodb/mongo-go-driver/mongo/options"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/kavenc/telepathy/internal/pkg/telepathy"
 )
 
 const (
 	twitchURL      = "https://www.twitch.tv/"
-	dbSyncInterval = 10 * time.Minute
 	notifIDTimeout = 5 * time.Minute
+	kvTimeout      = 10 * time.Second
 )
 
+// subRecord is a subscription stored in KV store
+type subRecord struct {
+	Key     string
+	Channel telepathy.Channel
+}
+
 type notification struct {
 	request *http.Request
 	body    []byte
@@ -37,18 +42,23 @@ type Service struct {
 	telepathy.PluginCommandHandler
 	telepathy.PluginWebhookHandler
 	telepathy.PluginMsgProducer
-	telepathy.PluginDatabaseUser
+	telepathy.PluginKVUser
+	telepathy.PluginMsgFilteredConsumer
 
 	cmdDone <-chan interface{}
+	msgIn   <-chan telepathy.InboundMessage
 	msgOut  chan telepathy.OutboundMessage
-	dbReq   chan telepathy.DatabaseRequest
+	kv      *telepathy.KVStore
 
 	webhookURL *url.URL
 
 	api *twitchAPI
 
-	subTopics     map[string]*table // topic -> user id -> [channels]
+	subLock       sync.RWMutex
+	subTopics     map[string]*table // topic -> user id -> [channels], replaced as a whole on Start
 	verifyingSubs sync.Map
+	verifiedSubs  sync.Map // subscriptionKey -> lease expiry time
+	subscribed    int32    // Set to 1 once stored subscriptions are subscribed on start
 
 	// Notification handling routine
 	notifQueue  chan *notification
@@ -64,11 +74,6 @@ type Service struct {
 
 	streamStatus sync.Map // UserID -> stream status
 
-	// DB routine
-	dbCtx    context.Context
-	dbCancel context.CancelFunc
-	dbDone   chan interface{}
-
 	// HMAC secret for validating incoming notifications
 	WebsubSecret []byte
 
@@ -78,7 +83,8 @@ type Service struct {
 	// The client secret of twitch API
 	ClientSecret string
 
-	logger *logrus.Entry
+	panicHandler func(interface{})
+	logger       *logrus.Entry
 }
 
 // ID implements telepathy.Plugin interface
@@ -91,9 +97,30 @@ func (s *Service) SetLogger(logger *logrus.Entry) {
 	s.logger = logger
 }
 
+// AttachPanicHandler implements telepathy.PluginPanicHandler
+func (s *Service) AttachPanicHandler(handler func(interface{})) {
+	s.panicHandler = handler
+}
+
+// recoverHandler recovers panics in routines started by Start, which are not recovered by the session
+func (s *Service) recoverHandler() {
+	if r := recover(); r != nil {
+		s.recovered(r)
+	}
+}
+
+func (s *Service) recovered(r interface{}) {
+	if s.panicHandler == nil {
+		s.logger.Errorf("handler panicked: %v", r)
+		return
+	}
+	s.panicHandler(r)
+}
+
 // Start implements telepathy.Plugin interface
 func (s *Service) Start() {
 	// Initialize
+	atomic.StoreInt32(&s.subscribed, 0)
 	s.notifQueue = make(chan *notification, 10)
 	s.notifCtx, s.notifCancel = context.WithCancel(context.Background())
 	s.notifDone = make(chan interface{})
@@ -101,20 +128,30 @@ func (s *Service) Start() {
 
 	s.renewCtx, s.renewCancel = context.WithCancel(context.Background())
 
-	s.dbCtx, s.dbCancel = context.WithCancel(context.Background())
-	s.dbDone = make(chan interface{})
+	// Routines started here are stopped even if Start panics,
+	// otherwise they run along with the ones started by Start called again
+	stop := make(chan interface{})
+	defer func() {
+		close(stop)
+		s.renewCancel()
+		s.notifCancel()
+	}()
 
 	s.api = newTwitchAPI(s.ClientID, s.ClientSecret,
 		string(s.WebsubSecret), s.webhookURL, s.logger)
 
-	s.subTopics = make(map[string]*table)
-
 	// - Supported Topics
+	topics := map[string]*table{"streams": newTable()}
+	if err := s.loadFromKV("streams", topics["streams"]); err != nil {
+		s.logger.Errorf("load subscriptions failed: %s", err.Error())
+	}
+	s.subLock.Lock()
+	s.subTopics = topics
+	s.subLock.Unlock()
+
 	wg := sync.WaitGroup{}
 	ctx, cancel := context.WithTimeout(context.Background(), reqTimeOut)
-	s.subTopics["streams"] = newTable()
-	s.loadFromDB("streams")
-	for _, userID := range s.subTopics["streams"].getKeys() {
+	for _, userID := range topics["streams"].getKeys() {
 		wg.Add(1)
 		go func(id string) {
 			<-s.subscribeStream(ctx, id)
@@ -123,17 +160,20 @@ func (s *Service) Start() {
 	}
 	wg.Wait()
 	cancel()
+	atomic.StoreInt32(&s.subscribed, 1)
 
-	go s.dbUpdateRoutine()
+	go s.notifHandler(s.notifCtx, s.notifQueue, s.notifDone)
 
-	go s.notifHandler()
+	msgDone := make(chan interface{})
+	go func() {
+		s.msgHandler(stop)
+		close(msgDone)
+	}()
 
 	s.logger.Info("started")
 	// Wait for close
 	<-s.cmdDone
-
-	// write back db
-	s.dbCancel()
+	<-msgDone
 
 	// Cancel all websub renewal routines
 	s.renewCancel()
@@ -143,13 +183,34 @@ func (s *Service) Start() {
 	<-s.notifDone
 	close(s.msgOut)
 
-	// wait for writeback
-	<-s.dbDone
-	close(s.dbReq)
-
 	s.logger.Info("terminated")
 }
 
+// Health implements telepathy.PluginHealthReporter
+// Subscriptions are not critical, and never block readiness as the hub verifies them through webhooks
+func (s *Service) Health() map[string]telepathy.ComponentHealth {
+	subs := telepathy.ComponentHealth{Status: telepathy.HealthDegraded, Detail: "subscribing"}
+	if atomic.LoadInt32(&s.subscribed) == 1 {
+		now := time.Now()
+		total, verified := 0, 0
+		for topic, subtable := range s.topics() {
+			for _, key := range subtable.getKeys() {
+				total++
+				params := topicParams(topic, key)
+				load, ok := s.verifiedSubs.Load(subscriptionKey(topic, &params))
+				if expire, _ := load.(time.Time); ok && expire.After(now) {
+					verified++
+				}
+			}
+		}
+		subs.Detail = fmt.Sprintf("%d of %d subscription(s) verified", verified, total)
+		if verified == total {
+			subs.Status = telepathy.HealthUp
+		}
+	}
+	return map[string]telepathy.ComponentHealth{"subscriptions": subs}
+}
+
 // Stop implements telepathy.Plugin interface
 func (s *Service) Stop() {
 
@@ -163,79 +224,97 @@ func (s *Service) OutMsgChannel() <-chan telepathy.OutboundMessage {
 	return s.msgOut
 }
 
-// DBRequestChannel implements telepathy.PluginDatabaseUser
-func (s *Service) DBRequestChannel() <-chan telepathy.DatabaseRequest {
-	if s.dbReq == nil {
-		s.dbReq = make(chan telepathy.DatabaseRequest, 1)
-	}
-	return s.dbReq
+// AttachInMsgChannel implements telepathy.PluginMsgConsumer
+func (s *Service) AttachInMsgChannel(ch <-chan telepathy.InboundMessage) {
+	s.msgIn = ch
 }
 
-func (s *Service) dbUpdateRoutine() {
-	defer close(s.dbDone)
-	logger := s.logger.WithField("phase", "dbRoutine")
-
-	do := func() {
-		for topic, table := range s.subTopics {
-			if table.isDirty() {
-				<-s.writeToDB(topic)
-				logger.Infof("topic: %s written to DB", topic)
-			}
-		}
-	}
+// MsgFilter implements telepathy.PluginMsgFilteredConsumer
+// Only channels the bot is removed from are handled, to clean up their subscriptions
+func (s *Service) MsgFilter() telepathy.MsgFilter {
+	return telepathy.MsgFilter{Events: []telepathy.InboundEvent{telepathy.EventBotLeft}}
+}
 
+// msgHandler handles messages until the inbound channel is closed, or stop is closed if Start panicked
+func (s *Service) msgHandler(stop <-chan interface{}) {
 	for {
+		var message telepathy.InboundMessage
 		select {
-		case <-time.After(dbSyncInterval):
-			do()
-		case <-s.dbCtx.Done():
-			do()
+		case msg, ok := <-s.msgIn:
+			if !ok {
+				return
+			}
+			message = msg
+		case <-stop:
 			return
 		}
+		s.removeChannel(message.FromChannel)
 	}
 }
 
-func (s *Service) writeToDB(topic string) chan interface{} {
-	logger := s.logger.WithField("phase", "writeToDB")
-	retCh := make(chan interface{}, 1)
-	tableBSON := s.subTopics[topic].bson()
-	s.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			dbBSON := bson.M{"ID": topic, "Table": *tableBSON}
-			collection := db.Collection("twitch")
-			result, err := collection.ReplaceOne(ctx,
-				map[string]string{"ID": topic}, dbBSON, options.Replace().SetUpsert(true))
-			if err != nil {
-				logger.Error("error when writing table back to DB: " + err.Error())
+// removeChannel removes the subscriptions of a channel which is gone, a panic only drops the message
+func (s *Service) removeChannel(channel telepathy.Channel) {
+	defer s.recoverHandler()
+	for topic, subtable := range s.topics() {
+		for _, key := range subtable.contains(channel) {
+			if _, removed := subtable.remove(key, channel); removed {
+				s.logger.Infof("channel is gone, subscription removed: %s %s %s", topic, key, channel.Name())
+				s.deleteSub(context.Background(), topic, key, channel)
 			}
-			return result
-		},
-		Return: retCh,
+		}
 	}
-	return retCh
-}
-
-func (s *Service) loadFromDB(topic string) error {
-	retCh := make(chan interface{}, 1)
-	s.dbReq <- telepathy.DatabaseRequest{
-		Action: func(ctx context.Context, db *mongo.Database) interface{} {
-			collection := db.Collection("twitch")
-			result := collection.FindOne(ctx, map[string]string{"ID": topic})
-			raw, err := result.DecodeBytes()
-			if err != nil {
-				return err
-			}
-			return raw.Lookup("Table")
-		},
-		Return: retCh,
+}
+
+// AttachKVStore implements telepathy.PluginKVUser
+func (s *Service) AttachKVStore(kv *telepathy.KVStore) {
+	s.kv = kv
+}
+
+// recordKey returns the KV store key of a subscription
+func recordKey(topic, key string, channel telepathy.Channel) string {
+	return fmt.Sprintf("%s/%s/%s", topic, key, channel.Name())
+}
+
+func (s *Service) storeSub(ctx context.Context, topic, key string, channel telepathy.Channel) {
+	ctx, cancel := context.WithTimeout(ctx, kvTimeout)
+	defer cancel()
+	err := s.kv.Put(ctx, recordKey(topic, key, channel), subRecord{Key: key, Channel: channel})
+	if err != nil {
+		s.logger.WithField("phase", "storeSub").Errorf("%s: %s", recordKey(topic, key, channel), err.Error())
 	}
+}
 
-	// Wait until DB operation is done
-	result := <-retCh
-	if err, ok := result.(error); ok {
+func (s *Service) deleteSub(ctx context.Context, topic, key string, channel telepathy.Channel) {
+	ctx, cancel := context.WithTimeout(ctx, kvTimeout)
+	defer cancel()
+	err := s.kv.Delete(ctx, recordKey(topic, key, channel))
+	if err != nil {
+		s.logger.WithField("phase", "deleteSub").Errorf("%s: %s", recordKey(topic, key, channel), err.Error())
+	}
+}
+
+// topics returns the subscription tables of all topics, the map must not be modified
+func (s *Service) topics() map[string]*table {
+	s.subLock.RLock()
+	defer s.subLock.RUnlock()
+	return s.subTopics
+}
+
+// loadFromKV adds the subscriptions to topic stored in KV store to subtable
+func (s *Service) loadFromKV(topic string, subtable *table) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+	defer cancel()
+	keys, err := s.kv.List(ctx, topic+"/")
+	if err != nil {
 		return err
 	}
 
-	bsonValue, _ := result.(bson.RawValue)
-	return s.subTopics[topic].fromBSON(bsonValue)
+	for _, key := range keys {
+		record := subRecord{}
+		if err := s.kv.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		subtable.add(record.Key, record.Channel)
+	}
+	return nil
 }
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
 )
 
 type websubReq struct {
@@ -81,6 +82,21 @@ func (s *Service) websubValidate(response http.ResponseWriter, req *http.Request
 	response.Write([]byte(req.URL.Query().Get("hub.challenge")))
 }
 
+// topicParams returns the parameters of the topic to subscribe to the updates of key
+func topicParams(topic, key string) url.Values {
+	params := make(url.Values)
+	switch topic {
+	case "streams":
+		params.Add("user_id", key)
+	}
+	return params
+}
+
+// subscriptionKey identifies a subscription to a topic with params
+func subscriptionKey(topic string, params *url.Values) string {
+	return fmt.Sprintf("%s?%s", topic, params.Encode())
+}
+
 func webSubID(query url.Values) string {
 	return fmt.Sprintf("%s&%s", query.Get("hub.topic"), query.Get("hub.mode"))
 }
@@ -106,51 +122,75 @@ func (s *Service) handleNotification(req *http.Request, body []byte) <-chan int
 
 // notifHandler handles websub notification callbacks in centeralized manner
 // we need to predefine the handlers so that it is possible to gracefully shutdown everything
-func (s *Service) notifHandler() {
+// It returns once queue is closed, or ctx is done if Start panicked, and closes done
+func (s *Service) notifHandler(ctx context.Context, queue <-chan *notification, done chan interface{}) {
+	defer close(done)
 	logger := s.logger.WithField("phase", "notifHandler")
-	for notification := range s.notifQueue {
-		req := notification.request
-		ret := notification.status
-		body := notification.body
-
-		notifID := notification.request.Header.Get("Twitch-Notification-Id")
-		if len(notifID) == 0 {
-			logger.Warnf("notification without ID")
-			logger.Warn(notification.request.Header)
-			logger.Warn(notification.body)
-			ret <- 200
-			continue
+	for {
+		select {
+		case notification, ok := <-queue:
+			if !ok {
+				return
+			}
+			s.handleNotif(logger, notification)
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		err := s.notifPrevID.Add(notifID, nil, cache.DefaultExpiration)
-		if err != nil {
-			// skip duplicated notifications
-			ret <- 200
-			continue
-		}
-		s.notifPrevID.DeleteExpired()
-
-		// A "topic" query is appended as callback url when subscribing
-		// Here we can use the "topic" query to identify the topic of this callback request
-		topic := req.URL.Query()["topic"]
-		if topic == nil {
-			logger.Warnf("invalid callback with no topic query. URL: %s", req.URL.String())
-			ret <- 400
-			continue
+// handleNotif answers a notification, a panic only drops the notification
+func (s *Service) handleNotif(logger *logrus.Entry, notification *notification) {
+	req := notification.request
+	ret := notification.status
+	body := notification.body
+	defer func() {
+		// The notification is answered if it panicked before that, so that the webhook is not blocked
+		if r := recover(); r != nil {
+			select {
+			case ret <- 500:
+			default:
+			}
+			s.recovered(r)
 		}
+	}()
 
-		// Take only the first mode parameters, ignore others
-		switch topic[0] {
-		case "streams":
-			// stream changed
-			ret <- s.streamChanged(req, body)
-		default:
-			// return sub as deleted for any unknown topics
-			logger.Warnf("unknown topic. URL: %s", req.URL.String())
-			ret <- 410
-		}
+	notifID := notification.request.Header.Get("Twitch-Notification-Id")
+	if len(notifID) == 0 {
+		logger.Warnf("notification without ID")
+		logger.Warn(notification.request.Header)
+		logger.Warn(notification.body)
+		ret <- 200
+		return
+	}
+
+	err := s.notifPrevID.Add(notifID, nil, cache.DefaultExpiration)
+	if err != nil {
+		// skip duplicated notifications
+		ret <- 200
+		return
+	}
+	s.notifPrevID.DeleteExpired()
+
+	// A "topic" query is appended as callback url when subscribing
+	// Here we can use the "topic" query to identify the topic of this callback request
+	topic := req.URL.Query()["topic"]
+	if topic == nil {
+		logger.Warnf("invalid callback with no topic query. URL: %s", req.URL.String())
+		ret <- 400
+		return
+	}
+
+	// Take only the first mode parameters, ignore others
+	switch topic[0] {
+	case "streams":
+		// stream changed
+		ret <- s.streamChanged(req, body)
+	default:
+		// return sub as deleted for any unknown topics
+		logger.Warnf("unknown topic. URL: %s", req.URL.String())
+		ret <- 410
 	}
-	close(s.notifDone)
 }
 
 // subscribe/unsubscribe to a websub topic
@@ -197,9 +237,11 @@ func (s *Service) subscription(ctx context.Context, topic string, params *url.Va
 	// we will use the lease second to start a subscription renewal routine
 	case realLease := <-verified:
 		if sub {
+			s.verifiedSubs.Store(subscriptionKey(topic, params), time.Now().Add(time.Duration(realLease)*time.Second))
 			// if this is a subscribe request
 			// start a goroutine to renew the subscription
 			go func() {
+				defer s.recoverHandler()
 				logger := logger.WithField("phase", "renew")
 				duration := time.Duration(realLease-10) * time.Second
 				// apart from waiting for the lease expired, the routing also accepts early termination
@@ -220,7 +262,7 @@ func (s *Service) subscription(ctx context.Context, topic string, params *url.Va
 				select {
 				case <-time.After(duration):
 					s.renewCancelMap.Delete(key)
-					if !s.subTopics[topic].hasKey(hubreq.id) {
+					if !s.topics()[topic].hasKey(hubreq.id) {
 						// unsubscribed
 						logger.Infof("renew terminated: %s", key)
 						return
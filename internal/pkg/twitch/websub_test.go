@@ -0,0 +1,25 @@
+package twitch
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHandleNotifPanic(t *testing.T) {
+	recovered := make(chan interface{}, 1)
+	s := &Service{panicHandler: func(r interface{}) {
+		recovered <- r
+	}}
+	// A notification without request panics
+	notif := &notification{status: make(chan int, 1)}
+	s.handleNotif(logrus.WithField("phase", "test"), notif)
+	if status := <-notif.status; status != 500 {
+		t.Errorf("status: %d", status)
+	}
+	select {
+	case <-recovered:
+	default:
+		t.Error("panic not recovered")
+	}
+}